@@ -0,0 +1,285 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/couchbase/sync_gateway/base"
+	ch "github.com/couchbase/sync_gateway/channels"
+)
+
+// An API key issued to a user through the admin API.  A key authenticates as its user, optionally
+// restricted to read-only access and/or a subset of the user's channels.  Only a bcrypt hash of the
+// key's secret is stored.
+type APIKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name,omitempty"`
+	SecretHash []byte     `json:"secret_hash_bcrypt,omitempty"`
+	Created    time.Time  `json:"created"`
+	Expiration *time.Time `json:"expiration,omitempty"`
+	ReadOnly   bool       `json:"read_only,omitempty"`
+	Channels   base.Set   `json:"channels,omitempty"` // If set, the key can only see these of the user's channels
+}
+
+// Options for a new API key
+type APIKeyOptions struct {
+	Name     string        // Name to identify the key, e.g. the device it's issued to
+	TTL      time.Duration // If non-zero, the key expires after this duration
+	ReadOnly bool          // If true, the key can't be used to write
+	Channels base.Set      // If set, restricts the key to these channels
+}
+
+// Lookup doc from API key ID to the user it was issued to
+type apiKeyInfo struct {
+	Username string `json:"username"`
+}
+
+func docIDForAPIKey(id string) string {
+	return base.APIKeyPrefix + id
+}
+
+// Returns true if the key has an expiration time that has passed.
+func (key *APIKey) Expired() bool {
+	return key.Expiration != nil && !time.Now().Before(*key.Expiration)
+}
+
+// Issues a new API key for a user.  Returns the key along with the token clients present in an
+// "Authorization: ApiKey <token>" header; the token can't be recovered once this returns.
+func (auth *Authenticator) CreateAPIKey(user User, options APIKeyOptions) (*APIKey, string, error) {
+	if options.TTL < 0 {
+		return nil, "", base.HTTPErrorf(http.StatusBadRequest, "Invalid API key time-to-live")
+	}
+	if options.Channels != nil {
+		if _, err := ch.SetFromArray(options.Channels.ToArray(), ch.KeepStar); err != nil {
+			return nil, "", err
+		}
+	}
+
+	secret := base.GenerateRandomSecret()
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcryptCost)
+	if err != nil {
+		return nil, "", err
+	}
+	key := &APIKey{
+		ID:         base.GenerateRandomSecret()[:16],
+		Name:       options.Name,
+		SecretHash: hash,
+		Created:    time.Now().UTC(),
+		ReadOnly:   options.ReadOnly,
+		Channels:   options.Channels,
+	}
+	expiry := uint32(0)
+	if options.TTL > 0 {
+		expiration := key.Created.Add(options.TTL)
+		key.Expiration = &expiration
+		expiry = base.DurationToCbsExpiry(options.TTL)
+	}
+
+	added, err := auth.bucket.Add(docIDForAPIKey(key.ID), expiry, apiKeyInfo{Username: user.Name()})
+	if err != nil {
+		return nil, "", err
+	} else if !added {
+		return nil, "", fmt.Errorf("API key ID %s is already in use", key.ID)
+	}
+
+	err = auth.casUpdatePrincipal(user, func(p Principal) (Principal, error) {
+		currentUser, ok := p.(User)
+		if !ok {
+			return nil, base.ErrUpdateCancel
+		}
+		apiKeys := make(map[string]*APIKey, len(currentUser.APIKeys())+1)
+		for id, existing := range currentUser.APIKeys() {
+			// Drop expired keys while the user is being updated anyway
+			if !existing.Expired() {
+				apiKeys[id] = existing
+			}
+		}
+		apiKeys[key.ID] = key
+		currentUser.setAPIKeys(apiKeys)
+		return currentUser, nil
+	})
+	if err != nil {
+		_ = auth.bucket.Delete(docIDForAPIKey(key.ID))
+		return nil, "", err
+	}
+
+	base.Infof(base.KeyAuth, "Created API key %s for user %s", key.ID, base.UD(user.Name()))
+	return key, key.ID + "." + secret, nil
+}
+
+// Revokes one of a user's API keys.  Returns a 404 error if the user has no key with the given ID.
+func (auth *Authenticator) RevokeAPIKey(user User, id string) error {
+	if _, ok := user.APIKeys()[id]; !ok {
+		return base.HTTPErrorf(http.StatusNotFound, "missing")
+	}
+
+	err := auth.casUpdatePrincipal(user, func(p Principal) (Principal, error) {
+		currentUser, ok := p.(User)
+		if !ok {
+			return nil, base.ErrUpdateCancel
+		}
+		if _, ok := currentUser.APIKeys()[id]; !ok {
+			return nil, base.ErrUpdateCancel
+		}
+		apiKeys := make(map[string]*APIKey, len(currentUser.APIKeys()))
+		for existingID, existing := range currentUser.APIKeys() {
+			if existingID != id {
+				apiKeys[existingID] = existing
+			}
+		}
+		currentUser.setAPIKeys(apiKeys)
+		return currentUser, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := auth.bucket.Delete(docIDForAPIKey(id)); err != nil && !base.IsDocNotFoundError(err) {
+		return err
+	}
+	base.Infof(base.KeyAuth, "Revoked API key %s for user %s", id, base.UD(user.Name()))
+	return nil
+}
+
+// Authenticates a user with an API key token, as returned by CreateAPIKey.  Returns a nil user if the
+// token is invalid, the key has expired or been revoked, or the user is disabled.  Otherwise the user is
+// restricted to the key's channels; the key itself is available via UserAPIKey.
+func (auth *Authenticator) AuthenticateAPIKey(token string) (User, error) {
+	separator := strings.IndexByte(token, '.')
+	if separator <= 0 {
+		return nil, nil
+	}
+	id, secret := token[:separator], token[separator+1:]
+
+	var info apiKeyInfo
+	if _, err := auth.bucket.Get(docIDForAPIKey(id), &info); err != nil {
+		if base.IsDocNotFoundError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	user, err := auth.GetUser(info.Username)
+	if err != nil || user == nil || user.Disabled() {
+		return nil, err
+	}
+	key := user.APIKeys()[id]
+	if key == nil || key.Expired() || !compareHashAndPassword(key.SecretHash, []byte(secret)) {
+		return nil, nil
+	}
+	return RestrictToAPIKey(user, key), nil
+}
+
+// Returns the API key a user authenticated with, or nil if they didn't use one.
+func UserAPIKey(user User) *APIKey {
+	if keyUser, ok := user.(*apiKeyUser); ok {
+		return keyUser.key
+	}
+	return nil
+}
+
+// Returns a view of the user with the access allowed by the API key.  Used to reapply a key's
+// restrictions after reloading the user it authenticated as.
+func RestrictToAPIKey(user User, key *APIKey) User {
+	if keyUser, ok := user.(*apiKeyUser); ok {
+		user = keyUser.User
+	}
+	return &apiKeyUser{User: user, key: key}
+}
+
+// A User authenticated by an API key.  When the key is restricted to a set of channels, the channel
+// access methods only allow those channels (along with the public "!" channel).
+type apiKeyUser struct {
+	User
+	key *APIKey
+}
+
+func (user *apiKeyUser) allowsChannel(channel string) bool {
+	return user.key.Channels == nil || user.key.Channels.Contains(ch.UserStarChannel) ||
+		user.key.Channels.Contains(channel) || channel == ch.DocumentStarChannel
+}
+
+func (user *apiKeyUser) filter(channels ch.TimedSet) ch.TimedSet {
+	if user.key.Channels == nil || channels == nil {
+		return channels
+	}
+	result := ch.TimedSet{}
+	for channel, sequence := range channels {
+		if user.allowsChannel(channel) {
+			result[channel] = sequence
+		}
+	}
+	return result
+}
+
+func (user *apiKeyUser) Channels() ch.TimedSet {
+	return user.filter(user.User.Channels())
+}
+
+func (user *apiKeyUser) CanSeeChannel(channel string) bool {
+	if user.key.Channels != nil && !user.key.Channels.Contains(ch.UserStarChannel) {
+		// The user's "*" channel only grants the key's channels
+		return user.allowsChannel(channel) && user.User.CanSeeChannel(channel)
+	}
+	return user.User.CanSeeChannel(channel)
+}
+
+func (user *apiKeyUser) CanSeeChannelSince(channel string) uint64 {
+	if !user.allowsChannel(channel) {
+		return 0
+	}
+	return user.User.CanSeeChannelSince(channel)
+}
+
+func (user *apiKeyUser) AuthorizeAllChannels(channels base.Set) error {
+	return authorizeAllChannels(user, channels)
+}
+
+func (user *apiKeyUser) AuthorizeAnyChannel(channels base.Set) error {
+	return authorizeAnyChannel(user, channels)
+}
+
+func (user *apiKeyUser) InheritedChannels() ch.TimedSet {
+	return user.filter(user.User.InheritedChannels())
+}
+
+func (user *apiKeyUser) ExpandWildCardChannel(channels base.Set) base.Set {
+	if channels.Contains(ch.AllChannelWildcard) {
+		channels = user.InheritedChannels().AsSet()
+	}
+	return channels
+}
+
+func (user *apiKeyUser) FilterToAvailableChannels(channels base.Set) ch.TimedSet {
+	if channels.Contains(ch.AllChannelWildcard) {
+		return user.InheritedChannels().Copy()
+	}
+	output := ch.TimedSet{}
+	for channel := range channels {
+		output.AddChannel(channel, user.CanSeeChannelSince(channel))
+	}
+	return output
+}
+
+func (user *apiKeyUser) GetAddedChannels(channels ch.TimedSet) base.Set {
+	output := base.Set{}
+	for userChannel := range user.InheritedChannels() {
+		if _, found := channels[userChannel]; !found {
+			output[userChannel] = struct{}{}
+		}
+	}
+	return output
+}
@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	ch "github.com/couchbase/sync_gateway/channels"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	testBucket := base.GetTestBucket(t)
+	defer testBucket.Close()
+	auth := NewAuthenticator(testBucket.Bucket, nil)
+
+	user, err := auth.NewUser("alice", "password", ch.SetOf(t, "a", "b"))
+	require.NoError(t, err)
+	require.NoError(t, auth.Save(user))
+
+	key, token, err := auth.CreateAPIKey(user, APIKeyOptions{Name: "sensor", ReadOnly: true})
+	require.NoError(t, err)
+	assert.Equal(t, "sensor", key.Name)
+	assert.Nil(t, key.Expiration)
+	assert.NotContains(t, string(key.SecretHash), token)
+
+	keyUser, err := auth.AuthenticateAPIKey(token)
+	require.NoError(t, err)
+	require.NotNil(t, keyUser)
+	assert.Equal(t, "alice", keyUser.Name())
+	require.NotNil(t, UserAPIKey(keyUser))
+	assert.True(t, UserAPIKey(keyUser).ReadOnly)
+	assert.True(t, keyUser.CanSeeChannel("a"))
+	assert.True(t, keyUser.CanSeeChannel("b"))
+
+	// Wrong secret, unknown key and malformed tokens
+	for _, invalidToken := range []string{key.ID + ".wrong", "unknown." + token[len(key.ID)+1:], "nodot", ""} {
+		keyUser, err = auth.AuthenticateAPIKey(invalidToken)
+		assert.NoError(t, err)
+		assert.Nil(t, keyUser, "Token %q", invalidToken)
+	}
+
+	// Keys of disabled users don't authenticate
+	user, err = auth.GetUser("alice")
+	require.NoError(t, err)
+	user.SetDisabled(true)
+	require.NoError(t, auth.Save(user))
+	keyUser, err = auth.AuthenticateAPIKey(token)
+	assert.NoError(t, err)
+	assert.Nil(t, keyUser)
+	user.SetDisabled(false)
+	require.NoError(t, auth.Save(user))
+
+	// Revoking a key removes it from the user
+	user, err = auth.GetUser("alice")
+	require.NoError(t, err)
+	require.NoError(t, auth.RevokeAPIKey(user, key.ID))
+	keyUser, err = auth.AuthenticateAPIKey(token)
+	assert.NoError(t, err)
+	assert.Nil(t, keyUser)
+	user, err = auth.GetUser("alice")
+	require.NoError(t, err)
+	assert.Len(t, user.APIKeys(), 0)
+	assert.Error(t, auth.RevokeAPIKey(user, key.ID))
+}
+
+func TestAPIKeyExpiry(t *testing.T) {
+	testBucket := base.GetTestBucket(t)
+	defer testBucket.Close()
+	auth := NewAuthenticator(testBucket.Bucket, nil)
+
+	user, err := auth.NewUser("alice", "password", ch.SetOf(t, "a"))
+	require.NoError(t, err)
+	require.NoError(t, auth.Save(user))
+
+	_, _, err = auth.CreateAPIKey(user, APIKeyOptions{TTL: -time.Second})
+	assert.Error(t, err)
+
+	key, token, err := auth.CreateAPIKey(user, APIKeyOptions{TTL: time.Hour})
+	require.NoError(t, err)
+	require.NotNil(t, key.Expiration)
+	keyUser, err := auth.AuthenticateAPIKey(token)
+	assert.NoError(t, err)
+	assert.NotNil(t, keyUser)
+
+	// Backdate the key's expiration
+	user, err = auth.GetUser("alice")
+	require.NoError(t, err)
+	expired := time.Now().Add(-time.Minute)
+	user.APIKeys()[key.ID].Expiration = &expired
+	require.NoError(t, auth.Save(user))
+	keyUser, err = auth.AuthenticateAPIKey(token)
+	assert.NoError(t, err)
+	assert.Nil(t, keyUser)
+}
+
+func TestAPIKeyChannelRestriction(t *testing.T) {
+	testBucket := base.GetTestBucket(t)
+	defer testBucket.Close()
+	auth := NewAuthenticator(testBucket.Bucket, nil)
+
+	user, err := auth.NewUser("alice", "password", ch.SetOf(t, "a", "b"))
+	require.NoError(t, err)
+	require.NoError(t, auth.Save(user))
+
+	_, token, err := auth.CreateAPIKey(user, APIKeyOptions{Channels: base.SetOf("b", "c")})
+	require.NoError(t, err)
+	keyUser, err := auth.AuthenticateAPIKey(token)
+	require.NoError(t, err)
+	require.NotNil(t, keyUser)
+
+	assert.False(t, keyUser.CanSeeChannel("a"))
+	assert.True(t, keyUser.CanSeeChannel("b"))
+	assert.False(t, keyUser.CanSeeChannel("c")) // Not granted to the user
+	assert.Equal(t, ch.SetOf(t, "b", "!"), keyUser.InheritedChannels().AsSet())
+	assert.Equal(t, ch.SetOf(t, "b", "!"), keyUser.ExpandWildCardChannel(base.SetOf("*")))
+	assert.Error(t, keyUser.AuthorizeAllChannels(base.SetOf("a", "b")))
+	assert.NoError(t, keyUser.AuthorizeAnyChannel(base.SetOf("a", "b")))
+	assert.Equal(t, uint64(0), keyUser.CanSeeChannelSince("a"))
+
+	// A user with access to all channels only gets the key's channels
+	user, err = auth.GetUser("alice")
+	require.NoError(t, err)
+	user.SetExplicitChannels(ch.AtSequence(ch.SetOf(t, "*"), 1))
+	require.NoError(t, auth.Save(user))
+	keyUser, err = auth.AuthenticateAPIKey(token)
+	require.NoError(t, err)
+	assert.True(t, keyUser.CanSeeChannel("c"))
+	assert.False(t, keyUser.CanSeeChannel("d"))
+}
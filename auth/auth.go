@@ -11,6 +11,7 @@ package auth
 
 import (
 	"fmt"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 
@@ -26,6 +27,8 @@ type Authenticator struct {
 	bucket            base.Bucket
 	channelComputer   ChannelComputer
 	sessionCookieName string // Custom per-database session cookie name
+	lockoutOptions    *LoginLockoutOptions
+	onLockout         LoginLockoutCallback
 }
 
 // Interface for deriving the set of channels and roles a User/Role has access to.
@@ -35,6 +38,63 @@ type ChannelComputer interface {
 	ComputeRolesForUser(User) (ch.TimedSet, error)
 }
 
+// Optionally implemented by a ChannelComputer to allocate the sequence at which roles and channels
+// granted by token claims, or the removal of expired grants, are recorded.  When not implemented, the
+// principal's current sequence is used.
+type PrincipalSequenceAllocator interface {
+	NextPrincipalSequence() (uint64, error)
+	ReleasePrincipalSequence(sequence uint64) error
+}
+
+// Allocates the sequence a principal is saved at by a CAS update, once however many times the update
+// is retried.  A new sequence is only allocated if another update has saved the principal at a later
+// sequence in the meantime.
+type principalSequence struct {
+	allocator PrincipalSequenceAllocator
+	sequence  uint64
+}
+
+func (auth *Authenticator) newPrincipalSequence() *principalSequence {
+	allocator, _ := auth.channelComputer.(PrincipalSequenceAllocator)
+	return &principalSequence{allocator: allocator}
+}
+
+// Returns the sequence to save the principal at, or zero if the channel computer doesn't allocate
+// sequences.
+func (ps *principalSequence) next(princ Principal) (uint64, error) {
+	if ps.allocator == nil {
+		return 0, nil
+	}
+	if ps.sequence != 0 && ps.sequence > princ.Sequence() {
+		return ps.sequence, nil
+	}
+	ps.release()
+	sequence, err := ps.allocator.NextPrincipalSequence()
+	if err != nil {
+		return 0, err
+	}
+	ps.sequence = sequence
+	return sequence, nil
+}
+
+// Releases the allocated sequence, if the update didn't save the principal at it.
+func (ps *principalSequence) release() {
+	if ps.sequence == 0 {
+		return
+	}
+	if err := ps.allocator.ReleasePrincipalSequence(ps.sequence); err != nil {
+		base.Warnf(base.KeyAll, "Unable to release unused principal sequence #%d: %v", ps.sequence, err)
+	}
+	ps.sequence = 0
+}
+
+// Optionally implemented by a ChannelComputer to reload principals whose time-limited channel or role
+// grants expire, so that the expiry is saved (and noticed by changes feeds) even if nothing else
+// loads the principal.  Called each time a principal with time-limited grants is loaded.
+type GrantExpiryScheduler interface {
+	ScheduleGrantExpiry(princ Principal, expiry time.Time)
+}
+
 type userByEmailInfo struct {
 	Username string
 }
@@ -98,9 +158,12 @@ func (auth *Authenticator) GetRole(name string) (Role, error) {
 // Common implementation of GetUser and GetRole. factory() parameter returns a new empty instance.
 func (auth *Authenticator) getPrincipal(docID string, factory func() Principal) (Principal, error) {
 	var princ Principal
+	expirySequence := auth.newPrincipalSequence()
+	expirySequenceUsed := false
 
 	cas, err := auth.bucket.Update(docID, 0, func(currentValue []byte) ([]byte, *uint32, error) {
 		// Be careful: this block can be invoked multiple times if there are races!
+		expirySequenceUsed = false
 		if currentValue == nil {
 			princ = nil
 			return nil, nil, base.ErrUpdateCancel
@@ -110,7 +173,18 @@ func (auth *Authenticator) getPrincipal(docID string, factory func() Principal)
 		if err := base.JSONUnmarshal(currentValue, princ); err != nil {
 			return nil, nil, pkgerrors.WithStack(base.RedactErrorf("base.JSONUnmarshal() error for doc ID: %s in getPrincipal().  Error: %v", base.UD(docID), err))
 		}
-		changed := false
+		changed := auth.removeExpiredGrants(princ, time.Now())
+		if changed {
+			// Save the principal at a new sequence, so that changes feeds are notified of the lost access
+			sequence, err := expirySequence.next(princ)
+			if err != nil {
+				return nil, nil, err
+			}
+			if sequence != 0 {
+				princ.SetSequence(sequence)
+				expirySequenceUsed = true
+			}
+		}
 		if princ.Channels() == nil {
 			// Channel list has been invalidated by a doc update -- rebuild it:
 			if err := auth.rebuildChannels(princ); err != nil {
@@ -142,6 +216,9 @@ func (auth *Authenticator) getPrincipal(docID string, factory func() Principal)
 		}
 	})
 
+	if err != nil || !expirySequenceUsed {
+		expirySequence.release()
+	}
 	if err != nil && err != base.ErrUpdateCancel {
 		return nil, err
 	}
@@ -149,13 +226,65 @@ func (auth *Authenticator) getPrincipal(docID string, factory func() Principal)
 	// If a principal was found, set the cas
 	if princ != nil {
 		princ.SetCas(cas)
+		auth.scheduleGrantExpiry(princ)
 	}
 
 	return princ, nil
 }
 
+// Removes expired time-limited grants from a principal, as though they had been revoked.  Expired
+// admin grants are dropped, and the channels and roles are invalidated if they include expired grants
+// made by the sync function, so that they're rebuilt without them.  Returns true if the principal changed.
+func (auth *Authenticator) removeExpiredGrants(princ Principal, now time.Time) (changed bool) {
+	if explicit := princ.ExplicitChannels(); explicit != nil {
+		if unexpired := explicit.Unexpired(now); len(unexpired) != len(explicit) {
+			princ.SetExplicitChannels(unexpired)
+			changed = true
+		}
+	}
+	if channels := princ.Channels(); channels != nil && len(channels.Unexpired(now)) != len(channels) {
+		princ.setChannels(nil)
+		changed = true
+	}
+	if user, ok := princ.(User); ok {
+		if explicit := user.ExplicitRoles(); explicit != nil {
+			if unexpired := explicit.Unexpired(now); len(unexpired) != len(explicit) {
+				user.SetExplicitRoles(unexpired)
+				changed = true
+			}
+		}
+		if roles := user.RoleNames(); roles != nil && len(roles.Unexpired(now)) != len(roles) {
+			user.setRolesSince(nil)
+			changed = true
+		}
+	}
+	if changed {
+		base.Infof(base.KeyAccess, "Time-limited grants to %q have expired", base.UD(princ.Name()))
+	}
+	return changed
+}
+
+// Asks the channel computer (if it supports it) to reload the principal when its next time-limited
+// grant expires.
+func (auth *Authenticator) scheduleGrantExpiry(princ Principal) {
+	scheduler, ok := auth.channelComputer.(GrantExpiryScheduler)
+	if !ok {
+		return
+	}
+	next := princ.Channels().NextExpiry()
+	if user, ok := princ.(User); ok {
+		if rolesExpiry := user.RoleNames().NextExpiry(); !rolesExpiry.IsZero() && (next.IsZero() || rolesExpiry.Before(next)) {
+			next = rolesExpiry
+		}
+	}
+	if !next.IsZero() {
+		scheduler.ScheduleGrantExpiry(princ, next)
+	}
+}
+
 func (auth *Authenticator) rebuildChannels(princ Principal) error {
-	channels := princ.ExplicitChannels().Copy()
+	now := time.Now()
+	channels := princ.ExplicitChannels().Unexpired(now).Copy()
 
 	// Changes for vbucket sequence management.  We can't determine relative ordering of sequences
 	// across vbuckets.  To avoid redundant channel backfills during changes processing, we maintain
@@ -174,11 +303,17 @@ func (auth *Authenticator) rebuildChannels(princ Principal) error {
 			base.Warnf(base.KeyAll, "channelComputer.ComputeChannelsForPrincipal returned error for %v: %v", base.UD(princ), err)
 			return err
 		}
+		viewChannels = viewChannels.Unexpired(now)
 		if previousChannels != nil {
 			viewChannels.UpdateIfPresent(previousChannels)
 		}
 		channels.Add(viewChannels)
 	}
+	if user, ok := princ.(User); ok {
+		if jwtChannels := user.JWTChannels(); jwtChannels != nil {
+			channels.Add(jwtChannels)
+		}
+	}
 	// always grant access to the public document channel
 	channels.AddChannel(ch.DocumentStarChannel, 1)
 
@@ -191,6 +326,7 @@ func (auth *Authenticator) rebuildChannels(princ Principal) error {
 }
 
 func (auth *Authenticator) rebuildRoles(user User) error {
+	now := time.Now()
 	var roles ch.TimedSet
 	if auth.channelComputer != nil {
 		var err error
@@ -202,10 +338,15 @@ func (auth *Authenticator) rebuildRoles(user User) error {
 	}
 	if roles == nil {
 		roles = ch.TimedSet{} // it mustn't be nil; nil means it's unknown
+	} else {
+		roles = roles.Unexpired(now)
 	}
 
 	if explicit := user.ExplicitRoles(); explicit != nil {
-		roles.Add(explicit)
+		roles.Add(explicit.Unexpired(now))
+	}
+	if jwtRoles := user.JWTRoles(); jwtRoles != nil {
+		roles.Add(jwtRoles)
 	}
 
 	base.Infof(base.KeyAccess, "Computed roles for %q: %s", base.UD(user.Name()), base.UD(roles))
@@ -397,6 +538,9 @@ func (auth *Authenticator) Delete(p Principal) error {
 		if user.Email() != "" {
 			auth.bucket.Delete(docIDForUserEmail(user.Email()))
 		}
+		for id := range user.APIKeys() {
+			_ = auth.bucket.Delete(docIDForAPIKey(id))
+		}
 	}
 	return auth.bucket.Delete(p.DocID())
 }
@@ -519,9 +663,177 @@ func (auth *Authenticator) authenticateJWT(jwt jose.JWT, provider *OIDCProvider)
 		}
 	}
 
+	if user != nil && (provider.RolesClaim != "" || provider.ChannelsClaim != "") {
+		claims, err := jwt.Claims()
+		if err != nil {
+			return nil, jwt, err
+		}
+		user, err = auth.UpdateUserClaimAccess(user, provider.RolesClaim, provider.ChannelsClaim, claims)
+		if err != nil {
+			base.Debugf(base.KeyAuth, "Error updating roles and channels from JWT claims for user %v: %v", base.UD(username), err)
+			return nil, jwt, err
+		}
+	}
+
 	return user, jwt, nil
 }
 
+// Authenticates a user based on a JWT issued by a trusted service and validated with locally configured keys, rather
+// than an OIDC provider.  When the validator is configured to register users, users that don't exist are created.
+func (auth *Authenticator) AuthenticateLocalJWT(token string, validator *LocalJWTValidator) (User, error) {
+
+	claims, err := validator.ValidateJWT(token)
+	if err != nil {
+		base.Debugf(base.KeyAuth, "Error validating local JWT: %v", err)
+		return nil, err
+	}
+
+	username, err := validator.Username(claims)
+	if err != nil {
+		base.Debugf(base.KeyAuth, "Error getting username from local JWT: %v", err)
+		return nil, err
+	}
+	email, _ := claims["email"].(string)
+
+	user, err := auth.GetUser(username)
+	if err != nil {
+		base.Debugf(base.KeyAuth, "Failed to get user %v for local JWT.  Error: %v", base.UD(username), err)
+		return nil, err
+	}
+
+	if user != nil && email != "" {
+		if err := auth.UpdateUserEmail(user, email); err != nil {
+			base.Warnf(base.KeyAll, "Unable to set user email to %v for local JWT", base.UD(email))
+		}
+	}
+
+	if user == nil && validator.Register() {
+		base.Debugf(base.KeyAuth, "Registering new user: %v with email: %v", base.UD(username), base.UD(email))
+		user, err = auth.RegisterNewUser(username, email)
+		if err != nil && !base.IsCasMismatch(err) {
+			base.Debugf(base.KeyAuth, "Error registering new user: %v", err)
+			return nil, err
+		}
+	}
+
+	if user != nil && (validator.options.RolesClaim != "" || validator.options.ChannelsClaim != "") {
+		user, err = auth.UpdateUserClaimAccess(user, validator.options.RolesClaim, validator.options.ChannelsClaim, claims)
+		if err != nil {
+			base.Debugf(base.KeyAuth, "Error updating roles and channels from local JWT claims for user %v: %v", base.UD(username), err)
+			return nil, err
+		}
+	}
+
+	return user, nil
+}
+
+// Updates the roles and channels a user is granted by token claims, for a provider configured with a roles
+// claim and/or channels claim.  These are stored separately from the roles and channels assigned through the
+// admin API, so that a grant is revoked when its value disappears from the claim.  A claim may hold a single
+// string or an array of strings; a missing claim revokes everything it previously granted.  Returns the
+// updated user, or the user as given if nothing changed.
+func (auth *Authenticator) UpdateUserClaimAccess(user User, rolesClaim, channelsClaim string, claims map[string]interface{}) (User, error) {
+
+	var roles, channels base.Set
+	var err error
+	if rolesClaim != "" {
+		if roles, err = claimStringSet(claims, rolesClaim); err != nil {
+			return nil, err
+		}
+		for role := range roles {
+			if role == "" || !IsValidPrincipalName(role) {
+				return nil, base.RedactErrorf("Invalid role name %q in claim %q", base.UD(role), rolesClaim)
+			}
+		}
+	}
+	if channelsClaim != "" {
+		if channels, err = claimStringSet(claims, channelsClaim); err != nil {
+			return nil, err
+		}
+		for channel := range channels {
+			if !ch.IsValidChannel(channel) {
+				return nil, base.RedactErrorf("Invalid channel name %q in claim %q", base.UD(channel), channelsClaim)
+			}
+		}
+	}
+
+	claimAccessChanged := func(u User) bool {
+		return (rolesClaim != "" && !u.JWTRoles().Equals(roles)) || (channelsClaim != "" && !u.JWTChannels().Equals(channels))
+	}
+	if !claimAccessChanged(user) {
+		return user, nil
+	}
+
+	// The claims' grants are recorded at a new sequence, allocated once however many times the update is retried
+	claimSequence := auth.newPrincipalSequence()
+	claimSequenceUsed := false
+	err = auth.casUpdatePrincipal(user, func(p Principal) (Principal, error) {
+		claimSequenceUsed = false
+		currentUser, ok := p.(User)
+		if !ok || !claimAccessChanged(currentUser) {
+			return nil, base.ErrUpdateCancel
+		}
+
+		sequence, err := claimSequence.next(currentUser)
+		if err != nil {
+			return nil, err
+		}
+		if sequence != 0 {
+			currentUser.SetSequence(sequence)
+			claimSequenceUsed = true
+		} else if sequence = currentUser.Sequence(); sequence == 0 {
+			sequence = 1
+		}
+
+		if rolesClaim != "" {
+			jwtRoles := currentUser.JWTRoles().Copy()
+			jwtRoles.UpdateAtSequence(roles, sequence)
+			currentUser.SetJWTRoles(jwtRoles)
+		}
+		if channelsClaim != "" {
+			jwtChannels := currentUser.JWTChannels().Copy()
+			jwtChannels.UpdateAtSequence(channels, sequence)
+			currentUser.SetJWTChannels(jwtChannels)
+		}
+		return currentUser, nil
+	})
+	if err != nil || !claimSequenceUsed {
+		claimSequence.release()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	base.Infof(base.KeyAccess, "Updated roles and channels from token claims for user %q", base.UD(user.Name()))
+
+	// Reload, to recompute the user's roles and channels
+	return auth.GetUser(user.Name())
+}
+
+// Returns the values of a string or string array claim as a set.  A missing claim is an empty set.
+func claimStringSet(claims map[string]interface{}, name string) (base.Set, error) {
+	switch value := claims[name].(type) {
+	case nil:
+		return base.Set{}, nil
+	case string:
+		return base.SetOf(value), nil
+	case []string:
+		return base.SetFromArray(value), nil
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, item := range value {
+			str, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("Claim %q must be a string or an array of strings", name)
+			}
+			values = append(values, str)
+		}
+		return base.SetFromArray(values), nil
+	default:
+		return nil, fmt.Errorf("Claim %q must be a string or an array of strings", name)
+	}
+}
+
 // Registers a new user account based on the given verified username and optional email address.
 // Password will be random. The user will have access to no channels.  If the user already exists,
 // returns the existing user along with the cas failure error
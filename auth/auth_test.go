@@ -312,6 +312,54 @@ func (self *mockComputer) UseGlobalSequence() bool {
 	return true
 }
 
+// A mockComputer that allocates principal sequences, recording those released.
+type mockSequenceComputer struct {
+	mockComputer
+	lastSequence uint64
+	released     []uint64
+}
+
+func (self *mockSequenceComputer) NextPrincipalSequence() (uint64, error) {
+	self.lastSequence++
+	return self.lastSequence, nil
+}
+
+func (self *mockSequenceComputer) ReleasePrincipalSequence(sequence uint64) error {
+	self.released = append(self.released, sequence)
+	return nil
+}
+
+// A principal sequence is allocated once however many times an update is retried, unless another update has saved
+// the principal at a later sequence in the meantime.
+func TestPrincipalSequence(t *testing.T) {
+	gTestBucket := base.GetTestBucket(t)
+	defer gTestBucket.Close()
+	computer := &mockSequenceComputer{lastSequence: 10}
+	auth := NewAuthenticator(gTestBucket.Bucket, computer)
+	user, err := auth.NewUser("alice", "password", nil)
+	require.NoError(t, err)
+	user.SetSequence(5)
+
+	sequence := auth.newPrincipalSequence()
+	seq, err := sequence.next(user)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(11), seq)
+	seq, err = sequence.next(user)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(11), seq)
+	assert.Empty(t, computer.released)
+
+	user.SetSequence(12)
+	computer.lastSequence = 12
+	seq, err = sequence.next(user)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(13), seq)
+	assert.Equal(t, []uint64{11}, computer.released)
+
+	sequence.release()
+	assert.Equal(t, []uint64{11, 13}, computer.released)
+}
+
 func TestRebuildUserChannels(t *testing.T) {
 
 	gTestBucket := base.GetTestBucket(t)
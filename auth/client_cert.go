@@ -0,0 +1,134 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package auth
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Client certificate fields that can be mapped to a username
+const (
+	ClientCertFieldCN       = "cn"        // The subject's common name
+	ClientCertFieldSANEmail = "san_email" // An email address subject alternative name
+	ClientCertFieldSANURI   = "san_uri"   // A URI subject alternative name
+)
+
+// Options for authenticating users with TLS client certificates.  The certificate must have been verified
+// against the server's client CA bundle; these options say how it maps to a Sync Gateway username.
+type ClientCertOptions struct {
+	UsernameField   string `json:"username_field,omitempty"`   // cn (the default), san_email or san_uri
+	UsernamePattern string `json:"username_pattern,omitempty"` // If set, a regexp whose first group extracts the username from the field
+	Register        bool   `json:"register,omitempty"`         // If true, users that don't exist are created
+}
+
+// ClientCertMapper maps verified client certificates to Sync Gateway usernames.
+type ClientCertMapper struct {
+	options ClientCertOptions
+	pattern *regexp.Regexp
+}
+
+// NewClientCertMapper validates the options and compiles the username pattern.
+func NewClientCertMapper(options ClientCertOptions) (*ClientCertMapper, error) {
+	switch options.UsernameField {
+	case "":
+		options.UsernameField = ClientCertFieldCN
+	case ClientCertFieldCN, ClientCertFieldSANEmail, ClientCertFieldSANURI:
+	default:
+		return nil, fmt.Errorf("client_cert_auth.username_field must be one of %q, %q or %q", ClientCertFieldCN, ClientCertFieldSANEmail, ClientCertFieldSANURI)
+	}
+
+	mapper := &ClientCertMapper{options: options}
+	if options.UsernamePattern != "" {
+		var err error
+		if mapper.pattern, err = regexp.Compile(options.UsernamePattern); err != nil {
+			return nil, fmt.Errorf("Invalid client_cert_auth.username_pattern: %v", err)
+		} else if mapper.pattern.NumSubexp() < 1 {
+			return nil, errors.New("client_cert_auth.username_pattern must have a group that matches the username")
+		}
+	}
+	return mapper, nil
+}
+
+// Register returns whether users that don't exist should be created.
+func (m *ClientCertMapper) Register() bool {
+	return m.options.Register
+}
+
+// Username returns the Sync Gateway username for a verified client certificate.  SANs are tried in the
+// order they appear in the certificate, and the first that matches the username pattern is used.
+func (m *ClientCertMapper) Username(cert *x509.Certificate) (string, error) {
+	var values []string
+	switch m.options.UsernameField {
+	case ClientCertFieldCN:
+		values = []string{cert.Subject.CommonName}
+	case ClientCertFieldSANEmail:
+		values = cert.EmailAddresses
+	case ClientCertFieldSANURI:
+		for _, uri := range cert.URIs {
+			values = append(values, uri.String())
+		}
+	}
+
+	for _, value := range values {
+		if m.pattern != nil {
+			match := m.pattern.FindStringSubmatch(value)
+			if match == nil {
+				continue
+			}
+			value = match[1]
+		}
+		if value == "" {
+			continue
+		}
+		if !IsValidPrincipalName(value) {
+			return "", base.RedactErrorf("Client certificate %s %q isn't a valid username", m.options.UsernameField, base.UD(value))
+		}
+		return value, nil
+	}
+	return "", fmt.Errorf("Client certificate has no %s that maps to a username", m.options.UsernameField)
+}
+
+// Authenticates a user by a client certificate that has already been verified by the TLS handshake.
+// Returns a nil user if the certificate's user doesn't exist and the mapper doesn't register new users.
+func (auth *Authenticator) AuthenticateClientCert(cert *x509.Certificate, mapper *ClientCertMapper) (User, error) {
+	username, err := mapper.Username(cert)
+	if err != nil {
+		base.Debugf(base.KeyAuth, "Error getting username from client certificate: %v", err)
+		return nil, err
+	}
+
+	user, err := auth.GetUser(username)
+	if err != nil {
+		base.Debugf(base.KeyAuth, "Failed to get user %v for client certificate.  Error: %v", base.UD(username), err)
+		return nil, err
+	}
+
+	if user == nil && mapper.Register() {
+		email := ""
+		if mapper.options.UsernameField == ClientCertFieldSANEmail {
+			email = username
+		}
+		base.Debugf(base.KeyAuth, "Registering new user: %v for client certificate", base.UD(username))
+		user, err = auth.RegisterNewUser(username, email)
+		if err != nil && !base.IsCasMismatch(err) {
+			base.Debugf(base.KeyAuth, "Error registering new user: %v", err)
+			return nil, err
+		}
+	}
+	if user != nil && user.Disabled() {
+		return nil, nil
+	}
+	return user, nil
+}
@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientCertMapperUsername(t *testing.T) {
+	spiffeURI, err := url.Parse("spiffe://example.com/device/alice")
+	require.NoError(t, err)
+	otherURI, err := url.Parse("https://example.com/alice")
+	require.NoError(t, err)
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "alice"},
+		EmailAddresses: []string{"alice@example.com"},
+		URIs:           []*url.URL{otherURI, spiffeURI},
+	}
+
+	mapper, err := NewClientCertMapper(ClientCertOptions{})
+	require.NoError(t, err)
+	username, err := mapper.Username(cert)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", username)
+
+	mapper, err = NewClientCertMapper(ClientCertOptions{UsernameField: ClientCertFieldSANEmail})
+	require.NoError(t, err)
+	username, err = mapper.Username(cert)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice@example.com", username)
+
+	// The pattern picks out the matching SAN and extracts the username from it
+	mapper, err = NewClientCertMapper(ClientCertOptions{UsernameField: ClientCertFieldSANURI, UsernamePattern: `^spiffe://example\.com/device/(.+)$`})
+	require.NoError(t, err)
+	username, err = mapper.Username(cert)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", username)
+
+	// A whole URI isn't a valid username
+	mapper, err = NewClientCertMapper(ClientCertOptions{UsernameField: ClientCertFieldSANURI})
+	require.NoError(t, err)
+	_, err = mapper.Username(cert)
+	assert.Error(t, err)
+
+	_, err = mapper.Username(&x509.Certificate{Subject: pkix.Name{CommonName: "alice"}})
+	assert.Error(t, err)
+
+	_, err = NewClientCertMapper(ClientCertOptions{UsernameField: "serial"})
+	assert.Error(t, err)
+	_, err = NewClientCertMapper(ClientCertOptions{UsernamePattern: "^user-.*$"})
+	assert.Error(t, err)
+	_, err = NewClientCertMapper(ClientCertOptions{UsernamePattern: "("})
+	assert.Error(t, err)
+}
+
+func TestAuthenticateClientCert(t *testing.T) {
+	testBucket := base.GetTestBucket(t)
+	defer testBucket.Close()
+	auth := NewAuthenticator(testBucket.Bucket, nil)
+
+	cert := &x509.Certificate{EmailAddresses: []string{"alice@example.com"}}
+	options := ClientCertOptions{UsernameField: ClientCertFieldSANEmail}
+	mapper, err := NewClientCertMapper(options)
+	require.NoError(t, err)
+
+	// Without registration, the user must already exist
+	user, err := auth.AuthenticateClientCert(cert, mapper)
+	assert.NoError(t, err)
+	assert.Nil(t, user)
+
+	options.Register = true
+	mapper, err = NewClientCertMapper(options)
+	require.NoError(t, err)
+	user, err = auth.AuthenticateClientCert(cert, mapper)
+	require.NoError(t, err)
+	require.NotNil(t, user)
+	assert.Equal(t, "alice@example.com", user.Name())
+	assert.Equal(t, "alice@example.com", user.Email())
+
+	// Disabled users can't authenticate
+	user.SetDisabled(true)
+	require.NoError(t, auth.Save(user))
+	user, err = auth.AuthenticateClientCert(cert, mapper)
+	assert.NoError(t, err)
+	assert.Nil(t, user)
+}
@@ -0,0 +1,421 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Signing algorithms supported for locally validated JWTs
+const (
+	JWTAlgorithmHS256 = "HS256"
+	JWTAlgorithmRS256 = "RS256"
+	JWTAlgorithmES256 = "ES256"
+)
+
+const (
+	defaultJWTUsernameClaim = "sub"
+	defaultJWTClockSkewSecs = 60
+)
+
+// Options for validating JWTs issued by a trusted service, without an OpenID Connect provider.  Tokens must be
+// signed by one of the configured keys, and have the configured issuer and an unexpired 'exp' claim.
+type LocalJWTOptions struct {
+	Issuer        string        `json:"issuer"`                    // Required value of the 'iss' claim
+	Audiences     []string      `json:"audiences,omitempty"`       // If set, the 'aud' claim must include one of these
+	Keys          []LocalJWTKey `json:"keys,omitempty"`            // Static validation keys
+	JWKSFile      string        `json:"jwks_file,omitempty"`       // Path of a JSON Web Key Set file holding validation keys
+	UsernameClaim string        `json:"username_claim,omitempty"`  // Claim holding the username, defaults to 'sub'
+	UserPrefix    string        `json:"user_prefix,omitempty"`     // If set, usernames are formed as [user_prefix]_[claim value]
+	Register      bool          `json:"register,omitempty"`        // If true, users that don't exist are created
+	RolesClaim    string        `json:"roles_claim,omitempty"`     // If set, the claim's values are granted to the user as roles
+	ChannelsClaim string        `json:"channels_claim,omitempty"`  // If set, the claim's values are granted to the user as channels
+	ClockSkewSecs *uint32       `json:"clock_skew_secs,omitempty"` // Leeway for clock skew when checking 'exp' and 'nbf', default 60
+}
+
+// A static key for validating JWTs.
+type LocalJWTKey struct {
+	KeyID     string `json:"kid,omitempty"` // If set, only used for tokens with a matching 'kid' header
+	Algorithm string `json:"alg"`           // HS256, RS256 or ES256
+	Key       string `json:"key"`           // Shared secret for HS256, or PEM-encoded public key for RS256 and ES256
+}
+
+// A JSON Web Key, as found in a JWKS file.  Only the members needed for the supported algorithms are parsed.
+type jsonWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	K         string `json:"k"`   // oct: key value
+	N         string `json:"n"`   // RSA: modulus
+	E         string `json:"e"`   // RSA: exponent
+	Curve     string `json:"crv"` // EC: curve
+	X         string `json:"x"`   // EC: x coordinate
+	Y         string `json:"y"`   // EC: y coordinate
+}
+
+// A parsed validation key.
+type jwtValidationKey struct {
+	keyID     string
+	algorithm string
+	key       interface{} // []byte, *rsa.PublicKey or *ecdsa.PublicKey, according to algorithm
+}
+
+// LocalJWTValidator validates JWTs against the keys in LocalJWTOptions, and maps them to Sync Gateway usernames.
+type LocalJWTValidator struct {
+	options   LocalJWTOptions
+	keys      []jwtValidationKey
+	clockSkew time.Duration
+}
+
+// NewLocalJWTValidator parses the configured static keys and JWKS file.
+func NewLocalJWTValidator(options LocalJWTOptions) (*LocalJWTValidator, error) {
+	if options.Issuer == "" {
+		return nil, errors.New("jwt.issuer must be set")
+	}
+	if options.UsernameClaim == "" {
+		options.UsernameClaim = defaultJWTUsernameClaim
+	}
+
+	validator := &LocalJWTValidator{options: options, clockSkew: defaultJWTClockSkewSecs * time.Second}
+	if options.ClockSkewSecs != nil {
+		validator.clockSkew = time.Duration(*options.ClockSkewSecs) * time.Second
+	}
+	for i, configKey := range options.Keys {
+		key, err := parseLocalJWTKey(configKey)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid jwt.keys[%d]: %v", i, err)
+		}
+		validator.keys = append(validator.keys, key)
+	}
+	if options.JWKSFile != "" {
+		keys, err := loadJWKSFile(options.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		validator.keys = append(validator.keys, keys...)
+	}
+	if len(validator.keys) == 0 {
+		return nil, errors.New("jwt.keys or jwt.jwks_file must provide at least one validation key")
+	}
+	return validator, nil
+}
+
+// Issuer returns the issuer whose tokens are validated.
+func (v *LocalJWTValidator) Issuer() string {
+	return v.options.Issuer
+}
+
+// Register returns whether users that don't exist should be created.
+func (v *LocalJWTValidator) Register() bool {
+	return v.options.Register
+}
+
+// ValidateJWT checks the token's signature and its 'iss', 'aud', 'exp' and 'nbf' claims, returning its claims.  The
+// time claims are checked with the configured leeway for clock skew between Sync Gateway and the token's issuer.
+func (v *LocalJWTValidator) ValidateJWT(token string) (claims map[string]interface{}, err error) {
+	header, claims, signingInput, signature, err := parseJWT(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := v.verifySignature(header, signingInput, signature); err != nil {
+		return nil, err
+	}
+
+	if issuer, _ := claims["iss"].(string); issuer != v.options.Issuer {
+		return nil, fmt.Errorf("Unexpected 'iss' claim %q", issuer)
+	}
+	if len(v.options.Audiences) > 0 && !jwtAudienceMatches(claims["aud"], v.options.Audiences) {
+		return nil, errors.New("'aud' claim doesn't match any configured audience")
+	}
+
+	now := time.Now()
+	expiry, ok := jwtTimeClaim(claims, "exp")
+	if !ok {
+		return nil, errors.New("Missing required 'exp' claim")
+	}
+	if !now.Before(expiry.Add(v.clockSkew)) {
+		return nil, errors.New("Token has expired")
+	}
+	if notBefore, ok := jwtTimeClaim(claims, "nbf"); ok && now.Before(notBefore.Add(-v.clockSkew)) {
+		return nil, errors.New("Token is not yet valid")
+	}
+	return claims, nil
+}
+
+// Username returns the Sync Gateway username for a validated token's claims.
+func (v *LocalJWTValidator) Username(claims map[string]interface{}) (string, error) {
+	value, ok := claims[v.options.UsernameClaim].(string)
+	if !ok || value == "" {
+		return "", fmt.Errorf("Missing or invalid username claim %q", v.options.UsernameClaim)
+	}
+	if v.options.UserPrefix != "" {
+		return fmt.Sprintf("%s_%s", v.options.UserPrefix, url.QueryEscape(value)), nil
+	}
+	return value, nil
+}
+
+// Finds a key that matches the token's algorithm and key ID, and uses it to verify the signature.
+func (v *LocalJWTValidator) verifySignature(header jwtHeader, signingInput string, signature []byte) error {
+	for _, key := range v.keys {
+		if key.algorithm != header.Algorithm || (key.keyID != "" && header.KeyID != "" && key.keyID != header.KeyID) {
+			continue
+		}
+		if err := verifyJWTSignature(key, signingInput, signature); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("No configured key with algorithm %q verifies the token's signature", header.Algorithm)
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+// Splits a compact-serialized JWT into its decoded parts.
+func parseJWT(token string) (header jwtHeader, claims map[string]interface{}, signingInput string, signature []byte, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return header, nil, "", nil, errors.New("Malformed JWT")
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return header, nil, "", nil, fmt.Errorf("Malformed JWT header: %v", err)
+	}
+	if err := base.JSONUnmarshal(headerJSON, &header); err != nil {
+		return header, nil, "", nil, fmt.Errorf("Malformed JWT header: %v", err)
+	}
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return header, nil, "", nil, fmt.Errorf("Malformed JWT claims: %v", err)
+	}
+	if err := base.JSONUnmarshal(claimsJSON, &claims); err != nil {
+		return header, nil, "", nil, fmt.Errorf("Malformed JWT claims: %v", err)
+	}
+	signature, err = base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return header, nil, "", nil, fmt.Errorf("Malformed JWT signature: %v", err)
+	}
+	return header, claims, parts[0] + "." + parts[1], signature, nil
+}
+
+// Returns the unverified 'iss' claim of a token, used to tell local JWTs apart from those of OIDC providers.
+func GetUnverifiedJWTIssuer(token string) string {
+	_, claims, _, _, err := parseJWT(token)
+	if err != nil {
+		return ""
+	}
+	issuer, _ := claims["iss"].(string)
+	return issuer
+}
+
+func verifyJWTSignature(key jwtValidationKey, signingInput string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signingInput))
+	switch publicKey := key.key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, publicKey)
+		_, _ = mac.Write([]byte(signingInput))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature)
+	case *ecdsa.PublicKey:
+		// JWS encodes ES256 signatures as the 32 byte big-endian values of r and s
+		if len(signature) != 64 {
+			return errors.New("invalid signature length")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(publicKey, digest[:], r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	default:
+		return errors.New("unsupported key type")
+	}
+}
+
+// The 'aud' claim may be a single string or an array.
+func jwtAudienceMatches(claim interface{}, audiences []string) bool {
+	switch aud := claim.(type) {
+	case string:
+		return base.ContainsString(audiences, aud)
+	case []interface{}:
+		for _, value := range aud {
+			if s, ok := value.(string); ok && base.ContainsString(audiences, s) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns a NumericDate claim (seconds since the epoch) as a time.
+func jwtTimeClaim(claims map[string]interface{}, name string) (time.Time, bool) {
+	switch value := claims[name].(type) {
+	case float64:
+		return time.Unix(int64(value), 0), true
+	case int64:
+		return time.Unix(value, 0), true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func parseLocalJWTKey(configKey LocalJWTKey) (jwtValidationKey, error) {
+	key := jwtValidationKey{keyID: configKey.KeyID, algorithm: configKey.Algorithm}
+	switch configKey.Algorithm {
+	case JWTAlgorithmHS256:
+		if configKey.Key == "" {
+			return key, errors.New("key must be set")
+		}
+		key.key = []byte(configKey.Key)
+		return key, nil
+	case JWTAlgorithmRS256, JWTAlgorithmES256:
+		block, _ := pem.Decode([]byte(configKey.Key))
+		if block == nil {
+			return key, errors.New("key must be a PEM-encoded public key")
+		}
+		publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return key, err
+		}
+		key.key = publicKey
+		return key, checkJWTKeyAlgorithm(key)
+	default:
+		return key, fmt.Errorf("unsupported algorithm %q; must be one of %s, %s or %s", configKey.Algorithm, JWTAlgorithmHS256, JWTAlgorithmRS256, JWTAlgorithmES256)
+	}
+}
+
+// Checks that a public key is of the type required by the key's algorithm.
+func checkJWTKeyAlgorithm(key jwtValidationKey) error {
+	switch publicKey := key.key.(type) {
+	case *rsa.PublicKey:
+		if key.algorithm == JWTAlgorithmRS256 {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		if key.algorithm == JWTAlgorithmES256 && publicKey.Curve == elliptic.P256() {
+			return nil
+		}
+	}
+	return fmt.Errorf("key type doesn't match algorithm %q", key.algorithm)
+}
+
+// Loads the signing keys from a JWKS file.  Keys for other uses or unsupported algorithms are skipped.
+func loadJWKSFile(path string) ([]jwtValidationKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read jwt.jwks_file: %v", err)
+	}
+	var keySet struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := base.JSONUnmarshal(data, &keySet); err != nil {
+		return nil, fmt.Errorf("Unable to parse jwt.jwks_file: %v", err)
+	}
+
+	var keys []jwtValidationKey
+	for _, jwk := range keySet.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := parseJSONWebKey(jwk)
+		if err != nil {
+			base.Warnf(base.KeyAll, "Skipping key %q in jwt.jwks_file: %v", base.UD(jwk.KeyID), err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func parseJSONWebKey(jwk jsonWebKey) (jwtValidationKey, error) {
+	key := jwtValidationKey{keyID: jwk.KeyID, algorithm: jwk.Algorithm}
+	switch jwk.KeyType {
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(jwk.K)
+		if err != nil {
+			return key, err
+		}
+		if key.algorithm == "" {
+			key.algorithm = JWTAlgorithmHS256
+		}
+		key.key = secret
+	case "RSA":
+		n, err := decodeJWKInt(jwk.N)
+		if err != nil {
+			return key, err
+		}
+		e, err := decodeJWKInt(jwk.E)
+		if err != nil {
+			return key, err
+		}
+		if key.algorithm == "" {
+			key.algorithm = JWTAlgorithmRS256
+		}
+		key.key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case "EC":
+		if jwk.Curve != "P-256" {
+			return key, fmt.Errorf("unsupported curve %q", jwk.Curve)
+		}
+		x, err := decodeJWKInt(jwk.X)
+		if err != nil {
+			return key, err
+		}
+		y, err := decodeJWKInt(jwk.Y)
+		if err != nil {
+			return key, err
+		}
+		if key.algorithm == "" {
+			key.algorithm = JWTAlgorithmES256
+		}
+		key.key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	default:
+		return key, fmt.Errorf("unsupported key type %q", jwk.KeyType)
+	}
+
+	if _, isSecret := key.key.([]byte); isSecret {
+		if key.algorithm != JWTAlgorithmHS256 {
+			return key, fmt.Errorf("unsupported algorithm %q", key.algorithm)
+		}
+		return key, nil
+	}
+	return key, checkJWTKeyAlgorithm(key)
+}
+
+func decodeJWKInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,307 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	ch "github.com/couchbase/sync_gateway/channels"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Builds a compact-serialized JWT, signed with a []byte secret, *rsa.PrivateKey or *ecdsa.PrivateKey.
+func signTestJWT(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	header := map[string]interface{}{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	headerJSON, err := base.JSONMarshal(header)
+	require.NoError(t, err)
+	claimsJSON, err := base.JSONMarshal(claims)
+	require.NoError(t, err)
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+
+	digest := sha256.Sum256([]byte(signingInput))
+	var signature []byte
+	switch privateKey := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, privateKey)
+		_, _ = mac.Write([]byte(signingInput))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, digest[:])
+		require.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, privateKey, digest[:])
+		require.NoError(t, err)
+		// Each value is left-padded to 32 bytes
+		signature = make([]byte, 64)
+		rBytes, sBytes := r.Bytes(), s.Bytes()
+		copy(signature[32-len(rBytes):32], rBytes)
+		copy(signature[64-len(sBytes):], sBytes)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func publicKeyPEM(t *testing.T, publicKey interface{}) string {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	require.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func testJWTClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss": "https://issuer.example.com",
+		"aud": []string{"other", "sync_gateway"},
+		"sub": "alice",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func TestLocalJWTValidatorAlgorithms(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	secret := []byte("shared secret")
+
+	validator, err := NewLocalJWTValidator(LocalJWTOptions{
+		Issuer:    "https://issuer.example.com",
+		Audiences: []string{"sync_gateway"},
+		Keys: []LocalJWTKey{
+			{Algorithm: JWTAlgorithmHS256, Key: string(secret)},
+			{Algorithm: JWTAlgorithmRS256, Key: publicKeyPEM(t, &rsaKey.PublicKey)},
+			{Algorithm: JWTAlgorithmES256, Key: publicKeyPEM(t, &ecKey.PublicKey)},
+		},
+	})
+	require.NoError(t, err)
+
+	for alg, key := range map[string]interface{}{JWTAlgorithmHS256: secret, JWTAlgorithmRS256: rsaKey, JWTAlgorithmES256: ecKey} {
+		claims, err := validator.ValidateJWT(signTestJWT(t, alg, "", key, testJWTClaims()))
+		assert.NoError(t, err, "Validating %s token", alg)
+		username, err := validator.Username(claims)
+		assert.NoError(t, err)
+		assert.Equal(t, "alice", username)
+	}
+
+	// Signed with the wrong key, or with a key for a different algorithm
+	_, err = validator.ValidateJWT(signTestJWT(t, JWTAlgorithmHS256, "", []byte("wrong"), testJWTClaims()))
+	assert.Error(t, err)
+	_, err = validator.ValidateJWT(signTestJWT(t, JWTAlgorithmHS256, "", []byte(publicKeyPEM(t, &rsaKey.PublicKey)), testJWTClaims()))
+	assert.Error(t, err)
+	_, err = validator.ValidateJWT("not.a.jwt")
+	assert.Error(t, err)
+}
+
+func TestLocalJWTValidatorClaims(t *testing.T) {
+	secret := []byte("shared secret")
+	validator, err := NewLocalJWTValidator(LocalJWTOptions{
+		Issuer:        "https://issuer.example.com",
+		Audiences:     []string{"sync_gateway"},
+		Keys:          []LocalJWTKey{{Algorithm: JWTAlgorithmHS256, Key: string(secret)}},
+		UsernameClaim: "preferred_username",
+		UserPrefix:    "svc",
+	})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name   string
+		update func(claims map[string]interface{})
+		valid  bool
+	}{
+		{"valid", func(claims map[string]interface{}) {}, true},
+		{"single audience", func(claims map[string]interface{}) { claims["aud"] = "sync_gateway" }, true},
+		{"wrong issuer", func(claims map[string]interface{}) { claims["iss"] = "https://other.example.com" }, false},
+		{"wrong audience", func(claims map[string]interface{}) { claims["aud"] = "other" }, false},
+		{"missing audience", func(claims map[string]interface{}) { delete(claims, "aud") }, false},
+		{"expired", func(claims map[string]interface{}) { claims["exp"] = time.Now().Add(-5 * time.Minute).Unix() }, false},
+		{"expired within clock skew", func(claims map[string]interface{}) { claims["exp"] = time.Now().Add(-10 * time.Second).Unix() }, true},
+		{"missing expiry", func(claims map[string]interface{}) { delete(claims, "exp") }, false},
+		{"not yet valid", func(claims map[string]interface{}) { claims["nbf"] = time.Now().Add(time.Hour).Unix() }, false},
+		{"not yet valid within clock skew", func(claims map[string]interface{}) { claims["nbf"] = time.Now().Add(10 * time.Second).Unix() }, true},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			claims := testJWTClaims()
+			claims["preferred_username"] = "bob/smith"
+			testCase.update(claims)
+			validated, err := validator.ValidateJWT(signTestJWT(t, JWTAlgorithmHS256, "", secret, claims))
+			if !testCase.valid {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			username, err := validator.Username(validated)
+			assert.NoError(t, err)
+			assert.Equal(t, "svc_bob%2Fsmith", username)
+		})
+	}
+
+	// Without leeway for clock skew, the time claims are checked exactly
+	noClockSkew := uint32(0)
+	validator, err = NewLocalJWTValidator(LocalJWTOptions{
+		Issuer:        "https://issuer.example.com",
+		Keys:          []LocalJWTKey{{Algorithm: JWTAlgorithmHS256, Key: string(secret)}},
+		ClockSkewSecs: &noClockSkew,
+	})
+	require.NoError(t, err)
+	claims := testJWTClaims()
+	claims["exp"] = time.Now().Add(-10 * time.Second).Unix()
+	_, err = validator.ValidateJWT(signTestJWT(t, JWTAlgorithmHS256, "", secret, claims))
+	assert.Error(t, err)
+	claims = testJWTClaims()
+	claims["nbf"] = time.Now().Add(10 * time.Second).Unix()
+	_, err = validator.ValidateJWT(signTestJWT(t, JWTAlgorithmHS256, "", secret, claims))
+	assert.Error(t, err)
+}
+
+func TestLocalJWTValidatorJWKSFile(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	encode := func(i *big.Int) string { return base64.RawURLEncoding.EncodeToString(i.Bytes()) }
+	jwks, err := base.JSONMarshal(map[string]interface{}{"keys": []map[string]interface{}{
+		{"kty": "RSA", "kid": "rsa1", "use": "sig", "n": encode(rsaKey.N), "e": encode(big.NewInt(int64(rsaKey.E)))},
+		{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": encode(ecKey.X), "y": encode(ecKey.Y)},
+		{"kty": "RSA", "kid": "enc1", "use": "enc", "n": encode(rsaKey.N), "e": encode(big.NewInt(int64(rsaKey.E)))},
+	}})
+	require.NoError(t, err)
+	jwksFile, err := ioutil.TempFile("", "jwks")
+	require.NoError(t, err)
+	defer func() { _ = os.Remove(jwksFile.Name()) }()
+	_, err = jwksFile.Write(jwks)
+	require.NoError(t, err)
+	require.NoError(t, jwksFile.Close())
+
+	validator, err := NewLocalJWTValidator(LocalJWTOptions{Issuer: "https://issuer.example.com", JWKSFile: jwksFile.Name()})
+	require.NoError(t, err)
+	assert.Len(t, validator.keys, 2)
+
+	_, err = validator.ValidateJWT(signTestJWT(t, JWTAlgorithmRS256, "rsa1", rsaKey, testJWTClaims()))
+	assert.NoError(t, err)
+	_, err = validator.ValidateJWT(signTestJWT(t, JWTAlgorithmES256, "ec1", ecKey, testJWTClaims()))
+	assert.NoError(t, err)
+
+	// A kid that doesn't match the key
+	_, err = validator.ValidateJWT(signTestJWT(t, JWTAlgorithmRS256, "ec1", rsaKey, testJWTClaims()))
+	assert.Error(t, err)
+}
+
+func TestNewLocalJWTValidatorErrors(t *testing.T) {
+	_, err := NewLocalJWTValidator(LocalJWTOptions{Keys: []LocalJWTKey{{Algorithm: JWTAlgorithmHS256, Key: "secret"}}})
+	assert.Error(t, err)
+	_, err = NewLocalJWTValidator(LocalJWTOptions{Issuer: "iss"})
+	assert.Error(t, err)
+	_, err = NewLocalJWTValidator(LocalJWTOptions{Issuer: "iss", Keys: []LocalJWTKey{{Algorithm: "none"}}})
+	assert.Error(t, err)
+	_, err = NewLocalJWTValidator(LocalJWTOptions{Issuer: "iss", Keys: []LocalJWTKey{{Algorithm: JWTAlgorithmRS256, Key: "not pem"}}})
+	assert.Error(t, err)
+}
+
+func TestAuthenticateLocalJWT(t *testing.T) {
+	testBucket := base.GetTestBucket(t)
+	defer testBucket.Close()
+	auth := NewAuthenticator(testBucket.Bucket, nil)
+
+	secret := []byte("shared secret")
+	options := LocalJWTOptions{
+		Issuer: "https://issuer.example.com",
+		Keys:   []LocalJWTKey{{Algorithm: JWTAlgorithmHS256, Key: string(secret)}},
+	}
+	validator, err := NewLocalJWTValidator(options)
+	require.NoError(t, err)
+
+	claims := testJWTClaims()
+	claims["email"] = "alice@example.com"
+	token := signTestJWT(t, JWTAlgorithmHS256, "", secret, claims)
+
+	// Without registration, the user must already exist
+	user, err := auth.AuthenticateLocalJWT(token, validator)
+	assert.NoError(t, err)
+	assert.Nil(t, user)
+
+	options.Register = true
+	validator, err = NewLocalJWTValidator(options)
+	require.NoError(t, err)
+	user, err = auth.AuthenticateLocalJWT(token, validator)
+	require.NoError(t, err)
+	require.NotNil(t, user)
+	assert.Equal(t, "alice", user.Name())
+	assert.Equal(t, "alice@example.com", user.Email())
+
+	user, err = auth.GetUser("alice")
+	assert.NoError(t, err)
+	assert.NotNil(t, user)
+}
+
+func TestAuthenticateLocalJWTClaimAccess(t *testing.T) {
+	testBucket := base.GetTestBucket(t)
+	defer testBucket.Close()
+	auth := NewAuthenticator(testBucket.Bucket, nil)
+
+	secret := []byte("shared secret")
+	validator, err := NewLocalJWTValidator(LocalJWTOptions{
+		Issuer:        "https://issuer.example.com",
+		Keys:          []LocalJWTKey{{Algorithm: JWTAlgorithmHS256, Key: string(secret)}},
+		Register:      true,
+		RolesClaim:    "groups",
+		ChannelsClaim: "channels",
+	})
+	require.NoError(t, err)
+
+	// An admin-assigned role is kept separately from those granted by claims
+	user, err := auth.NewUser("alice", "password", ch.SetOf(t, "admin_channel"))
+	require.NoError(t, err)
+	user.SetExplicitRoles(ch.AtSequence(ch.SetOf(t, "admin_role"), 1))
+	require.NoError(t, auth.Save(user))
+
+	claims := testJWTClaims()
+	claims["groups"] = []string{"editors", "viewers"}
+	claims["channels"] = "news"
+	user, err = auth.AuthenticateLocalJWT(signTestJWT(t, JWTAlgorithmHS256, "", secret, claims), validator)
+	require.NoError(t, err)
+	require.NotNil(t, user)
+	assert.Equal(t, ch.SetOf(t, "editors", "viewers"), user.JWTRoles().AsSet())
+	assert.Equal(t, ch.SetOf(t, "admin_role", "editors", "viewers"), user.RoleNames().AsSet())
+	assert.True(t, user.CanSeeChannel("news"))
+	assert.True(t, user.CanSeeChannel("admin_channel"))
+
+	// Removing a value from a claim revokes it, and a missing claim revokes everything it granted
+	claims["groups"] = []string{"viewers"}
+	delete(claims, "channels")
+	user, err = auth.AuthenticateLocalJWT(signTestJWT(t, JWTAlgorithmHS256, "", secret, claims), validator)
+	require.NoError(t, err)
+	assert.Equal(t, ch.SetOf(t, "admin_role", "viewers"), user.RoleNames().AsSet())
+	assert.False(t, user.CanSeeChannel("news"))
+	assert.True(t, user.CanSeeChannel("admin_channel"))
+
+	user, err = auth.GetUser("alice")
+	require.NoError(t, err)
+	assert.Equal(t, ch.SetOf(t, "admin_role"), user.ExplicitRoles().AsSet())
+	assert.Equal(t, ch.SetOf(t, "viewers"), user.JWTRoles().AsSet())
+	assert.Len(t, user.JWTChannels(), 0)
+
+	// Invalid claim values are rejected
+	claims["groups"] = []interface{}{"viewers", 5}
+	_, err = auth.AuthenticateLocalJWT(signTestJWT(t, JWTAlgorithmHS256, "", secret, claims), validator)
+	assert.Error(t, err)
+	claims["groups"] = "bad,name"
+	_, err = auth.AuthenticateLocalJWT(signTestJWT(t, JWTAlgorithmHS256, "", secret, claims), validator)
+	assert.Error(t, err)
+}
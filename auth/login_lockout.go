@@ -0,0 +1,353 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package auth
+
+import (
+	"sort"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+const (
+	DefaultLockoutMaxFailures = 5
+	DefaultLockoutWindow      = 5 * time.Minute
+	DefaultLockoutDuration    = time.Minute
+	DefaultMaxLockoutDuration = time.Hour
+)
+
+// Throttling of failed password logins.  When MaxFailures logins for a user, or from a client address,
+// fail within the window, further logins are rejected for the lockout duration.  The duration doubles
+// with each consecutive lockout, up to the maximum.
+type LoginLockoutOptions struct {
+	MaxFailures    int `json:"max_failures,omitempty"`     // Failed logins that trigger a lockout, default 5
+	WindowSecs     int `json:"window_secs,omitempty"`      // Period in which failures are counted, default 300
+	LockoutSecs    int `json:"lockout_secs,omitempty"`     // Duration of the first lockout, default 60
+	MaxLockoutSecs int `json:"max_lockout_secs,omitempty"` // Maximum lockout duration, default 3600
+}
+
+func (options *LoginLockoutOptions) maxFailures() int {
+	if options.MaxFailures > 0 {
+		return options.MaxFailures
+	}
+	return DefaultLockoutMaxFailures
+}
+
+func (options *LoginLockoutOptions) window() time.Duration {
+	if options.WindowSecs > 0 {
+		return time.Duration(options.WindowSecs) * time.Second
+	}
+	return DefaultLockoutWindow
+}
+
+func (options *LoginLockoutOptions) maxLockoutDuration() time.Duration {
+	if options.MaxLockoutSecs > 0 {
+		return time.Duration(options.MaxLockoutSecs) * time.Second
+	}
+	return DefaultMaxLockoutDuration
+}
+
+// Duration of a lockout, given the number of consecutive lockouts that preceded it.
+func (options *LoginLockoutOptions) lockoutDuration(previousLockouts int) time.Duration {
+	duration := DefaultLockoutDuration
+	if options.LockoutSecs > 0 {
+		duration = time.Duration(options.LockoutSecs) * time.Second
+	}
+	maxDuration := options.maxLockoutDuration()
+	for i := 0; i < previousLockouts && duration < maxDuration; i++ {
+		duration *= 2
+	}
+	if duration > maxDuration {
+		duration = maxDuration
+	}
+	return duration
+}
+
+// Failed login tracking for a user or client address.  A user's state is stored in the user doc,
+// a client address's in its own doc, so both are shared by all nodes.
+type LoginLockoutState struct {
+	Failures    int        `json:"failures,omitempty"`     // Failures in the current window
+	WindowStart time.Time  `json:"window_start"`           // Time of the first failure in the current window
+	Lockouts    int        `json:"lockouts,omitempty"`     // Consecutive lockouts, for the backoff
+	LockedUntil *time.Time `json:"locked_until,omitempty"` // Set while locked out
+}
+
+// Returns the lockout's end time, if locked out at the given time.
+func (state *LoginLockoutState) lockedUntil(now time.Time) (time.Time, bool) {
+	if state == nil || state.LockedUntil == nil || !now.Before(*state.LockedUntil) {
+		return time.Time{}, false
+	}
+	return *state.LockedUntil, true
+}
+
+// Counts a failed login, and returns true if it triggered a lockout.
+func (state *LoginLockoutState) recordFailure(options *LoginLockoutOptions, now time.Time) bool {
+	if _, locked := state.lockedUntil(now); locked {
+		return false
+	}
+	if state.Failures == 0 || now.Sub(state.WindowStart) > options.window() {
+		state.Failures = 0
+		state.WindowStart = now
+	}
+	state.Failures++
+	if state.Failures < options.maxFailures() {
+		return false
+	}
+
+	lockedUntil := now.Add(options.lockoutDuration(state.Lockouts))
+	state.LockedUntil = &lockedUntil
+	state.Lockouts++
+	state.Failures = 0
+	return true
+}
+
+// Expiry for a client address's state doc - it's kept long enough to count failures in the current
+// window, and for the backoff to apply to a lockout following the current one.
+func (state *LoginLockoutState) expiry(options *LoginLockoutOptions, now time.Time) uint32 {
+	end := state.WindowStart.Add(options.window())
+	if state.LockedUntil != nil && state.LockedUntil.After(end) {
+		end = *state.LockedUntil
+	}
+	return base.DurationToCbsExpiry(end.Sub(now) + options.maxLockoutDuration())
+}
+
+// A lockout of a user or client address.  Passed to the lockout callback, and listed by GetLoginLockouts.
+type LoginLockout struct {
+	Username    string    `json:"name,omitempty"`
+	ClientIP    string    `json:"client_ip,omitempty"`
+	LockedUntil time.Time `json:"locked_until"`
+	Lockouts    int       `json:"lockouts"` // Consecutive lockouts, including this one
+}
+
+// Called when a user or client address is locked out
+type LoginLockoutCallback func(lockout LoginLockout)
+
+// Returned when a login is rejected because the user or client address is locked out.
+type LoginLockedOutError struct {
+	LockedUntil time.Time
+}
+
+func (err *LoginLockedOutError) Error() string {
+	return "Too many failed login attempts"
+}
+
+// Index of the current lockouts, for listing by admins
+type loginLockoutIndex struct {
+	Users map[string]time.Time `json:"users,omitempty"`
+	IPs   map[string]time.Time `json:"ips,omitempty"`
+}
+
+func docIDForAddressLockout(clientIP string) string {
+	return base.LoginLockoutPrefix + clientIP
+}
+
+// Enables login lockout for the authenticator.  The callback, if non-nil, is called for each lockout.
+func (auth *Authenticator) SetLoginLockout(options *LoginLockoutOptions, onLockout LoginLockoutCallback) {
+	auth.lockoutOptions = options
+	auth.onLockout = onLockout
+}
+
+// Authenticates a user with a password, applying the login lockout when it's enabled.  Returns a
+// *LoginLockedOutError if the user or client address is locked out, or a nil user if the login fails.
+func (auth *Authenticator) AuthenticatePassword(username, password, clientIP string) (User, error) {
+	if auth.lockoutOptions == nil || username == "" {
+		return auth.AuthenticateUser(username, password), nil
+	}
+
+	now := time.Now()
+	var addressState *LoginLockoutState
+	if clientIP != "" {
+		addressState = &LoginLockoutState{}
+		if _, err := auth.bucket.Get(docIDForAddressLockout(clientIP), addressState); err != nil && !base.IsDocNotFoundError(err) {
+			return nil, err
+		}
+		if until, locked := addressState.lockedUntil(now); locked {
+			return nil, &LoginLockedOutError{LockedUntil: until}
+		}
+	}
+
+	user, err := auth.GetUser(username)
+	if err != nil {
+		return nil, err
+	}
+	if user != nil {
+		if until, locked := user.LoginLockout().lockedUntil(now); locked {
+			return nil, &LoginLockedOutError{LockedUntil: until}
+		}
+		if user.Authenticate(password) {
+			if user.LoginLockout() != nil {
+				if err := auth.ClearUserLockout(user); err != nil {
+					base.Warnf(base.KeyAuth, "Unable to reset failed logins for user %s: %v", base.UD(username), err)
+				}
+			}
+			return user, nil
+		}
+		if err := auth.recordUserLoginFailure(user, now); err != nil {
+			base.Warnf(base.KeyAuth, "Unable to record failed login for user %s: %v", base.UD(username), err)
+		}
+	}
+
+	if clientIP != "" {
+		if err := auth.recordAddressLoginFailure(clientIP, now); err != nil {
+			base.Warnf(base.KeyAuth, "Unable to record failed login from %s: %v", base.UD(clientIP), err)
+		}
+	}
+	return nil, nil
+}
+
+func (auth *Authenticator) recordUserLoginFailure(user User, now time.Time) error {
+	var lockout *LoginLockout
+	err := auth.casUpdatePrincipal(user, func(p Principal) (Principal, error) {
+		currentUser, ok := p.(User)
+		if !ok {
+			return nil, base.ErrUpdateCancel
+		}
+		state := &LoginLockoutState{}
+		if current := currentUser.LoginLockout(); current != nil {
+			*state = *current
+		}
+		lockout = nil
+		if state.recordFailure(auth.lockoutOptions, now) {
+			lockout = &LoginLockout{Username: currentUser.Name(), LockedUntil: *state.LockedUntil, Lockouts: state.Lockouts}
+		}
+		currentUser.setLoginLockout(state)
+		return currentUser, nil
+	})
+	if err != nil || lockout == nil {
+		return err
+	}
+
+	base.Warnf(base.KeyAuth, "User %s locked out until %v after repeated failed logins", base.UD(lockout.Username), lockout.LockedUntil)
+	auth.notifyLockout(*lockout)
+	return auth.updateLockoutIndex(func(index *loginLockoutIndex) {
+		index.Users[lockout.Username] = lockout.LockedUntil
+	})
+}
+
+func (auth *Authenticator) recordAddressLoginFailure(clientIP string, now time.Time) error {
+	var lockout *LoginLockout
+	_, err := auth.bucket.Update(docIDForAddressLockout(clientIP), 0, func(currentValue []byte) ([]byte, *uint32, error) {
+		// Be careful: this block can be invoked multiple times if there are races!
+		state := &LoginLockoutState{}
+		if currentValue != nil {
+			if err := base.JSONUnmarshal(currentValue, state); err != nil {
+				return nil, nil, err
+			}
+		}
+		lockout = nil
+		if state.recordFailure(auth.lockoutOptions, now) {
+			lockout = &LoginLockout{ClientIP: clientIP, LockedUntil: *state.LockedUntil, Lockouts: state.Lockouts}
+		}
+		updatedValue, err := base.JSONMarshal(state)
+		expiry := state.expiry(auth.lockoutOptions, now)
+		return updatedValue, &expiry, err
+	})
+	if err != nil || lockout == nil {
+		return err
+	}
+
+	base.Warnf(base.KeyAuth, "Client %s locked out until %v after repeated failed logins", base.UD(clientIP), lockout.LockedUntil)
+	auth.notifyLockout(*lockout)
+	return auth.updateLockoutIndex(func(index *loginLockoutIndex) {
+		index.IPs[clientIP] = lockout.LockedUntil
+	})
+}
+
+func (auth *Authenticator) notifyLockout(lockout LoginLockout) {
+	if auth.onLockout != nil {
+		auth.onLockout(lockout)
+	}
+}
+
+// Applies a change to the lockout index, dropping lockouts that have ended.
+func (auth *Authenticator) updateLockoutIndex(callback func(index *loginLockoutIndex)) error {
+	_, err := auth.bucket.Update(base.LoginLockoutIndexKey, 0, func(currentValue []byte) ([]byte, *uint32, error) {
+		// Be careful: this block can be invoked multiple times if there are races!
+		index := &loginLockoutIndex{}
+		if currentValue != nil {
+			if err := base.JSONUnmarshal(currentValue, index); err != nil {
+				return nil, nil, err
+			}
+		}
+		if index.Users == nil {
+			index.Users = map[string]time.Time{}
+		}
+		if index.IPs == nil {
+			index.IPs = map[string]time.Time{}
+		}
+		now := time.Now()
+		for _, lockouts := range []map[string]time.Time{index.Users, index.IPs} {
+			for name, lockedUntil := range lockouts {
+				if !now.Before(lockedUntil) {
+					delete(lockouts, name)
+				}
+			}
+		}
+		callback(index)
+		updatedValue, err := base.JSONMarshal(index)
+		return updatedValue, nil, err
+	})
+	return err
+}
+
+// Returns the current lockouts of users and client addresses, ordered by name and address.
+func (auth *Authenticator) GetLoginLockouts() (users []LoginLockout, clientIPs []LoginLockout, err error) {
+	users, clientIPs = []LoginLockout{}, []LoginLockout{}
+	var index loginLockoutIndex
+	if _, err = auth.bucket.Get(base.LoginLockoutIndexKey, &index); err != nil {
+		if base.IsDocNotFoundError(err) {
+			err = nil
+		}
+		return users, clientIPs, err
+	}
+
+	now := time.Now()
+	for username, lockedUntil := range index.Users {
+		if now.Before(lockedUntil) {
+			users = append(users, LoginLockout{Username: username, LockedUntil: lockedUntil})
+		}
+	}
+	for clientIP, lockedUntil := range index.IPs {
+		if now.Before(lockedUntil) {
+			clientIPs = append(clientIPs, LoginLockout{ClientIP: clientIP, LockedUntil: lockedUntil})
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	sort.Slice(clientIPs, func(i, j int) bool { return clientIPs[i].ClientIP < clientIPs[j].ClientIP })
+	return users, clientIPs, nil
+}
+
+// Clears a user's lockout and failed login count.
+func (auth *Authenticator) ClearUserLockout(user User) error {
+	err := auth.casUpdatePrincipal(user, func(p Principal) (Principal, error) {
+		currentUser, ok := p.(User)
+		if !ok || currentUser.LoginLockout() == nil {
+			return nil, base.ErrUpdateCancel
+		}
+		currentUser.setLoginLockout(nil)
+		return currentUser, nil
+	})
+	if err != nil {
+		return err
+	}
+	return auth.updateLockoutIndex(func(index *loginLockoutIndex) {
+		delete(index.Users, user.Name())
+	})
+}
+
+// Clears a client address's lockout and failed login count.
+func (auth *Authenticator) ClearAddressLockout(clientIP string) error {
+	if err := auth.bucket.Delete(docIDForAddressLockout(clientIP)); err != nil && !base.IsDocNotFoundError(err) {
+		return err
+	}
+	return auth.updateLockoutIndex(func(index *loginLockoutIndex) {
+		delete(index.IPs, clientIP)
+	})
+}
@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	ch "github.com/couchbase/sync_gateway/channels"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoginLockoutDuration(t *testing.T) {
+	options := &LoginLockoutOptions{LockoutSecs: 10, MaxLockoutSecs: 60}
+	assert.Equal(t, 10*time.Second, options.lockoutDuration(0))
+	assert.Equal(t, 20*time.Second, options.lockoutDuration(1))
+	assert.Equal(t, 40*time.Second, options.lockoutDuration(2))
+	assert.Equal(t, 60*time.Second, options.lockoutDuration(3))
+	assert.Equal(t, 60*time.Second, options.lockoutDuration(50))
+
+	defaults := &LoginLockoutOptions{}
+	assert.Equal(t, DefaultLockoutDuration, defaults.lockoutDuration(0))
+	assert.Equal(t, DefaultMaxLockoutDuration, defaults.lockoutDuration(50))
+}
+
+func TestLoginLockoutStateWindow(t *testing.T) {
+	options := &LoginLockoutOptions{MaxFailures: 3, WindowSecs: 60}
+	state := &LoginLockoutState{}
+	now := time.Now()
+
+	assert.False(t, state.recordFailure(options, now))
+	assert.False(t, state.recordFailure(options, now.Add(time.Second)))
+	// Failures outside the window start a new count
+	assert.False(t, state.recordFailure(options, now.Add(2*time.Minute)))
+	assert.Equal(t, 1, state.Failures)
+	assert.False(t, state.recordFailure(options, now.Add(2*time.Minute)))
+	assert.True(t, state.recordFailure(options, now.Add(2*time.Minute)))
+
+	lockedUntil, locked := state.lockedUntil(now.Add(2 * time.Minute))
+	assert.True(t, locked)
+	assert.True(t, lockedUntil.Equal(now.Add(2*time.Minute+DefaultLockoutDuration)))
+	_, locked = state.lockedUntil(lockedUntil)
+	assert.False(t, locked)
+}
+
+func TestAuthenticatePasswordLockout(t *testing.T) {
+	testBucket := base.GetTestBucket(t)
+	defer testBucket.Close()
+	auth := NewAuthenticator(testBucket.Bucket, nil)
+	var lockouts []LoginLockout
+	auth.SetLoginLockout(&LoginLockoutOptions{MaxFailures: 3}, func(lockout LoginLockout) {
+		lockouts = append(lockouts, lockout)
+	})
+
+	user, err := auth.NewUser("alice", "password", ch.SetOf(t, "a"))
+	require.NoError(t, err)
+	require.NoError(t, auth.Save(user))
+
+	// A successful login resets the failure count
+	for i := 0; i < 2; i++ {
+		user, err = auth.AuthenticatePassword("alice", "wrong", "")
+		assert.NoError(t, err)
+		assert.Nil(t, user)
+	}
+	user, err = auth.AuthenticatePassword("alice", "password", "")
+	assert.NoError(t, err)
+	assert.NotNil(t, user)
+	user, err = auth.GetUser("alice")
+	require.NoError(t, err)
+	assert.Nil(t, user.LoginLockout())
+
+	for i := 0; i < 3; i++ {
+		user, err = auth.AuthenticatePassword("alice", "wrong", "")
+		assert.NoError(t, err)
+		assert.Nil(t, user)
+	}
+	require.Len(t, lockouts, 1)
+	assert.Equal(t, "alice", lockouts[0].Username)
+	assert.Equal(t, 1, lockouts[0].Lockouts)
+
+	// The correct password is rejected while locked out
+	_, err = auth.AuthenticatePassword("alice", "password", "")
+	require.Error(t, err)
+	lockedOut, ok := err.(*LoginLockedOutError)
+	require.True(t, ok)
+	assert.True(t, lockedOut.LockedUntil.After(time.Now()))
+
+	users, clientIPs, err := auth.GetLoginLockouts()
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	assert.Equal(t, "alice", users[0].Username)
+	assert.Len(t, clientIPs, 0)
+
+	user, err = auth.GetUser("alice")
+	require.NoError(t, err)
+	require.NoError(t, auth.ClearUserLockout(user))
+	user, err = auth.AuthenticatePassword("alice", "password", "")
+	assert.NoError(t, err)
+	assert.NotNil(t, user)
+	users, _, err = auth.GetLoginLockouts()
+	require.NoError(t, err)
+	assert.Len(t, users, 0)
+}
+
+func TestAuthenticatePasswordAddressLockout(t *testing.T) {
+	testBucket := base.GetTestBucket(t)
+	defer testBucket.Close()
+	auth := NewAuthenticator(testBucket.Bucket, nil)
+	auth.SetLoginLockout(&LoginLockoutOptions{MaxFailures: 2}, nil)
+
+	user, err := auth.NewUser("alice", "password", ch.SetOf(t, "a"))
+	require.NoError(t, err)
+	require.NoError(t, auth.Save(user))
+
+	// Failures for users that don't exist count against the client address
+	for _, username := range []string{"bob", "carol"} {
+		user, err = auth.AuthenticatePassword(username, "guess", "10.0.0.1")
+		assert.NoError(t, err)
+		assert.Nil(t, user)
+	}
+	_, err = auth.AuthenticatePassword("alice", "password", "10.0.0.1")
+	assert.IsType(t, &LoginLockedOutError{}, err)
+
+	// Other addresses aren't affected
+	user, err = auth.AuthenticatePassword("alice", "password", "10.0.0.2")
+	assert.NoError(t, err)
+	assert.NotNil(t, user)
+
+	_, clientIPs, err := auth.GetLoginLockouts()
+	require.NoError(t, err)
+	require.Len(t, clientIPs, 1)
+	assert.Equal(t, "10.0.0.1", clientIPs[0].ClientIP)
+
+	require.NoError(t, auth.ClearAddressLockout("10.0.0.1"))
+	user, err = auth.AuthenticatePassword("alice", "password", "10.0.0.1")
+	assert.NoError(t, err)
+	assert.NotNil(t, user)
+}
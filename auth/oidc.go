@@ -49,6 +49,8 @@ type OIDCProvider struct {
 	UserPrefix              string   `json:"user_prefix,omitempty"`            // Username prefix for users created for this provider
 	DiscoveryURI            string   `json:"discovery_url,omitempty"`          // Non-standard discovery endpoints
 	DisableConfigValidation bool     `json:"disable_cfg_validation,omitempty"` // Bypasses config validation based on the OIDC spec.  Required for some OPs that don't strictly adhere to spec (eg. Yahoo)
+	RolesClaim              string   `json:"roles_claim,omitempty"`            // If set, the claim's values are granted to the user as roles, and revoked when removed from the claim
+	ChannelsClaim           string   `json:"channels_claim,omitempty"`         // If set, the claim's values are granted to the user as channels, and revoked when removed from the claim
 	OIDCClient              *oidc.Client
 	OIDCClientOnce          sync.Once
 	IsDefault               bool
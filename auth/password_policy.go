@@ -0,0 +1,85 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package auth
+
+import (
+	"net/http"
+	"unicode"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Requirements for user passwords, applied whenever a password is set or changed.
+type PasswordPolicy struct {
+	MinLength        int  `json:"min_length,omitempty"`        // Minimum number of characters
+	RequireUppercase bool `json:"require_uppercase,omitempty"` // Must contain an uppercase letter
+	RequireLowercase bool `json:"require_lowercase,omitempty"` // Must contain a lowercase letter
+	RequireDigit     bool `json:"require_digit,omitempty"`     // Must contain a digit
+	RequireSymbol    bool `json:"require_symbol,omitempty"`    // Must contain a character that isn't a letter or digit
+	HistoryCount     int  `json:"history_count,omitempty"`     // If set, the last N passwords (including the current one) can't be reused
+}
+
+// Checks a password against the policy's length and character class requirements.  Returns a 400
+// error describing the first requirement the password doesn't meet.
+func (policy *PasswordPolicy) ValidatePassword(password string) error {
+	if policy == nil {
+		return nil
+	}
+	if len([]rune(password)) < policy.MinLength {
+		return base.HTTPErrorf(http.StatusBadRequest, "Password must be at least %d characters", policy.MinLength)
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case !unicode.IsLetter(r):
+			hasSymbol = true
+		}
+	}
+	if policy.RequireUppercase && !hasUpper {
+		return base.HTTPErrorf(http.StatusBadRequest, "Password must contain an uppercase letter")
+	}
+	if policy.RequireLowercase && !hasLower {
+		return base.HTTPErrorf(http.StatusBadRequest, "Password must contain a lowercase letter")
+	}
+	if policy.RequireDigit && !hasDigit {
+		return base.HTTPErrorf(http.StatusBadRequest, "Password must contain a digit")
+	}
+	if policy.RequireSymbol && !hasSymbol {
+		return base.HTTPErrorf(http.StatusBadRequest, "Password must contain a symbol")
+	}
+	return nil
+}
+
+// Checks a new password for a user against the policy, including the reuse check.
+func (policy *PasswordPolicy) ValidatePasswordChange(user User, password string) error {
+	if err := policy.ValidatePassword(password); err != nil {
+		return err
+	}
+	if policy != nil && policy.HistoryCount > 0 && user != nil && user.MatchesRecentPassword(password, policy.HistoryCount) {
+		return base.HTTPErrorf(http.StatusBadRequest, "Password was used recently")
+	}
+	return nil
+}
+
+// Sets a user's password, keeping as many previous password hashes as the policy's reuse check needs.
+func (policy *PasswordPolicy) SetPassword(user User, password string) {
+	if policy != nil && policy.HistoryCount > 1 {
+		user.SetPasswordWithHistory(password, policy.HistoryCount-1)
+	} else {
+		user.SetPassword(password)
+	}
+}
@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	ch "github.com/couchbase/sync_gateway/channels"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPasswordPolicyValidatePassword(t *testing.T) {
+	policy := &PasswordPolicy{
+		MinLength:        8,
+		RequireUppercase: true,
+		RequireLowercase: true,
+		RequireDigit:     true,
+		RequireSymbol:    true,
+	}
+	testCases := map[string]bool{
+		"Sh0rt!":      false,
+		"alllower1!":  false,
+		"ALLUPPER1!":  false,
+		"NoDigits!!":  false,
+		"NoSymbols11": false,
+		"Válid-pass1": true,
+		"Passw0rd!":   true,
+	}
+	for password, valid := range testCases {
+		err := policy.ValidatePassword(password)
+		if valid {
+			assert.NoError(t, err, "Password %q", password)
+		} else {
+			assert.Error(t, err, "Password %q", password)
+		}
+	}
+
+	// A nil policy accepts anything
+	var nilPolicy *PasswordPolicy
+	assert.NoError(t, nilPolicy.ValidatePassword(""))
+}
+
+func TestPasswordPolicyHistory(t *testing.T) {
+	testBucket := base.GetTestBucket(t)
+	defer testBucket.Close()
+	auth := NewAuthenticator(testBucket.Bucket, nil)
+
+	policy := &PasswordPolicy{HistoryCount: 3}
+	user, err := auth.NewUser("alice", "password1", ch.SetOf(t))
+	require.NoError(t, err)
+
+	for _, password := range []string{"password2", "password3", "password4"} {
+		require.NoError(t, policy.ValidatePasswordChange(user, password))
+		policy.SetPassword(user, password)
+	}
+	require.NoError(t, auth.Save(user))
+
+	user, err = auth.GetUser("alice")
+	require.NoError(t, err)
+	assert.True(t, user.Authenticate("password4"))
+
+	// The current password and the two before it can't be reused; older ones can
+	for _, password := range []string{"password4", "password3", "password2"} {
+		assert.Error(t, policy.ValidatePasswordChange(user, password), "Password %q", password)
+	}
+	assert.NoError(t, policy.ValidatePasswordChange(user, "password1"))
+}
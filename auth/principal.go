@@ -93,6 +93,13 @@ type User interface {
 	// Changes the user's password.
 	SetPassword(password string)
 
+	// Changes the user's password, keeping the hashes of up to historyCount previous passwords.
+	SetPasswordWithHistory(password string, historyCount int)
+
+	// Returns true if the password is the current password or, of those kept by SetPasswordWithHistory,
+	// one of the previous count-1 passwords.
+	MatchesRecentPassword(password string, count int) bool
+
 	// The set of Roles the user belongs to (including ones given to it by the sync function)
 	RoleNames() ch.TimedSet
 
@@ -102,6 +109,26 @@ type User interface {
 	// Sets the explicit roles the user belongs to.
 	SetExplicitRoles(ch.TimedSet)
 
+	// The roles the user was granted by the claims of an OIDC or JWT token, when the provider
+	// is configured with a roles_claim.
+	JWTRoles() ch.TimedSet
+
+	// Sets the roles granted by token claims.
+	SetJWTRoles(ch.TimedSet)
+
+	// The channels the user was granted by the claims of an OIDC or JWT token, when the provider
+	// is configured with a channels_claim.
+	JWTChannels() ch.TimedSet
+
+	// Sets the channels granted by token claims.
+	SetJWTChannels(ch.TimedSet)
+
+	// The API keys issued to the user, by ID.
+	APIKeys() map[string]*APIKey
+
+	// The user's failed login tracking, when login lockout is enabled.
+	LoginLockout() *LoginLockoutState
+
 	// Every channel the user has access to, including those inherited from Roles.
 	InheritedChannels() ch.TimedSet
 
@@ -114,4 +141,6 @@ type User interface {
 	FilterToAvailableChannels(channels base.Set) ch.TimedSet
 
 	setRolesSince(ch.TimedSet)
+	setAPIKeys(map[string]*APIKey)
+	setLoginLockout(*LoginLockoutState)
 }
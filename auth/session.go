@@ -18,12 +18,19 @@ import (
 
 const kDefaultSessionTTL = 24 * time.Hour
 
+// How stale a session's last-used time can get before authenticating with it updates the session doc
+const kSessionLastUsedInterval = time.Minute
+
 // A user login session (used with cookie-based auth.)
 type LoginSession struct {
 	ID         string        `json:"id"`
 	Username   string        `json:"username"`
 	Expiration time.Time     `json:"expiration"`
 	Ttl        time.Duration `json:"ttl"`
+	Created    *time.Time    `json:"created,omitempty"`
+	LastUsed   *time.Time    `json:"last_used,omitempty"`  // Last time the session authenticated a request
+	ClientIP   string        `json:"client_ip,omitempty"`  // Client address of the last request
+	UserAgent  string        `json:"user_agent,omitempty"` // User-Agent of the last request
 }
 
 const DefaultCookieName = "SyncGatewaySession"
@@ -36,7 +43,7 @@ func (auth *Authenticator) AuthenticateCookie(rq *http.Request, response http.Re
 	}
 
 	var session LoginSession
-	_, err := auth.bucket.Get(DocIDForSession(cookie.Value), &session)
+	cas, err := auth.bucket.Get(DocIDForSession(cookie.Value), &session)
 	if err != nil {
 		if base.IsDocNotFoundError(err) {
 			return nil, base.HTTPErrorf(http.StatusUnauthorized, "Session Invalid")
@@ -52,6 +59,16 @@ func (auth *Authenticator) AuthenticateCookie(rq *http.Request, response http.Re
 	}
 	duration := session.Ttl
 
+	// Record when and where the session was last used.  To avoid a write on every request, the
+	// session doc is only updated for this if the client changed or the last-used time is stale.
+	now := time.Now()
+	clientIP, userAgent := base.RequestClientIP(rq), rq.UserAgent()
+	touched := session.LastUsed == nil || now.Sub(*session.LastUsed) >= kSessionLastUsedInterval ||
+		session.ClientIP != clientIP || session.UserAgent != userAgent
+	session.LastUsed = &now
+	session.ClientIP = clientIP
+	session.UserAgent = userAgent
+
 	// SessionTimeElapsed and tenPercentOfTtl use Nanoseconds for more precision when converting to int
 	sessionTimeElapsed := int((time.Now().Add(duration).Sub(session.Expiration)).Nanoseconds())
 	tenPercentOfTtl := int(duration.Nanoseconds()) / 10
@@ -63,6 +80,17 @@ func (auth *Authenticator) AuthenticateCookie(rq *http.Request, response http.Re
 		base.AddDbPathToCookie(rq, cookie)
 		cookie.Expires = session.Expiration
 		http.SetCookie(response, cookie)
+	} else if touched {
+		// Written with CAS, so that a session deleted or updated by a concurrent request isn't overwritten.  Losing
+		// that race only loses the last-used details, so it isn't an error.
+		remaining := time.Until(session.Expiration)
+		if remaining < time.Second {
+			remaining = time.Second
+		}
+		_, err = auth.bucket.WriteCas(DocIDForSession(session.ID), 0, base.DurationToCbsExpiry(remaining), cas, session, 0)
+		if err != nil && !base.IsCasMismatch(err) && !base.IsDocNotFoundError(err) {
+			return nil, err
+		}
 	}
 
 	user, err := auth.GetUser(session.Username)
@@ -78,11 +106,13 @@ func (auth *Authenticator) CreateSession(username string, ttl time.Duration) (*L
 		return nil, base.HTTPErrorf(400, "Invalid session time-to-live")
 	}
 
+	now := time.Now()
 	session := &LoginSession{
 		ID:         base.GenerateRandomSecret(),
 		Username:   username,
-		Expiration: time.Now().Add(ttl),
+		Expiration: now.Add(ttl),
 		Ttl:        ttl,
+		Created:    &now,
 	}
 	if err := auth.bucket.Set(DocIDForSession(session.ID), base.DurationToCbsExpiry(ttl), session); err != nil {
 		return nil, err
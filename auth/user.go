@@ -32,12 +32,17 @@ type userImpl struct {
 // Marshalable data is stored in separate struct from userImpl,
 // to work around limitations of JSON marshaling.
 type userImplBody struct {
-	Email_           string      `json:"email,omitempty"`
-	Disabled_        bool        `json:"disabled,omitempty"`
-	PasswordHash_    []byte      `json:"passwordhash_bcrypt,omitempty"`
-	OldPasswordHash_ interface{} `json:"passwordhash,omitempty"` // For pre-beta compatibility
-	ExplicitRoles_   ch.TimedSet `json:"explicit_roles,omitempty"`
-	RolesSince_      ch.TimedSet `json:"rolesSince"`
+	Email_           string             `json:"email,omitempty"`
+	Disabled_        bool               `json:"disabled,omitempty"`
+	PasswordHash_    []byte             `json:"passwordhash_bcrypt,omitempty"`
+	OldPasswordHash_ interface{}        `json:"passwordhash,omitempty"` // For pre-beta compatibility
+	ExplicitRoles_   ch.TimedSet        `json:"explicit_roles,omitempty"`
+	RolesSince_      ch.TimedSet        `json:"rolesSince"`
+	JWTRoles_        ch.TimedSet        `json:"jwt_roles,omitempty"`
+	JWTChannels_     ch.TimedSet        `json:"jwt_channels,omitempty"`
+	APIKeys_         map[string]*APIKey `json:"api_keys,omitempty"`
+	LoginLockout_    *LoginLockoutState `json:"login_lockout,omitempty"`
+	PasswordHistory_ [][]byte           `json:"password_history_bcrypt,omitempty"`
 
 	OldExplicitRoles_ []string `json:"admin_roles,omitempty"` // obsolete; declared for migration
 }
@@ -161,6 +166,40 @@ func (user *userImpl) SetExplicitRoles(roles ch.TimedSet) {
 	user.setRolesSince(nil) // invalidate persistent cache of role names
 }
 
+func (user *userImpl) JWTRoles() ch.TimedSet {
+	return user.JWTRoles_
+}
+
+func (user *userImpl) SetJWTRoles(roles ch.TimedSet) {
+	user.JWTRoles_ = roles
+	user.setRolesSince(nil) // invalidate persistent cache of role names
+}
+
+func (user *userImpl) JWTChannels() ch.TimedSet {
+	return user.JWTChannels_
+}
+
+func (user *userImpl) SetJWTChannels(channels ch.TimedSet) {
+	user.JWTChannels_ = channels
+	user.setChannels(nil) // invalidate persistent cache of channel names
+}
+
+func (user *userImpl) APIKeys() map[string]*APIKey {
+	return user.APIKeys_
+}
+
+func (user *userImpl) setAPIKeys(apiKeys map[string]*APIKey) {
+	user.APIKeys_ = apiKeys
+}
+
+func (user *userImpl) LoginLockout() *LoginLockoutState {
+	return user.LoginLockout_
+}
+
+func (user *userImpl) setLoginLockout(state *LoginLockoutState) {
+	user.LoginLockout_ = state
+}
+
 // Returns true if the given password is correct for this user, and the account isn't disabled.
 func (user *userImpl) Authenticate(password string) bool {
 	if user == nil {
@@ -214,6 +253,37 @@ func (user *userImpl) SetPassword(password string) {
 	}
 }
 
+// Changes a user's password, keeping the hashes of up to historyCount previous passwords.
+func (user *userImpl) SetPasswordWithHistory(password string, historyCount int) {
+	if user.PasswordHash_ != nil && historyCount > 0 {
+		history := append([][]byte{user.PasswordHash_}, user.PasswordHistory_...)
+		if len(history) > historyCount {
+			history = history[:historyCount]
+		}
+		user.PasswordHistory_ = history
+	}
+	user.SetPassword(password)
+}
+
+// Returns true if the password is the user's current password, or one of the previous count-1
+// passwords kept by SetPasswordWithHistory.
+func (user *userImpl) MatchesRecentPassword(password string, count int) bool {
+	hashes := make([][]byte, 0, count)
+	if user.PasswordHash_ != nil {
+		hashes = append(hashes, user.PasswordHash_)
+	}
+	hashes = append(hashes, user.PasswordHistory_...)
+	for i, hash := range hashes {
+		if i >= count {
+			break
+		}
+		if compareHashAndPassword(hash, []byte(password)) {
+			return true
+		}
+	}
+	return false
+}
+
 func (user *userImpl) getVbNo(hashFunction VBHashFunction) uint16 {
 	if user.vbNo == nil {
 		calculatedVbNo := uint16(hashFunction(user.DocID()))
@@ -88,10 +88,15 @@ const (
 	//==== Sync Prefix Documents & Keys ====
 	SyncPrefix = "_sync:"
 
+	APIKeyPrefix           = SyncPrefix + "apikey:"
 	AttPrefix              = SyncPrefix + "att:"
+	AttChunkPrefix         = SyncPrefix + "attc:"
+	AttGCMarkPrefix        = SyncPrefix + "attgc:mark:"
+	AttManifestPrefix      = SyncPrefix + "attm:"
 	BackfillCompletePrefix = SyncPrefix + "backfill:complete:"
 	BackfillPendingPrefix  = SyncPrefix + "backfill:pending:"
 	DCPCheckpointPrefix    = SyncPrefix + "dcp_ck:"
+	LoginLockoutPrefix     = SyncPrefix + "lockout:"
 	RepairBackup           = SyncPrefix + "repair:backup:"
 	RepairDryRun           = SyncPrefix + "repair:dryrun:"
 	RevBodyPrefix          = SyncPrefix + "rb:"
@@ -104,10 +109,13 @@ const (
 	UnusedSeqPrefix        = SyncPrefix + "unusedSeq:"
 	UnusedSeqRangePrefix   = SyncPrefix + "unusedSeqs:"
 
-	DCPBackfillSeqKey = SyncPrefix + "dcp_backfill"
-	SyncDataKey       = SyncPrefix + "syncdata"
-	SyncSeqKey        = SyncPrefix + "seq"
-	SyncXattrName     = "_sync"
+	AttGCCheckpointKey   = SyncPrefix + "attgc"
+	DCPBackfillSeqKey    = SyncPrefix + "dcp_backfill"
+	LoginLockoutIndexKey = SyncPrefix + "lockouts"
+	ResyncCheckpointKey  = SyncPrefix + "resync"
+	SyncDataKey          = SyncPrefix + "syncdata"
+	SyncSeqKey           = SyncPrefix + "seq"
+	SyncXattrName        = "_sync"
 )
 
 const (
@@ -137,15 +137,18 @@ const (
 	StatKeyImportHighSeq        = "import_high_seq"
 
 	// StatsCBLReplicationPush
-	StatKeyDocPushCount        = "doc_push_count"
-	StatKeyWriteProcessingTime = "write_processing_time"
-	StatKeySyncFunctionTime    = "sync_function_time"
-	StatKeySyncFunctionCount   = "sync_function_count"
-	StatKeyProposeChangeTime   = "propose_change_time"
-	StatKeyProposeChangeCount  = "propose_change_count"
-	StatKeyAttachmentPushCount = "attachment_push_count"
-	StatKeyAttachmentPushBytes = "attachment_push_bytes"
-	StatKeyConflictWriteCount  = "conflict_write_count"
+	StatKeyDocPushCount                = "doc_push_count"
+	StatKeyWriteProcessingTime         = "write_processing_time"
+	StatKeySyncFunctionTime            = "sync_function_time"
+	StatKeySyncFunctionCount           = "sync_function_count"
+	StatKeyProposeChangeTime           = "propose_change_time"
+	StatKeyProposeChangeCount          = "propose_change_count"
+	StatKeyAttachmentPushCount         = "attachment_push_count"
+	StatKeyAttachmentPushBytes         = "attachment_push_bytes"
+	StatKeyConflictWriteCount          = "conflict_write_count"
+	StatKeyConflictResolvedLocalCount  = "conflict_resolved_local_count"
+	StatKeyConflictResolvedRemoteCount = "conflict_resolved_remote_count"
+	StatKeyConflictResolvedMergeCount  = "conflict_resolved_merge_count"
 
 	// StatsCBLReplicationPull
 	StatKeyPullReplicationsActiveOneShot    = "num_pull_repl_active_one_shot"
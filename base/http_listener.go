@@ -2,6 +2,9 @@ package base
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"sync"
@@ -9,8 +12,10 @@ import (
 )
 
 // This is like a combination of http.ListenAndServe and http.ListenAndServeTLS, which also
-// uses ThrottledListen to limit the number of open HTTP connections.
-func ListenAndServeHTTP(addr string, connLimit int, certFile *string, keyFile *string, handler http.Handler, readTimeout *int, writeTimeout *int, http2Enabled bool, tlsMinVersion uint16) error {
+// uses ThrottledListen to limit the number of open HTTP connections.  If clientCAFile is given, clients
+// may present a certificate signed by one of its CAs; the verified chain is available in the request's TLS state.
+// If requireClientCert is also set, connections without a valid client certificate are rejected.
+func ListenAndServeHTTP(addr string, connLimit int, certFile *string, keyFile *string, clientCAFile string, requireClientCert bool, handler http.Handler, readTimeout *int, writeTimeout *int, http2Enabled bool, tlsMinVersion uint16) error {
 	var config *tls.Config
 	if certFile != nil {
 		config = &tls.Config{}
@@ -27,6 +32,21 @@ func ListenAndServeHTTP(addr string, connLimit int, certFile *string, keyFile *s
 		if err != nil {
 			return err
 		}
+		if clientCAFile != "" {
+			caCerts, err := ioutil.ReadFile(clientCAFile)
+			if err != nil {
+				return err
+			}
+			config.ClientCAs = x509.NewCertPool()
+			if !config.ClientCAs.AppendCertsFromPEM(caCerts) {
+				return fmt.Errorf("No certificates found in %s", clientCAFile)
+			}
+			if requireClientCert {
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			} else {
+				config.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+		}
 	}
 	listener, err := ThrottledListen("tcp", addr, connLimit)
 	if err != nil {
@@ -0,0 +1,150 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+
+	sgbucket "github.com/couchbase/sg-bucket"
+	"github.com/dop251/goja"
+)
+
+var stringMapType = reflect.TypeOf(map[string]interface{}{})
+
+// A jsVM implemented with goja.
+type gojaVM struct {
+	js        *goja.Runtime
+	fn        goja.Callable
+	jsonParse goja.Callable
+}
+
+func newGojaVM(consoleErrorFunc func(string), consoleLogFunc func(string)) *gojaVM {
+	vm := &gojaVM{js: goja.New()}
+	jsonParse, _ := vm.js.RunString("JSON.parse")
+	vm.jsonParse, _ = goja.AssertFunction(jsonParse)
+
+	console := vm.js.NewObject()
+	console.Set("error", gojaConsoleFunc(consoleErrorFunc))
+	console.Set("log", gojaConsoleFunc(consoleLogFunc))
+	vm.js.Set("console", console)
+	return vm
+}
+
+func gojaConsoleFunc(logFunc func(string)) func(goja.FunctionCall) goja.Value {
+	return func(call goja.FunctionCall) goja.Value {
+		output := make([]string, len(call.Arguments))
+		for i, arg := range call.Arguments {
+			output[i] = arg.String()
+		}
+		logFunc(strings.Join(output, " "))
+		return goja.Undefined()
+	}
+}
+
+func (vm *gojaVM) setFunction(funcSource string) error {
+	value, err := vm.js.RunString("(" + funcSource + ")")
+	if err != nil {
+		return err
+	}
+	fn, ok := goja.AssertFunction(value)
+	if !ok {
+		return errors.New("JavaScript source does not evaluate to a function")
+	}
+	vm.fn = fn
+	return nil
+}
+
+func (vm *gojaVM) defineNativeFunction(name string, fn JSNativeFunction) {
+	vm.js.Set(name, func(call goja.FunctionCall) goja.Value {
+		args := make([]interface{}, len(call.Arguments))
+		for i, arg := range call.Arguments {
+			args[i] = arg.Export()
+		}
+		result := fn(args)
+		if result == nil {
+			return goja.Undefined()
+		}
+		return vm.toValue(result)
+	})
+}
+
+func (vm *gojaVM) call(inputs []interface{}) (interface{}, error) {
+	args := make([]goja.Value, len(inputs))
+	for i, input := range inputs {
+		if jsonInput, ok := input.(sgbucket.JSONString); ok {
+			if jsonInput == "" {
+				args[i] = goja.Null()
+				continue
+			}
+			var err error
+			if args[i], err = vm.jsonParse(goja.Undefined(), vm.js.ToValue(string(jsonInput))); err != nil {
+				return nil, err
+			}
+		} else {
+			args[i] = vm.toValue(input)
+		}
+	}
+
+	value, err := vm.fn(goja.Undefined(), args...)
+	if err != nil {
+		if _, ok := err.(*goja.InterruptedError); ok {
+			// JSRunner reports why the call was interrupted
+			return nil, ErrJSInterrupted
+		}
+		return nil, err
+	}
+	if value == nil {
+		return nil, nil
+	}
+	return value.Export(), nil
+}
+
+// Converts a Go value to a native JavaScript value.  Maps and slices are copied into JavaScript objects
+// and arrays, rather than wrapped, so that functions see the same kinds of values as they do in otto.
+func (vm *gojaVM) toValue(value interface{}) goja.Value {
+	switch value := value.(type) {
+	case nil:
+		return goja.Null()
+	case map[string]interface{}:
+		obj := vm.js.NewObject()
+		for key, item := range value {
+			obj.Set(key, vm.toValue(item))
+		}
+		return obj
+	case []interface{}:
+		items := make([]interface{}, len(value))
+		for i, item := range value {
+			items[i] = vm.toValue(item)
+		}
+		return vm.js.NewArray(items...)
+	case []string:
+		items := make([]interface{}, len(value))
+		for i, item := range value {
+			items[i] = item
+		}
+		return vm.js.NewArray(items...)
+	}
+
+	// Named map types such as db.Body
+	if rv := reflect.ValueOf(value); rv.Kind() == reflect.Map && rv.Type().ConvertibleTo(stringMapType) {
+		return vm.toValue(rv.Convert(stringMapType).Interface())
+	}
+	return vm.js.ToValue(value)
+}
+
+func (vm *gojaVM) interrupt() {
+	vm.js.Interrupt(ErrJSInterrupted)
+}
+
+func (vm *gojaVM) clearInterrupt() {
+	vm.js.ClearInterrupt()
+}
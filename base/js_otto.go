@@ -0,0 +1,134 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"errors"
+	"strings"
+
+	sgbucket "github.com/couchbase/sg-bucket"
+	"github.com/robertkrimen/otto"
+)
+
+// Panic value used to unwind an interrupted otto call
+type ottoInterrupt struct{}
+
+// A jsVM implemented with otto.
+type ottoVM struct {
+	js *otto.Otto
+	fn otto.Value
+}
+
+func newOttoVM(consoleErrorFunc func(string), consoleLogFunc func(string)) *ottoVM {
+	vm := &ottoVM{js: otto.New(), fn: otto.UndefinedValue()}
+	vm.js.Interrupt = make(chan func(), 1)
+
+	console, _ := vm.js.Object("({})")
+	_ = console.Set("error", ottoConsoleFunc(consoleErrorFunc))
+	_ = console.Set("log", ottoConsoleFunc(consoleLogFunc))
+	_ = vm.js.Set("console", console)
+	return vm
+}
+
+func ottoConsoleFunc(logFunc func(string)) func(otto.FunctionCall) otto.Value {
+	return func(call otto.FunctionCall) otto.Value {
+		output := make([]string, len(call.ArgumentList))
+		for i, arg := range call.ArgumentList {
+			output[i] = arg.String()
+		}
+		logFunc(strings.Join(output, " "))
+		return otto.UndefinedValue()
+	}
+}
+
+func (vm *ottoVM) setFunction(funcSource string) error {
+	fnobj, err := vm.js.Object("(" + funcSource + ")")
+	if err != nil {
+		return err
+	}
+	if fnobj.Class() != "Function" {
+		return errors.New("JavaScript source does not evaluate to a function")
+	}
+	vm.fn = fnobj.Value()
+	return nil
+}
+
+func (vm *ottoVM) defineNativeFunction(name string, fn JSNativeFunction) {
+	_ = vm.js.Set(name, func(call otto.FunctionCall) otto.Value {
+		args := make([]interface{}, len(call.ArgumentList))
+		for i, arg := range call.ArgumentList {
+			args[i], _ = arg.Export()
+		}
+		result := fn(args)
+		if result == nil {
+			return otto.UndefinedValue()
+		}
+		value, err := vm.js.ToValue(result)
+		if err != nil {
+			panic(vm.js.MakeCustomError("Error", err.Error()))
+		}
+		return value
+	})
+}
+
+func (vm *ottoVM) call(inputs []interface{}) (result interface{}, err error) {
+	args := make([]interface{}, len(inputs))
+	for i, input := range inputs {
+		if args[i], err = vm.toValue(input); err != nil {
+			return nil, err
+		}
+	}
+
+	defer func() {
+		if caught := recover(); caught != nil {
+			if _, ok := caught.(ottoInterrupt); !ok {
+				panic(caught)
+			}
+			// JSRunner reports why the call was interrupted
+			result, err = nil, ErrJSInterrupted
+		}
+	}()
+
+	value, err := vm.fn.Call(vm.fn, args...)
+	if err != nil {
+		return nil, err
+	}
+	return value.Export()
+}
+
+func (vm *ottoVM) toValue(input interface{}) (otto.Value, error) {
+	switch input := input.(type) {
+	case sgbucket.JSONString:
+		if input == "" {
+			return otto.NullValue(), nil
+		}
+		obj, err := vm.js.Object("x = " + string(input))
+		if err != nil {
+			return otto.UndefinedValue(), err
+		}
+		return obj.Value(), nil
+	default:
+		return vm.js.ToValue(input)
+	}
+}
+
+func (vm *ottoVM) interrupt() {
+	select {
+	case vm.js.Interrupt <- func() { panic(ottoInterrupt{}) }:
+	default:
+	}
+}
+
+func (vm *ottoVM) clearInterrupt() {
+	select {
+	case <-vm.js.Interrupt:
+	default:
+	}
+}
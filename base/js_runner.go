@@ -0,0 +1,201 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// JSEngine identifies a JavaScript interpreter that can run sync functions, filters and other
+// user-defined functions.
+type JSEngine string
+
+const (
+	JSEngineOtto JSEngine = "otto" // The default, for compatibility with existing functions
+	JSEngineGoja JSEngine = "goja" // Faster, and supports ES6 syntax
+)
+
+var (
+	ErrJSTimeout     = errors.New("JavaScript function timed out")
+	ErrJSInterrupted = errors.New("JavaScript function was interrupted")
+)
+
+// JSOptions configures how user-defined JavaScript functions are run.
+type JSOptions struct {
+	Engine  JSEngine      // Defaults to JSEngineOtto
+	Timeout time.Duration // Maximum time a single call can run before it's interrupted; zero means no limit
+}
+
+// Validate returns an error if the options name an unknown engine.
+func (options JSOptions) Validate() error {
+	switch options.Engine {
+	case "", JSEngineOtto, JSEngineGoja:
+		return nil
+	}
+	return fmt.Errorf("Unknown JavaScript engine %q; must be %q or %q", options.Engine, JSEngineOtto, JSEngineGoja)
+}
+
+// JSNativeFunction is a Go function that can be called from JavaScript.  Its arguments are the
+// JavaScript values exported to Go: strings, numbers (int64 or float64), bools, time.Time for Dates,
+// []interface{} for arrays, map[string]interface{} for objects, and nil for null or undefined.  The
+// result is converted to a JavaScript value; nil returns undefined.
+type JSNativeFunction func(args []interface{}) interface{}
+
+// The interface to a JavaScript interpreter that runs a single function.
+type jsVM interface {
+	setFunction(funcSource string) error
+	defineNativeFunction(name string, fn JSNativeFunction)
+	call(inputs []interface{}) (interface{}, error) // Returns the function's result, exported to Go
+	interrupt()                                     // Stops the call in progress; may be called from any goroutine
+	clearInterrupt()                                // Resets the interpreter after an interrupt
+}
+
+// JSRunner runs a specific JavaScript function, using the engine given in its options.  Calls are
+// interrupted if they run longer than the options' timeout.  Not thread-safe, apart from Interrupt; it
+// implements sgbucket.JSServerTask so that a pool of runners can be shared by a sgbucket.JSServer.
+type JSRunner struct {
+	vm       jsVM
+	fnSource string
+	timeout  time.Duration
+
+	callLock        sync.Mutex // Protects running and interruptReason
+	running         bool       // True while a call is in progress
+	interruptReason error      // Why the call in progress was interrupted, if it was
+
+	// Optional function that will be called just before the JS function.
+	Before func()
+
+	// Optional function that will be called after the JS function returns, and can convert its
+	// output from an exported JS value to the result of Call.
+	After func(result interface{}, err error) (interface{}, error)
+}
+
+// Returns the argument at the given index, or nil if there aren't that many arguments.
+func JSArgument(args []interface{}, index int) interface{} {
+	if index < len(args) {
+		return args[index]
+	}
+	return nil
+}
+
+// Creates a new JSRunner for a function.
+func NewJSRunner(options JSOptions, funcSource string) (*JSRunner, error) {
+	runner := &JSRunner{}
+	if err := runner.Init(options, funcSource); err != nil {
+		return nil, err
+	}
+	return runner, nil
+}
+
+// Initializes a JSRunner, discarding any console output of the function.
+func (runner *JSRunner) Init(options JSOptions, funcSource string) error {
+	return runner.InitWithLogging(options, funcSource, func(string) {}, func(string) {})
+}
+
+// Initializes a JSRunner.  Calls to console.error and console.log in the function are passed to the
+// given logging functions.
+func (runner *JSRunner) InitWithLogging(options JSOptions, funcSource string, consoleErrorFunc func(string), consoleLogFunc func(string)) error {
+	if err := options.Validate(); err != nil {
+		return err
+	}
+	switch options.Engine {
+	case JSEngineGoja:
+		runner.vm = newGojaVM(consoleErrorFunc, consoleLogFunc)
+	default:
+		runner.vm = newOttoVM(consoleErrorFunc, consoleLogFunc)
+	}
+	runner.timeout = options.Timeout
+	_, err := runner.SetFunction(funcSource)
+	return err
+}
+
+// Defines a global function that the JavaScript function can call.
+func (runner *JSRunner) DefineNativeFunction(name string, function JSNativeFunction) {
+	runner.vm.defineNativeFunction(name, function)
+}
+
+// Sets the JavaScript function the runner executes.  Returns false if it's the same as the current one.
+func (runner *JSRunner) SetFunction(funcSource string) (bool, error) {
+	if funcSource == runner.fnSource {
+		return false, nil
+	}
+	if funcSource != "" {
+		if err := runner.vm.setFunction(funcSource); err != nil {
+			return false, err
+		}
+	}
+	runner.fnSource = funcSource
+	return true, nil
+}
+
+// Invokes the JavaScript function with the given inputs.  A sgbucket.JSONString input is parsed as JSON
+// (the empty string is null); any other value is converted to its JavaScript equivalent.  If the call
+// times out or is interrupted, it returns ErrJSTimeout or ErrJSInterrupted.
+func (runner *JSRunner) Call(inputs ...interface{}) (interface{}, error) {
+	if runner.Before != nil {
+		runner.Before()
+	}
+
+	var result interface{}
+	var err error
+	if runner.fnSource != "" {
+		runner.setRunning(true)
+		var timer *time.Timer
+		if runner.timeout > 0 {
+			timer = time.AfterFunc(runner.timeout, func() { runner.interrupt(ErrJSTimeout) })
+		}
+		result, err = runner.vm.call(inputs)
+		if timer != nil {
+			timer.Stop()
+		}
+		if reason := runner.setRunning(false); reason != nil && err != nil {
+			result, err = nil, reason
+		}
+	}
+
+	if runner.After != nil {
+		return runner.After(result, err)
+	}
+	return result, err
+}
+
+// Interrupts the call in progress, if any, which then returns ErrJSInterrupted.  This can be called
+// from any goroutine.
+func (runner *JSRunner) Interrupt() {
+	runner.interrupt(ErrJSInterrupted)
+}
+
+func (runner *JSRunner) interrupt(reason error) {
+	runner.callLock.Lock()
+	defer runner.callLock.Unlock()
+	if runner.running && runner.interruptReason == nil {
+		runner.interruptReason = reason
+		runner.vm.interrupt()
+	}
+}
+
+// Marks the start or end of a call.  At the end of a call, returns why it was interrupted, if it was,
+// and resets the interpreter so that the interrupt doesn't affect the next call.
+func (runner *JSRunner) setRunning(running bool) (interruptReason error) {
+	runner.callLock.Lock()
+	defer runner.callLock.Unlock()
+	runner.running = running
+	if !running {
+		interruptReason = runner.interruptReason
+		runner.interruptReason = nil
+		if interruptReason != nil {
+			runner.vm.clearInterrupt()
+		}
+	}
+	return interruptReason
+}
@@ -0,0 +1,109 @@
+package base
+
+import (
+	"testing"
+	"time"
+
+	sgbucket "github.com/couchbase/sg-bucket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testJSEngines = []JSEngine{JSEngineOtto, JSEngineGoja}
+
+func TestJSRunnerCall(t *testing.T) {
+	for _, engine := range testJSEngines {
+		t.Run(string(engine), func(t *testing.T) {
+			runner, err := NewJSRunner(JSOptions{Engine: engine}, `function(doc, oldDoc) {
+				return {name: doc.name, count: doc.tags.length, old: oldDoc, doubled: double(21)};
+			}`)
+			require.NoError(t, err)
+			runner.DefineNativeFunction("double", func(args []interface{}) interface{} {
+				n, _ := ToInt64(JSArgument(args, 0))
+				return n * 2
+			})
+
+			result, err := runner.Call(sgbucket.JSONString(`{"name": "alice", "tags": ["a", "b"]}`), sgbucket.JSONString(""))
+			require.NoError(t, err)
+			resultMap, ok := result.(map[string]interface{})
+			require.True(t, ok, "Unexpected result %#v", result)
+			assert.Equal(t, "alice", resultMap["name"])
+			count, _ := ToInt64(resultMap["count"])
+			assert.Equal(t, int64(2), count)
+			assert.Nil(t, resultMap["old"])
+			doubled, _ := ToInt64(resultMap["doubled"])
+			assert.Equal(t, int64(42), doubled)
+
+			// Go values are passed as native JavaScript values:
+			runner2, err := NewJSRunner(JSOptions{Engine: engine}, `function(doc) {return Array.isArray(doc.tags) && doc.tags.length;}`)
+			require.NoError(t, err)
+			result, err = runner2.Call(map[string]interface{}{"tags": []interface{}{"x", "y", "z"}})
+			require.NoError(t, err)
+			count, _ = ToInt64(result)
+			assert.Equal(t, int64(3), count)
+		})
+	}
+}
+
+func TestJSRunnerInvalidFunction(t *testing.T) {
+	for _, engine := range testJSEngines {
+		t.Run(string(engine), func(t *testing.T) {
+			_, err := NewJSRunner(JSOptions{Engine: engine}, `function(doc) {`)
+			assert.Error(t, err)
+			_, err = NewJSRunner(JSOptions{Engine: engine}, `"not a function"`)
+			assert.Error(t, err)
+		})
+	}
+
+	_, err := NewJSRunner(JSOptions{Engine: "spidermonkey"}, `function(doc) {}`)
+	assert.Error(t, err)
+}
+
+func TestJSRunnerTimeout(t *testing.T) {
+	for _, engine := range testJSEngines {
+		t.Run(string(engine), func(t *testing.T) {
+			runner, err := NewJSRunner(JSOptions{Engine: engine, Timeout: 100 * time.Millisecond}, `function(loop) {
+				while (loop) {}
+				return "done";
+			}`)
+			require.NoError(t, err)
+
+			_, err = runner.Call(true)
+			assert.Equal(t, ErrJSTimeout, err)
+
+			// The runner can still be used after a timeout:
+			result, err := runner.Call(false)
+			assert.NoError(t, err)
+			assert.Equal(t, "done", result)
+		})
+	}
+}
+
+func TestJSRunnerInterrupt(t *testing.T) {
+	for _, engine := range testJSEngines {
+		t.Run(string(engine), func(t *testing.T) {
+			runner, err := NewJSRunner(JSOptions{Engine: engine}, `function(loop) {
+				while (loop) {}
+				return "done";
+			}`)
+			require.NoError(t, err)
+
+			// Interrupting a runner that isn't running has no effect:
+			runner.Interrupt()
+			result, err := runner.Call(false)
+			assert.NoError(t, err)
+			assert.Equal(t, "done", result)
+
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				runner.Interrupt()
+			}()
+			_, err = runner.Call(true)
+			assert.Equal(t, ErrJSInterrupted, err)
+
+			result, err = runner.Call(false)
+			assert.NoError(t, err)
+			assert.Equal(t, "done", result)
+		})
+	}
+}
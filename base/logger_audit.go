@@ -0,0 +1,152 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"fmt"
+	"time"
+)
+
+// AuditEvent identifies a type of security-relevant action recorded by the audit log.
+type AuditEvent string
+
+const (
+	AuditEventLogin         AuditEvent = "login"          // A user authenticated with credentials, a token or a certificate, or logged in and was given a session
+	AuditEventLoginFailure  AuditEvent = "login_failure"  // Credentials were rejected, or the login was locked out
+	AuditEventSessionCreate AuditEvent = "session_create" // A login session was created
+	AuditEventSessionDelete AuditEvent = "session_delete" // A login session was deleted, or a user logged out
+	AuditEventUserChange    AuditEvent = "user_change"    // A user was created, updated or deleted
+	AuditEventRoleChange    AuditEvent = "role_change"    // A role was created, updated or deleted
+	AuditEventConfigChange  AuditEvent = "config_change"  // Server, database or logging config was changed, or a database was created or deleted
+	AuditEventPurge         AuditEvent = "purge"          // Documents were purged
+	AuditEventResync        AuditEvent = "resync"         // A database was resynced
+	AuditEventDbState       AuditEvent = "db_state"       // A database was taken online or offline
+	AuditEventAccessDenied  AuditEvent = "access_denied"  // An authenticated admin request was rejected as the caller's role doesn't allow it
+)
+
+// All of the audit events, which are enabled by default.
+var AllAuditEvents = []AuditEvent{
+	AuditEventLogin,
+	AuditEventLoginFailure,
+	AuditEventSessionCreate,
+	AuditEventSessionDelete,
+	AuditEventUserChange,
+	AuditEventRoleChange,
+	AuditEventConfigChange,
+	AuditEventPurge,
+	AuditEventResync,
+	AuditEventDbState,
+	AuditEventAccessDenied,
+}
+
+// Outcomes of audited actions
+const (
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeFailure = "failure"
+)
+
+const (
+	auditMinAge  = 180 // days
+	auditLogName = "audit"
+)
+
+// AuditEntry is a single line of the audit log.  Unlike the leveled logs, audit entries aren't redacted.
+type AuditEntry struct {
+	Timestamp time.Time              `json:"timestamp"`
+	Event     AuditEvent             `json:"event"`
+	Outcome   string                 `json:"outcome"`
+	Actor     string                 `json:"actor,omitempty"`     // Who performed the action; "admin" or "admin:<name>" for the admin API
+	SourceIP  string                 `json:"source_ip,omitempty"` // Address of the client making the request
+	Database  string                 `json:"db,omitempty"`
+	Target    string                 `json:"target,omitempty"` // The user, role, document or config the action applied to
+	Error     string                 `json:"error,omitempty"`  // Why the action failed
+	Details   map[string]interface{} `json:"details,omitempty"`
+}
+
+type AuditLoggerConfig struct {
+	FileLoggerConfig
+	EnabledEvents []AuditEvent `json:"enabled_events,omitempty"` // Event types to record. Defaults to all events.
+}
+
+// AuditLogger writes audit entries to their own file, as one JSON object per line.
+type AuditLogger struct {
+	FileLogger
+	enabledEvents map[AuditEvent]bool
+}
+
+var auditLogger *AuditLogger
+
+// NewAuditLogger returns a new AuditLogger from a config.  The audit log is disabled by default.
+func NewAuditLogger(config AuditLoggerConfig, logFilePath string) (*AuditLogger, error) {
+	if config.Enabled == nil {
+		config.Enabled = BoolPtr(false)
+	}
+	if config.CollationBufferSize == nil {
+		// Write each entry immediately, so none are lost if the process exits
+		config.CollationBufferSize = IntPtr(0)
+	}
+
+	enabledEvents := make(map[AuditEvent]bool, len(AllAuditEvents))
+	if len(config.EnabledEvents) == 0 {
+		for _, event := range AllAuditEvents {
+			enabledEvents[event] = true
+		}
+	}
+	for _, event := range config.EnabledEvents {
+		if !isAuditEvent(event) {
+			return nil, fmt.Errorf("unknown audit event %q", event)
+		}
+		enabledEvents[event] = true
+	}
+
+	// Since the audit log isn't leveled, use LevelNone for the level.
+	fileLogger, err := NewFileLogger(config.FileLoggerConfig, LevelNone, auditLogName, logFilePath, auditMinAge)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLogger{FileLogger: *fileLogger, enabledEvents: enabledEvents}, nil
+}
+
+func isAuditEvent(event AuditEvent) bool {
+	for _, e := range AllAuditEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *AuditLogger) shouldLog(event AuditEvent) bool {
+	return l != nil && l.FileLogger.shouldLog(LevelNone) && l.enabledEvents[event]
+}
+
+// AuditEnabled returns true if entries for the given event will be written to the audit log.
+func AuditEnabled(event AuditEvent) bool {
+	return auditLogger.shouldLog(event)
+}
+
+// Audit writes an entry to the audit log, if its event is enabled.  The timestamp is set if it's empty.
+func Audit(entry AuditEntry) {
+	if !auditLogger.shouldLog(entry.Event) {
+		return
+	}
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+	if entry.Outcome == "" {
+		entry.Outcome = AuditOutcomeSuccess
+	}
+	data, err := JSONMarshal(entry)
+	if err != nil {
+		Warnf(KeyAll, "Unable to write %s entry to the audit log: %v", entry.Event, err)
+		return
+	}
+	auditLogger.logf("%s", data)
+}
@@ -0,0 +1,63 @@
+package base
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditLoggerConfig(t *testing.T) {
+	var output bytes.Buffer
+	logger, err := NewAuditLogger(AuditLoggerConfig{FileLoggerConfig: FileLoggerConfig{Output: &output}}, "")
+	require.NoError(t, err)
+	assert.False(t, logger.Enabled, "The audit log should be disabled by default")
+
+	logger, err = NewAuditLogger(AuditLoggerConfig{FileLoggerConfig: FileLoggerConfig{Enabled: BoolPtr(true), Output: &output}}, "")
+	require.NoError(t, err)
+	for _, event := range AllAuditEvents {
+		assert.True(t, logger.shouldLog(event), "Event %s should be enabled by default", event)
+	}
+
+	logger, err = NewAuditLogger(AuditLoggerConfig{
+		FileLoggerConfig: FileLoggerConfig{Enabled: BoolPtr(true), Output: &output},
+		EnabledEvents:    []AuditEvent{AuditEventLogin, AuditEventPurge},
+	}, "")
+	require.NoError(t, err)
+	assert.True(t, logger.shouldLog(AuditEventLogin))
+	assert.True(t, logger.shouldLog(AuditEventPurge))
+	assert.False(t, logger.shouldLog(AuditEventLoginFailure))
+
+	_, err = NewAuditLogger(AuditLoggerConfig{EnabledEvents: []AuditEvent{"logins"}}, "")
+	assert.Error(t, err)
+}
+
+func TestAudit(t *testing.T) {
+	var output bytes.Buffer
+	defer SetUpTestAuditLog(&output, AuditEventUserChange)()
+
+	Audit(AuditEntry{Event: AuditEventLogin, Actor: "alice"})
+	Audit(AuditEntry{Event: AuditEventUserChange, Actor: "admin", SourceIP: "10.0.0.1", Database: "db", Target: "alice",
+		Details: map[string]interface{}{"action": "create"}})
+	Audit(AuditEntry{Event: AuditEventUserChange, Outcome: AuditOutcomeFailure, Actor: "admin", Target: "bob", Error: "Already exists"})
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	require.Len(t, lines, 2)
+
+	var entry AuditEntry
+	require.NoError(t, JSONUnmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, AuditEventUserChange, entry.Event)
+	assert.Equal(t, AuditOutcomeSuccess, entry.Outcome)
+	assert.Equal(t, "alice", entry.Target)
+	assert.Equal(t, "10.0.0.1", entry.SourceIP)
+	assert.Equal(t, "db", entry.Database)
+	assert.Equal(t, "create", entry.Details["action"])
+	assert.False(t, entry.Timestamp.IsZero())
+
+	entry = AuditEntry{}
+	require.NoError(t, JSONUnmarshal([]byte(lines[1]), &entry))
+	assert.Equal(t, AuditOutcomeFailure, entry.Outcome)
+	assert.Equal(t, "Already exists", entry.Error)
+}
@@ -355,6 +355,9 @@ func RotateLogfiles() map[*FileLogger]error {
 		errorLogger: nil,
 		statsLogger: nil,
 	}
+	if auditLogger != nil {
+		loggers[&auditLogger.FileLogger] = nil
+	}
 
 	for logger := range loggers {
 		loggers[logger] = logger.Rotate()
@@ -39,6 +39,7 @@ type LoggingConfig struct {
 	Info                 FileLoggerConfig    `json:"info,omitempty"`            // Info log file output
 	Debug                FileLoggerConfig    `json:"debug,omitempty"`           // Debug log file output
 	Stats                FileLoggerConfig    `json:"stats,omitempty"`           // Stats log file output
+	Audit                AuditLoggerConfig   `json:"audit,omitempty"`           // Audit log file output
 	DeprecatedDefaultLog *LogAppenderConfig  `json:"default,omitempty"`         // Deprecated "default" logging option.
 }
 
@@ -98,6 +99,11 @@ func (c *LoggingConfig) Init(defaultLogFilePath string) (warnings []DeferredLogF
 		return warnings, err
 	}
 
+	auditLogger, err = NewAuditLogger(c.Audit, c.LogFilePath)
+	if err != nil {
+		return warnings, err
+	}
+
 	// Initialize external loggers too
 	initExternalLoggers()
 
@@ -521,6 +521,15 @@ func ValueToStringArray(value interface{}) []string {
 	}
 }
 
+// Returns the address of the client making the request, without the port
+func RequestClientIP(rq *http.Request) string {
+	host, _, err := net.SplitHostPort(rq.RemoteAddr)
+	if err != nil {
+		return rq.RemoteAddr
+	}
+	return host
+}
+
 // SanitizeRequestURL will return a sanitised string of the URL by:
 // - Tagging mux path variables.
 // - Tagging query parameters.
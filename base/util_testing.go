@@ -3,6 +3,7 @@ package base
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"os"
@@ -572,6 +573,27 @@ func setTestLogging(logLevel LogLevel, logKeys LogKey, caller string) (teardownF
 	}
 }
 
+// SetUpTestAuditLog writes audit log entries for the given events (or all events, if none are given)
+// to the output until the teardownFn is called.
+//
+// Usage:
+//     var auditOutput bytes.Buffer
+//     defer SetUpTestAuditLog(&auditOutput)()
+func SetUpTestAuditLog(output io.Writer, events ...AuditEvent) (teardownFn func()) {
+	logger, err := NewAuditLogger(AuditLoggerConfig{
+		FileLoggerConfig: FileLoggerConfig{Enabled: BoolPtr(true), Output: output},
+		EnabledEvents:    events,
+	}, "")
+	if err != nil {
+		panic(fmt.Sprintf("Unable to set up test audit log: %v", err))
+	}
+	previous := auditLogger
+	auditLogger = logger
+	return func() {
+		auditLogger = previous
+	}
+}
+
 // Make a deep copy from src into dst.
 // Copied from https://github.com/getlantern/deepcopy, commit 7f45deb8130a0acc553242eb0e009e3f6f3d9ce3 (Apache 2 licensed)
 func DeepCopyInefficient(dst interface{}, src interface{}) error {
@@ -25,6 +25,18 @@ type ChannelMapperOutput struct {
 	Access    AccessMap // channels granted to users via access() callback
 	Rejection error     // Error associated with failed validate (require callbacks, etc)
 	Expiry    *uint32   // Expiry value specified by expiry() callback.  Standard CBS expiry format: seconds if less than 30 days, epoch time otherwise
+
+	GrantExpiry GrantExpiry // Expiry of time-limited grants made via access() and role() callbacks
+}
+
+// SyncMapper is the contract of a sync function: it assigns a document to channels, grants access, and can
+// reject the write.  It's implemented by ChannelMapper, which runs a JavaScript sync function, and by
+// SyncRulesMapper.
+type SyncMapper interface {
+	MapToChannelsAndAccess(body map[string]interface{}, oldBodyJSON string, userCtx map[string]interface{}) (*ChannelMapperOutput, error)
+
+	// Returns the source of the sync function, which identifies it
+	Function() string
 }
 
 type ChannelMapper struct {
@@ -34,15 +46,31 @@ type ChannelMapper struct {
 // Maps user names (or role names prefixed with "role:") to arrays of channel or role names
 type AccessMap map[string]base.Set
 
+// Maps user names (or role names prefixed with "role:") to the Unix times at which time-limited
+// channel or role grants expire.  Grants that aren't listed don't expire.
+type AccessExpiryMap map[string]map[string]int64
+
+// The expiry of time-limited grants made by a sync function, parallel to its Access and Roles
+type GrantExpiry struct {
+	Access AccessExpiryMap
+	Roles  AccessExpiryMap
+}
+
 // Number of SyncRunner tasks (and Otto contexts) to cache
 // Should be larger than sequence_allocator.maxBatchSize, to avoid pool overflow under some load scenarios (CBG-436)
 const kTaskCacheSize = 16
 
+// Creates a ChannelMapper that runs the sync function with the default JavaScript engine and no timeout.
 func NewChannelMapper(fnSource string) *ChannelMapper {
+	return NewChannelMapperWithOptions(fnSource, base.JSOptions{})
+}
+
+// Creates a ChannelMapper that runs the sync function with the given JavaScript engine and timeout.
+func NewChannelMapperWithOptions(fnSource string, jsOptions base.JSOptions) *ChannelMapper {
 	return &ChannelMapper{
 		JSServer: sgbucket.NewJSServer(fnSource, kTaskCacheSize,
 			func(fnSource string) (sgbucket.JSServerTask, error) {
-				return NewSyncRunner(fnSource)
+				return NewSyncRunner(fnSource, jsOptions)
 			}),
 	}
 }
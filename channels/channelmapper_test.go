@@ -11,6 +11,7 @@ package channels
 
 import (
 	"testing"
+	"time"
 
 	"github.com/couchbase/sync_gateway/base"
 	goassert "github.com/couchbaselabs/go.assert"
@@ -34,7 +35,8 @@ var noUser = map[string]interface{}{"name": nil, "channels": []string{}}
 func TestOttoValueToStringArray(t *testing.T) {
 	// Test for https://github.com/robertkrimen/otto/issues/24
 	value, _ := otto.New().ToValue([]string{"foo", "bar", "baz"})
-	strings := ottoValueToStringArray(value)
+	exported, _ := value.Export()
+	strings := jsValueToStringArray(exported)
 	goassert.DeepEquals(t, strings, []string{"foo", "bar", "baz"})
 }
 
@@ -46,6 +48,32 @@ func TestJavaScriptWorks(t *testing.T) {
 	goassert.DeepEquals(t, res.Channels, SetOf(t, "abc", "xyz"))
 }
 
+// verify that a sync function using ES6 syntax runs with the goja engine
+func TestSyncFunctionGoja(t *testing.T) {
+	mapper := NewChannelMapperWithOptions(`(doc, oldDoc) => {
+		const {x, y} = doc;
+		for (let ch of [...x, ...y]) { channel(`+"`ch-${ch}`"+`); }
+		access("alice", x);
+	}`, base.JSOptions{Engine: base.JSEngineGoja})
+	res, err := mapper.MapToChannelsAndAccess(parse(`{"x":["abc"],"y":["xyz"]}`), `{}`, noUser)
+	assert.NoError(t, err, "MapToChannelsAndAccess failed")
+	goassert.DeepEquals(t, res.Channels, SetOf(t, "ch-abc", "ch-xyz"))
+	goassert.DeepEquals(t, res.Access, AccessMap{"alice": SetOf(t, "abc")})
+}
+
+// verify that a sync function that runs too long is stopped
+func TestSyncFunctionTimeout(t *testing.T) {
+	for _, engine := range []base.JSEngine{base.JSEngineOtto, base.JSEngineGoja} {
+		mapper := NewChannelMapperWithOptions(`function(doc) {while (doc.loop) {} channel("ok");}`,
+			base.JSOptions{Engine: engine, Timeout: 100 * time.Millisecond})
+		_, err := mapper.MapToChannelsAndAccess(parse(`{"loop": true}`), `{}`, noUser)
+		assert.Equal(t, base.ErrJSTimeout, err, "engine %s", engine)
+		res, err := mapper.MapToChannelsAndAccess(parse(`{"loop": false}`), `{}`, noUser)
+		assert.NoError(t, err, "engine %s", engine)
+		goassert.DeepEquals(t, res.Channels, SetOf(t, "ok"))
+	}
+}
+
 // Just verify that the calls to the channel() fn show up in the output channel list.
 func TestSyncFunction(t *testing.T) {
 	mapper := NewChannelMapper(`function(doc) {channel("foo", "bar"); channel("baz")}`)
@@ -159,6 +187,40 @@ func TestRoleFunction(t *testing.T) {
 	goassert.DeepEquals(t, res.Roles, AccessMap{"bar": SetOf(t, "froods"), "baz": SetOf(t, "froods"), "foo": SetOf(t, "froods")})
 }
 
+// Grants made with an expiry are listed in GrantExpiry; ones without aren't.
+func TestAccessFunctionWithExpiry(t *testing.T) {
+	mapper := NewChannelMapper(`function(doc) {
+		access("foo", "bar", 4000000000);
+		access("foo", "baz");
+		access("foo", "qux", 4000000000);
+		access("foo", "qux", 4000000100);
+		access(["foo", "zed"], "perm", "4000000000");
+		access("foo", "perm");
+		role("foo", "role:froods", "2096-10-02T07:06:40Z");
+	}`)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, noUser)
+	assert.NoError(t, err, "MapToChannelsAndAccess failed")
+	assert.Equal(t, AccessMap{"foo": SetOf(t, "bar", "baz", "qux", "perm"), "zed": SetOf(t, "perm")}, res.Access)
+	assert.Equal(t, AccessExpiryMap{
+		"foo": {"bar": 4000000000, "qux": 4000000100},
+		"zed": {"perm": 4000000000},
+	}, res.GrantExpiry.Access)
+	assert.Equal(t, AccessExpiryMap{"foo": {"froods": 4000000000}}, res.GrantExpiry.Roles)
+
+	// Relative expiries are converted to absolute times
+	mapper = NewChannelMapper(`function(doc) {access("foo", "bar", 60)}`)
+	res, err = mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, noUser)
+	assert.NoError(t, err, "MapToChannelsAndAccess failed")
+	assert.InDelta(t, time.Now().Add(time.Minute).Unix(), res.GrantExpiry.Access["foo"]["bar"], 5)
+
+	// Grants with invalid expiries are ignored rather than made permanent
+	mapper = NewChannelMapper(`function(doc) {access("foo", "bar", "soon")}`)
+	res, err = mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, noUser)
+	assert.NoError(t, err, "MapToChannelsAndAccess failed")
+	assert.Equal(t, AccessMap{}, res.Access)
+	assert.Nil(t, res.GrantExpiry.Access)
+}
+
 // Now just make sure the input comes through intact
 func TestInputParse(t *testing.T) {
 	mapper := NewChannelMapper(`function(doc) {channel(doc.channel);}`)
@@ -0,0 +1,409 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package channels
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// SyncRules are declarative rules that can be used instead of a JavaScript sync function.  Every rule that
+// matches a document contributes its channels, grants, write requirements and expiry.  A deleted document is
+// matched using the properties of the revision it replaces, so that the tombstone is routed to the same
+// channels and has the same write requirements, but it makes no grants.  A write that replaces an existing
+// revision must also meet the requirements of every rule matching that revision, so that a writer can't take
+// over a document by changing the properties the rules match or refer to, such as its owner.
+//
+// Strings in a rule's channels, grants, requirements and expiry can refer to document properties:
+// "${owner}" is replaced by the owner property, or by each of its items if it's an array, and
+// "team-${team.id}" by the id property of the team object, with a prefix.  A reference to a property that's
+// missing, or isn't a string, number or array of strings, produces nothing.
+type SyncRules []SyncRule
+
+// SyncRule is a single declarative sync rule.
+type SyncRule struct {
+	Match        map[string]interface{} `json:"match,omitempty"`         // Property paths and the values they must have; an array lists alternative values
+	Channels     []string               `json:"channels,omitempty"`      // Channels to assign the document to
+	Grants       []SyncRuleGrant        `json:"grants,omitempty"`        // Channels and roles to grant to users and roles
+	RequireRoles []string               `json:"require_roles,omitempty"` // A non-admin writer must have one of these roles
+	RequireUsers []string               `json:"require_users,omitempty"` // A non-admin writer must be one of these users
+	Expiry       interface{}            `json:"expiry,omitempty"`        // Document expiry, in any format expiry() takes, or a property reference
+}
+
+// SyncRuleGrant grants channels and/or roles, as the access() and role() sync function callbacks do.
+type SyncRuleGrant struct {
+	To       []string `json:"to"`                 // Users, and roles prefixed with "role:", to grant to
+	Channels []string `json:"channels,omitempty"` // Channels to grant
+	Roles    []string `json:"roles,omitempty"`    // Roles to grant, without the "role:" prefix
+}
+
+// SyncRulesMapper is a native implementation of SyncMapper that applies SyncRules.  It runs no JavaScript, and
+// is safe to use from multiple goroutines.
+type SyncRulesMapper struct {
+	rules  []compiledSyncRule
+	source string // The rules as JSON, which identifies them in place of a sync function's source
+}
+
+type compiledSyncRule struct {
+	match        []syncRuleMatch
+	channels     []syncRuleTemplate
+	grants       []compiledSyncRuleGrant
+	requireRoles []syncRuleTemplate
+	requireUsers []syncRuleTemplate
+	expiry       *uint32           // A constant expiry
+	expiryRef    *syncRuleTemplate // An expiry read from a document property
+}
+
+type compiledSyncRuleGrant struct {
+	to       []syncRuleTemplate
+	channels []syncRuleTemplate
+	roles    []syncRuleTemplate
+}
+
+type syncRuleMatch struct {
+	path   []string
+	values []interface{} // Alternatives
+}
+
+// A string that may contain property references.  Even-numbered parts are literal text; odd-numbered parts
+// are property paths.
+type syncRuleTemplate struct {
+	parts [][]string
+}
+
+// Compiles SyncRules, returning an error if any rule is invalid.
+func NewSyncRulesMapper(rules SyncRules) (*SyncRulesMapper, error) {
+	source, err := base.JSONMarshal(rules)
+	if err != nil {
+		return nil, err
+	}
+	mapper := &SyncRulesMapper{
+		rules:  make([]compiledSyncRule, len(rules)),
+		source: string(source),
+	}
+	for i, rule := range rules {
+		if err := mapper.rules[i].compile(rule); err != nil {
+			return nil, fmt.Errorf("Invalid sync rule %d: %v", i, err)
+		}
+	}
+	return mapper, nil
+}
+
+// Returns the rules as JSON.
+func (mapper *SyncRulesMapper) Function() string {
+	return mapper.source
+}
+
+func (mapper *SyncRulesMapper) MapToChannelsAndAccess(body map[string]interface{}, oldBodyJSON string, userCtx map[string]interface{}) (*ChannelMapperOutput, error) {
+	var oldDoc map[string]interface{}
+	if oldBodyJSON != "" {
+		if err := base.JSONUnmarshal([]byte(oldBodyJSON), &oldDoc); err != nil {
+			return nil, err
+		}
+		if oldDeleted, _ := oldDoc["_deleted"].(bool); oldDeleted {
+			oldDoc = nil // Recreating a deleted document
+		}
+	}
+	doc := body
+	deleted, _ := body["_deleted"].(bool)
+	if deleted && oldDoc != nil {
+		doc = oldDoc
+	}
+	validate := userCtx != nil && userCtx["name"] != nil
+
+	output := &ChannelMapperOutput{}
+	channelNames := []string{}
+	access := map[string][]string{}
+	roles := map[string][]string{}
+	for _, rule := range mapper.rules {
+		if !rule.matches(doc) {
+			continue
+		}
+		if validate && output.Rejection == nil {
+			output.Rejection = rule.checkWriter(doc, userCtx)
+		}
+		channelNames = expandSyncRuleTemplates(rule.channels, doc, channelNames)
+		if !deleted {
+			for _, grant := range rule.grants {
+				grantChannels := expandSyncRuleTemplates(grant.channels, doc, nil)
+				grantRoles := expandSyncRuleTemplates(grant.roles, doc, nil)
+				for _, name := range expandSyncRuleTemplates(grant.to, doc, nil) {
+					if len(grantChannels) > 0 {
+						access[name] = append(access[name], grantChannels...)
+					}
+					if len(grantRoles) > 0 {
+						roles[name] = append(roles[name], grantRoles...)
+					}
+				}
+			}
+		}
+		if rule.expiry != nil {
+			output.Expiry = rule.expiry
+		} else if rule.expiryRef != nil {
+			if rawExpiry := rule.expiryRef.value(doc); rawExpiry != nil {
+				if expiry, err := base.ReflectExpiry(rawExpiry); err == nil {
+					output.Expiry = expiry
+				} else {
+					base.Warnf(base.KeyAll, "SyncRules: Invalid expiry property value: %+v", base.UD(rawExpiry))
+				}
+			}
+		}
+	}
+
+	if validate && output.Rejection == nil && oldDoc != nil && !deleted {
+		// The writer must also meet the requirements of the revision being replaced:
+		for _, rule := range mapper.rules {
+			if rule.matches(oldDoc) {
+				if output.Rejection = rule.checkWriter(oldDoc, userCtx); output.Rejection != nil {
+					break
+				}
+			}
+		}
+	}
+
+	var err error
+	if output.Channels, err = SetFromArray(channelNames, ExpandStar); err != nil {
+		return nil, err
+	}
+	if output.Access, err = compileAccessMap(access, ""); err != nil {
+		return nil, err
+	}
+	if output.Roles, err = compileAccessMap(roles, ""); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func (rule *compiledSyncRule) compile(source SyncRule) (err error) {
+	for path, value := range source.Match {
+		if path == "" {
+			return errors.New("empty match property")
+		}
+		match := syncRuleMatch{path: strings.Split(path, "."), values: []interface{}{value}}
+		if alternatives, ok := value.([]interface{}); ok {
+			match.values = alternatives
+		}
+		rule.match = append(rule.match, match)
+	}
+	if rule.channels, err = compileSyncRuleTemplates(source.Channels); err != nil {
+		return err
+	}
+	for _, sourceGrant := range source.Grants {
+		var grant compiledSyncRuleGrant
+		if len(sourceGrant.To) == 0 {
+			return errors.New("grant has no \"to\"")
+		} else if len(sourceGrant.Channels) == 0 && len(sourceGrant.Roles) == 0 {
+			return errors.New("grant has no channels or roles")
+		}
+		if grant.to, err = compileSyncRuleTemplates(sourceGrant.To); err != nil {
+			return err
+		}
+		if grant.channels, err = compileSyncRuleTemplates(sourceGrant.Channels); err != nil {
+			return err
+		}
+		if grant.roles, err = compileSyncRuleTemplates(sourceGrant.Roles); err != nil {
+			return err
+		}
+		rule.grants = append(rule.grants, grant)
+	}
+	if rule.requireRoles, err = compileSyncRuleTemplates(source.RequireRoles); err != nil {
+		return err
+	}
+	if rule.requireUsers, err = compileSyncRuleTemplates(source.RequireUsers); err != nil {
+		return err
+	}
+
+	if expiryString, ok := source.Expiry.(string); ok && strings.Contains(expiryString, "${") {
+		template, err := compileSyncRuleTemplate(expiryString)
+		if err != nil {
+			return err
+		} else if len(template.parts) != 3 || template.parts[0][0] != "" || template.parts[2][0] != "" {
+			return errors.New("expiry must be a single property reference")
+		}
+		rule.expiryRef = &template
+	} else if source.Expiry != nil {
+		if rule.expiry, err = base.ReflectExpiry(source.Expiry); err != nil {
+			return fmt.Errorf("invalid expiry: %v", err)
+		}
+	}
+	return nil
+}
+
+func (rule *compiledSyncRule) matches(doc map[string]interface{}) bool {
+	for _, match := range rule.match {
+		value := syncRuleProperty(doc, match.path)
+		matched := false
+		for _, expected := range match.values {
+			if syncRuleValuesEqual(value, expected) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the rejection of a write by the user whose context is given, if the rule's requirements aren't met.
+func (rule *compiledSyncRule) checkWriter(doc map[string]interface{}, userCtx map[string]interface{}) error {
+	if len(rule.requireUsers) > 0 {
+		userName, _ := userCtx["name"].(string)
+		if !base.StringSliceContains(expandSyncRuleTemplates(rule.requireUsers, doc, nil), userName) {
+			return base.HTTPErrorf(403, base.SyncFnErrorWrongUser)
+		}
+	}
+	if len(rule.requireRoles) > 0 {
+		userRoles := userCtxRoles(userCtx)
+		hasRole := false
+		for _, role := range expandSyncRuleTemplates(rule.requireRoles, doc, nil) {
+			if userRoles.Contains(role) {
+				hasRole = true
+				break
+			}
+		}
+		if !hasRole {
+			return base.HTTPErrorf(403, base.SyncFnErrorMissingRole)
+		}
+	}
+	return nil
+}
+
+// Returns the role names in a user context, whose roles may be a TimedSet (as from MakeUserCtx), an object,
+// or an array.
+func userCtxRoles(userCtx map[string]interface{}) base.Set {
+	switch roles := userCtx["roles"].(type) {
+	case TimedSet:
+		return roles.AsSet()
+	case map[string]interface{}:
+		set := make(base.Set, len(roles))
+		for role := range roles {
+			set[role] = struct{}{}
+		}
+		return set
+	default:
+		return base.SetFromArray(base.ValueToStringArray(roles))
+	}
+}
+
+func compileSyncRuleTemplates(sources []string) ([]syncRuleTemplate, error) {
+	templates := make([]syncRuleTemplate, len(sources))
+	for i, source := range sources {
+		var err error
+		if templates[i], err = compileSyncRuleTemplate(source); err != nil {
+			return nil, err
+		}
+	}
+	return templates, nil
+}
+
+func compileSyncRuleTemplate(source string) (syncRuleTemplate, error) {
+	var template syncRuleTemplate
+	for {
+		start := strings.Index(source, "${")
+		if start < 0 {
+			template.parts = append(template.parts, []string{source})
+			return template, nil
+		}
+		end := strings.Index(source[start:], "}")
+		if end < 0 {
+			return template, fmt.Errorf("unterminated property reference in %q", source)
+		}
+		path := source[start+2 : start+end]
+		if path == "" {
+			return template, fmt.Errorf("empty property reference in %q", source)
+		}
+		template.parts = append(template.parts, []string{source[:start]}, strings.Split(path, "."))
+		source = source[start+end+1:]
+	}
+}
+
+// Returns the raw value of a template that's a single property reference.
+func (template *syncRuleTemplate) value(doc map[string]interface{}) interface{} {
+	return syncRuleProperty(doc, template.parts[1])
+}
+
+// Appends the strings the template produces for the document to result.
+func (template *syncRuleTemplate) expand(doc map[string]interface{}, result []string) []string {
+	prefixes := []string{template.parts[0][0]}
+	for i := 1; i < len(template.parts) && len(prefixes) > 0; i += 2 {
+		values := syncRuleStrings(syncRuleProperty(doc, template.parts[i]))
+		suffix := template.parts[i+1][0]
+		expanded := make([]string, 0, len(prefixes)*len(values))
+		for _, prefix := range prefixes {
+			for _, value := range values {
+				expanded = append(expanded, prefix+value+suffix)
+			}
+		}
+		prefixes = expanded
+	}
+	return append(result, prefixes...)
+}
+
+func expandSyncRuleTemplates(templates []syncRuleTemplate, doc map[string]interface{}, result []string) []string {
+	for i := range templates {
+		result = templates[i].expand(doc, result)
+	}
+	return result
+}
+
+// Returns the value at a property path in a document, or nil if there isn't one.
+func syncRuleProperty(doc map[string]interface{}, path []string) interface{} {
+	var value interface{} = doc
+	for _, key := range path {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[key]
+	}
+	return value
+}
+
+// Converts a property value substituted into a template to strings.
+func syncRuleStrings(value interface{}) []string {
+	if number, ok := value.(json.Number); ok {
+		return []string{number.String()}
+	} else if number, ok := syncRuleNumber(value); ok {
+		return []string{strconv.FormatFloat(number, 'f', -1, 64)}
+	}
+	return base.ValueToStringArray(value)
+}
+
+// Compares a document property with a value from a rule, treating all numeric types alike.
+func syncRuleValuesEqual(value, expected interface{}) bool {
+	if number, ok := syncRuleNumber(value); ok {
+		expectedNumber, ok := syncRuleNumber(expected)
+		return ok && number == expectedNumber
+	}
+	return reflect.DeepEqual(value, expected)
+}
+
+func syncRuleNumber(value interface{}) (float64, bool) {
+	switch value := value.(type) {
+	case float64:
+		return value, true
+	case int64:
+		return float64(value), true
+	case int:
+		return float64(value), true
+	case json.Number:
+		number, err := value.Float64()
+		return number, err == nil
+	}
+	return 0, false
+}
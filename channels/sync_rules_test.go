@@ -0,0 +1,146 @@
+package channels
+
+import (
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func parseSyncRules(t *testing.T, rulesJSON string) *SyncRulesMapper {
+	var rules SyncRules
+	require.NoError(t, base.JSONUnmarshal([]byte(rulesJSON), &rules))
+	mapper, err := NewSyncRulesMapper(rules)
+	require.NoError(t, err)
+	return mapper
+}
+
+const testSyncRules = `[
+	{"match": {"type": "task"},
+	 "channels": ["tasks", "owner-${owner}", "${tags}"],
+	 "grants": [{"to": ["${owner}"], "channels": ["owner-${owner}"]},
+	            {"to": ["${reviewers}"], "roles": ["reviewer"]}],
+	 "require_users": ["${owner}"]},
+	{"match": {"type": ["note", "memo"], "meta.team": 7},
+	 "channels": ["team-${meta.team}-${kind}"],
+	 "require_roles": ["editor"],
+	 "expiry": "${expires}"},
+	{"channels": ["all"]}
+]`
+
+func TestSyncRulesChannelsAndAccess(t *testing.T) {
+	mapper := parseSyncRules(t, testSyncRules)
+
+	res, err := mapper.MapToChannelsAndAccess(parse(`{"type": "task", "owner": "alice", "tags": ["red", "blue"], "reviewers": ["bob", "carol"]}`), `{}`, noUser)
+	require.NoError(t, err)
+	assert.Equal(t, SetOf(t, "tasks", "owner-alice", "red", "blue", "all"), res.Channels)
+	assert.Equal(t, AccessMap{"alice": SetOf(t, "owner-alice")}, res.Access)
+	assert.Equal(t, AccessMap{"bob": SetOf(t, "reviewer"), "carol": SetOf(t, "reviewer")}, res.Roles)
+	assert.Nil(t, res.Rejection)
+	assert.Nil(t, res.Expiry)
+
+	// Nested properties, alternative values and numbers:
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"type": "memo", "meta": {"team": 7}, "kind": "draft", "expires": 3600}`), `{}`, noUser)
+	require.NoError(t, err)
+	assert.Equal(t, SetOf(t, "team-7-draft", "all"), res.Channels)
+	require.NotNil(t, res.Expiry)
+	assert.Equal(t, uint32(3600), *res.Expiry)
+
+	// A missing property produces nothing:
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"type": "note", "meta": {"team": 7}}`), `{}`, noUser)
+	require.NoError(t, err)
+	assert.Equal(t, SetOf(t, "all"), res.Channels)
+
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"type": "note", "meta": {"team": 8}, "kind": "draft"}`), `{}`, noUser)
+	require.NoError(t, err)
+	assert.Equal(t, SetOf(t, "all"), res.Channels)
+
+	// Invalid channel names are an error, as they are from a sync function:
+	_, err = mapper.MapToChannelsAndAccess(parse(`{"type": "task", "owner": "alice", "tags": ["no,commas"]}`), `{}`, noUser)
+	assert.Error(t, err)
+}
+
+func TestSyncRulesRequirements(t *testing.T) {
+	mapper := parseSyncRules(t, testSyncRules)
+	task := `{"type": "task", "owner": "alice"}`
+	note := `{"type": "note", "meta": {"team": 7}, "kind": "draft"}`
+
+	alice := map[string]interface{}{"name": "alice", "roles": TimedSet{}}
+	bob := map[string]interface{}{"name": "bob", "roles": AtSequence(base.SetOf("editor"), 1)}
+
+	res, err := mapper.MapToChannelsAndAccess(parse(task), `{}`, alice)
+	require.NoError(t, err)
+	assert.Nil(t, res.Rejection)
+
+	res, err = mapper.MapToChannelsAndAccess(parse(task), `{}`, bob)
+	require.NoError(t, err)
+	assert.Equal(t, base.HTTPErrorf(403, base.SyncFnErrorWrongUser), res.Rejection)
+
+	res, err = mapper.MapToChannelsAndAccess(parse(note), `{}`, alice)
+	require.NoError(t, err)
+	assert.Equal(t, base.HTTPErrorf(403, base.SyncFnErrorMissingRole), res.Rejection)
+
+	res, err = mapper.MapToChannelsAndAccess(parse(note), `{}`, bob)
+	require.NoError(t, err)
+	assert.Nil(t, res.Rejection)
+
+	// Roles given as a JSON array, as in a dry run's user context:
+	res, err = mapper.MapToChannelsAndAccess(parse(note), `{}`, map[string]interface{}{"name": "carol", "roles": []interface{}{"editor"}})
+	require.NoError(t, err)
+	assert.Nil(t, res.Rejection)
+
+	// Updates must meet the requirements of the replaced revision too, so a non-owner can't take over a task by
+	// making themselves its owner, or by changing its type:
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"type": "task", "owner": "bob"}`), task, bob)
+	require.NoError(t, err)
+	assert.Equal(t, base.HTTPErrorf(403, base.SyncFnErrorWrongUser), res.Rejection)
+
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"type": "memo", "owner": "bob"}`), task, bob)
+	require.NoError(t, err)
+	assert.Equal(t, base.HTTPErrorf(403, base.SyncFnErrorWrongUser), res.Rejection)
+
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"type": "task", "owner": "alice", "done": true}`), task, alice)
+	require.NoError(t, err)
+	assert.Nil(t, res.Rejection)
+
+	// Recreating a deleted document only has to meet the new revision's requirements:
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"type": "task", "owner": "bob"}`), `{"_deleted": true}`, bob)
+	require.NoError(t, err)
+	assert.Nil(t, res.Rejection)
+
+	// Admins aren't subject to requirements:
+	res, err = mapper.MapToChannelsAndAccess(parse(task), `{}`, nil)
+	require.NoError(t, err)
+	assert.Nil(t, res.Rejection)
+}
+
+func TestSyncRulesDeletion(t *testing.T) {
+	mapper := parseSyncRules(t, testSyncRules)
+	oldDoc := `{"type": "task", "owner": "alice", "tags": ["red"]}`
+
+	// The tombstone goes to the old revision's channels and must be written by its owner, but grants nothing:
+	res, err := mapper.MapToChannelsAndAccess(parse(`{"_deleted": true}`), oldDoc, map[string]interface{}{"name": "bob"})
+	require.NoError(t, err)
+	assert.Equal(t, SetOf(t, "tasks", "owner-alice", "red", "all"), res.Channels)
+	assert.Empty(t, res.Access)
+	assert.Equal(t, base.HTTPErrorf(403, base.SyncFnErrorWrongUser), res.Rejection)
+}
+
+func TestSyncRulesInvalid(t *testing.T) {
+	invalidRules := []string{
+		`[{"channels": ["${owner"]}]`,
+		`[{"channels": ["${}"]}]`,
+		`[{"grants": [{"channels": ["a"]}]}]`,
+		`[{"grants": [{"to": ["alice"]}]}]`,
+		`[{"expiry": "soon"}]`,
+		`[{"expiry": "in ${days} days"}]`,
+		`[{"match": {"": 1}}]`,
+	}
+	for _, rulesJSON := range invalidRules {
+		var rules SyncRules
+		require.NoError(t, base.JSONUnmarshal([]byte(rulesJSON), &rules))
+		_, err := NewSyncRulesMapper(rules)
+		assert.Error(t, err, "Rules %s", rulesJSON)
+	}
+}
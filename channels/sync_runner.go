@@ -12,10 +12,9 @@ package channels
 import (
 	"fmt"
 	"strings"
+	"time"
 
-	sgbucket "github.com/couchbase/sg-bucket"
 	"github.com/couchbase/sync_gateway/base"
-	"github.com/robertkrimen/otto"
 	_ "github.com/robertkrimen/otto/underscore"
 )
 
@@ -107,18 +106,20 @@ const funcWrapper = `
 
 // An object that runs a specific JS sync() function. Not thread-safe!
 type SyncRunner struct {
-	sgbucket.JSRunner                      // "Superclass"
-	output            *ChannelMapperOutput // Results being accumulated while the JS fn runs
-	channels          []string
-	access            map[string][]string // channels granted to users via access() callback
-	roles             map[string][]string // roles granted to users via role() callback
-	expiry            *uint32             // document expiry (in seconds) specified via expiry() callback
+	base.JSRunner                      // "Superclass"
+	output        *ChannelMapperOutput // Results being accumulated while the JS fn runs
+	channels      []string
+	access        map[string][]string // channels granted to users via access() callback
+	roles         map[string][]string // roles granted to users via role() callback
+	accessExpiry  grantExpiries       // expiry of time-limited access() grants
+	roleExpiry    grantExpiries       // expiry of time-limited role() grants
+	expiry        *uint32             // document expiry (in seconds) specified via expiry() callback
 }
 
-func NewSyncRunner(funcSource string) (*SyncRunner, error) {
+func NewSyncRunner(funcSource string, jsOptions base.JSOptions) (*SyncRunner, error) {
 	funcSource = wrappedFuncSource(funcSource)
 	runner := &SyncRunner{}
-	err := runner.InitWithLogging(funcSource,
+	err := runner.InitWithLogging(jsOptions, funcSource,
 		func(s string) { base.Errorf(base.KeyJavascript, "Sync %s", base.UD(s)) },
 		func(s string) { base.Infof(base.KeyJavascript, "Sync %s", base.UD(s)) })
 	if err != nil {
@@ -126,62 +127,58 @@ func NewSyncRunner(funcSource string) (*SyncRunner, error) {
 	}
 
 	// Implementation of the 'channel()' callback:
-	runner.DefineNativeFunction("channel", func(call otto.FunctionCall) otto.Value {
-		for _, arg := range call.ArgumentList {
-			if strings := ottoValueToStringArray(arg); strings != nil {
+	runner.DefineNativeFunction("channel", func(args []interface{}) interface{} {
+		for _, arg := range args {
+			if strings := jsValueToStringArray(arg); strings != nil {
 				runner.channels = append(runner.channels, strings...)
 			}
 		}
-		return otto.UndefinedValue()
+		return nil
 	})
 
 	// Implementation of the 'access()' callback:
-	runner.DefineNativeFunction("access", func(call otto.FunctionCall) otto.Value {
-		return runner.addValueForUser(call.Argument(0), call.Argument(1), runner.access)
+	runner.DefineNativeFunction("access", func(args []interface{}) interface{} {
+		runner.addValueForUser(base.JSArgument(args, 0), base.JSArgument(args, 1), base.JSArgument(args, 2), runner.access, runner.accessExpiry)
+		return nil
 	})
 
 	// Implementation of the 'role()' callback:
-	runner.DefineNativeFunction("role", func(call otto.FunctionCall) otto.Value {
-		return runner.addValueForUser(call.Argument(0), call.Argument(1), runner.roles)
+	runner.DefineNativeFunction("role", func(args []interface{}) interface{} {
+		runner.addValueForUser(base.JSArgument(args, 0), base.JSArgument(args, 1), base.JSArgument(args, 2), runner.roles, runner.roleExpiry)
+		return nil
 	})
 
 	// Implementation of the 'reject()' callback:
-	runner.DefineNativeFunction("reject", func(call otto.FunctionCall) otto.Value {
+	runner.DefineNativeFunction("reject", func(args []interface{}) interface{} {
 		if runner.output.Rejection == nil {
-			if status, err := call.Argument(0).ToInteger(); err == nil && status >= 400 {
+			if status, ok := base.ToInt64(base.JSArgument(args, 0)); ok && status >= 400 {
 				var message string
-				if len(call.ArgumentList) > 1 {
-					message = call.Argument(1).String()
+				if len(args) > 1 {
+					message = fmt.Sprint(args[1])
 				}
 				runner.output.Rejection = base.HTTPErrorf(int(status), message)
 			}
 		}
-		return otto.UndefinedValue()
+		return nil
 	})
 
 	// Implementation of the 'expiry()' callback:
-	runner.DefineNativeFunction("expiry", func(call otto.FunctionCall) otto.Value {
-		if len(call.ArgumentList) > 0 {
-			rawExpiry, exportErr := call.Argument(0).Export()
-			if exportErr != nil {
-				base.Warnf(base.KeyAll, "SyncRunner: Unable to export expiry parameter: %v Error: %s", call.Argument(0), exportErr)
-				return otto.UndefinedValue()
-			}
-
-			// Called expiry with null/undefined value - ignore
-			if rawExpiry == nil || call.Argument(0).IsUndefined() {
-				return otto.UndefinedValue()
-			}
+	runner.DefineNativeFunction("expiry", func(args []interface{}) interface{} {
+		rawExpiry := base.JSArgument(args, 0)
 
-			expiry, reflectErr := base.ReflectExpiry(rawExpiry)
-			if reflectErr != nil {
-				base.Warnf(base.KeyAll, "SyncRunner: Invalid value passed to expiry().  Value:%+v ", call.Argument(0))
-				return otto.UndefinedValue()
-			}
+		// Called expiry with null/undefined value - ignore
+		if rawExpiry == nil {
+			return nil
+		}
 
-			runner.expiry = expiry
+		expiry, reflectErr := base.ReflectExpiry(rawExpiry)
+		if reflectErr != nil {
+			base.Warnf(base.KeyAll, "SyncRunner: Invalid value passed to expiry().  Value:%+v ", rawExpiry)
+			return nil
 		}
-		return otto.UndefinedValue()
+
+		runner.expiry = expiry
+		return nil
 	})
 
 	runner.Before = func() {
@@ -189,9 +186,11 @@ func NewSyncRunner(funcSource string) (*SyncRunner, error) {
 		runner.channels = []string{}
 		runner.access = map[string][]string{}
 		runner.roles = map[string][]string{}
+		runner.accessExpiry = grantExpiries{}
+		runner.roleExpiry = grantExpiries{}
 		runner.expiry = nil
 	}
-	runner.After = func(result otto.Value, err error) (interface{}, error) {
+	runner.After = func(result interface{}, err error) (interface{}, error) {
 		output := runner.output
 		runner.output = nil
 		if err == nil {
@@ -201,6 +200,8 @@ func NewSyncRunner(funcSource string) (*SyncRunner, error) {
 				if err == nil {
 					output.Roles, err = compileAccessMap(runner.roles, RoleAccessPrefix)
 				}
+				output.GrantExpiry.Access = runner.accessExpiry.compile("")
+				output.GrantExpiry.Roles = runner.roleExpiry.compile(RoleAccessPrefix)
 			}
 			if runner.expiry != nil {
 				output.Expiry = runner.expiry
@@ -216,15 +217,73 @@ func (runner *SyncRunner) SetFunction(funcSource string) (bool, error) {
 	return runner.JSRunner.SetFunction(funcSource)
 }
 
-// Common implementation of 'access()' and 'role()' callbacks
-func (runner *SyncRunner) addValueForUser(user otto.Value, value otto.Value, mapping map[string][]string) otto.Value {
-	valueStrings := ottoValueToStringArray(value)
+// Common implementation of 'access()' and 'role()' callbacks.  The optional expiry argument makes the
+// grant time-limited; it takes the same formats as the 'expiry()' callback, or a Date.
+func (runner *SyncRunner) addValueForUser(user interface{}, value interface{}, expiryValue interface{}, mapping map[string][]string, expiries grantExpiries) {
+	valueStrings := jsValueToStringArray(value)
 	if len(valueStrings) > 0 {
-		for _, name := range ottoValueToStringArray(user) {
+		expiry, err := jsValueToGrantExpiry(expiryValue)
+		if err != nil {
+			// Don't turn a time-limited grant into a permanent one
+			base.Warnf(base.KeyAll, "SyncRunner: Ignoring grant with invalid expiry %v: %v", expiryValue, err)
+			return
+		}
+		for _, name := range jsValueToStringArray(user) {
 			mapping[name] = append(mapping[name], valueStrings...)
+			expiries.add(name, valueStrings, expiry)
 		}
 	}
-	return otto.UndefinedValue()
+}
+
+// Tracks the expiry of the grants made while the sync function runs.  A zero expiry marks a permanent grant.
+type grantExpiries map[string]map[string]int64
+
+// Records grants of the values to the named principal.  When the same value is granted more than once,
+// the grant lasts as long as the longest of them.
+func (expiries grantExpiries) add(name string, values []string, expiry int64) {
+	if expiries[name] == nil {
+		expiries[name] = make(map[string]int64, len(values))
+	}
+	for _, value := range values {
+		if old, seen := expiries[name][value]; !seen || (old != 0 && (expiry == 0 || expiry > old)) {
+			expiries[name][value] = expiry
+		}
+	}
+}
+
+// Returns the time-limited grants, stripping the prefix (if any) from the granted values.
+func (expiries grantExpiries) compile(prefix string) AccessExpiryMap {
+	var result AccessExpiryMap
+	for name, values := range expiries {
+		for value, expiry := range values {
+			if expiry == 0 {
+				continue
+			}
+			if result == nil {
+				result = AccessExpiryMap{}
+			}
+			if result[name] == nil {
+				result[name] = map[string]int64{}
+			}
+			result[name][strings.TrimPrefix(value, prefix)] = expiry
+		}
+	}
+	return result
+}
+
+// Converts the expiry argument of 'access()' or 'role()' to a Unix time, or zero if there's no expiry.
+func jsValueToGrantExpiry(rawExpiry interface{}) (int64, error) {
+	if rawExpiry == nil {
+		return 0, nil
+	}
+	if t, ok := rawExpiry.(time.Time); ok {
+		return t.Unix(), nil
+	}
+	expiry, err := base.ReflectExpiry(rawExpiry)
+	if err != nil || expiry == nil || *expiry == 0 {
+		return 0, err
+	}
+	return base.CbsExpiryToTime(*expiry).Unix(), nil
 }
 
 func compileAccessMap(input map[string][]string, prefix string) (AccessMap, error) {
@@ -256,14 +315,12 @@ func AccessNameToPrincipalName(accessPrincipalName string) (principalName string
 	return accessPrincipalName, false
 }
 
-// Converts a JS string or array into a Go string array.
-func ottoValueToStringArray(value otto.Value) []string {
-	nativeValue, _ := value.Export()
-
-	result := base.ValueToStringArray(nativeValue)
+// Converts an exported JS string or array into a Go string array.
+func jsValueToStringArray(value interface{}) []string {
+	result := base.ValueToStringArray(value)
 
-	if result == nil && !value.IsNull() && !value.IsUndefined() {
-		base.Warnf(base.KeyAll, "SyncRunner: Non-string, non-array passed to JS callback: %s", base.UD(value))
+	if result == nil && value != nil {
+		base.Warnf(base.KeyAll, "SyncRunner: Non-string, non-array passed to JS callback: %v", base.UD(value))
 	}
 
 	return result
@@ -10,7 +10,7 @@ import (
 
 func TestRequireUser(t *testing.T) {
 	const funcSource = `function(doc, oldDoc) { requireUser(oldDoc._names) }`
-	runner, err := NewSyncRunner(funcSource)
+	runner, err := NewSyncRunner(funcSource, base.JSOptions{})
 	assert.NoError(t, err)
 	var result interface{}
 	result, _ = runner.Call(parse(`{}`), parse(`{"_names": "alpha"}`), parse(`{"name": "alpha"}`))
@@ -23,7 +23,7 @@ func TestRequireUser(t *testing.T) {
 
 func TestRequireRole(t *testing.T) {
 	const funcSource = `function(doc, oldDoc) { requireRole(oldDoc._roles) }`
-	runner, err := NewSyncRunner(funcSource)
+	runner, err := NewSyncRunner(funcSource, base.JSOptions{})
 	assert.NoError(t, err)
 	var result interface{}
 	result, _ = runner.Call(parse(`{}`), parse(`{"_roles": ["alpha"]}`), parse(`{"name": "", "roles": {"alpha":""}}`))
@@ -36,7 +36,7 @@ func TestRequireRole(t *testing.T) {
 
 func TestRequireAccess(t *testing.T) {
 	const funcSource = `function(doc, oldDoc) { requireAccess(oldDoc._access) }`
-	runner, err := NewSyncRunner(funcSource)
+	runner, err := NewSyncRunner(funcSource, base.JSOptions{})
 	assert.NoError(t, err)
 	var result interface{}
 	result, _ = runner.Call(parse(`{}`), parse(`{"_access": ["alpha"]}`), parse(`{"name": "", "channels": ["alpha"]}`))
@@ -49,7 +49,7 @@ func TestRequireAccess(t *testing.T) {
 
 func TestRequireAdmin(t *testing.T) {
 	const funcSource = `function(doc, oldDoc) { requireAdmin() }`
-	runner, err := NewSyncRunner(funcSource)
+	runner, err := NewSyncRunner(funcSource, base.JSOptions{})
 	assert.NoError(t, err)
 	var result interface{}
 	result, _ = runner.Call(parse(`{}`), parse(`{}`), parse(`{}`))
@@ -14,6 +14,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/couchbase/sync_gateway/base"
 )
@@ -22,6 +23,7 @@ import (
 type VbSequence struct {
 	VbNo     *uint16 `json:"vb,omitempty"`
 	Sequence uint64  `json:"seq"`
+	Expiry   int64   `json:"exp,omitempty"` // Unix time when a time-limited grant expires; zero if it doesn't
 }
 
 func NewVbSequence(vbNo uint16, sequence uint64) VbSequence {
@@ -41,12 +43,36 @@ func (vbs VbSequence) String() string {
 }
 
 func (vbs VbSequence) Copy() VbSequence {
+	var result VbSequence
 	if vbs.VbNo == nil {
-		return NewVbSimpleSequence(vbs.Sequence)
+		result = NewVbSimpleSequence(vbs.Sequence)
 	} else {
 		vbInt := *vbs.VbNo
-		return NewVbSequence(vbInt, vbs.Sequence)
+		result = NewVbSequence(vbInt, vbs.Sequence)
 	}
+	result.Expiry = vbs.Expiry
+	return result
+}
+
+// Returns true if this is a time-limited grant that has expired as of the given time.
+func (vbs VbSequence) Expired(now time.Time) bool {
+	return vbs.Expiry != 0 && now.Unix() >= vbs.Expiry
+}
+
+// Returns the time a time-limited grant expires, or the zero time if it doesn't.
+func (vbs VbSequence) ExpiryTime() time.Time {
+	if vbs.Expiry == 0 {
+		return time.Time{}
+	}
+	return time.Unix(vbs.Expiry, 0)
+}
+
+// Converts a time to the Expiry format; the zero time means no expiry.
+func ExpiryFromTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
 }
 
 func (vbs VbSequence) Equals(other VbSequence) bool {
@@ -158,13 +184,31 @@ func (set TimedSet) Equals(other base.Set) bool {
 }
 
 func (set TimedSet) AddChannel(channelName string, atSequence uint64) bool {
-	if atSequence > 0 {
-		if oldSequence := set[channelName]; oldSequence.Sequence == 0 || atSequence < oldSequence.Sequence {
-			set[channelName] = NewVbSimpleSequence(atSequence)
-			return true
-		}
+	return set.addChannelWithExpiry(channelName, atSequence, 0)
+}
+
+// Adds a channel whose grant expires at the given Unix time (zero for no expiry).  If the channel is
+// already present, the earliest sequence wins and the grant lasts as long as the longer of the two.
+func (set TimedSet) addChannelWithExpiry(channelName string, atSequence uint64, expiry int64) bool {
+	if atSequence == 0 {
+		return false
+	}
+	oldSequence, exists := set[channelName]
+	if !exists || oldSequence.Sequence == 0 {
+		set[channelName] = VbSequence{Sequence: atSequence, Expiry: expiry}
+		return true
+	}
+	changed := false
+	if atSequence < oldSequence.Sequence {
+		oldSequence = VbSequence{Sequence: atSequence, Expiry: oldSequence.Expiry}
+		changed = true
+	}
+	if oldSequence.Expiry != 0 && (expiry == 0 || expiry > oldSequence.Expiry) {
+		oldSequence.Expiry = expiry
+		changed = true
 	}
-	return false
+	set[channelName] = oldSequence
+	return changed
 }
 
 // Merges the other set into the receiver. In case of collisions the earliest sequence wins.
@@ -184,7 +228,7 @@ func (set TimedSet) AddAtSequence(other TimedSet, atSequence uint64) bool {
 			if vbSeq.Sequence < atSequence {
 				vbSeq.Sequence = atSequence
 			}
-			if set.AddChannel(ch, vbSeq.Sequence) {
+			if set.addChannelWithExpiry(ch, vbSeq.Sequence, vbSeq.Expiry) {
 				changed = true
 			}
 		}
@@ -205,13 +249,55 @@ func (set TimedSet) AddAtVbSequence(other TimedSet, atVbSequence VbSequence) boo
 // For any channel present in both the set and the other set, updates the sequence to the value
 // from the other set
 func (set TimedSet) UpdateIfPresent(other TimedSet) {
-	for ch := range set {
+	for ch, vbSeq := range set {
 		if otherSeq, ok := other[ch]; ok {
+			otherSeq.Expiry = vbSeq.Expiry
 			set[ch] = otherSeq
 		}
 	}
 }
 
+// Returns the set without the grants that have expired as of the given time.  If none have, returns
+// the receiver itself.
+func (set TimedSet) Unexpired(now time.Time) TimedSet {
+	var result TimedSet
+	for ch, vbSeq := range set {
+		if vbSeq.Expired(now) {
+			if result == nil {
+				result = set.Copy()
+			}
+			delete(result, ch)
+		}
+	}
+	if result == nil {
+		return set
+	}
+	return result
+}
+
+// Returns the earliest expiry of the set's time-limited grants, or the zero time if there are none.
+func (set TimedSet) NextExpiry() time.Time {
+	var next int64
+	for _, vbSeq := range set {
+		if vbSeq.Expiry != 0 && (next == 0 || vbSeq.Expiry < next) {
+			next = vbSeq.Expiry
+		}
+	}
+	return VbSequence{Expiry: next}.ExpiryTime()
+}
+
+// Sets when a member's grant expires; the zero time means it doesn't.  Returns true if the member is
+// present and its expiry changed.
+func (set TimedSet) SetExpiry(ch string, expiry time.Time) bool {
+	vbSeq, ok := set[ch]
+	if !ok || vbSeq.Expiry == ExpiryFromTime(expiry) {
+		return false
+	}
+	vbSeq.Expiry = ExpiryFromTime(expiry)
+	set[ch] = vbSeq
+	return true
+}
+
 // TimedSetDiff stores the result of TimedSet.CompareKeys
 // Elements present in the set but not in the other are returned with value true
 // Elements present in the other set but not in set are returned with value false
@@ -279,10 +365,11 @@ func (setPtr *TimedSet) UnmarshalJSON(data []byte) error {
 
 func (set TimedSet) MarshalJSON() ([]byte, error) {
 
-	// If no vbuckets are defined, marshal as SequenceOnlySet for backwards compatibility.  Otherwise marshal with vbuckets
+	// If no vbuckets or expiries are defined, marshal as SequenceOnlySet for backwards compatibility.  Otherwise
+	// marshal with vbuckets and expiries
 	hasVbucket := false
 	for _, vbSeq := range set {
-		if vbSeq.VbNo != nil {
+		if vbSeq.VbNo != nil || vbSeq.Expiry != 0 {
 			hasVbucket = true
 			break
 		}
@@ -290,7 +377,8 @@ func (set TimedSet) MarshalJSON() ([]byte, error) {
 	if hasVbucket {
 		// Normal form - unmarshal as map[string]VbSequence.  Need to convert back to simple map[string]VbSequence to avoid
 		// having json.Marshal just call back into this function.
-		// Marshals entries as "ABC":{"vb":5,"seq":1} or "CBS":{"seq":1}, depending on whether VbSequence.VbNo is nil
+		// Marshals entries as "ABC":{"vb":5,"seq":1} or "CBS":{"seq":1}, depending on whether VbSequence.VbNo is nil,
+		// with an "exp" property for time-limited grants
 		var plainMap map[string]VbSequence
 		plainMap = set
 		return base.JSONMarshal(plainMap)
@@ -13,6 +13,7 @@ import (
 	"fmt"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/couchbase/sync_gateway/base"
 	goassert "github.com/couchbaselabs/go.assert"
@@ -45,6 +46,39 @@ func TestTimedSetMarshal(t *testing.T) {
 	assert.True(t, strings.Contains(string(bytes), `"b":17`))
 }
 
+func TestTimedSetExpiry(t *testing.T) {
+	now := time.Unix(1000, 0)
+	set := TimedSet{}
+	set.addChannelWithExpiry("a", 5, 900)
+	set.addChannelWithExpiry("b", 5, 2000)
+	set.AddChannel("c", 5)
+
+	// The longer grant wins, and a permanent grant beats any time-limited one
+	assert.True(t, set.AddAtSequence(TimedSet{"b": VbSequence{Sequence: 7, Expiry: 3000}}, 0))
+	assert.Equal(t, VbSequence{Sequence: 5, Expiry: 3000}, set["b"])
+	assert.False(t, set.AddAtSequence(TimedSet{"c": VbSequence{Sequence: 7, Expiry: 3000}}, 0))
+	assert.Equal(t, VbSequence{Sequence: 5}, set["c"])
+
+	assert.Equal(t, time.Unix(900, 0), set.NextExpiry())
+	unexpired := set.Unexpired(now)
+	assert.Equal(t, SetOf(t, "b", "c"), unexpired.AsSet())
+	assert.Equal(t, time.Unix(3000, 0), unexpired.NextExpiry())
+	assert.Len(t, set, 3, "Unexpired shouldn't modify the receiver")
+
+	assert.True(t, unexpired.SetExpiry("c", time.Unix(4000, 0)))
+	assert.False(t, unexpired.SetExpiry("c", time.Unix(4000, 0)))
+	assert.False(t, unexpired.SetExpiry("z", time.Unix(4000, 0)))
+	assert.True(t, unexpired.SetExpiry("b", time.Time{}))
+	assert.Equal(t, time.Unix(4000, 0), unexpired.NextExpiry())
+
+	bytes, err := base.JSONMarshal(unexpired)
+	assert.NoError(t, err, "Marshal")
+	var roundTrip TimedSet
+	assert.NoError(t, base.JSONUnmarshal(bytes, &roundTrip), "Unmarshal")
+	assert.Equal(t, unexpired, roundTrip)
+	assert.Contains(t, string(bytes), `"exp":4000`)
+}
+
 func TestTimedSetUnmarshal(t *testing.T) {
 	var str struct {
 		Channels TimedSet
@@ -18,7 +18,6 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"net/textproto"
@@ -38,6 +37,13 @@ const kMinCompressedJSONSize = 300
 type AttachmentKey string
 type AttachmentData map[AttachmentKey][]byte
 
+// A StoredAttachment stands in for the data of an attachment that has already been streamed to the attachment
+// store, as the "data" property of the attachment's metadata.
+type StoredAttachment struct {
+	Key    AttachmentKey
+	Length int64
+}
+
 // A map of keys -> DocAttachments.
 type AttachmentMap map[string]*DocAttachment
 
@@ -66,13 +72,20 @@ func (db *Database) storeAttachments(doc *Document, newAttachmentsMeta Attachmen
 		}
 		data := meta["data"]
 		if data != nil {
-			// Attachment contains data, so store it in the db:
-			attachment, err := decodeAttachment(data)
-			if err != nil {
-				return nil, err
+			// Attachment contains data, so store it in the db, unless it's already been streamed there:
+			var key AttachmentKey
+			var length int
+			if stored, ok := data.(*StoredAttachment); ok {
+				key, length = stored.Key, int(stored.Length)
+			} else {
+				attachment, err := decodeAttachment(data)
+				if err != nil {
+					return nil, err
+				}
+				key = AttachmentKey(Sha1DigestKey(attachment))
+				newAttachmentData[key] = attachment
+				length = len(attachment)
 			}
-			key := AttachmentKey(Sha1DigestKey(attachment))
-			newAttachmentData[key] = attachment
 
 			newMeta := map[string]interface{}{
 				"stub":   true,
@@ -84,12 +97,12 @@ func (db *Database) storeAttachments(doc *Document, newAttachmentsMeta Attachmen
 			}
 			if encoding := meta["encoding"]; encoding != nil {
 				newMeta["encoding"] = encoding
-				newMeta["encoded_length"] = len(attachment)
+				newMeta["encoded_length"] = length
 				if length, ok := meta["length"].(float64); ok {
 					newMeta["length"] = length
 				}
 			} else {
-				newMeta["length"] = len(attachment)
+				newMeta["length"] = length
 			}
 			atts[name] = newMeta
 
@@ -180,14 +193,79 @@ func (db *Database) loadBodyAttachments(body Body, minRevpos int, docid string)
 
 // Retrieves an attachment given its key.
 func (db *Database) GetAttachment(key AttachmentKey) ([]byte, error) {
-	v, _, err := db.Bucket.GetRaw(attachmentKeyToString(key))
-	return v, err
+	return db.Options.AttachmentStore.GetAttachment(key)
+}
+
+// OpenAttachment returns a reader that streams an attachment given its key.  The caller must close the reader.
+func (db *Database) OpenAttachment(key AttachmentKey) (AttachmentReader, error) {
+	return db.Options.AttachmentStore.OpenAttachment(key)
+}
+
+// StreamAttachment stores the attachment read from r without holding it in memory.  The result can be used as the
+// "data" property of the attachment's metadata in a document body passed to Put.
+func (db *Database) StreamAttachment(r io.Reader) (*StoredAttachment, error) {
+	key, length, _, err := db.Options.AttachmentStore.WriteAttachment(r)
+	if err != nil {
+		return nil, err
+	}
+	base.InfofCtx(db.Ctx, base.KeyCRUD, "\tAdded attachment %q", base.UD(key))
+	db.DbStats.CblReplicationPush().Add(base.StatKeyAttachmentPushCount, 1)
+	db.DbStats.CblReplicationPush().Add(base.StatKeyAttachmentPushBytes, length)
+	return &StoredAttachment{Key: key, Length: length}, nil
+}
+
+// CheckAttachmentPut checks, before an attachment is streamed to the attachment store, that the current user could
+// save body as the new revision of the document the attachment is being added to: that its _rev matches the
+// document as Put requires, and that the sync function accepts it.  This can't be exact, as the attachment isn't
+// known yet, but it stops writes that could never succeed from filling the attachment store.
+func (db *Database) CheckAttachmentPut(docid string, body Body) error {
+	matchRev, _ := body[BodyRev].(string)
+	doc, err := db.GetDocument(docid, DocUnmarshalAll)
+	if err != nil && !base.IsDocNotFoundError(err) {
+		return err
+	}
+	if matchRev == "" {
+		if doc != nil && doc.CurrentRev != "" && !doc.History[doc.CurrentRev].Deleted {
+			return base.HTTPErrorf(http.StatusConflict, "Document exists")
+		}
+	} else if doc == nil || !doc.History.isLeaf(matchRev) || db.IsIllegalConflict(doc, matchRev, false, false) {
+		return base.HTTPErrorf(http.StatusConflict, "Document revision conflict")
+	}
+
+	if db.user == nil {
+		// Admin writes can't be rejected for lack of access
+		return nil
+	}
+	var oldDoc Body
+	if doc != nil && matchRev != "" {
+		oldJSON, err := db.getRevisionBodyJSON(doc, matchRev)
+		if err != nil && !base.IsDocNotFoundError(err) {
+			return err
+		}
+		if oldJSON != nil {
+			if err := oldDoc.Unmarshal(oldJSON); err != nil {
+				return err
+			}
+		}
+	}
+	newDoc := body.ShallowCopy()
+	delete(newDoc, BodyAttachments)
+	newDoc[BodyId] = docid
+	result, err := db.SyncFnDryRun(newDoc, oldDoc, MakeUserCtx(db.user), "")
+	if err != nil {
+		return err
+	} else if result.Rejection != nil {
+		return base.HTTPErrorf(result.Rejection.Status, "%s", result.Rejection.Reason)
+	} else if result.Exception != "" {
+		return base.HTTPErrorf(http.StatusInternalServerError, "Exception in JS sync function")
+	}
+	return nil
 }
 
 // Stores a base64-encoded attachment and returns the key to get it by.
 func (db *Database) setAttachment(attachment []byte) (AttachmentKey, error) {
 	key := AttachmentKey(Sha1DigestKey(attachment))
-	_, err := db.Bucket.AddRaw(attachmentKeyToString(key), 0, attachment)
+	_, err := db.Options.AttachmentStore.AddAttachment(key, attachment)
 	if err == nil {
 		base.InfofCtx(db.Ctx, base.KeyCRUD, "\tAdded attachment %q", base.UD(key))
 	}
@@ -198,7 +276,7 @@ func (db *Database) setAttachments(attachments AttachmentData) error {
 
 	for key, data := range attachments {
 		attachmentSize := int64(len(data))
-		_, err := db.Bucket.AddRaw(attachmentKeyToString(key), 0, data)
+		_, err := db.Options.AttachmentStore.AddAttachment(key, data)
 		if err == nil {
 			base.InfofCtx(db.Ctx, base.KeyCRUD, "\tAdded attachment %q", base.UD(key))
 			db.DbStats.CblReplicationPush().Add(base.StatKeyAttachmentPushCount, 1)
@@ -355,7 +433,11 @@ func (db *Database) WriteRevisionAsPart(revBody Body, isError bool, compressPart
 	}
 }
 
-func ReadMultipartDocument(reader *multipart.Reader) (Body, error) {
+// ReadMultipartDocument reads a document body followed by MIME parts for its attachments.  Attachment parts are
+// streamed to the attachment store as they're read, rather than being held in memory.  Attachments streamed for a
+// document that then fails to be read or written are left to attachment garbage collection, as other documents may
+// reference the same content.
+func (db *Database) ReadMultipartDocument(reader *multipart.Reader) (Body, error) {
 	// First read the main JSON document body:
 	mainPart, err := reader.NextPart()
 	if err != nil {
@@ -401,17 +483,18 @@ func ReadMultipartDocument(reader *multipart.Reader) (Body, error) {
 			}
 			return nil, err
 		}
-		data, err := ioutil.ReadAll(part)
+		md5Digester := md5.New()
+		stored, err := db.StreamAttachment(io.TeeReader(part, md5Digester))
 		part.Close()
 		if err != nil {
 			return nil, err
 		}
 
 		// Look up the attachment by its digest:
-		digest := Sha1DigestKey(data)
+		digest := string(stored.Key)
 		name, meta := findFollowingAttachment(digest)
 		if meta == nil {
-			name, meta = findFollowingAttachment(Md5DigestKey(data))
+			name, meta = findFollowingAttachment("md5-" + base64.StdEncoding.EncodeToString(md5Digester.Sum(nil)))
 			if meta == nil {
 				return nil, base.HTTPErrorf(http.StatusBadRequest,
 					"MIME part #%d doesn't match any attachment", i+2)
@@ -423,14 +506,14 @@ func ReadMultipartDocument(reader *multipart.Reader) (Body, error) {
 			length, ok = base.ToInt64(meta["length"])
 		}
 		if ok {
-			if length != int64(len(data)) {
-				return nil, base.HTTPErrorf(http.StatusBadRequest, "Attachment length mismatch for %q: read %d bytes, should be %d", name, len(data), length)
+			if length != stored.Length {
+				return nil, base.HTTPErrorf(http.StatusBadRequest, "Attachment length mismatch for %q: read %d bytes, should be %d", name, stored.Length, length)
 			}
 		}
 
-		// Stuff the data into the attachment metadata and remove the "follows" property:
+		// Stuff the stored attachment into the metadata and remove the "follows" property:
 		delete(meta, "follows")
-		meta["data"] = data
+		meta["data"] = stored
 		meta["digest"] = digest
 	}
 
@@ -0,0 +1,536 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Attachment garbage collection states, as reported in AttachmentGCStatus.State
+const (
+	AttachmentGCStateRunning   = "running"
+	AttachmentGCStateCompleted = "completed"
+	AttachmentGCStateFailed    = "failed"
+)
+
+// Attachment garbage collection phases, as reported in AttachmentGCStatus.Phase
+const (
+	AttachmentGCPhaseMark  = "mark"
+	AttachmentGCPhaseSweep = "sweep"
+)
+
+// Unreferenced attachments stored more recently than this aren't deleted by default, as the document referencing an
+// attachment is saved after the attachment itself.
+const DefaultAttachmentGCGracePeriod = 24 * time.Hour
+
+// Number of documents marked, or stored attachments swept, between checkpoints.
+var AttachmentGCBatchSize = 1000
+
+// Options for an attachment garbage collection run.
+type AttachmentGCOptions struct {
+	DryRun      bool          // Report the unreferenced attachments without deleting them
+	GracePeriod time.Duration // Unreferenced attachments stored more recently than this are kept
+	Restart     bool          // Start a new run rather than resuming an interrupted one
+}
+
+// Progress of an attachment garbage collection run.  Also stored as the run's checkpoint, so that an interrupted run
+// can be resumed, along with the lease of the node running it.
+type AttachmentGCStatus struct {
+	BackgroundJobLease
+	State              string     `json:"state"`
+	Phase              string     `json:"phase"`
+	DryRun             bool       `json:"dry_run"`
+	GracePeriodSeconds int64      `json:"grace_period_seconds"`
+	StartTime          time.Time  `json:"start_time"`
+	EndTime            *time.Time `json:"end_time,omitempty"`
+	Error              string     `json:"error,omitempty"`
+
+	DocsMarked    int `json:"docs_marked"`                 // Documents whose attachments have been marked
+	Referenced    int `json:"attachments_referenced"`      // Distinct attachments referenced by documents
+	Swept         int `json:"attachments_swept"`           // Stored attachments checked by the sweep
+	Deleted       int `json:"attachments_deleted"`         // Unreferenced attachments deleted, or that would be in a dry run
+	InGracePeriod int `json:"attachments_in_grace_period"` // Unreferenced attachments kept as they're within the grace period
+	Undated       int `json:"attachments_undated"`         // Unreferenced attachments kept as when they were stored isn't known
+
+	LastDocID      string   `json:"last_doc_id,omitempty"`     // Last document marked
+	LastAttachment string   `json:"last_attachment,omitempty"` // Position of the last stored attachment swept (see storedAttachment)
+	MarkDocs       []string `json:"mark_docs,omitempty"`       // IDs of the _sync:attgc:mark: docs holding the marked digests
+}
+
+// The time before which unreferenced attachments may be deleted.
+func (status *AttachmentGCStatus) cutoff() time.Time {
+	return status.StartTime.Add(-time.Duration(status.GracePeriodSeconds) * time.Second)
+}
+
+func (status *AttachmentGCStatus) isComplete() bool {
+	return status.State == AttachmentGCStateCompleted
+}
+
+// StartAttachmentGC starts an attachment garbage collection run in the background, and returns its initial status.
+// An interrupted run with the same dry run setting is resumed from its checkpoint, unless options.Restart is set.
+func (db *Database) StartAttachmentGC(options AttachmentGCOptions) (*AttachmentGCStatus, error) {
+	status, err := db.beginAttachmentGC(options)
+	if err != nil {
+		return nil, err
+	}
+	gcDb := &Database{DatabaseContext: db.DatabaseContext, Ctx: db.Ctx}
+	go func() {
+		_ = gcDb.runAttachmentGC(status)
+	}()
+	return db.AttachmentGCStatus()
+}
+
+// AttachmentGC runs attachment garbage collection to completion, returning the final status.
+func (db *Database) AttachmentGC(options AttachmentGCOptions) (*AttachmentGCStatus, error) {
+	status, err := db.beginAttachmentGC(options)
+	if err != nil {
+		return nil, err
+	}
+	err = db.runAttachmentGC(status)
+	finalStatus := *status
+	return &finalStatus, err
+}
+
+// AttachmentGCStatus returns the status of the run in progress on this node, otherwise that of the most recent run
+// (which may be running on another node) as recorded in its checkpoint.  Returns a 404 error if attachment garbage
+// collection has never been run.
+func (context *DatabaseContext) AttachmentGCStatus() (*AttachmentGCStatus, error) {
+	context.attachmentGCLock.Lock()
+	if context.attachmentGCStatus != nil {
+		status := *context.attachmentGCStatus
+		context.attachmentGCLock.Unlock()
+		return &status, nil
+	}
+	context.attachmentGCLock.Unlock()
+
+	status, _, err := context.getAttachmentGCCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+	if status.State == AttachmentGCStateRunning && !status.heldByOther(context.nodeID) {
+		// Nothing is running here or on another node, so the run was interrupted - e.g. by a restart
+		status.State = AttachmentGCStateFailed
+		status.Error = "Interrupted"
+	}
+	return status, nil
+}
+
+// Claims the database's attachment garbage collection, by taking the lease in its checkpoint, and returns the status
+// of the run to be made.
+func (db *Database) beginAttachmentGC(options AttachmentGCOptions) (*AttachmentGCStatus, error) {
+	db.attachmentGCLock.Lock()
+	defer db.attachmentGCLock.Unlock()
+	if db.attachmentGCStatus != nil {
+		return nil, base.HTTPErrorf(http.StatusServiceUnavailable, "Attachment garbage collection already running")
+	}
+
+	checkpoint, cas, err := db.getAttachmentGCCheckpoint()
+	if err != nil && !base.IsDocNotFoundError(err) {
+		return nil, err
+	}
+	if checkpoint != nil && checkpoint.State == AttachmentGCStateRunning && checkpoint.heldByOther(db.nodeID) {
+		return nil, base.HTTPErrorf(http.StatusServiceUnavailable, "Attachment garbage collection already running on another node")
+	}
+
+	var status *AttachmentGCStatus
+	resume := checkpoint != nil && !checkpoint.isComplete() && checkpoint.DryRun == options.DryRun && !options.Restart
+	if resume {
+		base.InfofCtx(db.Ctx, base.KeyAll, "Resuming attachment garbage collection for %s from %s phase", base.MD(db.Name), checkpoint.Phase)
+		status = checkpoint
+		status.Error = ""
+	} else {
+		status = &AttachmentGCStatus{
+			Phase:              AttachmentGCPhaseMark,
+			DryRun:             options.DryRun,
+			GracePeriodSeconds: int64(options.GracePeriod / time.Second),
+			StartTime:          time.Now().UTC(),
+		}
+	}
+	status.State = AttachmentGCStateRunning
+	status.EndTime = nil
+	status.renew(db.nodeID)
+	saver, err := claimBackgroundJob(db.Bucket, base.AttGCCheckpointKey, cas, status)
+	if err != nil {
+		return nil, err
+	}
+	if checkpoint != nil && !resume {
+		db.deleteAttachmentGCMarks(checkpoint.MarkDocs)
+	}
+	db.attachmentGCStatus = status
+	db.attachmentGCSaver = saver
+	return status, nil
+}
+
+// Runs both phases of garbage collection, from the given status.  The status is updated as the run progresses, and
+// checkpointed after each batch.
+func (db *Database) runAttachmentGC(status *AttachmentGCStatus) error {
+	err := db.markAndSweepAttachments(status)
+
+	db.attachmentGCLock.Lock()
+	defer db.attachmentGCLock.Unlock()
+	switch err {
+	case errAttachmentGCTerminated:
+		// Leave the checkpoint as running, to be resumed by the next run
+		base.InfofCtx(db.Ctx, base.KeyAll, "Attachment garbage collection for %s stopped as the database is closing", base.MD(db.Name))
+		db.attachmentGCStatus, db.attachmentGCSaver = nil, nil
+		return err
+	case errBackgroundJobLeaseLost:
+		// The checkpoint and its mark docs now belong to the node that took over the run
+		base.WarnfCtx(db.Ctx, base.KeyAll, "Attachment garbage collection for %s stopped as another node took it over", base.MD(db.Name))
+		db.attachmentGCStatus, db.attachmentGCSaver = nil, nil
+		return err
+	}
+	endTime := time.Now().UTC()
+	status.EndTime = &endTime
+	checkpoint := *status
+	if err != nil {
+		base.WarnfCtx(db.Ctx, base.KeyAll, "Attachment garbage collection for %s failed: %v", base.MD(db.Name), err)
+		status.State = AttachmentGCStateFailed
+		status.Error = err.Error()
+
+		// Progress since the last checkpoint may include marks that weren't saved, so only the outcome is recorded
+		if lastCheckpoint, _, getErr := db.getAttachmentGCCheckpoint(); getErr == nil {
+			checkpoint = *lastCheckpoint
+		}
+		checkpoint.State, checkpoint.Error, checkpoint.EndTime = status.State, status.Error, status.EndTime
+	} else {
+		base.InfofCtx(db.Ctx, base.KeyAll, "Finished attachment garbage collection for %s: %d referenced, %d swept, %d deleted, %d within grace period (dry run: %t)",
+			base.MD(db.Name), status.Referenced, status.Swept, status.Deleted, status.InGracePeriod, status.DryRun)
+		status.State = AttachmentGCStateCompleted
+		checkpoint = *status
+		checkpoint.MarkDocs = nil
+	}
+	if checkpointErr := db.attachmentGCSaver.save(checkpoint); checkpointErr != nil {
+		base.WarnfCtx(db.Ctx, base.KeyAll, "Unable to save attachment garbage collection checkpoint for %s: %v", base.MD(db.Name), checkpointErr)
+	} else if err == nil {
+		// Mark docs are only removed once the checkpoint no longer refers to them
+		db.deleteAttachmentGCMarks(status.MarkDocs)
+		status.MarkDocs = nil
+	}
+	db.attachmentGCStatus, db.attachmentGCSaver = nil, nil
+	return err
+}
+
+var errAttachmentGCTerminated = base.HTTPErrorf(http.StatusServiceUnavailable, "Database is closing")
+
+func (db *Database) markAndSweepAttachments(status *AttachmentGCStatus) error {
+	base.InfofCtx(db.Ctx, base.KeyAll, "Starting attachment garbage collection for %s (dry run: %t)", base.MD(db.Name), status.DryRun)
+
+	marked, err := db.loadAttachmentGCMarks(status.MarkDocs)
+	if err != nil {
+		return err
+	}
+	if status.Phase == AttachmentGCPhaseMark {
+		if err := db.markAttachments(status, marked); err != nil {
+			return err
+		}
+	}
+	return db.sweepAttachments(status, marked)
+}
+
+// Mark phase: records the digests of every attachment referenced by a document.  Documents are processed in ID
+// order, a page at a time, with the digests newly found saved to a mark doc at each checkpoint, so that the phase can
+// resume after the last document checkpointed.
+func (db *Database) markAttachments(status *AttachmentGCStatus, marked map[AttachmentKey]struct{}) error {
+	var batch []AttachmentKey
+	for {
+		docIDs, err := db.docIDsAfter(status.LastDocID, AttachmentGCBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(docIDs) == 0 {
+			break
+		}
+
+		for _, docID := range docIDs {
+			doc, err := db.GetDocument(docID, DocUnmarshalAll)
+			if err != nil && !base.IsDocNotFoundError(err) {
+				return err
+			}
+			if doc != nil {
+				for _, digest := range db.docAttachmentDigests(doc) {
+					key := AttachmentKey(digest)
+					if _, ok := marked[key]; !ok {
+						marked[key] = struct{}{}
+						batch = append(batch, key)
+					}
+				}
+			}
+
+			db.updateAttachmentGCStatus(func() {
+				status.DocsMarked++
+				status.Referenced = len(marked)
+				status.LastDocID = docID
+			})
+			if db.attachmentGCSaver.heartbeatDue() {
+				if err := db.checkpointAttachmentGCMarks(status, batch); err != nil {
+					return err
+				}
+				batch = nil
+			}
+		}
+		if err := db.checkpointAttachmentGCMarks(status, batch); err != nil {
+			return err
+		}
+		batch = nil
+	}
+
+	db.updateAttachmentGCStatus(func() {
+		status.Phase = AttachmentGCPhaseSweep
+	})
+	return db.setAttachmentGCCheckpoint(status)
+}
+
+// Sweep phase: deletes stored attachments that weren't marked, and were stored before the grace period.  Attachments
+// are processed a page at a time in the order of their positions, so that the phase can resume after the last
+// attachment checkpointed.
+func (db *Database) sweepAttachments(status *AttachmentGCStatus, marked map[AttachmentKey]struct{}) error {
+	cutoff := status.cutoff()
+	store := db.Options.AttachmentStore
+
+	for {
+		stored, err := db.listStoredAttachments(status.LastAttachment, AttachmentGCBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(stored) == 0 {
+			return nil
+		}
+
+		for _, attachment := range stored {
+			var missing, deleted, inGracePeriod, undated bool
+			if _, ok := marked[attachment.key]; !ok {
+				modified, err := db.storedAttachmentModified(attachment)
+				if base.IsDocNotFoundError(err) {
+					missing = true
+				} else if err != nil {
+					return err
+				}
+				switch {
+				case missing:
+				case modified.IsZero() && status.GracePeriodSeconds > 0:
+					// Without knowing when it was stored, the attachment may belong to a document that's yet to be saved
+					undated = true
+				case modified.After(cutoff):
+					inGracePeriod = true
+				case status.DryRun:
+					base.DebugfCtx(db.Ctx, base.KeyAll, "Attachment garbage collection dry run would delete %q", base.UD(attachment.key))
+					deleted = true
+				default:
+					err := store.DeleteAttachment(attachment.key)
+					if err != nil && !base.IsDocNotFoundError(err) {
+						return err
+					}
+					deleted = err == nil
+				}
+			}
+
+			db.updateAttachmentGCStatus(func() {
+				status.LastAttachment = attachment.position
+				if !missing {
+					status.Swept++
+				}
+				if deleted {
+					status.Deleted++
+				}
+				if inGracePeriod {
+					status.InGracePeriod++
+				}
+				if undated {
+					status.Undated++
+				}
+			})
+			if db.attachmentGCSaver.heartbeatDue() {
+				if err := db.checkpointAttachmentGC(status); err != nil {
+					return err
+				}
+			}
+		}
+		if err := db.checkpointAttachmentGC(status); err != nil {
+			return err
+		}
+	}
+}
+
+// Applies an update to the status of the run in progress, under the lock used by AttachmentGCStatus.
+func (db *Database) updateAttachmentGCStatus(update func()) {
+	db.attachmentGCLock.Lock()
+	update()
+	db.attachmentGCLock.Unlock()
+}
+
+// Saves the checkpoint, unless the database is closing.
+func (db *Database) checkpointAttachmentGC(status *AttachmentGCStatus) error {
+	select {
+	case <-db.terminator:
+		return errAttachmentGCTerminated
+	default:
+	}
+	return db.setAttachmentGCCheckpoint(status)
+}
+
+// Saves a batch of newly marked digests, then the checkpoint that refers to them.  The mark doc's ID includes this
+// node's ID, so that a node that has lost the lease can't overwrite the mark docs of the node that took over the run.
+// If the checkpoint can't be saved because the lease was lost, the new mark doc is removed again.
+func (db *Database) checkpointAttachmentGCMarks(status *AttachmentGCStatus, batch []AttachmentKey) error {
+	if len(batch) == 0 {
+		return db.checkpointAttachmentGC(status)
+	}
+	markKey := attachmentGCMarkKey(db.nodeID, len(status.MarkDocs))
+	if err := db.Bucket.Set(markKey, 0, batch); err != nil {
+		return err
+	}
+	db.updateAttachmentGCStatus(func() {
+		status.MarkDocs = append(status.MarkDocs, markKey)
+	})
+	err := db.checkpointAttachmentGC(status)
+	if err == errBackgroundJobLeaseLost {
+		db.deleteAttachmentGCMarks([]string{markKey})
+	}
+	return err
+}
+
+// Returns the checkpoint, along with its CAS.
+func (context *DatabaseContext) getAttachmentGCCheckpoint() (*AttachmentGCStatus, uint64, error) {
+	var status AttachmentGCStatus
+	cas, err := context.Bucket.Get(base.AttGCCheckpointKey, &status)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &status, cas, nil
+}
+
+// Saves the checkpoint, renewing this node's lease.
+func (db *Database) setAttachmentGCCheckpoint(status *AttachmentGCStatus) error {
+	db.attachmentGCLock.Lock()
+	status.renew(db.nodeID)
+	checkpoint := *status
+	db.attachmentGCLock.Unlock()
+	return db.attachmentGCSaver.save(checkpoint)
+}
+
+// Returns the ID of a mark doc written by the node with the given ID, as the index'th mark doc of the run.
+func attachmentGCMarkKey(nodeID string, index int) string {
+	return base.AttGCMarkPrefix + nodeID + ":" + strconv.Itoa(index)
+}
+
+// Loads the digests saved by the mark phase of an interrupted run.
+func (db *Database) loadAttachmentGCMarks(markDocs []string) (map[AttachmentKey]struct{}, error) {
+	marked := make(map[AttachmentKey]struct{})
+	for _, markKey := range markDocs {
+		var batch []AttachmentKey
+		if _, err := db.Bucket.Get(markKey, &batch); err != nil {
+			return nil, err
+		}
+		for _, key := range batch {
+			marked[key] = struct{}{}
+		}
+	}
+	return marked, nil
+}
+
+func (db *Database) deleteAttachmentGCMarks(markDocs []string) {
+	for _, markKey := range markDocs {
+		if err := db.Bucket.Delete(markKey); err != nil && !base.IsDocNotFoundError(err) {
+			base.WarnfCtx(db.Ctx, base.KeyAll, "Unable to delete attachment garbage collection mark doc %s: %v", markKey, err)
+		}
+	}
+}
+
+// Returns the IDs of up to limit documents after startAfter, in the order of the index used by QueryResync.  The
+// first page starts after the empty string.
+func (db *Database) docIDsAfter(startAfter string, limit int) ([]string, error) {
+	results, err := db.QueryResync(startAfter, limit)
+	if err != nil {
+		return nil, err
+	}
+	var docIDs []string
+	var row QueryIdRow
+	for results.Next(&row) {
+		if row.Id != startAfter {
+			docIDs = append(docIDs, row.Id)
+		}
+	}
+	if err := results.Close(); err != nil {
+		return nil, err
+	}
+	return docIDs, nil
+}
+
+// An attachment found in the attachment store by the sweep.
+type storedAttachment struct {
+	key      AttachmentKey
+	position string    // Orders the sweep: the attachment's doc ID for the bucket store, otherwise its attachmentStoreName
+	modified time.Time // When the attachment was stored, or zero if it must be looked up
+}
+
+// Lists up to limit attachments in the database's attachment store, after the position startAfter.
+func (db *Database) listStoredAttachments(startAfter string, limit int) ([]storedAttachment, error) {
+	var stored []storedAttachment
+	switch store := db.Options.AttachmentStore.(type) {
+	case *BucketAttachmentStore:
+		results, err := db.QueryAttachments(startAfter, limit)
+		if err != nil {
+			return nil, err
+		}
+		var row QueryIdRow
+		for results.Next(&row) {
+			if row.Id == startAfter {
+				continue
+			}
+			key := strings.TrimPrefix(strings.TrimPrefix(row.Id, base.AttManifestPrefix), base.AttPrefix)
+			stored = append(stored, storedAttachment{key: AttachmentKey(key), position: row.Id})
+		}
+		if err := results.Close(); err != nil {
+			return nil, err
+		}
+	case AttachmentLister:
+		err := store.ListAttachments(startAfter, limit, func(key AttachmentKey, modified time.Time) error {
+			stored = append(stored, storedAttachment{key: key, position: attachmentStoreName(key), modified: modified})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, base.HTTPErrorf(http.StatusNotImplemented, "Attachment store doesn't support garbage collection")
+	}
+	return stored, nil
+}
+
+// Returns when an attachment was stored, or the zero time if that isn't known.  The bucket store records this in the
+// manifest of a chunked attachment.  An attachment stored as a single document has no timestamp, so the document's
+// CAS is used when the bucket is a Couchbase Server bucket, which generates CAS values from a hybrid logical clock in
+// nanoseconds; other buckets, such as walrus, don't.
+func (db *Database) storedAttachmentModified(attachment storedAttachment) (time.Time, error) {
+	if !attachment.modified.IsZero() {
+		return attachment.modified, nil
+	}
+	if store, ok := db.Options.AttachmentStore.(*BucketAttachmentStore); ok && strings.HasPrefix(attachment.position, base.AttManifestPrefix) {
+		manifest, err := store.getManifest(attachment.key)
+		if err != nil || manifest.Stored == nil {
+			return time.Time{}, err
+		}
+		return *manifest.Stored, nil
+	}
+	_, cas, err := db.Bucket.GetRaw(attachment.position)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if _, ok := base.AsGoCBBucket(db.Bucket); !ok {
+		return time.Time{}, nil
+	}
+	return time.Unix(0, int64(cas)), nil
+}
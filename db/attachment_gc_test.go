@@ -0,0 +1,232 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAttachmentGC(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	_, err := db.AttachmentGCStatus()
+	assert.True(t, base.IsDocNotFoundError(err))
+
+	_, _, err = db.Put("doc1", unjson(`{"_attachments": {"hello.txt": {"data":"aGVsbG8gd29ybGQ="}}}`))
+	require.NoError(t, err)
+	referencedKey := AttachmentKey("sha1-Kq5sNclPz7QV2+lfQIuc6R7oRu0=")
+
+	orphanData := []byte("orphaned")
+	orphanKey := AttachmentKey(Sha1DigestKey(orphanData))
+	_, err = db.Options.AttachmentStore.AddAttachment(orphanKey, orphanData)
+	require.NoError(t, err)
+
+	// A dry run reports the orphan without deleting it
+	status, err := db.AttachmentGC(AttachmentGCOptions{DryRun: true})
+	require.NoError(t, err)
+	assert.Equal(t, AttachmentGCStateCompleted, status.State)
+	assert.Equal(t, 1, status.DocsMarked)
+	assert.Equal(t, 1, status.Referenced)
+	assert.Equal(t, 2, status.Swept)
+	assert.Equal(t, 1, status.Deleted)
+	_, err = db.GetAttachment(orphanKey)
+	assert.NoError(t, err)
+
+	status, err = db.AttachmentGC(AttachmentGCOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, AttachmentGCStateCompleted, status.State)
+	assert.False(t, status.DryRun)
+	assert.Equal(t, 1, status.Deleted)
+	_, err = db.GetAttachment(orphanKey)
+	assert.True(t, base.IsDocNotFoundError(err))
+	_, err = db.GetAttachment(referencedKey)
+	assert.NoError(t, err)
+
+	// The outcome of the last run is available from the checkpoint
+	status, err = db.AttachmentGCStatus()
+	require.NoError(t, err)
+	assert.Equal(t, AttachmentGCStateCompleted, status.State)
+	assert.Equal(t, 1, status.Deleted)
+	assert.NotNil(t, status.EndTime)
+}
+
+func TestAttachmentGCGracePeriod(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	dir, err := ioutil.TempDir("", "attachments")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	db.Options.AttachmentStore, err = NewFileSystemAttachmentStore(dir)
+	require.NoError(t, err)
+
+	orphanData := []byte("orphaned")
+	orphanKey := AttachmentKey(Sha1DigestKey(orphanData))
+	_, err = db.Options.AttachmentStore.AddAttachment(orphanKey, orphanData)
+	require.NoError(t, err)
+
+	// A recently stored attachment is kept
+	status, err := db.AttachmentGC(AttachmentGCOptions{GracePeriod: time.Hour})
+	require.NoError(t, err)
+	assert.Equal(t, 0, status.Deleted)
+	assert.Equal(t, 1, status.InGracePeriod)
+
+	twoHoursAgo := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, attachmentStoreName(orphanKey)), twoHoursAgo, twoHoursAgo))
+	status, err = db.AttachmentGC(AttachmentGCOptions{GracePeriod: time.Hour})
+	require.NoError(t, err)
+	assert.Equal(t, 1, status.Deleted)
+	assert.Equal(t, 0, status.InGracePeriod)
+	_, err = db.GetAttachment(orphanKey)
+	assert.True(t, base.IsDocNotFoundError(err))
+}
+
+func TestAttachmentGCResume(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	markedData := []byte("marked")
+	markedKey := AttachmentKey(Sha1DigestKey(markedData))
+	orphanData := []byte("orphaned")
+	orphanKey := AttachmentKey(Sha1DigestKey(orphanData))
+	for key, data := range map[AttachmentKey][]byte{markedKey: markedData, orphanKey: orphanData} {
+		_, err := db.Options.AttachmentStore.AddAttachment(key, data)
+		require.NoError(t, err)
+	}
+
+	// Checkpoint of a run interrupted after its mark phase, which found the first attachment referenced
+	markKey := attachmentGCMarkKey("other-node", 0)
+	require.NoError(t, db.Bucket.Set(markKey, 0, []AttachmentKey{markedKey}))
+	require.NoError(t, db.Bucket.Set(base.AttGCCheckpointKey, 0, AttachmentGCStatus{
+		State:      AttachmentGCStateRunning,
+		Phase:      AttachmentGCPhaseSweep,
+		StartTime:  time.Now().UTC(),
+		DocsMarked: 5,
+		Referenced: 1,
+		MarkDocs:   []string{markKey},
+	}))
+
+	status, err := db.AttachmentGCStatus()
+	require.NoError(t, err)
+	assert.Equal(t, AttachmentGCStateFailed, status.State)
+
+	status, err = db.AttachmentGC(AttachmentGCOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, AttachmentGCStateCompleted, status.State)
+	assert.Equal(t, 5, status.DocsMarked)
+	assert.Equal(t, 1, status.Deleted)
+	_, err = db.GetAttachment(markedKey)
+	assert.NoError(t, err)
+	_, err = db.GetAttachment(orphanKey)
+	assert.True(t, base.IsDocNotFoundError(err))
+
+	// Mark docs are removed once the run completes
+	_, _, err = db.Bucket.GetRaw(markKey)
+	assert.True(t, base.IsDocNotFoundError(err))
+}
+
+func TestAttachmentGCMarksAfterLeaseLost(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	status, err := db.beginAttachmentGC(AttachmentGCOptions{})
+	require.NoError(t, err)
+	markedKey := AttachmentKey(Sha1DigestKey([]byte("marked")))
+	require.NoError(t, db.checkpointAttachmentGCMarks(status, []AttachmentKey{markedKey}))
+	require.Len(t, status.MarkDocs, 1)
+
+	// Another node takes over the run, and saves a mark doc of its own
+	takenOver := *status
+	takenOver.Owner = "other-node"
+	otherMarkKey := attachmentGCMarkKey("other-node", len(status.MarkDocs))
+	takenOver.MarkDocs = append(append([]string{}, status.MarkDocs...), otherMarkKey)
+	require.NoError(t, db.Bucket.Set(otherMarkKey, 0, []AttachmentKey{markedKey}))
+	require.NoError(t, db.Bucket.Set(base.AttGCCheckpointKey, 0, takenOver))
+
+	// This node's next batch doesn't overwrite it, and isn't left behind
+	orphanKey := AttachmentKey(Sha1DigestKey([]byte("orphaned")))
+	err = db.checkpointAttachmentGCMarks(status, []AttachmentKey{orphanKey})
+	assert.Equal(t, errBackgroundJobLeaseLost, err)
+	marked, err := db.loadAttachmentGCMarks(takenOver.MarkDocs)
+	require.NoError(t, err)
+	assert.Equal(t, map[AttachmentKey]struct{}{markedKey: {}}, marked)
+	_, _, err = db.Bucket.GetRaw(status.MarkDocs[len(status.MarkDocs)-1])
+	assert.True(t, base.IsDocNotFoundError(err))
+}
+
+func TestAttachmentStoreNameKey(t *testing.T) {
+	for _, key := range []AttachmentKey{"sha1-Kq5sNclPz7QV2+lfQIuc6R7oRu0=", "md5-a/b+c==", "sha1-abc"} {
+		restored, ok := attachmentStoreNameKey(attachmentStoreName(key))
+		assert.True(t, ok)
+		assert.Equal(t, key, restored)
+	}
+	_, ok := attachmentStoreNameKey(".tmp-12345")
+	assert.False(t, ok)
+}
+
+func TestAttachmentGCLease(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	defer func(batchSize int) { AttachmentGCBatchSize = batchSize }(AttachmentGCBatchSize)
+	AttachmentGCBatchSize = 1
+
+	for _, docID := range []string{"doc1", "doc2", "doc3"} {
+		_, _, err := db.Put(docID, unjson(`{"_attachments": {"hello.txt": {"data":"aGVsbG8gd29ybGQ="}}}`))
+		require.NoError(t, err)
+	}
+	for _, data := range []string{"orphan1", "orphan2"} {
+		_, err := db.Options.AttachmentStore.AddAttachment(AttachmentKey(Sha1DigestKey([]byte(data))), []byte(data))
+		require.NoError(t, err)
+	}
+
+	// A run checkpointed recently by another node is still running there
+	heartbeat := time.Now().UTC()
+	require.NoError(t, db.Bucket.Set(base.AttGCCheckpointKey, 0, AttachmentGCStatus{
+		BackgroundJobLease: BackgroundJobLease{Owner: "other-node", Heartbeat: &heartbeat},
+		State:              AttachmentGCStateRunning,
+		Phase:              AttachmentGCPhaseMark,
+		StartTime:          heartbeat,
+	}))
+	status, err := db.AttachmentGCStatus()
+	require.NoError(t, err)
+	assert.Equal(t, AttachmentGCStateRunning, status.State)
+	_, err = db.AttachmentGC(AttachmentGCOptions{})
+	assert.Error(t, err)
+
+	// Once its lease has expired, the run is taken over, a page at a time
+	heartbeat = heartbeat.Add(-2 * BackgroundJobLeaseExpiry)
+	require.NoError(t, db.Bucket.Set(base.AttGCCheckpointKey, 0, AttachmentGCStatus{
+		BackgroundJobLease: BackgroundJobLease{Owner: "other-node", Heartbeat: &heartbeat},
+		State:              AttachmentGCStateRunning,
+		Phase:              AttachmentGCPhaseMark,
+		StartTime:          heartbeat,
+	}))
+	status, err = db.AttachmentGC(AttachmentGCOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, AttachmentGCStateCompleted, status.State)
+	assert.Equal(t, 3, status.DocsMarked)
+	assert.Equal(t, 3, status.Swept)
+	assert.Equal(t, 2, status.Deleted)
+	assert.Equal(t, db.nodeID, status.Owner)
+
+	// The bucket store can't tell when a walrus attachment was stored, so keeps it during a grace period
+	_, err = db.Options.AttachmentStore.AddAttachment(AttachmentKey(Sha1DigestKey([]byte("orphan3"))), []byte("orphan3"))
+	require.NoError(t, err)
+	status, err = db.AttachmentGC(AttachmentGCOptions{GracePeriod: time.Hour})
+	require.NoError(t, err)
+	assert.Equal(t, 0, status.Deleted)
+	assert.Equal(t, 1, status.Undated)
+}
@@ -0,0 +1,730 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Attachment store types, as set in AttachmentStoreConfig.Type
+const (
+	AttachmentStoreTypeBucket     = "bucket"
+	AttachmentStoreTypeFileSystem = "filesystem"
+	AttachmentStoreTypeS3         = "s3"
+)
+
+// An AttachmentStore holds attachment bodies, keyed by digest.  As keys are derived from the attachment's
+// content, stored attachments are never modified.  Storing an attachment that already exists refreshes the time it
+// was stored, as used by attachment garbage collection, so that it's given a new grace period.
+type AttachmentStore interface {
+	// GetAttachment returns the attachment with the given key, or a 404 error if it doesn't exist.
+	GetAttachment(key AttachmentKey) ([]byte, error)
+
+	// OpenAttachment returns a reader that streams the attachment with the given key, or a 404 error if it
+	// doesn't exist.  The caller must close the reader.
+	OpenAttachment(key AttachmentKey) (AttachmentReader, error)
+
+	// AddAttachment stores an attachment, unless one with the same key already exists.  Returns whether it was added.
+	AddAttachment(key AttachmentKey, data []byte) (added bool, err error)
+
+	// WriteAttachment stores the attachment read from r without holding it in memory, keyed by the SHA-1 digest
+	// computed as it's read.  Returns whether it was added, rather than already existing.
+	WriteAttachment(r io.Reader) (key AttachmentKey, length int64, added bool, err error)
+
+	// DeleteAttachment removes the attachment with the given key, returning a 404 error if it doesn't exist.
+	DeleteAttachment(key AttachmentKey) error
+}
+
+// An AttachmentReader streams an attachment's data.  Seek can be used to read from an offset, e.g. for a Range
+// request.
+type AttachmentReader interface {
+	io.ReadSeeker
+	io.Closer
+	Size() int64 // Total length of the attachment
+}
+
+// An AttachmentLister is an AttachmentStore that can enumerate the attachments it holds, for attachment garbage
+// collection.  The bucket store doesn't implement this, as its attachments are found with QueryAttachments.
+type AttachmentLister interface {
+	// ListAttachments invokes callback for up to limit stored attachments (all of them if limit is zero) whose
+	// attachmentStoreName sorts after startAfter, in that order, with the time each was stored.
+	ListAttachments(startAfter string, limit int, callback func(key AttachmentKey, modified time.Time) error) error
+}
+
+// Configuration for a database's attachment store.
+type AttachmentStoreConfig struct {
+	Type string                   `json:"type,omitempty"` // "bucket" (default), "filesystem" or "s3"
+	Path string                   `json:"path,omitempty"` // Directory holding attachments, for the filesystem store
+	S3   *S3AttachmentStoreConfig `json:"s3,omitempty"`   // Object store settings, for the s3 store
+}
+
+// NewAttachmentStore creates the attachment store described by config.  A nil config selects the bucket store.
+func NewAttachmentStore(config *AttachmentStoreConfig, bucket base.Bucket) (AttachmentStore, error) {
+	if config == nil {
+		return NewBucketAttachmentStore(bucket), nil
+	}
+	switch config.Type {
+	case "", AttachmentStoreTypeBucket:
+		return NewBucketAttachmentStore(bucket), nil
+	case AttachmentStoreTypeFileSystem:
+		return NewFileSystemAttachmentStore(config.Path)
+	case AttachmentStoreTypeS3:
+		if config.S3 == nil {
+			return nil, fmt.Errorf("attachment_store.s3 must be set for attachment store type %q", config.Type)
+		}
+		return NewS3AttachmentStore(*config.S3)
+	default:
+		return nil, fmt.Errorf("Unknown attachment store type %q; must be one of %q, %q or %q", config.Type,
+			AttachmentStoreTypeBucket, AttachmentStoreTypeFileSystem, AttachmentStoreTypeS3)
+	}
+}
+
+// Maps the characters of a base64 digest that aren't safe in file names or URL paths.
+var attachmentNameReplacer = strings.NewReplacer("/", "_", "+", "-", "=", ".")
+
+// Reverses attachmentNameReplacer
+var attachmentNameRestorer = strings.NewReplacer("_", "/", "-", "+", ".", "=")
+
+// Returns a name for the attachment that's safe to use as a file name or object key.
+func attachmentStoreName(key AttachmentKey) string {
+	return attachmentNameReplacer.Replace(string(key))
+}
+
+// Returns the attachment key for a name returned by attachmentStoreName, or false if it isn't one.  Only the digest
+// following the algorithm prefix (e.g. "sha1-") was escaped.
+func attachmentStoreNameKey(name string) (AttachmentKey, bool) {
+	separator := strings.Index(name, "-")
+	if separator <= 0 || !(strings.HasPrefix(name, "sha1-") || strings.HasPrefix(name, "md5-")) {
+		return "", false
+	}
+	return AttachmentKey(name[:separator+1] + attachmentNameRestorer.Replace(name[separator+1:])), true
+}
+
+// Returns the attachment key for a SHA-1 digester that has been fed the attachment's data.
+func sha1DigesterKey(digester hash.Hash) AttachmentKey {
+	return AttachmentKey("sha1-" + base64.StdEncoding.EncodeToString(digester.Sum(nil)))
+}
+
+// Returns the new offset for a Seek on a reader of the given size.
+func seekOffset(current, size, offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += current
+	case io.SeekEnd:
+		offset += size
+	default:
+		return current, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return current, errors.New("negative position")
+	}
+	return offset, nil
+}
+
+// An AttachmentReader over an attachment held in memory.
+type bytesAttachmentReader struct {
+	*bytes.Reader
+}
+
+func (r bytesAttachmentReader) Close() error {
+	return nil
+}
+
+//////// BUCKET STORE
+
+// Attachments larger than this are stored by the bucket store as a series of chunk documents, to stay within the
+// bucket's value size limit and to allow streaming without loading the whole attachment.
+var BucketAttachmentChunkSize = 1024 * 1024
+
+// Describes an attachment stored as chunks.  Stored under the attachment's _sync:attm: key.
+type bucketAttachmentManifest struct {
+	ID        string     `json:"id"`               // Identifies the chunk documents
+	Length    int64      `json:"length"`           // Total length of the attachment
+	ChunkSize int64      `json:"chunk_size"`       // Length of every chunk but the last
+	Chunks    int        `json:"chunks"`           // Number of chunks
+	Stored    *time.Time `json:"stored,omitempty"` // When the attachment was stored, for attachment garbage collection
+}
+
+func (manifest *bucketAttachmentManifest) chunkKey(index int) string {
+	return base.AttChunkPrefix + manifest.ID + ":" + strconv.Itoa(index)
+}
+
+// BucketAttachmentStore stores attachments in the data bucket, as _sync:att: documents.  Large attachments are
+// split across _sync:attc: chunk documents listed by a _sync:attm: manifest.
+type BucketAttachmentStore struct {
+	bucket base.Bucket
+}
+
+func NewBucketAttachmentStore(bucket base.Bucket) *BucketAttachmentStore {
+	return &BucketAttachmentStore{bucket: bucket}
+}
+
+func (s *BucketAttachmentStore) GetAttachment(key AttachmentKey) ([]byte, error) {
+	v, _, err := s.bucket.GetRaw(attachmentKeyToString(key))
+	if !base.IsDocNotFoundError(err) {
+		return v, err
+	}
+	reader, err := s.openChunks(key)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = reader.Close() }()
+	return ioutil.ReadAll(reader)
+}
+
+func (s *BucketAttachmentStore) OpenAttachment(key AttachmentKey) (AttachmentReader, error) {
+	v, _, err := s.bucket.GetRaw(attachmentKeyToString(key))
+	if err == nil {
+		return bytesAttachmentReader{bytes.NewReader(v)}, nil
+	} else if !base.IsDocNotFoundError(err) {
+		return nil, err
+	}
+	return s.openChunks(key)
+}
+
+func (s *BucketAttachmentStore) AddAttachment(key AttachmentKey, data []byte) (added bool, err error) {
+	if len(data) <= BucketAttachmentChunkSize {
+		return s.addSingleDoc(key, data)
+	}
+	if found, err := s.touchManifest(key); err != nil || found {
+		return false, err
+	}
+	manifest, err := s.writeChunks(bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	return s.addManifest(key, manifest)
+}
+
+func (s *BucketAttachmentStore) WriteAttachment(r io.Reader) (key AttachmentKey, length int64, added bool, err error) {
+	digester := sha1.New()
+	r = io.TeeReader(r, digester)
+
+	// Attachments that fit in a single chunk are stored as a single document, as they always have been
+	first, err := readAttachmentChunk(r, BucketAttachmentChunkSize)
+	if err != nil {
+		return "", 0, false, err
+	}
+	second, err := readAttachmentChunk(r, BucketAttachmentChunkSize)
+	if err != nil {
+		return "", 0, false, err
+	}
+	if len(second) == 0 {
+		key = sha1DigesterKey(digester)
+		added, err = s.addSingleDoc(key, first)
+		return key, int64(len(first)), added, err
+	}
+
+	manifest, err := s.writeChunks(io.MultiReader(bytes.NewReader(first), bytes.NewReader(second), r))
+	if err != nil {
+		return "", 0, false, err
+	}
+	key = sha1DigesterKey(digester)
+	added, err = s.addManifest(key, manifest)
+	return key, manifest.Length, added, err
+}
+
+func (s *BucketAttachmentStore) DeleteAttachment(key AttachmentKey) error {
+	err := s.bucket.Delete(attachmentKeyToString(key))
+	if !base.IsDocNotFoundError(err) {
+		return err
+	}
+	manifest, err := s.getManifest(key)
+	if err != nil {
+		return err
+	}
+	if err := s.bucket.Delete(base.AttManifestPrefix + string(key)); err != nil {
+		return err
+	}
+	s.deleteChunks(manifest)
+	return nil
+}
+
+// Writes the data read from r as a series of chunk documents, returning the manifest describing them.
+func (s *BucketAttachmentStore) writeChunks(r io.Reader) (*bucketAttachmentManifest, error) {
+	manifest := &bucketAttachmentManifest{ID: base.CreateUUID(), ChunkSize: int64(BucketAttachmentChunkSize)}
+	for {
+		chunk, err := readAttachmentChunk(r, BucketAttachmentChunkSize)
+		if err == nil && len(chunk) > 0 {
+			err = s.bucket.SetRaw(manifest.chunkKey(manifest.Chunks), 0, chunk)
+		}
+		if err != nil {
+			s.deleteChunks(manifest)
+			return nil, err
+		}
+		if len(chunk) == 0 {
+			return manifest, nil
+		}
+		manifest.Chunks++
+		manifest.Length += int64(len(chunk))
+	}
+}
+
+// Stores an attachment that fits in a single chunk as a single document.  If it already exists, it's rewritten, as
+// garbage collection uses the document's CAS as the time it was stored.
+func (s *BucketAttachmentStore) addSingleDoc(key AttachmentKey, data []byte) (added bool, err error) {
+	added, err = s.bucket.AddRaw(attachmentKeyToString(key), 0, data)
+	if err == nil && !added {
+		err = s.bucket.SetRaw(attachmentKeyToString(key), 0, data)
+	}
+	return added, err
+}
+
+// Stores the manifest for a chunked attachment.  If the attachment has already been stored by someone else, the
+// chunks described by the manifest are deleted, and the existing manifest's timestamp is refreshed instead.
+func (s *BucketAttachmentStore) addManifest(key AttachmentKey, manifest *bucketAttachmentManifest) (added bool, err error) {
+	stored := time.Now().UTC()
+	manifest.Stored = &stored
+	manifestBytes, err := base.JSONMarshal(manifest)
+	for err == nil && !added {
+		added, err = s.bucket.AddRaw(base.AttManifestPrefix+string(key), 0, manifestBytes)
+		if err == nil && !added {
+			var found bool
+			if found, err = s.touchManifest(key); found {
+				break
+			}
+		}
+	}
+	if !added {
+		s.deleteChunks(manifest)
+	}
+	return added, err
+}
+
+// Sets the time a chunked attachment was stored to now.  Returns false if the attachment has no manifest.
+func (s *BucketAttachmentStore) touchManifest(key AttachmentKey) (found bool, err error) {
+	manifestKey := base.AttManifestPrefix + string(key)
+	for {
+		manifestBytes, cas, err := s.bucket.GetRaw(manifestKey)
+		if base.IsDocNotFoundError(err) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		var manifest bucketAttachmentManifest
+		if err := base.JSONUnmarshal(manifestBytes, &manifest); err != nil {
+			return false, err
+		}
+		stored := time.Now().UTC()
+		manifest.Stored = &stored
+		_, err = s.bucket.WriteCas(manifestKey, 0, 0, cas, manifest, 0)
+		if base.IsDocNotFoundError(err) {
+			return false, nil
+		} else if !base.IsCasMismatch(err) {
+			return err == nil, err
+		}
+	}
+}
+
+func (s *BucketAttachmentStore) getManifest(key AttachmentKey) (*bucketAttachmentManifest, error) {
+	manifestBytes, _, err := s.bucket.GetRaw(base.AttManifestPrefix + string(key))
+	if err != nil {
+		return nil, err
+	}
+	var manifest bucketAttachmentManifest
+	if err := base.JSONUnmarshal(manifestBytes, &manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+func (s *BucketAttachmentStore) deleteChunks(manifest *bucketAttachmentManifest) {
+	for i := 0; i < manifest.Chunks; i++ {
+		if err := s.bucket.Delete(manifest.chunkKey(i)); err != nil && !base.IsDocNotFoundError(err) {
+			base.Warnf(base.KeyAll, "Unable to delete attachment chunk %s: %v", base.UD(manifest.chunkKey(i)), err)
+		}
+	}
+}
+
+func (s *BucketAttachmentStore) openChunks(key AttachmentKey) (AttachmentReader, error) {
+	manifest, err := s.getManifest(key)
+	if err != nil {
+		return nil, err
+	}
+	return &bucketChunkReader{bucket: s.bucket, manifest: manifest, chunkIndex: -1}, nil
+}
+
+// Reads up to size bytes from r, returning fewer only at the end of the data.
+func readAttachmentChunk(r io.Reader, size int) ([]byte, error) {
+	var chunk bytes.Buffer
+	_, err := io.CopyN(&chunk, r, int64(size))
+	if err == io.EOF {
+		err = nil
+	}
+	return chunk.Bytes(), err
+}
+
+// An AttachmentReader over a chunked attachment, which loads one chunk at a time.
+type bucketChunkReader struct {
+	bucket     base.Bucket
+	manifest   *bucketAttachmentManifest
+	offset     int64  // Current read position
+	chunk      []byte // The loaded chunk
+	chunkIndex int    // Index of the loaded chunk, or -1 if none is loaded
+}
+
+func (r *bucketChunkReader) Read(p []byte) (int, error) {
+	if r.offset >= r.manifest.Length {
+		return 0, io.EOF
+	}
+	index := int(r.offset / r.manifest.ChunkSize)
+	if index != r.chunkIndex {
+		chunk, _, err := r.bucket.GetRaw(r.manifest.chunkKey(index))
+		if err != nil {
+			return 0, err
+		}
+		r.chunk, r.chunkIndex = chunk, index
+	}
+	chunkOffset := r.offset - int64(index)*r.manifest.ChunkSize
+	if chunkOffset >= int64(len(r.chunk)) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, r.chunk[chunkOffset:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *bucketChunkReader) Seek(offset int64, whence int) (int64, error) {
+	var err error
+	r.offset, err = seekOffset(r.offset, r.manifest.Length, offset, whence)
+	return r.offset, err
+}
+
+func (r *bucketChunkReader) Close() error {
+	r.chunk = nil
+	return nil
+}
+
+func (r *bucketChunkReader) Size() int64 {
+	return r.manifest.Length
+}
+
+//////// FILESYSTEM STORE
+
+// FileSystemAttachmentStore stores each attachment as a file in a local directory.
+type FileSystemAttachmentStore struct {
+	path string
+}
+
+func NewFileSystemAttachmentStore(path string) (*FileSystemAttachmentStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("attachment_store.path must be set for attachment store type %q", AttachmentStoreTypeFileSystem)
+	}
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+	return &FileSystemAttachmentStore{path: path}, nil
+}
+
+func (s *FileSystemAttachmentStore) filePath(key AttachmentKey) string {
+	return filepath.Join(s.path, attachmentStoreName(key))
+}
+
+func (s *FileSystemAttachmentStore) GetAttachment(key AttachmentKey) ([]byte, error) {
+	data, err := ioutil.ReadFile(s.filePath(key))
+	if os.IsNotExist(err) {
+		return nil, base.HTTPErrorf(http.StatusNotFound, "missing")
+	}
+	return data, err
+}
+
+func (s *FileSystemAttachmentStore) OpenAttachment(key AttachmentKey) (AttachmentReader, error) {
+	file, err := os.Open(s.filePath(key))
+	if os.IsNotExist(err) {
+		return nil, base.HTTPErrorf(http.StatusNotFound, "missing")
+	} else if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return &fileAttachmentReader{File: file, size: info.Size()}, nil
+}
+
+func (s *FileSystemAttachmentStore) AddAttachment(key AttachmentKey, data []byte) (added bool, err error) {
+	if found, err := touchFile(s.filePath(key)); err != nil || found {
+		return false, err
+	}
+	tempPath, _, _, err := s.writeTempFile(bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	return s.commitTempFile(tempPath, key)
+}
+
+func (s *FileSystemAttachmentStore) WriteAttachment(r io.Reader) (key AttachmentKey, length int64, added bool, err error) {
+	tempPath, key, length, err := s.writeTempFile(r)
+	if err != nil {
+		return "", 0, false, err
+	}
+	added, err = s.commitTempFile(tempPath, key)
+	return key, length, added, err
+}
+
+// Lists the attachment files, using each file's modification time.  Temporary files are skipped.  Every file name in
+// the directory is read, but only the files listed are stat'ed.
+func (s *FileSystemAttachmentStore) ListAttachments(startAfter string, limit int, callback func(key AttachmentKey, modified time.Time) error) error {
+	dir, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	names, err := dir.Readdirnames(-1)
+	_ = dir.Close()
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	listed := 0
+	for _, name := range names[sort.SearchStrings(names, startAfter):] {
+		key, ok := attachmentStoreNameKey(name)
+		if !ok || name == startAfter {
+			continue
+		}
+		file, err := os.Stat(filepath.Join(s.path, name))
+		if os.IsNotExist(err) || (err == nil && file.IsDir()) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := callback(key, file.ModTime()); err != nil {
+			return err
+		}
+		if listed++; listed == limit {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *FileSystemAttachmentStore) DeleteAttachment(key AttachmentKey) error {
+	err := os.Remove(s.filePath(key))
+	if os.IsNotExist(err) {
+		return base.HTTPErrorf(http.StatusNotFound, "missing")
+	}
+	return err
+}
+
+// Writes the data read from r to a temporary file in the store's directory, so that a partially written attachment
+// is never visible.  Returns the file's path, and the attachment's key and length.
+func (s *FileSystemAttachmentStore) writeTempFile(r io.Reader) (tempPath string, key AttachmentKey, length int64, err error) {
+	tempFile, err := ioutil.TempFile(s.path, ".tmp-")
+	if err != nil {
+		return "", "", 0, err
+	}
+	digester := sha1.New()
+	length, err = io.Copy(io.MultiWriter(tempFile, digester), r)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tempFile.Name())
+		return "", "", 0, err
+	}
+	return tempFile.Name(), sha1DigesterKey(digester), length, nil
+}
+
+// Renames a temporary file written by writeTempFile into place, unless the attachment already exists.
+func (s *FileSystemAttachmentStore) commitTempFile(tempPath string, key AttachmentKey) (added bool, err error) {
+	filePath := s.filePath(key)
+	if found, err := touchFile(filePath); err != nil || found {
+		_ = os.Remove(tempPath)
+		return false, err
+	}
+	if err := os.Rename(tempPath, filePath); err != nil {
+		_ = os.Remove(tempPath)
+		return false, err
+	}
+	return true, nil
+}
+
+// Sets the modification time of an attachment file, which garbage collection uses as the time it was stored, to
+// now.  Returns false if the file doesn't exist.
+func touchFile(filePath string) (found bool, err error) {
+	now := time.Now()
+	err = os.Chtimes(filePath, now, now)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// An AttachmentReader over an attachment file.
+type fileAttachmentReader struct {
+	*os.File
+	size int64
+}
+
+func (r *fileAttachmentReader) Size() int64 {
+	return r.size
+}
+
+//////// MIGRATION
+
+// Result of a MigrateAttachments run.
+type AttachmentMigrationResult struct {
+	Migrated int `json:"migrated"` // Attachments copied to the database's attachment store
+	Missing  int `json:"missing"`  // Referenced attachments found in neither store
+	Deleted  int `json:"deleted"`  // Attachments removed from the source store
+}
+
+// MigrateAttachments copies every attachment referenced by a document from source into the database's attachment
+// store, and when deleteSource is set removes them from source once all have been copied.  Attachments that aren't
+// referenced by any document are left behind.  Intended to be run while the database is offline, after switching
+// the database's attachment store, with source set to the previous store.
+func (db *Database) MigrateAttachments(source AttachmentStore, deleteSource bool) (result AttachmentMigrationResult, err error) {
+
+	base.InfofCtx(db.Ctx, base.KeyAll, "Migrating attachments for database %s...", base.MD(db.Name))
+
+	destination := db.Options.AttachmentStore
+	var migratedKeys []AttachmentKey
+	err = db.forEachReferencedAttachment(func(key AttachmentKey) error {
+		err := copyAttachment(source, destination, key)
+		if base.IsDocNotFoundError(err) {
+			if reader, destErr := destination.OpenAttachment(key); destErr == nil {
+				_ = reader.Close()
+			} else {
+				base.WarnfCtx(db.Ctx, base.KeyAll, "Attachment %q is referenced by a document but missing from both attachment stores", base.UD(key))
+				result.Missing++
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+		migratedKeys = append(migratedKeys, key)
+		result.Migrated++
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+
+	if deleteSource {
+		for _, key := range migratedKeys {
+			if err := source.DeleteAttachment(key); err != nil && !base.IsDocNotFoundError(err) {
+				return result, err
+			}
+			result.Deleted++
+		}
+	}
+
+	base.InfofCtx(db.Ctx, base.KeyAll, "Finished migrating attachments for database %s: %d migrated, %d missing, %d deleted from source",
+		base.MD(db.Name), result.Migrated, result.Missing, result.Deleted)
+	return result, nil
+}
+
+// Copies an attachment between stores.  Attachments keyed by SHA-1 digest are streamed; legacy MD5-keyed
+// attachments are copied in memory, as WriteAttachment always keys by SHA-1.
+func copyAttachment(source, destination AttachmentStore, key AttachmentKey) error {
+	if !strings.HasPrefix(string(key), "sha1-") {
+		data, err := source.GetAttachment(key)
+		if err != nil {
+			return err
+		}
+		_, err = destination.AddAttachment(key, data)
+		return err
+	}
+
+	reader, err := source.OpenAttachment(key)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = reader.Close() }()
+	writtenKey, _, _, err := destination.WriteAttachment(reader)
+	if err == nil && writtenKey != key {
+		err = fmt.Errorf("Digest of attachment %q read from source attachment store doesn't match: %s", key, writtenKey)
+	}
+	return err
+}
+
+// forEachReferencedAttachment invokes callback once for each attachment referenced by the current, a non-winning leaf
+// or a retained revision of any document in the database.
+func (db *Database) forEachReferencedAttachment(callback func(key AttachmentKey) error) error {
+	results, err := db.QueryResync("", 0)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[AttachmentKey]struct{})
+	var row QueryIdRow
+	for results.Next(&row) {
+		doc, err := db.GetDocument(row.Id, DocUnmarshalAll)
+		if base.IsDocNotFoundError(err) {
+			continue
+		} else if err != nil {
+			_ = results.Close()
+			return err
+		}
+
+		for _, digest := range db.docAttachmentDigests(doc) {
+			key := AttachmentKey(digest)
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			if err := callback(key); err != nil {
+				_ = results.Close()
+				return err
+			}
+		}
+	}
+	return results.Close()
+}
+
+// Returns the digests of the attachments referenced by the document's current and non-winning leaf revisions, and by
+// the revision bodies retained for delta sync and in-flight replications.
+func (db *Database) docAttachmentDigests(doc *Document) []string {
+	digests := AttachmentDigests(doc.SyncData.Attachments)
+	doc.History.forEachLeaf(func(rev *RevInfo) {
+		if rev.ID != doc.CurrentRev {
+			body := doc.getNonWinningRevisionBody(rev.ID, db.RevisionBodyLoader)
+			digests = append(digests, AttachmentDigests(GetBodyAttachments(body))...)
+		}
+		digests = append(digests, db.retainedRevisionDigests(doc, rev.ID)...)
+	})
+	return digests
+}
+
+// Returns the digests of the attachments referenced by the retained bodies of a leaf revision's ancestors.  Older
+// bodies expire first, so ancestors are only followed as far as the first one without a retained body.
+func (db *Database) retainedRevisionDigests(doc *Document, leafRevID string) (digests []string) {
+	for revID := doc.History.getParent(leafRevID); revID != ""; revID = doc.History.getParent(revID) {
+		bodyJSON, err := db.getOldRevisionJSON(doc.ID, revID)
+		if err != nil {
+			break
+		}
+		var body Body
+		if err := body.Unmarshal(bodyJSON); err != nil {
+			base.WarnfCtx(db.Ctx, base.KeyAll, "Unable to parse retained body of doc %q rev %q: %v", base.UD(doc.ID), revID, err)
+			continue
+		}
+		digests = append(digests, AttachmentDigests(GetBodyAttachments(body))...)
+	}
+	return digests
+}
@@ -0,0 +1,413 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+const (
+	defaultS3Region  = "us-east-1"
+	s3RequestTimeout = 60 * time.Second
+	unsignedPayload  = "UNSIGNED-PAYLOAD" // Payload hash used when the body is streamed rather than signed
+)
+
+// Hex SHA-256 of an empty request body
+var emptyPayloadHash = sha256Hex(nil)
+
+// Configuration for an S3-compatible object store holding attachments.
+type S3AttachmentStoreConfig struct {
+	Endpoint        string `json:"endpoint"`                    // Base URL of the object store, e.g. https://s3.us-east-1.amazonaws.com
+	Region          string `json:"region,omitempty"`            // Region used to sign requests, defaults to us-east-1
+	Bucket          string `json:"bucket"`                      // Name of the bucket holding attachments
+	Prefix          string `json:"prefix,omitempty"`            // Optional prefix for attachment object keys
+	AccessKeyID     string `json:"access_key_id,omitempty"`     // Credentials; requests are unsigned when not set
+	SecretAccessKey string `json:"secret_access_key,omitempty"` // Credentials; requests are unsigned when not set
+}
+
+// S3AttachmentStore stores each attachment as an object in an S3-compatible object store, using path-style
+// requests signed with AWS Signature Version 4.
+type S3AttachmentStore struct {
+	config   S3AttachmentStoreConfig
+	endpoint *url.URL
+	client   *http.Client
+}
+
+func NewS3AttachmentStore(config S3AttachmentStoreConfig) (*S3AttachmentStore, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, fmt.Errorf("attachment_store.s3.endpoint and attachment_store.s3.bucket must be set")
+	}
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid attachment_store.s3.endpoint %q: %v", config.Endpoint, err)
+	}
+	if config.Region == "" {
+		config.Region = defaultS3Region
+	}
+	return &S3AttachmentStore{
+		config:   config,
+		endpoint: endpoint,
+		client: &http.Client{
+			// Only the wait for a response is limited, as reading the body of a large attachment may take a while
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, ResponseHeaderTimeout: s3RequestTimeout},
+		},
+	}, nil
+}
+
+func (s *S3AttachmentStore) GetAttachment(key AttachmentKey) ([]byte, error) {
+	response, err := s.do(http.MethodGet, key, nil, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = response.Body.Close() }()
+	if err := s3ResponseError(response); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(response.Body)
+}
+
+// Returns a reader that only issues a GET when first read, using a ranged GET after a Seek.
+func (s *S3AttachmentStore) OpenAttachment(key AttachmentKey) (AttachmentReader, error) {
+	response, err := s.do(http.MethodHead, key, nil, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	_ = response.Body.Close()
+	if err := s3ResponseError(response); err != nil {
+		return nil, err
+	}
+	return &s3AttachmentReader{store: s, key: key, size: response.ContentLength}, nil
+}
+
+// Object stores don't offer an atomic add, but as attachments are content-addressed an overwrite is harmless.  An
+// existing attachment is overwritten anyway, to refresh the last modified time used by garbage collection.
+func (s *S3AttachmentStore) AddAttachment(key AttachmentKey, data []byte) (added bool, err error) {
+	exists, err := s.exists(key)
+	if err != nil {
+		return false, err
+	}
+	return !exists, s.put(key, bytes.NewReader(data), int64(len(data)), sha256Hex(data))
+}
+
+// The object store needs to know the length up front, so the attachment is spooled to a temporary file while its
+// digest is computed, then uploaded from there.
+func (s *S3AttachmentStore) WriteAttachment(r io.Reader) (key AttachmentKey, length int64, added bool, err error) {
+	tempFile, err := ioutil.TempFile("", "sg-attachment-")
+	if err != nil {
+		return "", 0, false, err
+	}
+	defer func() {
+		_ = tempFile.Close()
+		_ = os.Remove(tempFile.Name())
+	}()
+
+	digester := sha1.New()
+	if length, err = io.Copy(io.MultiWriter(tempFile, digester), r); err != nil {
+		return "", 0, false, err
+	}
+	key = sha1DigesterKey(digester)
+
+	exists, err := s.exists(key)
+	if err != nil {
+		return "", 0, false, err
+	}
+	if _, err := tempFile.Seek(0, io.SeekStart); err != nil {
+		return "", 0, false, err
+	}
+	return key, length, !exists, s.put(key, tempFile, length, unsignedPayload)
+}
+
+// S3 doesn't report whether a deleted object existed, so this checks first to honour the interface.
+func (s *S3AttachmentStore) DeleteAttachment(key AttachmentKey) error {
+	if exists, err := s.exists(key); err != nil {
+		return err
+	} else if !exists {
+		return base.HTTPErrorf(http.StatusNotFound, "missing")
+	}
+
+	response, err := s.do(http.MethodDelete, key, nil, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = response.Body.Close() }()
+	return s3ResponseError(response)
+}
+
+// Response to an S3 ListObjectsV2 request
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// Lists the objects under the store's prefix, a page at a time, using each object's last modified time.
+func (s *S3AttachmentStore) ListAttachments(startAfter string, limit int, callback func(key AttachmentKey, modified time.Time) error) error {
+	continuationToken := ""
+	listed := 0
+	for {
+		result, err := s.listObjects(startAfter, limit-listed, continuationToken)
+		if err != nil {
+			return err
+		}
+		for _, object := range result.Contents {
+			key, ok := attachmentStoreNameKey(strings.TrimPrefix(object.Key, s.config.Prefix))
+			if !ok {
+				continue
+			}
+			if err := callback(key, object.LastModified); err != nil {
+				return err
+			}
+			if listed++; listed == limit {
+				return nil
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+// Requests a page of up to maxKeys objects (the server's default if zero or less) after the object named startAfter.
+func (s *S3AttachmentStore) listObjects(startAfter string, maxKeys int, continuationToken string) (*s3ListBucketResult, error) {
+	query := url.Values{"list-type": {"2"}}
+	if s.config.Prefix != "" {
+		query.Set("prefix", s.config.Prefix)
+	}
+	if startAfter != "" {
+		query.Set("start-after", s.config.Prefix+startAfter)
+	}
+	if maxKeys > 0 {
+		query.Set("max-keys", strconv.Itoa(maxKeys))
+	}
+	if continuationToken != "" {
+		query.Set("continuation-token", continuationToken)
+	}
+	bucketURL := *s.endpoint
+	bucketURL.Path = strings.TrimSuffix(bucketURL.Path, "/") + "/" + s.config.Bucket
+	// Encode sorts by key, as SigV4 requires; spaces must be encoded as %20 rather than '+'
+	bucketURL.RawQuery = strings.Replace(query.Encode(), "+", "%20", -1)
+
+	request, err := http.NewRequest(http.MethodGet, bucketURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := s.send(request, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = response.Body.Close() }()
+	if err := s3ResponseError(response); err != nil {
+		return nil, err
+	}
+	var result s3ListBucketResult
+	if err := xml.NewDecoder(response.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("Unable to parse attachment object store listing: %v", err)
+	}
+	return &result, nil
+}
+
+func (s *S3AttachmentStore) exists(key AttachmentKey) (bool, error) {
+	response, err := s.do(http.MethodHead, key, nil, emptyPayloadHash)
+	if err != nil {
+		return false, err
+	}
+	_ = response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return false, nil
+	} else if err := s3ResponseError(response); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *S3AttachmentStore) put(key AttachmentKey, body io.Reader, length int64, payloadHash string) error {
+	request, err := s.newRequest(http.MethodPut, key, body)
+	if err != nil {
+		return err
+	}
+	request.ContentLength = length
+	response, err := s.send(request, payloadHash)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = response.Body.Close() }()
+	return s3ResponseError(response)
+}
+
+// Sends a request with no additional headers for the object holding the given attachment.
+func (s *S3AttachmentStore) do(method string, key AttachmentKey, body io.Reader, payloadHash string) (*http.Response, error) {
+	request, err := s.newRequest(method, key, body)
+	if err != nil {
+		return nil, err
+	}
+	return s.send(request, payloadHash)
+}
+
+func (s *S3AttachmentStore) newRequest(method string, key AttachmentKey, body io.Reader) (*http.Request, error) {
+	objectURL := *s.endpoint
+	objectURL.Path = strings.TrimSuffix(objectURL.Path, "/") + "/" + s.config.Bucket + "/" + s.config.Prefix + attachmentStoreName(key)
+	return http.NewRequest(method, objectURL.String(), body)
+}
+
+// Signs and sends a request.  payloadHash is the hex SHA-256 of the body, or unsignedPayload.
+func (s *S3AttachmentStore) send(request *http.Request, payloadHash string) (*http.Response, error) {
+	if s.config.AccessKeyID != "" {
+		signS3Request(request, payloadHash, s.config.Region, s.config.AccessKeyID, s.config.SecretAccessKey, time.Now().UTC())
+	}
+	return s.client.Do(request)
+}
+
+// An AttachmentReader over an object, which streams the body of a GET.
+type s3AttachmentReader struct {
+	store  *S3AttachmentStore
+	key    AttachmentKey
+	size   int64
+	offset int64         // Current read position
+	body   io.ReadCloser // Body of the GET being read, or nil if none has been sent since the last Seek
+}
+
+func (r *s3AttachmentReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		request, err := r.store.newRequest(http.MethodGet, r.key, nil)
+		if err != nil {
+			return 0, err
+		}
+		if r.offset > 0 {
+			request.Header.Set("Range", fmt.Sprintf("bytes=%d-", r.offset))
+		}
+		response, err := r.store.send(request, emptyPayloadHash)
+		if err != nil {
+			return 0, err
+		}
+		if err := s3ResponseError(response); err != nil {
+			_ = response.Body.Close()
+			return 0, err
+		}
+		r.body = response.Body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *s3AttachmentReader) Seek(offset int64, whence int) (int64, error) {
+	newOffset, err := seekOffset(r.offset, r.size, offset, whence)
+	if err == nil && newOffset != r.offset {
+		_ = r.Close()
+		r.offset = newOffset
+	}
+	return r.offset, err
+}
+
+func (r *s3AttachmentReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+func (r *s3AttachmentReader) Size() int64 {
+	return r.size
+}
+
+// Converts a non-2xx response into an error, using 404 for missing objects.
+func s3ResponseError(response *http.Response) error {
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return nil
+	}
+	if response.StatusCode == http.StatusNotFound {
+		return base.HTTPErrorf(http.StatusNotFound, "missing")
+	}
+	return fmt.Errorf("Unexpected response from attachment object store: %s %s: %s", response.Request.Method, response.Request.URL.Path, response.Status)
+}
+
+// Adds AWS Signature Version 4 headers to the request.
+func signS3Request(request *http.Request, payloadHash, region, accessKeyID, secretAccessKey string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		s3EscapePath(request.URL.Path),
+		request.URL.RawQuery,
+		"host:" + request.URL.Host + "\n" +
+			"x-amz-content-sha256:" + payloadHash + "\n" +
+			"x-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	signingKey := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID, scope, signedHeaders, signature))
+}
+
+// URI-encodes a path as required for the SigV4 canonical request: everything but unreserved characters and '/'.
+func s3EscapePath(path string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
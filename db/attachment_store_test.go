@@ -0,0 +1,300 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Exercises the AttachmentStore contract common to all implementations.
+func testAttachmentStore(t *testing.T, store AttachmentStore) {
+	data := []byte("hello world")
+	key := AttachmentKey(Sha1DigestKey(data))
+
+	_, err := store.GetAttachment(key)
+	assert.True(t, base.IsDocNotFoundError(err), "Expected not found error, got %v", err)
+
+	added, err := store.AddAttachment(key, data)
+	assert.NoError(t, err)
+	assert.True(t, added)
+
+	added, err = store.AddAttachment(key, data)
+	assert.NoError(t, err)
+	assert.False(t, added)
+
+	retrieved, err := store.GetAttachment(key)
+	assert.NoError(t, err)
+	assert.Equal(t, data, retrieved)
+
+	assert.NoError(t, store.DeleteAttachment(key))
+	_, err = store.GetAttachment(key)
+	assert.True(t, base.IsDocNotFoundError(err), "Expected not found error, got %v", err)
+	assert.True(t, base.IsDocNotFoundError(store.DeleteAttachment(key)))
+
+	// Streamed write and read
+	streamedKey, length, added, err := store.WriteAttachment(strings.NewReader("hello world"))
+	assert.NoError(t, err)
+	assert.Equal(t, key, streamedKey)
+	assert.Equal(t, int64(len(data)), length)
+	assert.True(t, added)
+	assertAttachmentReader(t, store, key, data)
+	_, _, added, err = store.WriteAttachment(strings.NewReader("hello world"))
+	assert.NoError(t, err)
+	assert.False(t, added)
+	assert.NoError(t, store.DeleteAttachment(key))
+
+	_, err = store.OpenAttachment(key)
+	assert.True(t, base.IsDocNotFoundError(err), "Expected not found error, got %v", err)
+}
+
+// Checks the attachment can be streamed in full and from an offset.
+func assertAttachmentReader(t *testing.T, store AttachmentStore, key AttachmentKey, expected []byte) {
+	reader, err := store.OpenAttachment(key)
+	require.NoError(t, err)
+	defer func() { assert.NoError(t, reader.Close()) }()
+	assert.Equal(t, int64(len(expected)), reader.Size())
+
+	data, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, data)
+
+	offset := int64(len(expected) / 2)
+	position, err := reader.Seek(offset, io.SeekStart)
+	assert.NoError(t, err)
+	assert.Equal(t, offset, position)
+	data, err = ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, expected[offset:], data)
+}
+
+func TestBucketAttachmentStore(t *testing.T) {
+	testBucket := base.GetTestBucket(t)
+	defer testBucket.Close()
+	testAttachmentStore(t, NewBucketAttachmentStore(testBucket.Bucket))
+}
+
+func TestBucketAttachmentStoreChunks(t *testing.T) {
+	testBucket := base.GetTestBucket(t)
+	defer testBucket.Close()
+	store := NewBucketAttachmentStore(testBucket.Bucket)
+
+	defer func(chunkSize int) { BucketAttachmentChunkSize = chunkSize }(BucketAttachmentChunkSize)
+	BucketAttachmentChunkSize = 4
+
+	data := []byte("the quick brown fox")
+	key, length, _, err := store.WriteAttachment(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, AttachmentKey(Sha1DigestKey(data)), key)
+	assert.Equal(t, int64(len(data)), length)
+
+	// Stored as a manifest and five chunks, rather than a single document
+	_, _, err = testBucket.Bucket.GetRaw(base.AttPrefix + string(key))
+	assert.True(t, base.IsDocNotFoundError(err))
+	manifest, err := store.getManifest(key)
+	require.NoError(t, err)
+	assert.Equal(t, 5, manifest.Chunks)
+
+	retrieved, err := store.GetAttachment(key)
+	assert.NoError(t, err)
+	assert.Equal(t, data, retrieved)
+	assertAttachmentReader(t, store, key, data)
+
+	// Adding the same data again leaves no extra chunks behind
+	added, err := store.AddAttachment(key, data)
+	assert.NoError(t, err)
+	assert.False(t, added)
+	_, _, added, err = store.WriteAttachment(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.False(t, added)
+
+	// ...but refreshes the time it was stored, for garbage collection
+	touched, err := store.getManifest(key)
+	require.NoError(t, err)
+	assert.Equal(t, manifest.ID, touched.ID)
+	require.NotNil(t, touched.Stored)
+	assert.False(t, touched.Stored.Before(*manifest.Stored))
+
+	// Deleting removes the manifest and the chunks
+	assert.NoError(t, store.DeleteAttachment(key))
+	for i := 0; i < manifest.Chunks; i++ {
+		_, _, err = testBucket.Bucket.GetRaw(manifest.chunkKey(i))
+		assert.True(t, base.IsDocNotFoundError(err))
+	}
+	_, err = store.GetAttachment(key)
+	assert.True(t, base.IsDocNotFoundError(err))
+}
+
+func TestFileSystemAttachmentStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "attachments")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	store, err := NewFileSystemAttachmentStore(dir)
+	require.NoError(t, err)
+	testAttachmentStore(t, store)
+
+	// Storing an attachment again refreshes the time it was stored, for garbage collection
+	key, _, _, err := store.WriteAttachment(strings.NewReader("hello world"))
+	require.NoError(t, err)
+	stale := time.Now().Add(-48 * time.Hour)
+	require.NoError(t, os.Chtimes(store.filePath(key), stale, stale))
+	_, _, added, err := store.WriteAttachment(strings.NewReader("hello world"))
+	require.NoError(t, err)
+	assert.False(t, added)
+	info, err := os.Stat(store.filePath(key))
+	require.NoError(t, err)
+	assert.True(t, info.ModTime().After(stale.Add(time.Hour)))
+}
+
+// A minimal in-memory stand-in for an S3-compatible object store.
+type fakeS3Server struct {
+	objects map[string][]byte
+	lock    sync.Mutex
+}
+
+func (s *fakeS3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if r.URL.Query().Get("list-type") == "2" {
+		s.listObjects(w, r)
+		return
+	}
+	data, found := s.objects[r.URL.Path]
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var offset int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &offset); err == nil {
+			data = data[offset:]
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.WriteHeader(http.StatusPartialContent)
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		}
+		_, _ = w.Write(data)
+	case http.MethodPut:
+		s.objects[r.URL.Path], _ = ioutil.ReadAll(r.Body)
+	case http.MethodDelete:
+		delete(s.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Lists the objects in the bucket after start-after, in key order, in a single page of up to max-keys objects.
+func (s *fakeS3Server) listObjects(w http.ResponseWriter, r *http.Request) {
+	bucketPath := r.URL.Path + "/"
+	query := r.URL.Query()
+	prefix, startAfter := query.Get("prefix"), query.Get("start-after")
+	maxKeys, _ := strconv.Atoi(query.Get("max-keys"))
+	var keys []string
+	for path := range s.objects {
+		key := strings.TrimPrefix(path, bucketPath)
+		if strings.HasPrefix(path, bucketPath) && strings.HasPrefix(key, prefix) && key > startAfter {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	truncated := maxKeys > 0 && len(keys) > maxKeys
+	if truncated {
+		keys = keys[:maxKeys]
+	}
+	_, _ = fmt.Fprintf(w, "<ListBucketResult><IsTruncated>%t</IsTruncated>", truncated)
+	for _, key := range keys {
+		_, _ = fmt.Fprintf(w, "<Contents><Key>%s</Key><LastModified>2019-01-02T03:04:05.000Z</LastModified></Contents>", key)
+	}
+	_, _ = io.WriteString(w, "</ListBucketResult>")
+}
+
+func TestS3AttachmentStore(t *testing.T) {
+	fakeS3 := &fakeS3Server{objects: make(map[string][]byte)}
+	server := httptest.NewServer(fakeS3)
+	defer server.Close()
+
+	store, err := NewS3AttachmentStore(S3AttachmentStoreConfig{
+		Endpoint:        server.URL,
+		Bucket:          "atts",
+		Prefix:          "db/",
+		AccessKeyID:     "key",
+		SecretAccessKey: "secret",
+	})
+	require.NoError(t, err)
+	testAttachmentStore(t, store)
+
+	// Object keys must not contain the '/' or '+' found in base64 digests
+	_, err = store.AddAttachment("sha1-Kq5sNclPz7QV2+lfQIuc6R7oRu0=", []byte("hello world"))
+	assert.NoError(t, err)
+	_, found := fakeS3.objects["/atts/db/sha1-Kq5sNclPz7QV2-lfQIuc6R7oRu0."]
+	assert.True(t, found)
+
+	_, err = store.AddAttachment("sha1-abc", []byte("abc"))
+	assert.NoError(t, err)
+	list := func(startAfter string, limit int) (listed []AttachmentKey) {
+		err := store.ListAttachments(startAfter, limit, func(key AttachmentKey, modified time.Time) error {
+			listed = append(listed, key)
+			assert.Equal(t, 2019, modified.Year())
+			return nil
+		})
+		assert.NoError(t, err)
+		return listed
+	}
+	assert.Equal(t, []AttachmentKey{"sha1-Kq5sNclPz7QV2+lfQIuc6R7oRu0=", "sha1-abc"}, list("", 0))
+	assert.Equal(t, []AttachmentKey{"sha1-Kq5sNclPz7QV2+lfQIuc6R7oRu0="}, list("", 1))
+	assert.Equal(t, []AttachmentKey{"sha1-abc"}, list(attachmentStoreName("sha1-Kq5sNclPz7QV2+lfQIuc6R7oRu0="), 1))
+}
+
+func TestMigrateAttachments(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	_, _, err := db.Put("doc1", unjson(`{"_attachments": {"hello.txt": {"data":"aGVsbG8gd29ybGQ="}}}`))
+	require.NoError(t, err)
+	key := AttachmentKey("sha1-Kq5sNclPz7QV2+lfQIuc6R7oRu0=")
+
+	// Switch the database to a filesystem store, and migrate from the bucket
+	dir, err := ioutil.TempDir("", "attachments")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	bucketStore := db.Options.AttachmentStore
+	db.Options.AttachmentStore, err = NewFileSystemAttachmentStore(dir)
+	require.NoError(t, err)
+
+	_, err = db.GetAttachment(key)
+	assert.True(t, base.IsDocNotFoundError(err))
+
+	result, err := db.MigrateAttachments(bucketStore, true)
+	require.NoError(t, err)
+	assert.Equal(t, AttachmentMigrationResult{Migrated: 1, Deleted: 1}, result)
+
+	data, err := db.GetAttachment(key)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world", string(data))
+	_, _, err = db.Bucket.GetRaw(base.AttPrefix + string(key))
+	assert.True(t, base.IsDocNotFoundError(err))
+
+	// A second run finds nothing left to migrate
+	result, err = db.MigrateAttachments(bucketStore, true)
+	require.NoError(t, err)
+	assert.Equal(t, AttachmentMigrationResult{}, result)
+}
@@ -10,8 +10,11 @@
 package db
 
 import (
+	"bytes"
 	"fmt"
 	"log"
+	"mime/multipart"
+	"net/textproto"
 	"testing"
 
 	"github.com/couchbase/sync_gateway/base"
@@ -245,6 +248,58 @@ func TestAttachmentForRejectedDocument(t *testing.T) {
 
 }
 
+// Builds a multipart document whose JSON body describes the given attachments as following it, followed by the given
+// attachment parts.
+func multipartDocument(t *testing.T, attachments []string, parts []string) *multipart.Reader {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	atts := map[string]interface{}{}
+	for i, data := range attachments {
+		atts[fmt.Sprintf("att%d.txt", i)] = map[string]interface{}{"follows": true, "digest": Sha1DigestKey([]byte(data)), "length": len(data)}
+	}
+	part, err := writer.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json"}})
+	require.NoError(t, err)
+	_, err = part.Write([]byte(tojson(Body{BodyAttachments: atts})))
+	require.NoError(t, err)
+	for _, data := range parts {
+		part, err := writer.CreatePart(textproto.MIMEHeader{})
+		require.NoError(t, err)
+		_, err = part.Write([]byte(data))
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.Close())
+	return multipart.NewReader(&buf, writer.Boundary())
+}
+
+func TestStreamedAttachmentForRejectedDocument(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	// A document referencing the attachment is written while another with the same attachment is rejected
+	attachments := []string{"shared"}
+	body, err := db.ReadMultipartDocument(multipartDocument(t, attachments, attachments))
+	require.NoError(t, err)
+	_, _, err = db.Put("doc1", body)
+	require.NoError(t, err)
+
+	_, err = db.ReadMultipartDocument(multipartDocument(t, attachments, append(attachments, "extra")))
+	assertHTTPError(t, err, 400)
+
+	db.ChannelMapper = channels.NewChannelMapper(`function(doc, oldDoc) {
+		throw({forbidden: "None shall pass!"});
+	}`)
+	body, err = db.ReadMultipartDocument(multipartDocument(t, attachments, attachments))
+	require.NoError(t, err)
+	_, _, err = db.Put("doc2", body)
+	assertHTTPError(t, err, 403)
+
+	// The attachment is left in the store, for the document that references it
+	data, err := db.GetAttachment(AttachmentKey(Sha1DigestKey([]byte("shared"))))
+	require.NoError(t, err)
+	assert.Equal(t, "shared", string(data))
+}
+
 func TestAttachmentRetrievalUsingRevCache(t *testing.T) {
 
 	testBucket := base.GetTestBucket(t)
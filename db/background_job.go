@@ -0,0 +1,93 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// How often the node running a background job, such as attachment garbage collection, saves the job's checkpoint
+// to show that it's still running.
+var BackgroundJobHeartbeatInterval = 10 * time.Second
+
+// How long after the last heartbeat of a background job another node may take it over.
+var BackgroundJobLeaseExpiry = 60 * time.Second
+
+// The node running a background job, as recorded in the job's checkpoint.  Only one node in the cluster holds the
+// lease on a job at a time.
+type BackgroundJobLease struct {
+	Owner     string     `json:"owner,omitempty"`     // Identifies the node running the job
+	Heartbeat *time.Time `json:"heartbeat,omitempty"` // When the owner last saved the checkpoint
+}
+
+// Whether the lease is held by a node other than owner, which has saved the job's checkpoint recently enough to be
+// considered still running.
+func (lease *BackgroundJobLease) heldByOther(owner string) bool {
+	return lease.Owner != "" && lease.Owner != owner && lease.Heartbeat != nil &&
+		time.Since(*lease.Heartbeat) < BackgroundJobLeaseExpiry
+}
+
+// Records that owner holds the lease, as of now.
+func (lease *BackgroundJobLease) renew(owner string) {
+	now := time.Now().UTC()
+	lease.Owner, lease.Heartbeat = owner, &now
+}
+
+// Returned when saving a checkpoint of a background job that another node has taken over.
+var errBackgroundJobLeaseLost = base.HTTPErrorf(http.StatusConflict, "Background job was taken over by another node")
+
+// Saves the checkpoint of a background job with CAS, so that only the node holding the job's lease can save it.
+type jobCheckpointer struct {
+	bucket base.Bucket
+	key    string
+	lock   sync.Mutex
+	cas    uint64    // CAS of the checkpoint last saved, or read before claiming the lease
+	saved  time.Time // When the checkpoint was last saved
+}
+
+// Claims the lease on a background job by saving its initial checkpoint, which mustn't have changed since it was
+// read with the given CAS (zero if there was no checkpoint).  Returns a 503 error if another node claimed it first.
+func claimBackgroundJob(bucket base.Bucket, key string, cas uint64, checkpoint interface{}) (*jobCheckpointer, error) {
+	checkpointer := &jobCheckpointer{bucket: bucket, key: key, cas: cas}
+	if err := checkpointer.save(checkpoint); err == errBackgroundJobLeaseLost {
+		return nil, base.HTTPErrorf(http.StatusServiceUnavailable, "Already running on another node")
+	} else if err != nil {
+		return nil, err
+	}
+	return checkpointer, nil
+}
+
+// Saves the checkpoint.  Returns errBackgroundJobLeaseLost if it's been saved by another node since this node last
+// saved it.
+func (checkpointer *jobCheckpointer) save(checkpoint interface{}) error {
+	checkpointer.lock.Lock()
+	defer checkpointer.lock.Unlock()
+	casOut, err := checkpointer.bucket.WriteCas(checkpointer.key, 0, 0, checkpointer.cas, checkpoint, 0)
+	if base.IsCasMismatch(err) || (checkpointer.cas != 0 && base.IsDocNotFoundError(err)) {
+		return errBackgroundJobLeaseLost
+	} else if err != nil {
+		return err
+	}
+	checkpointer.cas = casOut
+	checkpointer.saved = time.Now()
+	return nil
+}
+
+// Whether the checkpoint should be saved to renew the lease, as BackgroundJobHeartbeatInterval has passed since it
+// was last saved.
+func (checkpointer *jobCheckpointer) heartbeatDue() bool {
+	checkpointer.lock.Lock()
+	defer checkpointer.lock.Unlock()
+	return time.Since(checkpointer.saved) >= BackgroundJobHeartbeatInterval
+}
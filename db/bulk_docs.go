@@ -0,0 +1,160 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"net/http"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// The state of a document prior to an all-or-nothing write, used to roll the write back.
+type bulkDocPriorState struct {
+	revID   string // Current revision before the write, empty if the doc didn't exist
+	deleted bool   // Whether the current revision was a tombstone
+	body    Body   // Body of the current revision, including attachment stubs
+	expiry  int64  // Unix time the document expires, or 0 if it doesn't
+}
+
+// PutAllOrNothing writes a batch of documents such that either all of them are written, or none of them are left
+// current.  Every document is first validated and authorized against its current state - making the same checks as
+// Put, including running the sync function as the user - and nothing is written unless all documents pass.  If a
+// write then fails (e.g. due to a concurrent update), the documents already written are rolled back by adding a
+// revision that restores their previous state.
+//
+// This isn't atomic.  Each document is validated without the effect of the others in the batch (such as access
+// granted by one of them), the written revisions are visible to other clients until they're rolled back, and they
+// remain in the documents' histories afterwards.
+//
+// On success returns the new revision IDs.  Otherwise docErrors has an entry per document, which is nil for
+// documents that were valid and aren't left written.  A document that was written but couldn't be rolled back has
+// the error from the rollback.
+func (db *Database) PutAllOrNothing(docids []string, bodies []Body) (newRevIDs []string, docErrors []error) {
+
+	// Validate everything before writing anything
+	priorStates := make([]*bulkDocPriorState, len(bodies))
+	failed := false
+	docErrors = make([]error, len(bodies))
+	for i, body := range bodies {
+		priorStates[i], docErrors[i] = db.validatePut(docids[i], body)
+		if docErrors[i] != nil {
+			failed = true
+		}
+	}
+	if failed {
+		return nil, docErrors
+	}
+
+	newRevIDs = make([]string, len(bodies))
+	for i, body := range bodies {
+		newRevID, _, err := db.Put(docids[i], body)
+		if err != nil {
+			base.InfofCtx(db.Ctx, base.KeyCRUD, "All-or-nothing write of doc %q failed, rolling back %d written docs: %v", base.UD(docids[i]), i, err)
+			docErrors[i] = err
+			for j := i - 1; j >= 0; j-- {
+				docErrors[j] = db.rollbackPut(docids[j], newRevIDs[j], priorStates[j])
+			}
+			return nil, docErrors
+		}
+		newRevIDs[i] = newRevID
+	}
+	return newRevIDs, nil
+}
+
+// validatePut runs the checks made by Put against the document's current state, including the sync function,
+// without writing anything.  Returns the document's current state, for use by rollbackPut.
+func (db *Database) validatePut(docid string, body Body) (*bulkDocPriorState, error) {
+	// preparePut removes properties from the body, which is still to be written by Put
+	newDoc, matchRev, deleted, _, err := preparePut(docid, body.ShallowCopy())
+	if err != nil {
+		return nil, err
+	}
+
+	// Attachments are checked on a copy, as storeAttachments updates their metadata.  Nothing is stored until the
+	// attachment data is added by the write.
+	if newDoc.DocAttachments != nil {
+		attachments := make(AttachmentsMeta, len(newDoc.DocAttachments))
+		for name, meta := range newDoc.DocAttachments {
+			attachments[name] = meta
+		}
+		newDoc.DocAttachments = attachments
+	}
+
+	doc, err := db.GetDocument(docid, DocUnmarshalAll)
+	docExists := err == nil
+	if base.IsDocNotFoundError(err) {
+		doc = NewDocument(docid)
+	} else if err != nil {
+		return nil, err
+	}
+	if err := db.validateExistingDoc(doc, db.UseXattrs(), docExists); err != nil {
+		return nil, err
+	}
+
+	priorState := &bulkDocPriorState{revID: doc.CurrentRev}
+	if doc.CurrentRev != "" {
+		priorState.deleted = doc.History[doc.CurrentRev].Deleted
+	}
+	if priorState.revID != "" && !priorState.deleted {
+		priorState.body = doc.Body().DeepCopy()
+		if priorState.body == nil {
+			priorState.body = Body{}
+		}
+		if len(doc.SyncData.Attachments) > 0 {
+			priorState.body[BodyAttachments] = doc.SyncData.Attachments
+		}
+	}
+	if doc.Expiry != nil {
+		priorState.expiry = doc.Expiry.Unix()
+	}
+
+	// Add the revision to the (unsaved) rev tree, and run the sync function on it, as Put does
+	if _, err := db.addPutRevision(doc, newDoc, matchRev, deleted); err != nil {
+		return nil, err
+	}
+	newBody := newDoc.Body()
+	if deleted {
+		newBody[BodyDeleted] = true
+	}
+	if err := validateNewBody(newBody); err != nil {
+		return nil, err
+	}
+	newBody[BodyId] = docid
+	newBody[BodyRev] = newDoc.RevID
+	if _, _, _, _, _, _, err := db.getChannelsAndAccess(doc, newBody, newDoc.RevID); err != nil {
+		return nil, err
+	}
+
+	return priorState, nil
+}
+
+// rollbackPut undoes a write made by PutAllOrNothing by adding a revision that restores the document's prior
+// state, and its expiry - a tombstone for documents that didn't previously exist.  Runs as admin, so that the sync function
+// can't reject the rollback on the user's behalf.
+func (db *Database) rollbackPut(docid string, revID string, priorState *bulkDocPriorState) error {
+	adminDb := &Database{DatabaseContext: db.DatabaseContext}
+
+	var body Body
+	if priorState.revID == "" || priorState.deleted {
+		body = Body{BodyDeleted: true}
+	} else {
+		body = priorState.body.ShallowCopy()
+	}
+	body[BodyRev] = revID
+	if priorState.expiry != 0 {
+		body["_exp"] = priorState.expiry
+	}
+
+	if _, _, err := adminDb.Put(docid, body); err != nil {
+		base.WarnfCtx(db.Ctx, base.KeyAll, "Unable to roll back all-or-nothing write of doc %q rev %s: %v", base.UD(docid), revID, err)
+		return base.HTTPErrorf(http.StatusInternalServerError, "Written as %s, but unable to roll back: %v", revID, err)
+	}
+	return nil
+}
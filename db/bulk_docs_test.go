@@ -0,0 +1,101 @@
+package db
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/channels"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPutAllOrNothing(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	db.ChannelMapper = channels.NewChannelMapper(`function(doc, oldDoc) {
+		if (doc.invalid) {
+			throw({forbidden: "invalid doc"});
+		}
+	}`)
+
+	existingRev, _, err := db.Put("existing", Body{"value": 1})
+	require.NoError(t, err)
+
+	// A batch containing a doc rejected by the sync function writes nothing
+	newRevIDs, docErrors := db.PutAllOrNothing(
+		[]string{"parent", "existing", "child"},
+		[]Body{{"value": 1}, {BodyRev: existingRev, "value": 2}, {"invalid": true}})
+	assert.Nil(t, newRevIDs)
+	require.Len(t, docErrors, 3)
+	assert.NoError(t, docErrors[0])
+	assert.NoError(t, docErrors[1])
+	assertHTTPError(t, docErrors[2], http.StatusForbidden)
+
+	_, err = db.Get("parent")
+	assertHTTPError(t, err, http.StatusNotFound)
+	body, err := db.Get("existing")
+	require.NoError(t, err)
+	assert.Equal(t, existingRev, body[BodyRev])
+
+	// As does a batch containing a doc with invalid attachments
+	newRevIDs, docErrors = db.PutAllOrNothing(
+		[]string{"parent", "child"},
+		[]Body{{"value": 1}, {BodyAttachments: map[string]interface{}{"hello.txt": map[string]interface{}{"content_type": "text/plain"}}}})
+	assert.Nil(t, newRevIDs)
+	require.Len(t, docErrors, 2)
+	assert.NoError(t, docErrors[0])
+	assertHTTPError(t, docErrors[1], http.StatusBadRequest)
+	_, err = db.Get("parent")
+	assertHTTPError(t, err, http.StatusNotFound)
+
+	// A valid batch writes every doc
+	newRevIDs, docErrors = db.PutAllOrNothing(
+		[]string{"parent", "existing", "child"},
+		[]Body{{"value": 1}, {BodyRev: existingRev, "value": 2}, {"value": 3}})
+	require.Nil(t, docErrors)
+	require.Len(t, newRevIDs, 3)
+	body, err = db.Get("existing")
+	require.NoError(t, err)
+	assert.Equal(t, newRevIDs[1], body[BodyRev])
+}
+
+// Rollback restores the previous body of updated docs, and tombstones created docs
+func TestRollbackPut(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	expiry := time.Now().Add(time.Hour).Unix()
+	rev1, _, err := db.Put("existing", Body{"value": "original", "_exp": expiry})
+	require.NoError(t, err)
+
+	existingState, err := db.validatePut("existing", Body{BodyRev: rev1, "value": "updated"})
+	require.NoError(t, err)
+	createdState, err := db.validatePut("created", Body{"value": "new"})
+	require.NoError(t, err)
+
+	rev2, _, err := db.Put("existing", Body{BodyRev: rev1, "value": "updated"})
+	require.NoError(t, err)
+	createdRev, _, err := db.Put("created", Body{"value": "new"})
+	require.NoError(t, err)
+
+	require.NoError(t, db.rollbackPut("existing", rev2, existingState))
+	require.NoError(t, db.rollbackPut("created", createdRev, createdState))
+
+	body, err := db.Get("existing")
+	require.NoError(t, err)
+	assert.Equal(t, "original", body["value"])
+	generation, _ := ParseRevID(body[BodyRev].(string))
+	assert.Equal(t, 3, generation)
+	doc, err := db.GetDocument("existing", DocUnmarshalAll)
+	require.NoError(t, err)
+	require.NotNil(t, doc.Expiry)
+	assert.Equal(t, expiry, doc.Expiry.Unix())
+
+	doc, err = db.GetDocument("created", DocUnmarshalAll)
+	require.NoError(t, err)
+	assert.True(t, doc.History[doc.CurrentRev].Deleted)
+}
@@ -25,17 +25,19 @@ import (
 
 // Options for changes-feeds
 type ChangesOptions struct {
-	Since       SequenceID      // sequence # to start _after_
-	Limit       int             // Max number of changes to return, if nonzero
-	Conflicts   bool            // Show all conflicting revision IDs, not just winning one?
-	IncludeDocs bool            // Include doc body of each change?
-	Wait        bool            // Wait for results, instead of immediately returning empty result?
-	Continuous  bool            // Run continuously until terminated?
-	Terminator  chan bool       // Caller can close this channel to terminate the feed
-	HeartbeatMs uint64          // How often to send a heartbeat to the client
-	TimeoutMs   uint64          // After this amount of time, close the longpoll connection
-	ActiveOnly  bool            // If true, only return information on non-deleted, non-removed revisions
-	Ctx         context.Context // Used for adding context to logs
+	Since         SequenceID             // sequence # to start _after_
+	Limit         int                    // Max number of changes to return, if nonzero
+	Conflicts     bool                   // Show all conflicting revision IDs, not just winning one?
+	IncludeDocs   bool                   // Include doc body of each change?
+	Wait          bool                   // Wait for results, instead of immediately returning empty result?
+	Continuous    bool                   // Run continuously until terminated?
+	Terminator    chan bool              // Caller can close this channel to terminate the feed
+	HeartbeatMs   uint64                 // How often to send a heartbeat to the client
+	TimeoutMs     uint64                 // After this amount of time, close the longpoll connection
+	ActiveOnly    bool                   // If true, only return information on non-deleted, non-removed revisions
+	Filter        *ChangesFilterFunction // User-defined filter function; only changes it accepts are returned
+	FilterRequest Body                   // The 'req' argument passed to Filter
+	Ctx           context.Context        // Used for adding context to logs
 }
 
 // A changes entry; Database.GetChanges returns an array of these.
@@ -633,6 +635,11 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 					db.addDocToChangeEntry(minEntry, options)
 				}
 
+				// Skip entries rejected by the user-defined filter, if any
+				if !db.changeEntryPassesFilter(minEntry, options) {
+					continue
+				}
+
 				// Update the low sequence on the entry we're going to send
 				// NOTE: if 0, the low seq part of compound sequence gets removed
 				minEntry.Seq.LowSeq = lowSequence
@@ -984,5 +991,9 @@ func createChangesEntry(docid string, db *Database, options ChangesOptions) *Cha
 		db.AddDocInstanceToChangeEntry(row, populatedDoc, options)
 	}
 
+	if !db.changeEntryPassesFilter(row, options) {
+		return nil
+	}
+
 	return row
 }
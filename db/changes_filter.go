@@ -0,0 +1,131 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"errors"
+	"strconv"
+
+	sgbucket "github.com/couchbase/sg-bucket"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+//////// Changes Filter Function
+
+// Compiles a JavaScript changes filter function to a jsEventTask object.
+func newChangesFilterRunner(funcSource string, jsOptions base.JSOptions) (sgbucket.JSServerTask, error) {
+	changesFilterRunner := &jsEventTask{}
+	err := changesFilterRunner.InitWithLogging(jsOptions, funcSource,
+		func(s string) { base.Errorf(base.KeyJavascript, "ChangesFilter %s", base.UD(s)) },
+		func(s string) { base.Infof(base.KeyJavascript, "ChangesFilter %s", base.UD(s)) })
+	if err != nil {
+		return nil, err
+	}
+
+	changesFilterRunner.After = func(nativeValue interface{}, err error) (interface{}, error) {
+		return nativeValue, err
+	}
+
+	return changesFilterRunner, nil
+}
+
+// ChangesFilterFunction is a named, user-defined filter that can be applied to a changes feed.  The function is
+// invoked as filter(doc, req), and a change is only sent when it returns true.
+type ChangesFilterFunction struct {
+	*sgbucket.JSServer
+}
+
+func NewChangesFilterFunction(fnSource string, jsOptions base.JSOptions) *ChangesFilterFunction {
+
+	base.Debugf(base.KeyChanges, "Creating new ChangesFilterFunction")
+	return &ChangesFilterFunction{
+		JSServer: sgbucket.NewJSServer(fnSource, kTaskCacheSize,
+			func(fnSource string) (sgbucket.JSServerTask, error) {
+				return newChangesFilterRunner(fnSource, jsOptions)
+			}),
+	}
+}
+
+// Calls the filter function for the given doc and request, returning whether the doc passes the filter.
+func (f *ChangesFilterFunction) EvaluateFunction(doc Body, req Body) (bool, error) {
+
+	result, err := f.Call(doc, req)
+	if err != nil {
+		base.Warnf(base.KeyAll, "Unexpected error invoking changes filter for document %s - document will not be sent.  Error: %v", base.UD(doc[BodyId]), err)
+		return false, err
+	}
+	switch result := result.(type) {
+	case bool:
+		return result, nil
+	case string:
+		boolResult, err := strconv.ParseBool(result)
+		if err != nil {
+			return false, err
+		}
+		return boolResult, nil
+	default:
+		base.Warnf(base.KeyAll, "Changes filter function returned non-boolean result %v Type: %T", base.UD(result), result)
+		return false, errors.New("Changes filter function returned non-boolean value.")
+	}
+}
+
+// GetChangesFilter returns the changes filter function defined in the database config with the given name.
+func (context *DatabaseContext) GetChangesFilter(name string) (filter *ChangesFilterFunction, found bool) {
+	filter, found = context.Options.ChangesFilters[name]
+	return filter, found
+}
+
+// MakeChangesFilterRequest builds the 'req' argument passed to a changes filter function, made up of the
+// request's query parameters and the context of the user making the request (null for admin requests).
+func (db *Database) MakeChangesFilterRequest(query map[string]interface{}) Body {
+	var userCtx map[string]interface{}
+	if db.user != nil {
+		userCtx = map[string]interface{}{
+			"name":     db.user.Name(),
+			"roles":    db.user.RoleNames().AllChannels(),
+			"channels": db.user.Channels().AllChannels(),
+		}
+	}
+	return Body{"query": query, "userCtx": userCtx}
+}
+
+// changeEntryPassesFilter runs options.Filter against the revision referenced by the given change entry.  Uses
+// the entry's doc body when already present (include_docs), otherwise loads the revision.  As with the channel filter,
+// removals and revisions whose body can't be read are always sent, so that the client learns it has lost access.
+func (db *Database) changeEntryPassesFilter(entry *ChangeEntry, options ChangesOptions) bool {
+	if options.Filter == nil || entry.principalDoc || len(entry.Removed) > 0 {
+		return true
+	}
+
+	revID := entry.Changes[0]["rev"]
+	doc := entry.Doc
+	if doc == nil {
+		var err error
+		doc, err = db.getRev(entry.ID, revID, 0, nil, nil, false, BodyShallowCopy)
+		if err != nil {
+			base.DebugfCtx(db.Ctx, base.KeyChanges, "Changes feed: sending %q (%s) unfiltered, as its revision body couldn't be read: %v", base.UD(entry.ID), revID, err)
+			return true
+		}
+	}
+
+	// Ensure the filter sees the same metadata regardless of how the body was retrieved
+	doc = doc.ShallowCopy()
+	doc[BodyId] = entry.ID
+	doc[BodyRev] = revID
+	if entry.Deleted {
+		doc[BodyDeleted] = true
+	}
+
+	passes, err := options.Filter.EvaluateFunction(doc, options.FilterRequest)
+	if err != nil {
+		return false
+	}
+	return passes
+}
@@ -44,6 +44,9 @@ type ChannelCache interface {
 	// Returns the set of all cached data for a given channel (intended for diagnostic usage)
 	GetCachedChanges(channelName string) []*LogEntry
 
+	// Returns the stats of every channel resident in the cache (intended for diagnostic usage)
+	GetCachedChannelStats() []ChannelCacheStats
+
 	// Clear reinitializes the cache to an empty state
 	Clear()
 
@@ -233,6 +236,21 @@ func (c *channelCacheImpl) GetCachedChanges(channelName string) []*LogEntry {
 	return changes
 }
 
+func (c *channelCacheImpl) GetCachedChannelStats() []ChannelCacheStats {
+	stats := make([]ChannelCacheStats, 0, c.channelCaches.Length())
+	callback := func(v interface{}) bool {
+		channelCache := AsSingleChannelCache(v)
+		if channelCache == nil {
+			return false
+		}
+		stats = append(stats, channelCache.getStats())
+		return true
+	}
+	c.channelCaches.Range(callback)
+
+	return stats
+}
+
 // CleanAgedItems prunes the caches based on age of items. Error returned to fulfill BackgroundTaskFunc signature.
 func (c *channelCacheImpl) cleanAgedItems(ctx context.Context) error {
 
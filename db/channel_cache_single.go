@@ -660,6 +660,28 @@ func (c *singleChannelCacheImpl) GetSize() int {
 	return len(c.logs)
 }
 
+// ChannelCacheStats describes the contents of a single channel's cache.
+type ChannelCacheStats struct {
+	ChannelName string
+	Entries     int    // Number of cached log entries
+	ValidFrom   uint64 // First sequence the cache is complete from
+	LatestSeq   uint64 // Sequence of the most recent cached entry, or 0 if the cache is empty
+}
+
+func (c *singleChannelCacheImpl) getStats() ChannelCacheStats {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	stats := ChannelCacheStats{
+		ChannelName: c.channelName,
+		Entries:     len(c.logs),
+		ValidFrom:   c.validFrom,
+	}
+	if len(c.logs) > 0 {
+		stats.LatestSeq = c.logs[len(c.logs)-1].Sequence
+	}
+	return stats
+}
+
 type lateLogEntry struct {
 	logEntry      *LogEntry
 	arrived       time.Time    // Time arrived in late log - for diagnostics tracking
@@ -0,0 +1,221 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+const DefaultChannelListLimit = 100 // Default number of channels returned by ListChannels
+
+// ChannelInfo describes a channel in a ListChannels or GetChannelInfo response.
+type ChannelInfo struct {
+	Name           string `json:"name"`
+	Cached         bool   `json:"cached"`                     // Whether the channel is resident in the channel cache
+	CacheEntries   int    `json:"cache_entries"`              // Number of entries in the channel's cache
+	CacheValidFrom uint64 `json:"cache_valid_from,omitempty"` // First sequence the channel's cache is complete from
+	LatestSeq      uint64 `json:"latest_seq,omitempty"`       // Latest sequence known to be in the channel
+	DocCount       *int   `json:"doc_count,omitempty"`        // Documents currently in the channel; only set for exact counts
+}
+
+// ListChannelsOptions selects the channels returned by ListChannels.
+type ListChannelsOptions struct {
+	StartKey string // Name of the first channel to return
+	Limit    int    // Maximum number of channels to return; defaults to DefaultChannelListLimit
+	Exact    bool   // If true, lists every channel in the channels index, with exact document counts
+}
+
+// ListChannels returns channels in name order, starting at options.StartKey, along with the name of the channel
+// starting the next page (or "" if there are no more channels).  By default only channels resident in the channel
+// cache are listed, which is cheap.  If options.Exact is set every channel in the channels index is listed, each
+// found with an index lookup, and the document counts of the channels in the returned page are queried from the
+// index; a page's cost depends on the size of its channels rather than of the database.
+func (context *DatabaseContext) ListChannels(options ListChannelsOptions) (list []*ChannelInfo, next string, err error) {
+	if options.Limit <= 0 {
+		options.Limit = DefaultChannelListLimit
+	}
+
+	cacheStats := context.changeCache.getChannelCache().GetCachedChannelStats()
+	if options.Exact {
+		// Fetch one extra channel to find the start of the next page:
+		if list, err = context.listIndexedChannels(options.StartKey, options.Limit+1); err != nil {
+			return nil, "", err
+		}
+	} else {
+		list = make([]*ChannelInfo, 0, len(cacheStats))
+		for _, stats := range cacheStats {
+			if stats.ChannelName >= options.StartKey {
+				list = append(list, &ChannelInfo{Name: stats.ChannelName})
+			}
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	}
+
+	if len(list) > options.Limit {
+		next = list[options.Limit].Name
+		list = list[:options.Limit]
+	}
+
+	if options.Exact {
+		for _, info := range list {
+			var docCount int
+			if docCount, info.LatestSeq, err = context.channelStats(info.Name); err != nil {
+				return nil, "", err
+			}
+			info.DocCount = &docCount
+		}
+	}
+
+	cached := make(map[string]ChannelCacheStats, len(cacheStats))
+	for _, stats := range cacheStats {
+		cached[stats.ChannelName] = stats
+	}
+	for _, info := range list {
+		if stats, ok := cached[info.Name]; ok {
+			info.setCacheStats(stats)
+		}
+	}
+	return list, next, nil
+}
+
+// GetChannelInfo returns the stats of a single channel, with its exact document count and latest sequence from the
+// channels index, which reads each of the channel's entries.  Returns a 404 error if the channel is neither in the
+// index nor in the channel cache.
+func (context *DatabaseContext) GetChannelInfo(channelName string) (*ChannelInfo, error) {
+	info := &ChannelInfo{Name: channelName}
+	docCount, latestSeq, err := context.channelStats(channelName)
+	if err != nil {
+		return nil, err
+	}
+	info.DocCount = &docCount
+	info.LatestSeq = latestSeq
+
+	for _, stats := range context.changeCache.getChannelCache().GetCachedChannelStats() {
+		if stats.ChannelName == channelName {
+			info.setCacheStats(stats)
+		}
+	}
+	if info.LatestSeq == 0 && !info.Cached {
+		return nil, base.HTTPErrorf(http.StatusNotFound, "missing")
+	}
+	return info, nil
+}
+
+func (info *ChannelInfo) setCacheStats(stats ChannelCacheStats) {
+	info.Cached = true
+	info.CacheEntries = stats.Entries
+	info.CacheValidFrom = stats.ValidFrom
+	if stats.LatestSeq > info.LatestSeq {
+		info.LatestSeq = stats.LatestSeq
+	}
+}
+
+// Lists up to limit channels from the channels index, starting at the channel named startChannel.  Each channel is
+// found by looking up the first index entry after the previous channel's entries.
+func (context *DatabaseContext) listIndexedChannels(startChannel string, limit int) ([]*ChannelInfo, error) {
+	list := make([]*ChannelInfo, 0, limit)
+	startKey := []interface{}{startChannel}
+	for len(list) < limit {
+		channelName, found, err := context.nextIndexedChannel(startKey)
+		if err != nil {
+			return nil, err
+		} else if !found {
+			break
+		}
+		startKey = []interface{}{channelName, map[string]interface{}{}}
+		if channelName == channels.UserStarChannel {
+			continue
+		}
+		list = append(list, &ChannelInfo{Name: channelName})
+	}
+	return list, nil
+}
+
+// Returns the name of the channel of the first entry in the channels index whose key sorts at or after startKey.
+func (context *DatabaseContext) nextIndexedChannel(startKey []interface{}) (channelName string, found bool, err error) {
+	if context.Options.UseViews {
+		results, err := context.ViewQueryWithStats(DesignDocSyncGateway(), ViewChannels, map[string]interface{}{
+			"stale": false, QueryParamStartKey: startKey, QueryParamLimit: 1})
+		if err != nil {
+			return "", false, err
+		}
+		var viewRow channelsViewRow
+		found = results.Next(&viewRow) && len(viewRow.Key) > 0
+		if err := results.Close(); err != nil {
+			return "", false, err
+		}
+		if found {
+			channelName, _ = viewRow.Key[0].(string)
+		}
+		return channelName, found, nil
+	}
+
+	results, err := context.QueryNextChannel(startKey)
+	if err != nil {
+		return "", false, err
+	}
+	var row QueryNextChannelRow
+	found = results.Next(&row)
+	if err := results.Close(); err != nil {
+		return "", false, err
+	}
+	return row.Name, found, nil
+}
+
+// Counts the documents in a channel and finds its latest sequence from the channels index.
+func (context *DatabaseContext) channelStats(channelName string) (docCount int, latestSeq uint64, err error) {
+	if context.Options.UseViews {
+		return context.viewChannelStats(channelName)
+	}
+	return context.queryChannelStats(channelName)
+}
+
+// Counts the documents in a channel and finds its latest sequence with QueryChannelStats.
+func (context *DatabaseContext) queryChannelStats(channelName string) (docCount int, latestSeq uint64, err error) {
+	results, err := context.QueryChannelStats(channelName)
+	if err != nil {
+		return 0, 0, err
+	}
+	var row QueryChannelStatsRow
+	results.Next(&row)
+	if err := results.Close(); err != nil {
+		return 0, 0, err
+	}
+	return row.DocCount, row.Sequence, nil
+}
+
+// The channels view has no reduce function, so the channel's rows are counted.
+func (context *DatabaseContext) viewChannelStats(channelName string) (docCount int, latestSeq uint64, err error) {
+	results, err := context.ViewQueryWithStats(DesignDocSyncGateway(), ViewChannels, map[string]interface{}{
+		"stale": false, QueryParamStartKey: []interface{}{channelName}, QueryParamEndKey: []interface{}{channelName, map[string]interface{}{}}})
+	if err != nil {
+		return 0, 0, err
+	}
+	var viewRow channelsViewRow
+	for results.Next(&viewRow) {
+		if len(viewRow.Key) > 1 {
+			if seq, ok := base.ToInt64(viewRow.Key[1]); ok && uint64(seq) > latestSeq {
+				latestSeq = uint64(seq)
+			}
+		}
+		if viewRow.Value.Flags&(channels.Removed|channels.Deleted) == 0 {
+			docCount++
+		}
+		viewRow = channelsViewRow{}
+	}
+	if err := results.Close(); err != nil {
+		return 0, 0, err
+	}
+	return docCount, latestSeq, nil
+}
@@ -0,0 +1,224 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"fmt"
+	"net/http"
+
+	sgbucket "github.com/couchbase/sg-bucket"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// ConflictResolutionType identifies the outcome of running the conflict resolver.
+type ConflictResolutionType string
+
+const (
+	ConflictResolutionLocal    ConflictResolutionType = "local"     // The existing (local) revision wins, the incoming branch is tombstoned
+	ConflictResolutionRemote   ConflictResolutionType = "remote"    // The incoming (remote) revision wins, the local branch is tombstoned
+	ConflictResolutionMerge    ConflictResolutionType = "merge"     // A merged revision is added as a child of the remote revision, the local branch is tombstoned
+	ConflictResolutionKeepBoth ConflictResolutionType = "keep_both" // Both branches are kept, as if no resolver was defined
+)
+
+// ConflictResolution is the result of a call to the conflict resolver.  Body is only set for ConflictResolutionMerge.
+type ConflictResolution struct {
+	Type ConflictResolutionType
+	Body Body
+}
+
+//////// Conflict Resolver Function
+
+// Compiles a JavaScript conflict resolver function to a jsEventTask object.
+func newConflictResolverRunner(funcSource string, jsOptions base.JSOptions) (sgbucket.JSServerTask, error) {
+	conflictResolverRunner := &jsEventTask{}
+	err := conflictResolverRunner.InitWithLogging(jsOptions, funcSource,
+		func(s string) { base.Errorf(base.KeyJavascript, "ConflictResolver %s", base.UD(s)) },
+		func(s string) { base.Infof(base.KeyJavascript, "ConflictResolver %s", base.UD(s)) })
+	if err != nil {
+		return nil, err
+	}
+
+	conflictResolverRunner.After = func(nativeValue interface{}, err error) (interface{}, error) {
+		return nativeValue, err
+	}
+
+	return conflictResolverRunner, nil
+}
+
+// ConflictResolverFunction is a thread-safe wrapper around the JavaScript conflict resolver.  The function is
+// invoked as resolver(local, remote), and is expected to return one of:
+//   - "local" or "remote", to pick a winning revision
+//   - "keep_both", null or undefined, to store the conflict without resolving it
+//   - an object, to be stored as a new merged revision
+type ConflictResolverFunction struct {
+	*sgbucket.JSServer
+}
+
+func NewConflictResolverFunction(fnSource string, jsOptions base.JSOptions) *ConflictResolverFunction {
+
+	base.Debugf(base.KeyCRUD, "Creating new ConflictResolverFunction")
+	return &ConflictResolverFunction{
+		JSServer: sgbucket.NewJSServer(fnSource, kTaskCacheSize,
+			func(fnSource string) (sgbucket.JSServerTask, error) {
+				return newConflictResolverRunner(fnSource, jsOptions)
+			}),
+	}
+}
+
+// Resolve invokes the conflict resolver for the given local and remote revision bodies.
+func (c *ConflictResolverFunction) Resolve(localBody, remoteBody Body) (*ConflictResolution, error) {
+
+	result, err := c.Call(localBody, remoteBody)
+	if err != nil {
+		base.Warnf(base.KeyAll, "Unexpected error invoking conflict resolver for document %s - conflict will not be resolved.  Error: %v", base.UD(localBody[BodyId]), err)
+		return nil, err
+	}
+
+	switch result := result.(type) {
+	case nil:
+		return &ConflictResolution{Type: ConflictResolutionKeepBoth}, nil
+	case string:
+		switch resolutionType := ConflictResolutionType(result); resolutionType {
+		case ConflictResolutionLocal, ConflictResolutionRemote, ConflictResolutionKeepBoth:
+			return &ConflictResolution{Type: resolutionType}, nil
+		}
+		return nil, fmt.Errorf("Conflict resolver returned unknown resolution %q", result)
+	case map[string]interface{}:
+		return &ConflictResolution{Type: ConflictResolutionMerge, Body: Body(result)}, nil
+	default:
+		base.Warnf(base.KeyAll, "Conflict resolver returned unexpected result %v Type: %T", base.UD(result), result)
+		return nil, fmt.Errorf("Conflict resolver returned unexpected result of type %T", result)
+	}
+}
+
+// isResolvableConflict returns true when adding a revision with the given parent would create a conflict that
+// should be passed to the conflict resolver.  Tombstoning an existing non-winning leaf isn't treated as a conflict.
+func isResolvableConflict(doc *Document, parentRevID string, deleted bool) bool {
+	if doc.CurrentRev == "" || parentRevID == doc.CurrentRev || doc.History[doc.CurrentRev].Deleted {
+		return false
+	}
+	if deleted && parentRevID != "" && doc.History.isLeaf(parentRevID) {
+		return false
+	}
+	return true
+}
+
+// resolveConflict runs the conflict resolver against the doc's current revision and newDoc, which must already have
+// been added to the doc's rev tree.  Tombstones the losing branch, and returns the document that should be stored as
+// the new revision - newDoc for a remote win, the tombstone of the remote branch for a local win, or the merged
+// revision.  The merged revision's DocAttachments are those of the local revision, to be combined with the remote
+// revision's by mergeConflictAttachments once they've been stored.  Returns a nil resolution when both branches
+// should be kept.
+func (db *Database) resolveConflict(doc *Document, newDoc *Document) (resolution *ConflictResolution, resolvedDoc *Document, err error) {
+
+	localRevID := doc.CurrentRev
+	localBody, err := db.getAvailableRev(doc, localRevID)
+	if err != nil {
+		return nil, nil, err
+	}
+	localBody = localBody.ShallowCopy()
+	localBody[BodyRev] = localRevID
+	if doc.History[localRevID].Deleted {
+		localBody[BodyDeleted] = true
+	}
+
+	remoteBody := newDoc.Body().ShallowCopy()
+	remoteBody[BodyId] = newDoc.ID
+	remoteBody[BodyRev] = newDoc.RevID
+	if newDoc.Deleted {
+		remoteBody[BodyDeleted] = true
+	}
+
+	resolution, err = db.Options.ConflictResolver.Resolve(localBody, remoteBody)
+	if err != nil {
+		return nil, nil, base.HTTPErrorf(http.StatusInternalServerError, "Exception in JS conflict resolver")
+	}
+
+	switch resolution.Type {
+	case ConflictResolutionKeepBoth:
+		return nil, nil, nil
+	case ConflictResolutionLocal:
+		tombstone, err := db.tombstoneConflictBranch(doc, newDoc.RevID)
+		if err != nil {
+			return nil, nil, err
+		}
+		tombstoneDoc := &Document{ID: newDoc.ID, RevID: tombstone, Deleted: true}
+		tombstoneDoc.UpdateBody(Body{BodyDeleted: true})
+		resolvedDoc = tombstoneDoc
+	case ConflictResolutionRemote:
+		if _, err := db.tombstoneConflictBranch(doc, localRevID); err != nil {
+			return nil, nil, err
+		}
+		resolvedDoc = newDoc
+	case ConflictResolutionMerge:
+		if _, err := db.tombstoneConflictBranch(doc, localRevID); err != nil {
+			return nil, nil, err
+		}
+		mergedBody := stripAllSpecialProperties(resolution.Body)
+		generation, _ := ParseRevID(newDoc.RevID)
+		mergedRevID, err := createRevID(generation+1, newDoc.RevID, mergedBody)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := doc.History.addRevision(newDoc.ID, RevInfo{ID: mergedRevID, Parent: newDoc.RevID}); err != nil {
+			return nil, nil, err
+		}
+		mergedDoc := &Document{ID: newDoc.ID, RevID: mergedRevID}
+		mergedDoc.UpdateBody(mergedBody)
+		mergedDoc.DocAttachments = make(AttachmentsMeta, len(doc.Attachments))
+		for name, meta := range doc.Attachments {
+			mergedDoc.DocAttachments[name] = meta
+		}
+		resolvedDoc = mergedDoc
+	}
+
+	base.DebugfCtx(db.Ctx, base.KeyCRUD, "Conflict resolver resolved conflict between %q and %q for doc %q as %s",
+		localRevID, newDoc.RevID, base.UD(newDoc.ID), resolution.Type)
+	return resolution, resolvedDoc, nil
+}
+
+// mergeConflictAttachments returns the attachments of a merged revision: those of the local revision, along with the
+// stored attachments of the remote revision it descends from, which take precedence where both have the same name.
+func mergeConflictAttachments(local, remote AttachmentsMeta) AttachmentsMeta {
+	merged := make(AttachmentsMeta, len(local)+len(remote))
+	for name, meta := range local {
+		merged[name] = meta
+	}
+	for name, meta := range remote {
+		merged[name] = meta
+	}
+	return merged
+}
+
+// tombstoneConflictBranch adds a tombstone revision as a child of the given leaf revision, and returns its revID.
+func (db *Database) tombstoneConflictBranch(doc *Document, leafRevID string) (string, error) {
+	generation, _ := ParseRevID(leafRevID)
+	tombstoneRevID, err := createRevID(generation+1, leafRevID, Body{BodyDeleted: true})
+	if err != nil {
+		return "", err
+	}
+	if err := doc.History.addRevision(doc.ID, RevInfo{ID: tombstoneRevID, Parent: leafRevID, Deleted: true}); err != nil {
+		return "", err
+	}
+	doc.setNonWinningRevisionBody(tombstoneRevID, []byte("{}"), db.AllowExternalRevBodyStorage())
+	return tombstoneRevID, nil
+}
+
+// Increments the auto-resolved conflict stat matching the given resolution.
+func (db *Database) updateConflictResolutionStats(resolution *ConflictResolution) {
+	switch resolution.Type {
+	case ConflictResolutionLocal:
+		db.DbStats.CblReplicationPush().Add(base.StatKeyConflictResolvedLocalCount, 1)
+	case ConflictResolutionRemote:
+		db.DbStats.CblReplicationPush().Add(base.StatKeyConflictResolvedRemoteCount, 1)
+	case ConflictResolutionMerge:
+		db.DbStats.CblReplicationPush().Add(base.StatKeyConflictResolvedMergeCount, 1)
+	}
+}
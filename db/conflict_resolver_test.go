@@ -0,0 +1,156 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	goassert "github.com/couchbaselabs/go.assert"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Creates doc with revisions 1-a and 2-a, then pushes a conflicting 2-b using new_edits=false.  Returns the revision
+// ID given for the push.
+func pushConflictingRevision(t *testing.T, db *Database, docID string) (string, error) {
+	_, err := db.PutExistingRevWithBody(docID, Body{"n": 1}, []string{"1-a"}, false)
+	assert.NoError(t, err, "add 1-a")
+	_, err = db.PutExistingRevWithBody(docID, Body{"n": 2, "local": true}, []string{"2-a", "1-a"}, false)
+	assert.NoError(t, err, "add 2-a")
+
+	body := Body{"n": 3, "remote": true}
+	_, err = db.PutExistingRevWithBody(docID, body, []string{"2-b", "1-a"}, false)
+	revID, _ := body[BodyRev].(string)
+	return revID, err
+}
+
+// Asserts that the branch ending in revID has been tombstoned.
+func assertBranchTombstoned(t *testing.T, doc *Document, revID string) {
+	for _, leaf := range doc.History.GetLeaves() {
+		if doc.History[leaf].Parent == revID {
+			assert.True(t, doc.History[leaf].Deleted, "Expected leaf %s to be a tombstone", leaf)
+			return
+		}
+	}
+	t.Errorf("No tombstone found for branch %s", revID)
+}
+
+func TestConflictResolverLocalWins(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	db.Options.AllowConflicts = base.BoolPtr(false)
+	db.Options.ConflictResolver = NewConflictResolverFunction(`function(local, remote) { return "local"; }`, base.JSOptions{})
+
+	revID, err := pushConflictingRevision(t, db, "doc1")
+	assert.NoError(t, err, "push 2-b")
+	assert.Equal(t, "2-a", revID)
+
+	doc, err := db.GetDocument("doc1", DocUnmarshalAll)
+	assert.NoError(t, err)
+	goassert.Equals(t, doc.CurrentRev, "2-a")
+	assert.Equal(t, true, doc.Body()["local"])
+	assertBranchTombstoned(t, doc, "2-b")
+	assert.Equal(t, base.ExpvarIntVal(1), db.DbStats.CblReplicationPush().Get(base.StatKeyConflictResolvedLocalCount))
+}
+
+func TestConflictResolverRemoteWins(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	db.Options.AllowConflicts = base.BoolPtr(false)
+	db.Options.ConflictResolver = NewConflictResolverFunction(`function(local, remote) { return "remote"; }`, base.JSOptions{})
+
+	revID, err := pushConflictingRevision(t, db, "doc1")
+	assert.NoError(t, err, "push 2-b")
+	assert.Equal(t, "2-b", revID)
+
+	doc, err := db.GetDocument("doc1", DocUnmarshalAll)
+	assert.NoError(t, err)
+	goassert.Equals(t, doc.CurrentRev, "2-b")
+	assert.Equal(t, true, doc.Body()["remote"])
+	assertBranchTombstoned(t, doc, "2-a")
+	assert.Equal(t, base.ExpvarIntVal(1), db.DbStats.CblReplicationPush().Get(base.StatKeyConflictResolvedRemoteCount))
+}
+
+func TestConflictResolverMerge(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	db.Options.AllowConflicts = base.BoolPtr(false)
+	db.Options.ConflictResolver = NewConflictResolverFunction(`function(local, remote) {
+		return {n: local.n + remote.n, local: local.local, remote: remote.remote};
+	}`, base.JSOptions{})
+
+	revID, err := pushConflictingRevision(t, db, "doc1")
+	assert.NoError(t, err, "push 2-b")
+
+	doc, err := db.GetDocument("doc1", DocUnmarshalAll)
+	assert.NoError(t, err)
+	assert.Equal(t, doc.CurrentRev, revID)
+	generation, _ := ParseRevID(doc.CurrentRev)
+	goassert.Equals(t, generation, 3)
+	goassert.Equals(t, doc.History[doc.CurrentRev].Parent, "2-b")
+	assert.Equal(t, float64(5), doc.Body()["n"])
+	assert.Equal(t, true, doc.Body()["local"])
+	assert.Equal(t, true, doc.Body()["remote"])
+	assertBranchTombstoned(t, doc, "2-a")
+	assert.Equal(t, base.ExpvarIntVal(1), db.DbStats.CblReplicationPush().Get(base.StatKeyConflictResolvedMergeCount))
+}
+
+func TestConflictResolverMergeAttachments(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	db.Options.AllowConflicts = base.BoolPtr(false)
+	db.Options.ConflictResolver = NewConflictResolverFunction(`function(local, remote) {
+		return {n: local.n + remote.n};
+	}`, base.JSOptions{})
+
+	// The attachment is only on the local branch
+	_, err := db.PutExistingRevWithBody("doc1", Body{"n": 1}, []string{"1-a"}, false)
+	assert.NoError(t, err, "add 1-a")
+	_, err = db.PutExistingRevWithBody("doc1", Body{"n": 2, BodyAttachments: map[string]interface{}{
+		"hello.txt": map[string]interface{}{"data": "aGVsbG8gd29ybGQ="},
+	}}, []string{"2-a", "1-a"}, false)
+	assert.NoError(t, err, "add 2-a")
+	_, err = db.PutExistingRevWithBody("doc1", Body{"n": 3}, []string{"2-b", "1-a"}, false)
+	assert.NoError(t, err, "push 2-b")
+
+	doc, err := db.GetDocument("doc1", DocUnmarshalAll)
+	assert.NoError(t, err)
+	goassert.Equals(t, doc.History[doc.CurrentRev].Parent, "2-b")
+	require.Contains(t, doc.Attachments, "hello.txt")
+
+	body, err := db.GetRev("doc1", "", false, []string{})
+	assert.NoError(t, err)
+	atts := GetBodyAttachments(body)
+	require.Contains(t, atts, "hello.txt")
+	hello := atts["hello.txt"].(map[string]interface{})
+	assert.Equal(t, "hello world", string(hello["data"].([]byte)))
+}
+
+func TestConflictResolverKeepBoth(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	db.Options.ConflictResolver = NewConflictResolverFunction(`function(local, remote) { return "keep_both"; }`, base.JSOptions{})
+
+	// With conflicts allowed, both branches are kept
+	revID, err := pushConflictingRevision(t, db, "doc1")
+	assert.NoError(t, err, "push 2-b")
+	assert.Equal(t, "2-b", revID)
+	doc, err := db.GetDocument("doc1", DocUnmarshalAll)
+	assert.NoError(t, err)
+	goassert.Equals(t, len(doc.History.GetLeaves()), 2)
+	goassert.Equals(t, doc.CurrentRev, "2-b")
+
+	// With conflicts disallowed, the push is rejected
+	db.Options.AllowConflicts = base.BoolPtr(false)
+	_, err = pushConflictingRevision(t, db, "doc2")
+	assertHTTPError(t, err, 409)
+}
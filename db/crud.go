@@ -10,6 +10,7 @@
 package db
 
 import (
+	"encoding/json"
 	"fmt"
 	"math"
 	"net/http"
@@ -395,6 +396,57 @@ func (db *Database) GetDelta(docID, fromRevID, toRevID string) (delta *RevisionD
 	return nil, nil, nil
 }
 
+// GetDeltaBody returns the delta from fromRevID to toRevID (or the current revision, if toRevID is empty) in the
+// form returned by the REST API: the delta under _delta, alongside _id, _rev, _deltaSrc and _deleted.  Returns a
+// nil body when delta sync is disabled or a delta isn't available, in which case the caller should fall back to
+// returning the full revision.
+func (db *Database) GetDeltaBody(docID, fromRevID, toRevID string) (Body, error) {
+	if !db.DeltaSyncEnabled() || fromRevID == "" {
+		return nil, nil
+	}
+
+	if toRevID == "" {
+		syncData, err := db.GetDocSyncData(docID)
+		if err != nil {
+			return nil, err
+		}
+		toRevID = syncData.CurrentRev
+	}
+
+	// The user must be able to see the source revision, as well as the target revision checked by GetDelta
+	fromBody, err := db.getRev(docID, fromRevID, 0, nil, nil, false, BodyShallowCopy)
+	if err != nil {
+		base.DebugfCtx(db.Ctx, base.KeyCRUD, "Unable to get deltaSrc %s for doc %q, returning full revision: %v", fromRevID, base.UD(docID), err)
+		return nil, nil
+	} else if fromBody["_removed"] != nil {
+		return nil, nil
+	}
+
+	db.DbStats.StatsDeltaSync().Add(base.StatKeyDeltasRequested, 1)
+	revDelta, redactedBody, err := db.GetDelta(docID, fromRevID, toRevID)
+	if err == ErrForbidden {
+		return nil, err
+	} else if err != nil {
+		base.InfofCtx(db.Ctx, base.KeyCRUD, "Error generating delta from %s to %s for doc %q, returning full revision: %v", fromRevID, toRevID, base.UD(docID), err)
+		return nil, nil
+	} else if redactedBody != nil || revDelta == nil {
+		return nil, nil
+	}
+
+	body := Body{
+		BodyId:       docID,
+		BodyRev:      revDelta.ToRevID,
+		BodyDeltaSrc: fromRevID,
+		BodyDelta:    json.RawMessage(revDelta.DeltaBytes),
+	}
+	if revDelta.ToDeleted {
+		body[BodyDeleted] = true
+	}
+
+	db.DbStats.StatsDeltaSync().Add(base.StatKeyDeltasSent, 1)
+	return body, nil
+}
+
 func (db *Database) authorizeUserForChannels(docID, revID string, channels base.Set, isDeleted bool, history Revisions) (isAuthorized bool, redactedBody Body) {
 	if db.user != nil {
 		if err := db.user.AuthorizeAnyChannel(channels); err != nil {
@@ -636,32 +688,11 @@ func (db *Database) OnDemandImportForWrite(docid string, doc *Document, deleted
 // Updates or creates a document.
 // The new body's BodyRev property must match the current revision's, if any.
 func (db *Database) Put(docid string, body Body) (newRevID string, doc *Document, err error) {
-	// Get the revision ID to match, and the new generation number:
-	matchRev, _ := body[BodyRev].(string)
-	generation, _ := ParseRevID(matchRev)
-	if generation < 0 {
-		return "", nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid revision ID")
-	}
-	generation++
-	deleted, _ := body[BodyDeleted].(bool)
-
-	expiry, err := body.ExtractExpiry()
+	newDoc, matchRev, deleted, expiry, err := preparePut(docid, body)
 	if err != nil {
-		return "", nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid expiry: %v", err)
-	}
-
-	// Create newDoc which will be used to pass around Body
-	newDoc := &Document{
-		ID: docid,
+		return "", nil, err
 	}
 
-	// Pull out attachments
-	newDoc.DocAttachments = GetBodyAttachments(body)
-	delete(body, BodyAttachments)
-	delete(body, BodyRevisions)
-
-	newDoc.UpdateBody(body)
-
 	allowImport := db.UseXattrs()
 	doc, newRevID, err = db.updateAndReturnDoc(newDoc.ID, allowImport, expiry, nil, func(doc *Document) (resultDoc *Document, resultAttachmentData AttachmentData, updatedExpiry *uint32, resultErr error) {
 
@@ -685,55 +716,185 @@ func (db *Database) Put(docid string, body Body) (newRevID string, doc *Document
 			}
 		}
 
-		// First, make sure matchRev matches an existing leaf revision:
-		if matchRev == "" {
-			matchRev = doc.CurrentRev
-			if matchRev != "" {
-				// PUT with no parent rev given, but there is an existing current revision.
-				// This is OK as long as the current one is deleted.
-				if !doc.History[matchRev].Deleted {
-					return nil, nil, nil, base.HTTPErrorf(http.StatusConflict, "Document exists")
-				}
-				generation, _ = ParseRevID(matchRev)
-				generation++
+		newAttachments, err := db.addPutRevision(doc, newDoc, matchRev, deleted)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return newDoc, newAttachments, nil, nil
+	})
+
+	body[BodyId] = docid
+	body[BodyRev] = newRevID
+
+	return newRevID, doc, err
+}
+
+// Checks the revision ID and expiry of a body to be written by Put, and returns the document to be saved, along
+// with the revision it's to replace, whether it's a deletion, and its expiry.  Removes the special properties
+// that aren't saved from body.
+func preparePut(docid string, body Body) (newDoc *Document, matchRev string, deleted bool, expiry uint32, err error) {
+	// Get the revision ID to match:
+	matchRev, _ = body[BodyRev].(string)
+	if generation, _ := ParseRevID(matchRev); generation < 0 {
+		return nil, "", false, 0, base.HTTPErrorf(http.StatusBadRequest, "Invalid revision ID")
+	}
+	deleted, _ = body[BodyDeleted].(bool)
+
+	expiry, err = body.ExtractExpiry()
+	if err != nil {
+		return nil, "", false, 0, base.HTTPErrorf(http.StatusBadRequest, "Invalid expiry: %v", err)
+	}
+
+	// Create newDoc which will be used to pass around Body
+	newDoc = &Document{
+		ID: docid,
+	}
+
+	// Pull out attachments
+	newDoc.DocAttachments = GetBodyAttachments(body)
+	delete(body, BodyAttachments)
+	delete(body, BodyRevisions)
+
+	newDoc.UpdateBody(body)
+	return newDoc, matchRev, deleted, expiry, nil
+}
+
+// Adds the revision prepared by preparePut to doc's rev tree as a child of matchRev, or of the current revision if
+// matchRev is empty, and processes its attachments.  Returns the data of the attachments to be added.
+func (db *Database) addPutRevision(doc *Document, newDoc *Document, matchRev string, deleted bool) (AttachmentData, error) {
+	generation, _ := ParseRevID(matchRev)
+	generation++
+
+	// First, make sure matchRev matches an existing leaf revision:
+	if matchRev == "" {
+		matchRev = doc.CurrentRev
+		if matchRev != "" {
+			// PUT with no parent rev given, but there is an existing current revision.
+			// This is OK as long as the current one is deleted.
+			if !doc.History[matchRev].Deleted {
+				return nil, base.HTTPErrorf(http.StatusConflict, "Document exists")
+			}
+			generation, _ = ParseRevID(matchRev)
+			generation++
+		}
+	} else if !doc.History.isLeaf(matchRev) || db.IsIllegalConflict(doc, matchRev, deleted, false) {
+		return nil, base.HTTPErrorf(http.StatusConflict, "Document revision conflict")
+	}
+
+	// Process the attachments, and populate _sync with metadata. This alters 'body' so it has to
+	// be done before calling createRevID (the ID is based on the digest of the body.)
+	newAttachments, err := db.storeAttachments(doc, newDoc.DocAttachments, generation, matchRev, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Make up a new _rev, and add it to the history:
+	newRev, err := createRevID(generation, matchRev, newDoc.Body())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := doc.History.addRevision(newDoc.ID, RevInfo{ID: newRev, Parent: matchRev, Deleted: deleted}); err != nil {
+		base.InfofCtx(db.Ctx, base.KeyCRUD, "Failed to add revision ID: %s, for doc: %s, error: %v", newRev, base.UD(newDoc.ID), err)
+		return nil, base.ErrRevTreeAddRevFailure
+	}
+
+	// move _attachment metadata to syncdata of doc after rev-id generation
+	doc.SyncData.Attachments = newDoc.DocAttachments
+	newDoc.RevID = newRev
+	newDoc.Deleted = deleted
+
+	return newAttachments, nil
+}
+
+// Applies a partial update to the current revision of a document.  If matchRev is non-empty it must be the
+// document's current revision.  The patch is applied within the CAS retry loop, so concurrent updates to the
+// document are merged rather than rejected as conflicts.
+func (db *Database) Patch(docid string, matchRev string, patch DocumentPatch) (newRevID string, doc *Document, err error) {
+	if matchRev != "" {
+		if generation, _ := ParseRevID(matchRev); generation < 1 {
+			return "", nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid revision ID")
+		}
+	}
+
+	newDoc := &Document{
+		ID: docid,
+	}
+
+	allowImport := db.UseXattrs()
+	doc, newRevID, err = db.updateAndReturnDoc(newDoc.ID, allowImport, 0, nil, func(doc *Document) (resultDoc *Document, resultAttachmentData AttachmentData, updatedExpiry *uint32, resultErr error) {
+		// (Be careful: this block can be invoked multiple times if there are races!)
+
+		// If the existing doc isn't an SG write, import prior to updating
+		if isSgWrite, _ := doc.IsSGWrite(nil); !isSgWrite && db.UseXattrs() {
+			err := db.OnDemandImportForWrite(newDoc.ID, doc, false)
+			if err != nil {
+				return nil, nil, nil, err
 			}
-		} else if !doc.History.isLeaf(matchRev) || db.IsIllegalConflict(doc, matchRev, deleted, false) {
+		}
+
+		// Patches can only be applied to an existing, non-deleted current revision
+		parentRev := doc.CurrentRev
+		if parentRev == "" {
+			return nil, nil, nil, base.HTTPErrorf(http.StatusNotFound, "missing")
+		} else if doc.History[parentRev].Deleted {
+			return nil, nil, nil, base.HTTPErrorf(http.StatusNotFound, "deleted")
+		} else if matchRev != "" && matchRev != parentRev {
 			return nil, nil, nil, base.HTTPErrorf(http.StatusConflict, "Document revision conflict")
 		}
 
-		// Process the attachments, and populate _sync with metadata. This alters 'body' so it has to
-		// be done before calling createRevID (the ID is based on the digest of the body.)
-		newAttachments, err := db.storeAttachments(doc, newDoc.DocAttachments, generation, matchRev, nil)
+		body, err := patch.Apply(doc.Body().DeepCopy())
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for key := range body {
+			if strings.HasPrefix(key, "_") {
+				return nil, nil, nil, base.HTTPErrorf(http.StatusBadRequest, "Patch may not set top level properties beginning with '_'")
+			}
+		}
+		newDoc.UpdateBody(body)
+
+		// Carry the current revision's attachments forward as stubs
+		newDoc.DocAttachments = make(AttachmentsMeta, len(doc.SyncData.Attachments))
+		for name, meta := range doc.SyncData.Attachments {
+			newDoc.DocAttachments[name] = meta
+		}
+
+		generation, _ := ParseRevID(parentRev)
+		generation++
+		newAttachments, err := db.storeAttachments(doc, newDoc.DocAttachments, generation, parentRev, nil)
 		if err != nil {
 			return nil, nil, nil, err
 		}
 
-		// Make up a new _rev, and add it to the history:
-		newRev, err := createRevID(generation, matchRev, newDoc.Body())
+		newRev, err := createRevID(generation, parentRev, newDoc.Body())
 		if err != nil {
 			return nil, nil, nil, err
 		}
 
-		if err := doc.History.addRevision(newDoc.ID, RevInfo{ID: newRev, Parent: matchRev, Deleted: deleted}); err != nil {
+		if err := doc.History.addRevision(newDoc.ID, RevInfo{ID: newRev, Parent: parentRev}); err != nil {
 			base.InfofCtx(db.Ctx, base.KeyCRUD, "Failed to add revision ID: %s, for doc: %s, error: %v", newRev, base.UD(docid), err)
 			return nil, nil, nil, base.ErrRevTreeAddRevFailure
 		}
 
-		// move _attachment metadata to syncdata of doc after rev-id generation
 		doc.SyncData.Attachments = newDoc.DocAttachments
 		newDoc.RevID = newRev
-		newDoc.Deleted = deleted
 
-		return newDoc, newAttachments, nil, nil
-	})
+		// Keep the document's expiry, unless the sync function sets a new one
+		var expiry *uint32
+		if doc.Expiry != nil {
+			unixExpiry := uint32(doc.Expiry.Unix())
+			expiry = &unixExpiry
+		}
 
-	body[BodyId] = docid
-	body[BodyRev] = newRevID
+		return newDoc, newAttachments, expiry, nil
+	})
 
 	return newRevID, doc, err
 }
 
-// Adds an existing revision to a document along with its history (list of rev IDs.)
+// Adds an existing revision to a document along with its history (list of rev IDs.)  Returns the ID of the added
+// revision, or if the conflict resolver resolved a conflict with it, that of the resolution's current revision.
 func (db *Database) PutExistingRev(newDoc *Document, docHistory []string, noConflicts bool) (doc *Document, newRevID string, err error) {
 	newRev := docHistory[0]
 	generation, _ := ParseRevID(newRev)
@@ -741,9 +902,11 @@ func (db *Database) PutExistingRev(newDoc *Document, docHistory []string, noConf
 		return nil, "", base.HTTPErrorf(http.StatusBadRequest, "Invalid revision ID")
 	}
 
+	var conflictResolution *ConflictResolution // Set when the conflict resolver resolves a conflict
 	allowImport := db.UseXattrs()
 	doc, _, err = db.updateAndReturnDoc(newDoc.ID, allowImport, newDoc.DocExpiry, nil, func(doc *Document) (resultDoc *Document, resultAttachmentData AttachmentData, updatedExpiry *uint32, resultErr error) {
 		// (Be careful: this block can be invoked multiple times if there are races!)
+		conflictResolution = nil
 
 		var isSgWrite bool
 		var crc32Match bool
@@ -780,8 +943,12 @@ func (db *Database) PutExistingRev(newDoc *Document, docHistory []string, noConf
 			return nil, nil, nil, base.ErrUpdateCancel // No new revisions to add
 		}
 
+		// Conflicts are handed to the conflict resolver, when defined, once the new revisions have been added
+		resolveConflict := db.Options.ConflictResolver != nil && isResolvableConflict(doc, parent, newDoc.Deleted)
+
 		// Conflict-free mode check
-		if db.IsIllegalConflict(doc, parent, newDoc.Deleted, noConflicts) {
+		illegalConflict := db.IsIllegalConflict(doc, parent, newDoc.Deleted, noConflicts)
+		if illegalConflict && !resolveConflict {
 			return nil, nil, nil, base.HTTPErrorf(http.StatusConflict, "Document revision conflict")
 		}
 
@@ -798,6 +965,28 @@ func (db *Database) PutExistingRev(newDoc *Document, docHistory []string, noConf
 			}
 			parent = docHistory[i]
 		}
+		newDoc.RevID = newRev
+
+		resultDoc = newDoc
+		if resolveConflict {
+			resolution, resolvedDoc, err := db.resolveConflict(doc, newDoc)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if resolution == nil {
+				// Resolver chose to keep both branches - apply the usual conflict handling
+				if illegalConflict {
+					return nil, nil, nil, base.HTTPErrorf(http.StatusConflict, "Document revision conflict")
+				}
+			} else {
+				conflictResolution = resolution
+				resultDoc = resolvedDoc
+				if resolution.Type == ConflictResolutionLocal {
+					// The local revision remains current, so the incoming attachments aren't needed
+					return resultDoc, nil, nil, nil
+				}
+			}
+		}
 
 		// Process the attachments, replacing bodies with digests.
 		parentRevID := doc.History[newRev].Parent
@@ -807,11 +996,20 @@ func (db *Database) PutExistingRev(newDoc *Document, docHistory []string, noConf
 		}
 
 		doc.SyncData.Attachments = newDoc.DocAttachments
-		newDoc.RevID = newRev
+		if conflictResolution != nil && conflictResolution.Type == ConflictResolutionMerge {
+			// The merged revision keeps the local branch's attachments too
+			doc.SyncData.Attachments = mergeConflictAttachments(resultDoc.DocAttachments, newDoc.DocAttachments)
+		}
 
-		return newDoc, newAttachments, nil, nil
+		return resultDoc, newAttachments, nil, nil
 	})
 
+	if err == nil && conflictResolution != nil {
+		db.updateConflictResolutionStats(conflictResolution)
+		// The resolved conflict's winner - the merged revision, or the local one - is current, rather than newRev
+		return doc, doc.CurrentRev, nil
+	}
+
 	return doc, newRev, err
 }
 
@@ -912,29 +1110,29 @@ func (db *Database) storeOldBodyInRevTreeAndUpdateCurrent(doc *Document, prevCur
 
 // Run the sync function on the given document and body. Need to inject the document ID and rev ID temporarily to run
 // the sync function.
-func (db *Database) runSyncFn(doc *Document, body Body, newRevId string) (*uint32, string, base.Set, channels.AccessMap, channels.AccessMap, error) {
+func (db *Database) runSyncFn(doc *Document, body Body, newRevId string) (*uint32, string, base.Set, channels.AccessMap, channels.AccessMap, channels.GrantExpiry, error) {
 	body[BodyId] = doc.ID
 	body[BodyRev] = newRevId
 
-	channelSet, access, roles, syncExpiry, oldBody, err := db.getChannelsAndAccess(doc, body, newRevId)
+	channelSet, access, roles, grantExpiry, syncExpiry, oldBody, err := db.getChannelsAndAccess(doc, body, newRevId)
 	if err != nil {
-		return nil, ``, nil, nil, nil, err
+		return nil, ``, nil, nil, nil, channels.GrantExpiry{}, err
 	}
 	db.checkDocChannelsAndGrantsLimits(doc.ID, channelSet, access, roles)
 
 	delete(body, BodyId)
 	delete(body, BodyRev)
-	return syncExpiry, oldBody, channelSet, access, roles, nil
+	return syncExpiry, oldBody, channelSet, access, roles, grantExpiry, nil
 }
 
-func (db *Database) recalculateSyncFnForActiveRev(doc *Document, newRevID string) (channelSet base.Set, access, roles channels.AccessMap, syncExpiry *uint32, oldBodyJSON string, err error) {
+func (db *Database) recalculateSyncFnForActiveRev(doc *Document, newRevID string) (channelSet base.Set, access, roles channels.AccessMap, grantExpiry channels.GrantExpiry, syncExpiry *uint32, oldBodyJSON string, err error) {
 	// In some cases an older revision might become the current one. If so, get its
 	// channels & access, for purposes of updating the doc:
 	var curBody Body
 	if curBody, err = db.getAvailableRev(doc, doc.CurrentRev); curBody != nil {
 		base.DebugfCtx(db.Ctx, base.KeyCRUD, "updateDoc(%q): Rev %q causes %q to become current again",
 			base.UD(doc.ID), newRevID, doc.CurrentRev)
-		channelSet, access, roles, syncExpiry, oldBodyJSON, err = db.getChannelsAndAccess(doc, curBody, doc.CurrentRev)
+		channelSet, access, roles, grantExpiry, syncExpiry, oldBodyJSON, err = db.getChannelsAndAccess(doc, curBody, doc.CurrentRev)
 		if err != nil {
 			return
 		}
@@ -1125,7 +1323,7 @@ func (db *Database) documentUpdateFunc(docExists bool, doc *Document, allowImpor
 	doc.updateWinningRevAndSetDocFlags()
 	db.storeOldBodyInRevTreeAndUpdateCurrent(doc, prevCurrentRev, newRevID, newDoc)
 
-	syncExpiry, oldBodyJSON, channelSet, access, roles, err := db.runSyncFn(doc, body, newRevID)
+	syncExpiry, oldBodyJSON, channelSet, access, roles, grantExpiry, err := db.runSyncFn(doc, body, newRevID)
 	if err != nil {
 		return
 	}
@@ -1152,14 +1350,14 @@ func (db *Database) documentUpdateFunc(docExists bool, doc *Document, allowImpor
 		// need to update the doc's top-level Channels and Access properties to correspond
 		// to the current rev's state.
 		if newRevID != doc.CurrentRev {
-			channelSet, access, roles, syncExpiry, oldBodyJSON, err = db.recalculateSyncFnForActiveRev(doc, newRevID)
+			channelSet, access, roles, grantExpiry, syncExpiry, oldBodyJSON, err = db.recalculateSyncFnForActiveRev(doc, newRevID)
 		}
 		_, err = doc.updateChannels(channelSet)
 		if err != nil {
 			return
 		}
-		changedAccessPrincipals = doc.Access.updateAccess(doc, access)
-		changedRoleAccessUsers = doc.RoleAccess.updateAccess(doc, roles)
+		changedAccessPrincipals = doc.Access.updateAccess(doc, access, grantExpiry.Access)
+		changedRoleAccessUsers = doc.RoleAccess.updateAccess(doc, roles, grantExpiry.Roles)
 	} else {
 		base.DebugfCtx(db.Ctx, base.KeyCRUD, "updateDoc(%q): Rev %q leaves %q still current",
 			base.UD(doc.ID), newRevID, prevCurrentRev)
@@ -1437,8 +1635,8 @@ func (db *Database) MarkPrincipalsChanged(docid string, newRevID string, changed
 		user, err := db.Authenticator().GetUser(db.user.Name())
 		if err != nil {
 			base.WarnfCtx(db.Ctx, base.KeyAll, "Error reloading active db.user[%s], security information will not be recalculated until next authentication --> %+v", base.UD(db.user.Name()), err)
-		} else {
-			db.user = user
+		} else if user != nil {
+			db.user = reapplyAPIKey(user, db.user)
 		}
 	}
 
@@ -1487,6 +1685,7 @@ func (db *Database) getChannelsAndAccess(doc *Document, body Body, revID string)
 	result base.Set,
 	access channels.AccessMap,
 	roles channels.AccessMap,
+	grantExpiry channels.GrantExpiry,
 	expiry *uint32,
 	oldJson string,
 	err error) {
@@ -1506,7 +1705,7 @@ func (db *Database) getChannelsAndAccess(doc *Document, body Body, revID string)
 
 		var output *channels.ChannelMapperOutput
 		output, err = db.ChannelMapper.MapToChannelsAndAccess(body, oldJson,
-			makeUserCtx(db.user))
+			MakeUserCtx(db.user))
 
 		db.DbStats.CblReplicationPush().Add(base.StatKeySyncFunctionTime, time.Since(startTime).Nanoseconds())
 
@@ -1514,6 +1713,7 @@ func (db *Database) getChannelsAndAccess(doc *Document, body Body, revID string)
 			result = output.Channels
 			access = output.Access
 			roles = output.Roles
+			grantExpiry = output.GrantExpiry
 			expiry = output.Expiry
 			err = output.Rejection
 			if err != nil {
@@ -1540,11 +1740,11 @@ func (db *Database) getChannelsAndAccess(doc *Document, body Body, revID string)
 			result, err = channels.SetFromArray(array, channels.KeepStar)
 		}
 	}
-	return result, access, roles, expiry, oldJson, err
+	return result, access, roles, grantExpiry, expiry, oldJson, err
 }
 
 // Creates a userCtx object to be passed to the sync function
-func makeUserCtx(user auth.User) map[string]interface{} {
+func MakeUserCtx(user auth.User) map[string]interface{} {
 	if user == nil {
 		return nil
 	}
@@ -1814,6 +2014,9 @@ func (db *Database) CheckProposedRev(docid string, revid string, parentRevID str
 	} else if parentRevID == "" && doc.History[doc.CurrentRev].Deleted {
 		// Proposed rev has no parent and doc is currently deleted; OK to add:
 		return ProposedRev_OK
+	} else if db.Options.ConflictResolver != nil {
+		// Proposed rev conflicts, but will be handed to the conflict resolver when pushed:
+		return ProposedRev_OK
 	} else {
 		// Parent revision mismatch, so this is a conflict:
 		return ProposedRev_Conflict
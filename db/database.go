@@ -16,6 +16,7 @@ import (
 	"fmt"
 	"net/http"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -72,32 +73,45 @@ const (
 // Basic description of a database. Shared between all Database objects on the same database.
 // This object is thread-safe so it can be shared between HTTP handlers.
 type DatabaseContext struct {
-	Name               string                   // Database name
-	Bucket             base.Bucket              // Storage
-	BucketSpec         base.BucketSpec          // The BucketSpec
-	BucketLock         sync.RWMutex             // Control Access to the underlying bucket object
-	mutationListener   changeListener           // Caching feed listener
-	importListener     *importListener          // Import feed listener
-	sequences          *sequenceAllocator       // Source of new sequence numbers
-	ChannelMapper      *channels.ChannelMapper  // Runs JS 'sync' function
-	StartTime          time.Time                // Timestamp when context was instantiated
-	RevsLimit          uint32                   // Max depth a document's revision tree can grow to
-	autoImport         bool                     // Add sync data to new untracked couchbase server docs?  (Xattr mode specific)
-	revisionCache      RevisionCache            // Cache of recently-accessed doc revisions
-	changeCache        *changeCache             // Cache of recently-access channels
-	EventMgr           *EventManager            // Manages notification events
-	AllowEmptyPassword bool                     // Allow empty passwords?  Defaults to false
-	Options            DatabaseContextOptions   // Database Context Options
-	AccessLock         sync.RWMutex             // Allows DB offline to block until synchronous calls have completed
-	State              uint32                   // The runtime state of the DB from a service perspective
-	ExitChanges        chan struct{}            // Active _changes feeds on the DB will close when this channel is closed
-	OIDCProviders      auth.OIDCProviderMap     // OIDC clients
-	PurgeInterval      int                      // Metadata purge interval, in hours
-	serverUUID         string                   // UUID of the server, if available
-	DbStats            *DatabaseStats           // stats that correspond to this database context
-	CompactState       uint32                   // Status of database compaction
-	terminator         chan bool                // Signal termination of background goroutines
-	activeChannels     *channels.ActiveChannels // Tracks active replications by channel
+	Name               string                       // Database name
+	Bucket             base.Bucket                  // Storage
+	BucketSpec         base.BucketSpec              // The BucketSpec
+	BucketLock         sync.RWMutex                 // Control Access to the underlying bucket object
+	mutationListener   changeListener               // Caching feed listener
+	importListener     *importListener              // Import feed listener
+	sequences          *sequenceAllocator           // Source of new sequence numbers
+	ChannelMapper      channels.SyncMapper          // Runs JS 'sync' function, or applies sync rules
+	StartTime          time.Time                    // Timestamp when context was instantiated
+	RevsLimit          uint32                       // Max depth a document's revision tree can grow to
+	autoImport         bool                         // Add sync data to new untracked couchbase server docs?  (Xattr mode specific)
+	revisionCache      RevisionCache                // Cache of recently-accessed doc revisions
+	changeCache        *changeCache                 // Cache of recently-access channels
+	EventMgr           *EventManager                // Manages notification events
+	AllowEmptyPassword bool                         // Allow empty passwords?  Defaults to false
+	Options            DatabaseContextOptions       // Database Context Options
+	AccessLock         sync.RWMutex                 // Allows DB offline to block until synchronous calls have completed
+	State              uint32                       // The runtime state of the DB from a service perspective
+	ExitChanges        chan struct{}                // Active _changes feeds on the DB will close when this channel is closed
+	OIDCProviders      auth.OIDCProviderMap         // OIDC clients
+	LocalJWTValidator  *auth.LocalJWTValidator      // Validates JWTs issued by a trusted service, if configured
+	ClientCertMapper   *auth.ClientCertMapper       // Maps TLS client certificates to users, if configured
+	PurgeInterval      int                          // Metadata purge interval, in hours
+	serverUUID         string                       // UUID of the server, if available
+	DbStats            *DatabaseStats               // stats that correspond to this database context
+	CompactState       uint32                       // Status of database compaction
+	terminator         chan bool                    // Signal termination of background goroutines
+	activeChannels     *channels.ActiveChannels     // Tracks active replications by channel
+	nodeID             string                       // Identifies this node in the leases of background jobs
+	attachmentGCLock   sync.Mutex                   // Protects attachmentGCStatus
+	attachmentGCStatus *AttachmentGCStatus          // Attachment garbage collection running on this node, or nil
+	attachmentGCSaver  *jobCheckpointer             // Saves the checkpoints of attachmentGCStatus
+	resyncLock         sync.Mutex                   // Protects resyncStatus and resyncStop
+	resyncStatus       *ResyncStatus                // Background resync running on this node, or nil
+	resyncSaver        *jobCheckpointer             // Saves the checkpoints of resyncStatus
+	resyncStop         chan struct{}                // Closed to stop the background resync
+	resyncDone         chan struct{}                // Closed when the background resync has stopped
+	grantExpiryLock    sync.Mutex                   // Protects grantExpiryTimers
+	grantExpiryTimers  map[string]*grantExpiryTimer // Pending reloads of principals with expiring grants, by doc ID
 }
 
 type DatabaseContextOptions struct {
@@ -107,16 +121,24 @@ type DatabaseContextOptions struct {
 	AdminInterface            *string
 	UnsupportedOptions        UnsupportedOptions
 	OIDCOptions               *auth.OIDCOptions
-	DBOnlineCallback          DBOnlineCallback // Callback function to take the DB back online
+	LocalJWTOptions           *auth.LocalJWTOptions     // Validation of JWTs issued without an OIDC provider
+	ClientCertOptions         *auth.ClientCertOptions   // Authentication of users by TLS client certificate
+	LoginLockoutOptions       *auth.LoginLockoutOptions // Throttling of failed password logins, if set
+	PasswordPolicy            *auth.PasswordPolicy      // Requirements for user passwords, if set
+	DBOnlineCallback          DBOnlineCallback          // Callback function to take the DB back online
 	ImportOptions             ImportOptions
-	EnableXattr               bool             // Use xattr for _sync
-	LocalDocExpirySecs        uint32           // The _local doc expiry time in seconds
-	SessionCookieName         string           // Pass-through DbConfig.SessionCookieName
-	AllowConflicts            *bool            // False forbids creating conflicts
-	SendWWWAuthenticateHeader *bool            // False disables setting of 'WWW-Authenticate' header
-	UseViews                  bool             // Force use of views
-	DeltaSyncOptions          DeltaSyncOptions // Delta Sync Options
-	CompactInterval           uint32           // Interval in seconds between compaction is automatically ran - 0 means don't run
+	EnableXattr               bool                              // Use xattr for _sync
+	LocalDocExpirySecs        uint32                            // The _local doc expiry time in seconds
+	SessionCookieName         string                            // Pass-through DbConfig.SessionCookieName
+	AllowConflicts            *bool                             // False forbids creating conflicts
+	SendWWWAuthenticateHeader *bool                             // False disables setting of 'WWW-Authenticate' header
+	UseViews                  bool                              // Force use of views
+	DeltaSyncOptions          DeltaSyncOptions                  // Delta Sync Options
+	CompactInterval           uint32                            // Interval in seconds between compaction is automatically ran - 0 means don't run
+	ConflictResolver          *ConflictResolverFunction         // Optional resolver for conflicts created by pushed revisions
+	ChangesFilters            map[string]*ChangesFilterFunction // Named filter functions for changes feeds
+	AttachmentStore           AttachmentStore                   // Where attachment bodies are stored; defaults to the bucket
+	JSOptions                 base.JSOptions                    // JavaScript engine and timeout for the sync function
 }
 
 type OidcTestProviderOptions struct {
@@ -232,6 +254,11 @@ func NewDatabaseContext(dbName string, bucket base.Bucket, autoImport bool, opti
 		autoImport: autoImport,
 		Options:    options,
 		DbStats:    dbStats,
+		nodeID:     base.CreateUUID(),
+	}
+
+	if dbContext.Options.AttachmentStore == nil {
+		dbContext.Options.AttachmentStore = NewBucketAttachmentStore(bucket)
 	}
 
 	if dbContext.AllowConflicts() {
@@ -354,6 +381,25 @@ func NewDatabaseContext(dbName string, bucket base.Bucket, autoImport bool, opti
 
 	}
 
+	if options.LocalJWTOptions != nil {
+		dbContext.LocalJWTValidator, err = auth.NewLocalJWTValidator(*options.LocalJWTOptions)
+		if err != nil {
+			return nil, err
+		}
+		for _, provider := range dbContext.OIDCProviders {
+			if provider.Issuer == options.LocalJWTOptions.Issuer {
+				return nil, base.RedactErrorf("JWT issuer %v is also defined for OIDC provider %q", base.UD(provider.Issuer), base.UD(provider.Name))
+			}
+		}
+	}
+
+	if options.ClientCertOptions != nil {
+		dbContext.ClientCertMapper, err = auth.NewClientCertMapper(*options.ClientCertOptions)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if dbContext.UseXattrs() {
 		// Set the purge interval for tombstone compaction
 		dbContext.PurgeInterval = DefaultPurgeInterval
@@ -465,6 +511,7 @@ func (context *DatabaseContext) Close() {
 	defer context.BucketLock.Unlock()
 
 	close(context.terminator)
+	context.stopGrantExpiryTimers()
 	context.sequences.Stop()
 	context.mutationListener.Stop()
 	context.changeCache.Stop()
@@ -566,9 +613,22 @@ func (context *DatabaseContext) Authenticator() *auth.Authenticator {
 	if context.Options.SessionCookieName != "" {
 		authenticator.SetSessionCookieName(context.Options.SessionCookieName)
 	}
+	if context.Options.LoginLockoutOptions != nil {
+		authenticator.SetLoginLockout(context.Options.LoginLockoutOptions, context.raiseAccountLockedEvent)
+	}
 	return authenticator
 }
 
+// Raises an AccountLocked event when a user or client address is locked out after failed logins.
+func (context *DatabaseContext) raiseAccountLockedEvent(lockout auth.LoginLockout) {
+	if !context.EventMgr.HasHandlerForEvent(AccountLocked) {
+		return
+	}
+	if err := context.EventMgr.RaiseAccountLockedEvent(context.Name, lockout); err != nil {
+		base.Warnf(base.KeyAll, "Error raising account locked event: %v", err)
+	}
+}
+
 // Makes a Database object given its name and bucket.
 func GetDatabase(context *DatabaseContext, user auth.User) (*Database, error) {
 	return &Database{DatabaseContext: context, user: user}, nil
@@ -591,7 +651,8 @@ func (db *Database) User() auth.User {
 	return db.user
 }
 
-// Reloads the database's User object, in case its persistent properties have been changed.
+// Reloads the database's User object, in case its persistent properties have been changed.  The restrictions of
+// the API key the user authenticated with, if any, are kept.
 func (db *Database) ReloadUser() error {
 	if db.user == nil {
 		return nil
@@ -603,11 +664,19 @@ func (db *Database) ReloadUser() error {
 	if user == nil {
 		return errors.New("User not found during reload")
 	} else {
-		db.user = user
+		db.user = reapplyAPIKey(user, db.user)
 		return nil
 	}
 }
 
+// Returns the reloaded user restricted to the API key the previous instance of the user authenticated with, if any.
+func reapplyAPIKey(user, oldUser auth.User) auth.User {
+	if key := auth.UserAPIKey(oldUser); key != nil {
+		return auth.RestrictToAPIKey(user, key)
+	}
+	return user
+}
+
 //////// ALL DOCUMENTS:
 
 type IDRevAndSequence struct {
@@ -769,6 +838,41 @@ func (db *DatabaseContext) DeleteUserSessions(userName string) error {
 	return results.Close()
 }
 
+// Returns all unexpired sessions for a user, oldest first
+func (db *DatabaseContext) GetUserSessions(userName string) ([]*auth.LoginSession, error) {
+
+	results, err := db.QuerySessions(userName)
+	if err != nil {
+		return nil, err
+	}
+
+	authenticator := db.Authenticator()
+	sessions := []*auth.LoginSession{}
+	var sessionsRow QueryIdRow
+	for results.Next(&sessionsRow) {
+		session, err := authenticator.GetSession(strings.TrimPrefix(sessionsRow.Id, base.SessionPrefix))
+		if err != nil {
+			_ = results.Close()
+			return nil, err
+		} else if session != nil && session.Username == userName {
+			sessions = append(sessions, session)
+		}
+	}
+	if err := results.Close(); err != nil {
+		return nil, err
+	}
+
+	// Sessions created before creation times were recorded sort by their expiration instead
+	created := func(session *auth.LoginSession) time.Time {
+		if session.Created != nil {
+			return *session.Created
+		}
+		return session.Expiration.Add(-session.Ttl)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return created(sessions[i]).Before(created(sessions[j])) })
+	return sessions, nil
+}
+
 // Trigger tombstone compaction from view and/or GSI indexes.  Several Sync Gateway indexes server tombstones (deleted documents with an xattr).
 // There currently isn't a mechanism for server to remove these docs from the index when the tombstone is purged by the server during
 // metadata purge, because metadata purge doesn't trigger a DCP event.
@@ -852,11 +956,6 @@ func (db *Database) Compact() (int, error) {
 	return purgedDocCount, nil
 }
 
-// Deletes all orphaned CouchDB attachments not used by any revisions.
-func VacuumAttachments(bucket base.Bucket) (int, error) {
-	return 0, base.HTTPErrorf(http.StatusNotImplemented, "Vacuum is temporarily out of order")
-}
-
 //////// SYNC FUNCTION:
 
 // Sets the database context's sync function based on the JS code from config.
@@ -866,16 +965,33 @@ func VacuumAttachments(bucket base.Bucket) (int, error) {
 func (context *DatabaseContext) UpdateSyncFun(syncFun string) (changed bool, err error) {
 	if syncFun == "" {
 		context.ChannelMapper = nil
-	} else if context.ChannelMapper != nil {
-		_, err = context.ChannelMapper.SetFunction(syncFun)
+	} else if jsMapper, ok := context.ChannelMapper.(*channels.ChannelMapper); ok {
+		_, err = jsMapper.SetFunction(syncFun)
 	} else {
-		context.ChannelMapper = channels.NewChannelMapper(syncFun)
+		context.ChannelMapper = channels.NewChannelMapperWithOptions(syncFun, context.Options.JSOptions)
 	}
 	if err != nil {
 		base.Warnf(base.KeyAll, "Error setting sync function: %s", err)
 		return
 	}
+	return context.saveSyncFunction(syncFun)
+}
+
+// Sets the database context's sync rules, which replace its sync function.  Returns a boolean indicating
+// whether the rules are different from the saved sync function or rules, as UpdateSyncFun does.
+func (context *DatabaseContext) UpdateSyncRules(rules channels.SyncRules) (changed bool, err error) {
+	mapper, err := channels.NewSyncRulesMapper(rules)
+	if err != nil {
+		base.Warnf(base.KeyAll, "Error setting sync rules: %s", err)
+		return false, err
+	}
+	context.ChannelMapper = mapper
+	return context.saveSyncFunction(mapper.Function())
+}
 
+// Saves the source of the sync function (or the sync rules) in the bucket, returning true if it's different
+// from the one previously saved.
+func (context *DatabaseContext) saveSyncFunction(syncFun string) (changed bool, err error) {
 	var syncData struct { // format of the sync-fn document
 		Sync string
 	}
@@ -910,7 +1026,7 @@ func (db *Database) UpdateAllDocChannels() (int, error) {
 
 	base.Infof(base.KeyAll, "Recomputing document channels...")
 
-	results, err := db.QueryResync()
+	results, err := db.QueryResync("", 0)
 	if err != nil {
 		return 0, err
 	}
@@ -931,110 +1047,12 @@ func (db *Database) UpdateAllDocChannels() (int, error) {
 
 	var importRow QueryIdRow
 	for results.Next(&importRow) {
-		docid := importRow.Id
-		key := realDocID(docid)
-
 		docCount++
-		documentUpdateFunc := func(doc *Document) (updatedDoc *Document, shouldUpdate bool, updatedExpiry *uint32, err error) {
-			imported := false
-			if !doc.HasValidSyncData() {
-				// This is a document not known to the sync gateway. Ignore it:
-				return nil, false, nil, base.ErrUpdateCancel
-			} else {
-				base.Debugf(base.KeyCRUD, "\tRe-syncing document %q", base.UD(docid))
-			}
-
-			// Run the sync fn over each current/leaf revision, in case there are conflicts:
-			changed := 0
-			doc.History.forEachLeaf(func(rev *RevInfo) {
-				body, _ := db.getRevFromDoc(doc, rev.ID, false)
-				channels, access, roles, syncExpiry, _, err := db.getChannelsAndAccess(doc, body, rev.ID)
-				if err != nil {
-					// Probably the validator rejected the doc
-					base.Warnf(base.KeyAll, "Error calling sync() on doc %q: %v", base.UD(docid), err)
-					access = nil
-					channels = nil
-				}
-				rev.Channels = channels
-
-				if rev.ID == doc.CurrentRev {
-					changedChannels, err := doc.updateChannels(channels)
-					changed = len(doc.Access.updateAccess(doc, access)) +
-						len(doc.RoleAccess.updateAccess(doc, roles)) +
-						len(changedChannels)
-					if err != nil {
-						return
-					}
-					// Only update document expiry based on the current (active) rev
-					if syncExpiry != nil {
-						doc.UpdateExpiry(*syncExpiry)
-						updatedExpiry = syncExpiry
-					}
-				}
-			})
-			shouldUpdate = changed > 0 || imported
-			return doc, shouldUpdate, updatedExpiry, nil
-		}
-		var err error
-		if db.UseXattrs() {
-			writeUpdateFunc := func(currentValue []byte, currentXattr []byte, cas uint64) (
-				raw []byte, rawXattr []byte, deleteDoc bool, expiry *uint32, err error) {
-				// There's no scenario where a doc should from non-deleted to deleted during UpdateAllDocChannels processing,
-				// so deleteDoc is always returned as false.
-				if currentValue == nil || len(currentValue) == 0 {
-					return nil, nil, deleteDoc, nil, base.ErrUpdateCancel
-				}
-				doc, err := unmarshalDocumentWithXattr(docid, currentValue, currentXattr, cas, DocUnmarshalAll)
-				if err != nil {
-					return nil, nil, deleteDoc, nil, err
-				}
-
-				updatedDoc, shouldUpdate, updatedExpiry, err := documentUpdateFunc(doc)
-				if err != nil {
-					return nil, nil, deleteDoc, nil, err
-				}
-				if shouldUpdate {
-					base.Infof(base.KeyAccess, "Saving updated channels and access grants of %q", base.UD(docid))
-					if updatedExpiry != nil {
-						updatedDoc.UpdateExpiry(*updatedExpiry)
-					}
-					raw, rawXattr, err = updatedDoc.MarshalWithXattr()
-					return raw, rawXattr, deleteDoc, updatedExpiry, err
-				} else {
-					return nil, nil, deleteDoc, nil, base.ErrUpdateCancel
-				}
-			}
-			_, err = db.Bucket.WriteUpdateWithXattr(key, base.SyncXattrName, 0, nil, writeUpdateFunc)
-		} else {
-			_, err = db.Bucket.Update(key, 0, func(currentValue []byte) ([]byte, *uint32, error) {
-				// Be careful: this block can be invoked multiple times if there are races!
-				if currentValue == nil {
-					return nil, nil, base.ErrUpdateCancel // someone deleted it?!
-				}
-				doc, err := unmarshalDocument(docid, currentValue)
-				if err != nil {
-					return nil, nil, err
-				}
-				updatedDoc, shouldUpdate, updatedExpiry, err := documentUpdateFunc(doc)
-				if err != nil {
-					return nil, nil, err
-				}
-				if shouldUpdate {
-					base.Infof(base.KeyAccess, "Saving updated channels and access grants of %q", base.UD(docid))
-					if updatedExpiry != nil {
-						updatedDoc.UpdateExpiry(*updatedExpiry)
-					}
-					updatedBytes, marshalErr := base.JSONMarshal(updatedDoc)
-					return updatedBytes, updatedExpiry, marshalErr
-				} else {
-					return nil, nil, base.ErrUpdateCancel
-				}
-			})
-		}
-		if err == nil {
+		updated, err := db.resyncDocument(importRow.Id, false)
+		if err != nil {
+			base.Warnf(base.KeyAll, "Error updating doc %q: %v", base.UD(importRow.Id), err)
+		} else if updated {
 			changeCount++
-		} else if err != base.ErrUpdateCancel {
-			base.Warnf(base.KeyAll, "Error updating doc %q: %v", base.UD(docid), err)
 		}
 	}
 
@@ -1060,6 +1078,159 @@ func (db *Database) UpdateAllDocChannels() (int, error) {
 	return changeCount, nil
 }
 
+// Re-runs the sync function on each current/leaf revision of a document, and saves the document if its channels or
+// access grants have changed.  If regenerateSequences is set, a changed document is given a new sequence as in a
+// normal update, so that the change cache and affected users see the change while the database is online.
+// Otherwise the document keeps its sequence, and the caller is responsible for the channel cache and principals.
+func (db *Database) resyncDocument(docid string, regenerateSequences bool) (updated bool, err error) {
+	key := realDocID(docid)
+	var docSequence uint64                           // Sequence assigned when regenerating, kept across retries
+	var unusedSequences []uint64                     // Sequences assigned by attempts that lost a race
+	var changedPrincipals, changedRoleUsers []string // Returned by documentUpdateFunc
+	var currentRev string
+
+	documentUpdateFunc := func(doc *Document) (updatedDoc *Document, shouldUpdate bool, updatedExpiry *uint32, err error) {
+		imported := false
+		if !doc.HasValidSyncData() {
+			// This is a document not known to the sync gateway. Ignore it:
+			return nil, false, nil, base.ErrUpdateCancel
+		} else {
+			base.Debugf(base.KeyCRUD, "\tRe-syncing document %q", base.UD(docid))
+		}
+		currentRev = doc.CurrentRev
+		changedPrincipals, changedRoleUsers = nil, nil
+
+		// Run the sync fn over each current/leaf revision, in case there are conflicts:
+		changed := 0
+		doc.History.forEachLeaf(func(rev *RevInfo) {
+			body, _ := db.getRevFromDoc(doc, rev.ID, false)
+			channels, access, roles, grantExpiry, syncExpiry, _, err := db.getChannelsAndAccess(doc, body, rev.ID)
+			if err != nil {
+				// Probably the validator rejected the doc
+				base.Warnf(base.KeyAll, "Error calling sync() on doc %q: %v", base.UD(docid), err)
+				access = nil
+				channels = nil
+			}
+			rev.Channels = channels
+
+			if rev.ID == doc.CurrentRev {
+				changedChannels, err := doc.updateChannels(channels)
+				changedPrincipals = doc.Access.updateAccess(doc, access, grantExpiry.Access)
+				changedRoleUsers = doc.RoleAccess.updateAccess(doc, roles, grantExpiry.Roles)
+				changed = len(changedPrincipals) + len(changedRoleUsers) + len(changedChannels)
+				if err != nil {
+					return
+				}
+				// Only update document expiry based on the current (active) rev
+				if syncExpiry != nil {
+					doc.UpdateExpiry(*syncExpiry)
+					updatedExpiry = syncExpiry
+				}
+			}
+		})
+		shouldUpdate = changed > 0 || imported
+		return doc, shouldUpdate, updatedExpiry, nil
+	}
+
+	// Channel removals and grants are recorded at the document's sequence, so when regenerating sequences a changed
+	// document is updated again from its stored value, after being assigned its new sequence.
+	resyncUpdateFunc := func(unmarshal func() (*Document, error)) (updatedDoc *Document, shouldUpdate bool, updatedExpiry *uint32, err error) {
+		doc, err := unmarshal()
+		if err != nil {
+			return nil, false, nil, err
+		}
+		updatedDoc, shouldUpdate, updatedExpiry, err = documentUpdateFunc(doc)
+		if err != nil || !shouldUpdate || !regenerateSequences {
+			return updatedDoc, shouldUpdate, updatedExpiry, err
+		}
+		if doc, err = unmarshal(); err != nil {
+			return nil, false, nil, err
+		}
+		if unusedSequences, err = db.assignSequence(docSequence, doc, unusedSequences); err != nil {
+			return nil, false, nil, err
+		}
+		docSequence = doc.Sequence
+		return documentUpdateFunc(doc)
+	}
+
+	if db.UseXattrs() {
+		writeUpdateFunc := func(currentValue []byte, currentXattr []byte, cas uint64) (
+			raw []byte, rawXattr []byte, deleteDoc bool, expiry *uint32, err error) {
+			// There's no scenario where a doc should from non-deleted to deleted during UpdateAllDocChannels processing,
+			// so deleteDoc is always returned as false.
+			if currentValue == nil || len(currentValue) == 0 {
+				return nil, nil, deleteDoc, nil, base.ErrUpdateCancel
+			}
+			updatedDoc, shouldUpdate, updatedExpiry, err := resyncUpdateFunc(func() (*Document, error) {
+				return unmarshalDocumentWithXattr(docid, currentValue, currentXattr, cas, DocUnmarshalAll)
+			})
+			if err != nil {
+				return nil, nil, deleteDoc, nil, err
+			}
+			if shouldUpdate {
+				base.Infof(base.KeyAccess, "Saving updated channels and access grants of %q", base.UD(docid))
+				if updatedExpiry != nil {
+					updatedDoc.UpdateExpiry(*updatedExpiry)
+				}
+				raw, rawXattr, err = updatedDoc.MarshalWithXattr()
+				return raw, rawXattr, deleteDoc, updatedExpiry, err
+			} else {
+				return nil, nil, deleteDoc, nil, base.ErrUpdateCancel
+			}
+		}
+		_, err = db.Bucket.WriteUpdateWithXattr(key, base.SyncXattrName, 0, nil, writeUpdateFunc)
+	} else {
+		_, err = db.Bucket.Update(key, 0, func(currentValue []byte) ([]byte, *uint32, error) {
+			// Be careful: this block can be invoked multiple times if there are races!
+			if currentValue == nil {
+				return nil, nil, base.ErrUpdateCancel // someone deleted it?!
+			}
+			updatedDoc, shouldUpdate, updatedExpiry, err := resyncUpdateFunc(func() (*Document, error) {
+				return unmarshalDocument(docid, currentValue)
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+			if shouldUpdate {
+				base.Infof(base.KeyAccess, "Saving updated channels and access grants of %q", base.UD(docid))
+				if updatedExpiry != nil {
+					updatedDoc.UpdateExpiry(*updatedExpiry)
+				}
+				updatedBytes, marshalErr := base.JSONMarshal(updatedDoc)
+				return updatedBytes, updatedExpiry, marshalErr
+			} else {
+				return nil, nil, base.ErrUpdateCancel
+			}
+		})
+	}
+
+	if err == base.ErrUpdateCancel {
+		err = nil
+	} else if err == nil {
+		updated = true
+	}
+
+	if !updated {
+		// Release any sequences assigned to the document, so the change cache doesn't wait for them
+		for _, seq := range append(unusedSequences, docSequence) {
+			if seq == 0 {
+				continue
+			}
+			if releaseErr := db.sequences.releaseSequence(seq); releaseErr != nil {
+				base.Warnf(base.KeyCRUD, "Error returned when releasing sequence %d. Falling back to skipped sequence handling.  Error:%v", seq, releaseErr)
+			}
+		}
+		return false, err
+	}
+
+	// The cached current revision has the channels it was in before the resync:
+	db.revisionCache.Remove(docid, currentRev)
+	if regenerateSequences {
+		db.MarkPrincipalsChanged(docid, currentRev, changedPrincipals, changedRoleUsers)
+	}
+	return true, nil
+}
+
 func (db *Database) invalUserRoles(username string) {
 	authr := db.Authenticator()
 	if user, _ := authr.GetUser(username); user != nil {
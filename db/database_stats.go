@@ -199,6 +199,9 @@ func initEmptyStatsMap(key string, d *DatabaseStats) *expvar.Map {
 		result.Set(base.StatKeyAttachmentPushCount, base.ExpvarIntVal(0))
 		result.Set(base.StatKeyAttachmentPushBytes, base.ExpvarIntVal(0))
 		result.Set(base.StatKeyConflictWriteCount, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyConflictResolvedLocalCount, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyConflictResolvedRemoteCount, base.ExpvarIntVal(0))
+		result.Set(base.StatKeyConflictResolvedMergeCount, base.ExpvarIntVal(0))
 		d.cblReplicationPush = result
 	case base.StatsGroupKeyCblReplicationPull:
 		result.Set(base.StatKeyPullReplicationsActiveContinuous, base.ExpvarIntVal(0))
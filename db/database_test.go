@@ -1607,3 +1607,40 @@ func BenchmarkPut(b *testing.B) {
 
 	db.Close()
 }
+
+// Compares the JavaScript engines running a sync function on every Put.
+func BenchmarkPutSyncFn(b *testing.B) {
+	defer base.DisableTestLogging()()
+
+	syncFn := `function(doc, oldDoc) {
+		if (doc.type != "item") { throw({forbidden: "not an item"}); }
+		channel("items", "owner-" + doc.owner);
+		access(doc.owner, "owner-" + doc.owner);
+	}`
+	body := Body{"type": "item", "owner": "alice", "key1": "value1", "key2": 1234}
+
+	for _, engine := range []base.JSEngine{base.JSEngineOtto, base.JSEngineGoja} {
+		b.Run(string(engine), func(b *testing.B) {
+			bucket, err := ConnectToBucket(base.BucketSpec{
+				Server:          base.UnitTestUrl(),
+				CouchbaseDriver: base.ChooseCouchbaseDriver(base.DataBucket),
+				BucketName:      "Bucket-" + string(engine)})
+			assert.NoError(b, err)
+			context, err := NewDatabaseContext("db", bucket, false, DatabaseContextOptions{
+				JSOptions: base.JSOptions{Engine: engine},
+			})
+			assert.NoError(b, err)
+			_, err = context.UpdateSyncFun(syncFn)
+			assert.NoError(b, err)
+			db, err := CreateDatabase(context)
+			assert.NoError(b, err)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				db.Put(fmt.Sprintf("doc%d", i), body)
+			}
+
+			db.Close()
+		})
+	}
+}
@@ -16,15 +16,17 @@ import (
 
 // ViewVersion should be incremented every time any view definition changes.
 // Currently both Sync Gateway design docs share the same view version, but this is
-// subject to change if the update schedule diverges
-const DesignDocVersion = "2.1"
+// subject to change if the update schedule diverges.
+// 2.2 added the attachments view used by attachment garbage collection.  As the version is part of the design doc
+// names, upgrading from 2.1 creates new design docs, so every view is reindexed on upgrade.
+const DesignDocVersion = "2.2"
 const DesignDocFormat = "%s_%s" // Design doc prefix, view version
 
 // DesignDocPreviousVersions defines the set of versions included during removal of obsolete
 // design docs.  Must be updated whenever DesignDocVersion is incremented.
 // Uses a hardcoded list instead of version comparison to simpify the processing
 // (particularly since there aren't expected to be many view versions before moving to GSI).
-var DesignDocPreviousVersions = []string{"", "2.0"}
+var DesignDocPreviousVersions = []string{"", "2.0", "2.1"}
 
 const (
 	DesignDocSyncGatewayPrefix      = "sync_gateway"
@@ -39,6 +41,7 @@ const (
 	ViewImport                      = "import"
 	ViewSessions                    = "sessions"
 	ViewTombstones                  = "tombstones"
+	ViewAttachments                 = "attachments"
 )
 
 func isInternalDDoc(ddocName string) bool {
@@ -392,6 +395,14 @@ func installViews(bucket base.Bucket) error {
                      		emit(sync.tombstoned_at, meta.id);}`
 	tombstones_map = fmt.Sprintf(tombstones_map, syncData)
 
+	// Attachments view - used for attachment garbage collection
+	// Key is the doc id of a stored attachment, or of the manifest of a chunked attachment
+	attachments_map := `function (doc, meta) {
+                     	var prefix = meta.id.substring(0,%d);
+                     	if (prefix == %q || meta.id.substring(0,%d) == %q)
+                     		emit(meta.id, null);}`
+	attachments_map = fmt.Sprintf(attachments_map, len(base.AttPrefix), base.AttPrefix, len(base.AttManifestPrefix), base.AttManifestPrefix)
+
 	// All-principals view
 	// Key is name; value is true for user, false for role
 	principals_map := `function (doc, meta) {
@@ -534,10 +545,11 @@ func installViews(bucket base.Bucket) error {
 
 	designDocMap[DesignDocSyncHousekeeping()] = sgbucket.DesignDoc{
 		Views: sgbucket.ViewMap{
-			ViewAllDocs:    sgbucket.ViewDef{Map: alldocs_map, Reduce: "_count"},
-			ViewImport:     sgbucket.ViewDef{Map: import_map, Reduce: "_count"},
-			ViewSessions:   sgbucket.ViewDef{Map: sessions_map},
-			ViewTombstones: sgbucket.ViewDef{Map: tombstones_map},
+			ViewAllDocs:     sgbucket.ViewDef{Map: alldocs_map, Reduce: "_count"},
+			ViewImport:      sgbucket.ViewDef{Map: import_map, Reduce: "_count"},
+			ViewSessions:    sgbucket.ViewDef{Map: sessions_map},
+			ViewTombstones:  sgbucket.ViewDef{Map: tombstones_map},
+			ViewAttachments: sgbucket.ViewDef{Map: attachments_map},
 		},
 		Options: &sgbucket.DesignDocOptions{
 			IndexXattrOnTombstones: true, // For ViewTombstones
@@ -757,12 +757,17 @@ func (doc *Document) IsChannelRemoval(revID string) (body Body, history Revision
 	return body, history, channels, true, nil
 }
 
-// Updates a document's channel/role UserAccessMap with new access settings from an AccessMap.
+// Updates a document's channel/role UserAccessMap with new access settings from an AccessMap, and the
+// expiry of any time-limited grants from an AccessExpiryMap.
 // Returns an array of the user/role names whose access has changed as a result.
-func (accessMap *UserAccessMap) updateAccess(doc *Document, newAccess channels.AccessMap) (changedUsers []string) {
+func (accessMap *UserAccessMap) updateAccess(doc *Document, newAccess channels.AccessMap, newExpiry channels.AccessExpiryMap) (changedUsers []string) {
 	// Update users already appearing in doc.Access:
 	for name, access := range *accessMap {
-		if access.UpdateAtSequence(newAccess[name], doc.Sequence) {
+		changed := access.UpdateAtSequence(newAccess[name], doc.Sequence)
+		if updateGrantExpiry(access, newExpiry[name]) {
+			changed = true
+		}
+		if changed {
 			if len(access) == 0 {
 				delete(*accessMap, name)
 			}
@@ -776,6 +781,7 @@ func (accessMap *UserAccessMap) updateAccess(doc *Document, newAccess channels.A
 				*accessMap = UserAccessMap{}
 			}
 			(*accessMap)[name] = channels.AtSequence(access, doc.Sequence)
+			updateGrantExpiry((*accessMap)[name], newExpiry[name])
 			changedUsers = append(changedUsers, name)
 		}
 	}
@@ -789,6 +795,21 @@ func (accessMap *UserAccessMap) updateAccess(doc *Document, newAccess channels.A
 	return changedUsers
 }
 
+// Sets the expiry of each grant in a principal's access to the given Unix time, or clears it if the
+// grant isn't listed.  Returns true if any expiry changed.
+func updateGrantExpiry(access channels.TimedSet, expiries map[string]int64) (changed bool) {
+	for name := range access {
+		var expiry time.Time
+		if unixTime := expiries[name]; unixTime != 0 {
+			expiry = time.Unix(unixTime, 0)
+		}
+		if access.SetExpiry(name, expiry) {
+			changed = true
+		}
+	}
+	return changed
+}
+
 //////// MARSHALING ////////
 
 type documentRoot struct {
@@ -7,7 +7,6 @@ import (
 
 	sgbucket "github.com/couchbase/sg-bucket"
 	"github.com/couchbase/sync_gateway/base"
-	"github.com/robertkrimen/otto"
 )
 
 // Event type
@@ -17,6 +16,7 @@ const (
 	DocumentChange EventType = iota
 	DBStateChange
 	UserAdd
+	AccountLocked
 )
 
 // An event that can be raised during SG processing.
@@ -70,6 +70,21 @@ func (dsce *DBStateChangeEvent) EventType() EventType {
 	return DBStateChange
 }
 
+// AccountLockedEvent is raised when a user or client address is locked out after repeated failed logins.
+// Event has the name of the DB, the user name or client IP that was locked out and the end of the lockout.
+type AccountLockedEvent struct {
+	AsyncEvent
+	Doc Body
+}
+
+func (ale *AccountLockedEvent) String() string {
+	return fmt.Sprintf("Account locked event for db name: %s", ale.Doc["dbname"])
+}
+
+func (ale *AccountLockedEvent) EventType() EventType {
+	return AccountLocked
+}
+
 // Javascript function handling for events
 const kTaskCacheSize = 4
 
@@ -82,22 +97,21 @@ const (
 
 // A compiled JavaScript event function.
 type jsEventTask struct {
-	sgbucket.JSRunner
+	base.JSRunner
 	responseType ResponseType
 }
 
 // Compiles a JavaScript event function to a jsEventTask object.
-func newJsEventTask(funcSource string) (sgbucket.JSServerTask, error) {
+func newJsEventTask(funcSource string, jsOptions base.JSOptions) (sgbucket.JSServerTask, error) {
 	eventTask := &jsEventTask{}
-	err := eventTask.InitWithLogging(funcSource,
+	err := eventTask.InitWithLogging(jsOptions, funcSource,
 		func(s string) { base.Errorf(base.KeyJavascript, "Webhook %s", base.UD(s)) },
 		func(s string) { base.Infof(base.KeyJavascript, "Webhook %s", base.UD(s)) })
 	if err != nil {
 		return nil, err
 	}
 
-	eventTask.After = func(result otto.Value, err error) (interface{}, error) {
-		nativeValue, _ := result.Export()
+	eventTask.After = func(nativeValue interface{}, err error) (interface{}, error) {
 		/*
 			switch nativeValue := nativeValue.(type) {
 			case string:
@@ -126,13 +140,13 @@ type JSEventFunction struct {
 	*sgbucket.JSServer
 }
 
-func NewJSEventFunction(fnSource string) *JSEventFunction {
+func NewJSEventFunction(fnSource string, jsOptions base.JSOptions) *JSEventFunction {
 
 	base.Infof(base.KeyEvents, "Creating new JSEventFunction")
 	return &JSEventFunction{
 		JSServer: sgbucket.NewJSServer(fnSource, kTaskCacheSize,
 			func(fnSource string) (sgbucket.JSServerTask, error) {
-				return newJsEventTask(fnSource)
+				return newJsEventTask(fnSource, jsOptions)
 			}),
 	}
 }
@@ -150,6 +164,8 @@ func (ef *JSEventFunction) CallFunction(event Event) (interface{}, error) {
 		result, err = ef.Call(sgbucket.JSONString(event.DocBytes), sgbucket.JSONString(event.OldDoc))
 	case *DBStateChangeEvent:
 		result, err = ef.Call(event.Doc)
+	case *AccountLockedEvent:
+		result, err = ef.Call(event.Doc)
 	}
 
 	if err != nil {
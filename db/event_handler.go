@@ -32,8 +32,9 @@ type Webhook struct {
 // default HTTP post timeout
 const kDefaultWebhookTimeout = 60
 
-// Creates a new webhook handler based on the url and filter function.
-func NewWebhook(url string, filterFnString string, timeout *uint64) (*Webhook, error) {
+// Creates a new webhook handler based on the url and filter function.  The filter function is run with
+// the given JavaScript engine and timeout.
+func NewWebhook(url string, filterFnString string, timeout *uint64, jsOptions base.JSOptions) (*Webhook, error) {
 
 	var err error
 
@@ -46,7 +47,7 @@ func NewWebhook(url string, filterFnString string, timeout *uint64) (*Webhook, e
 		url: url,
 	}
 	if filterFnString != "" {
-		wh.filter = NewJSEventFunction(filterFnString)
+		wh.filter = NewJSEventFunction(filterFnString, jsOptions)
 	}
 
 	if timeout != nil {
@@ -104,6 +105,14 @@ func (wh *Webhook) HandleEvent(event Event) {
 		}
 		contentType = "application/json"
 		payload = bytes.NewBuffer(jsonOut)
+	case *AccountLockedEvent:
+		jsonOut, err := base.JSONMarshal(event.Doc)
+		if err != nil {
+			base.Warnf(base.KeyAll, "Error marshalling doc for webhook post")
+			return
+		}
+		contentType = "application/json"
+		payload = bytes.NewBuffer(jsonOut)
 	default:
 		base.Warnf(base.KeyAll, "Webhook invoked for unsupported event type.")
 		return
@@ -5,6 +5,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/couchbase/sync_gateway/auth"
 	"github.com/couchbase/sync_gateway/base"
 )
 
@@ -154,3 +155,28 @@ func (em *EventManager) RaiseDBStateChangeEvent(dbName string, state string, rea
 
 	return em.raiseEvent(event)
 }
+
+// Raises an event when a user or client address is locked out after repeated failed logins.
+func (em *EventManager) RaiseAccountLockedEvent(dbName string, lockout auth.LoginLockout) error {
+
+	if !em.activeEventTypes[AccountLocked] {
+		return nil
+	}
+
+	body := make(Body, 5)
+	body["dbname"] = dbName
+	if lockout.Username != "" {
+		body["name"] = lockout.Username
+	}
+	if lockout.ClientIP != "" {
+		body["client_ip"] = lockout.ClientIP
+	}
+	body["locked_until"] = lockout.LockedUntil.Format(base.ISO8601Format)
+	body["lockouts"] = lockout.Lockouts
+
+	event := &AccountLockedEvent{
+		Doc: body,
+	}
+
+	return em.raiseEvent(event)
+}
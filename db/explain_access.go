@@ -0,0 +1,264 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"sort"
+	"time"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// How an AccessGrant was made
+const (
+	AccessGrantAdmin        = "admin"         // By the admin API or config, as admin_channels or admin_roles
+	AccessGrantSyncFunction = "sync_function" // By an access() or role() call in the sync function
+	AccessGrantJWT          = "jwt"           // By the claims of the user's OIDC or JWT token
+	AccessGrantPublic       = "public"        // Every user can see the public "!" channel
+	AccessGrantRole         = "role"          // Inherited from one of the user's roles
+)
+
+// AccessGrant is one path by which a user was granted a channel (or a role).
+type AccessGrant struct {
+	Source        string         `json:"source"`                   // How the grant was made
+	Channel       string         `json:"channel,omitempty"`        // Set if the grant is of the "*" channel, rather than the one being explained
+	DocID         string         `json:"doc_id,omitempty"`         // For sync function grants, the document whose access() or role() call made it
+	Sequence      uint64         `json:"seq"`                      // Sequence at which the grant was made
+	Expiry        *time.Time     `json:"expiry,omitempty"`         // When a time-limited grant expires
+	Expired       bool           `json:"expired,omitempty"`        // True if a time-limited grant has expired, so gives no access
+	Role          string         `json:"role,omitempty"`           // For grants inherited from a role, the role
+	RoleGrants    []*AccessGrant `json:"role_grants,omitempty"`    // For grants inherited from a role, how the user was granted the role
+	ChannelGrants []*AccessGrant `json:"channel_grants,omitempty"` // For grants inherited from a role, how the role was granted the channel
+}
+
+// ChannelAccessExplanation lists the ways a user has been granted access to a channel.
+type ChannelAccessExplanation struct {
+	Channel string         `json:"channel"`
+	CanSee  bool           `json:"can_see"` // Whether the user can currently see the channel
+	Grants  []*AccessGrant `json:"grants"`
+}
+
+// DocAccessExplanation explains whether a user can see a document, through each of its channels.
+type DocAccessExplanation struct {
+	DocID    string                      `json:"doc_id"`
+	CanSee   bool                        `json:"can_see"` // Whether the user can currently see the document
+	Channels []*ChannelAccessExplanation `json:"channels"`
+}
+
+// ExplainChannelAccess returns every path by which the user has been granted access to the channel, including
+// grants of the "*" channel, and grants that have expired.
+func (context *DatabaseContext) ExplainChannelAccess(user auth.User, channelName string) (*ChannelAccessExplanation, error) {
+	explainer := accessExplainer{context: context, now: time.Now()}
+	grants, err := explainer.userChannelGrants(user, channelName)
+	if err != nil {
+		return nil, err
+	}
+	return &ChannelAccessExplanation{
+		Channel: channelName,
+		CanSee:  user.CanSeeChannel(channelName),
+		Grants:  grants,
+	}, nil
+}
+
+// ExplainDocAccess explains whether the user can see the current revision of a document, through each channel
+// it's in.
+func (context *DatabaseContext) ExplainDocAccess(user auth.User, docID string) (*DocAccessExplanation, error) {
+	doc, err := context.GetDocument(docID, DocUnmarshalSync)
+	if err != nil {
+		return nil, err
+	}
+
+	docChannels := make(base.Set, len(doc.Channels))
+	for channelName, removal := range doc.Channels {
+		if removal == nil {
+			docChannels[channelName] = struct{}{}
+		}
+	}
+
+	explainer := accessExplainer{context: context, now: time.Now()}
+	explanation := &DocAccessExplanation{
+		DocID:    docID,
+		CanSee:   user.AuthorizeAnyChannel(docChannels) == nil,
+		Channels: make([]*ChannelAccessExplanation, 0, len(docChannels)),
+	}
+	for _, channelName := range docChannels.ToArray() {
+		grants, err := explainer.userChannelGrants(user, channelName)
+		if err != nil {
+			return nil, err
+		}
+		explanation.Channels = append(explanation.Channels, &ChannelAccessExplanation{
+			Channel: channelName,
+			CanSee:  user.CanSeeChannel(channelName),
+			Grants:  grants,
+		})
+	}
+	sort.Slice(explanation.Channels, func(i, j int) bool {
+		return explanation.Channels[i].Channel < explanation.Channels[j].Channel
+	})
+	return explanation, nil
+}
+
+// Looks up grants, caching the results of access queries.
+type accessExplainer struct {
+	context      *DatabaseContext
+	now          time.Time
+	accessGrants map[string]map[string][]*AccessGrant // Sync function channel grants, by principal then channel
+}
+
+func (explainer *accessExplainer) userChannelGrants(user auth.User, channelName string) ([]*AccessGrant, error) {
+	grants, err := explainer.principalChannelGrants(user, channelName)
+	if err != nil {
+		return nil, err
+	}
+	if channelName == channels.DocumentStarChannel {
+		grants = append(grants, &AccessGrant{Source: AccessGrantPublic, Sequence: 1})
+	}
+
+	roleGrants, err := explainer.userRoleGrants(user)
+	if err != nil {
+		return nil, err
+	}
+	roleNames := make([]string, 0, len(roleGrants))
+	for roleName := range roleGrants {
+		roleNames = append(roleNames, roleName)
+	}
+	sort.Strings(roleNames)
+	for _, roleName := range roleNames {
+		role, err := explainer.context.Authenticator().GetRole(roleName)
+		if err != nil {
+			return nil, err
+		} else if role == nil {
+			continue
+		}
+		channelGrants, err := explainer.principalChannelGrants(role, channelName)
+		if err != nil {
+			return nil, err
+		}
+		if len(channelGrants) > 0 {
+			grants = append(grants, &AccessGrant{
+				Source:        AccessGrantRole,
+				Role:          roleName,
+				Sequence:      user.RoleNames()[roleName].Sequence,
+				RoleGrants:    roleGrants[roleName],
+				ChannelGrants: channelGrants,
+			})
+		}
+	}
+	return grants, nil
+}
+
+// Returns a principal's own grants of a channel, and of the "*" channel.
+func (explainer *accessExplainer) principalChannelGrants(princ auth.Principal, channelName string) ([]*AccessGrant, error) {
+	key := princ.Name()
+	if _, ok := princ.(auth.User); !ok {
+		key = channels.RoleAccessPrefix + key // Roles are identified in access view by a "role:" prefix
+	}
+	syncGrants, err := explainer.syncFunctionGrants(key)
+	if err != nil {
+		return nil, err
+	}
+
+	grants := []*AccessGrant{}
+	names := []string{channelName}
+	if channelName != channels.UserStarChannel {
+		names = append(names, channels.UserStarChannel)
+	}
+	for _, name := range names {
+		nameGrants := explainer.timedSetGrants(AccessGrantAdmin, princ.ExplicitChannels(), name)
+		nameGrants = append(nameGrants, syncGrants[name]...)
+		if user, ok := princ.(auth.User); ok {
+			nameGrants = append(nameGrants, explainer.timedSetGrants(AccessGrantJWT, user.JWTChannels(), name)...)
+		}
+		for _, grant := range nameGrants {
+			if name != channelName {
+				grant.Channel = name
+			}
+		}
+		grants = append(grants, nameGrants...)
+	}
+	return grants, nil
+}
+
+// Returns the ways the user was granted each of its roles.
+func (explainer *accessExplainer) userRoleGrants(user auth.User) (map[string][]*AccessGrant, error) {
+	grants := map[string][]*AccessGrant{}
+	for roleName := range user.ExplicitRoles() {
+		grants[roleName] = append(grants[roleName], explainer.timedSetGrants(AccessGrantAdmin, user.ExplicitRoles(), roleName)...)
+	}
+	for roleName := range user.JWTRoles() {
+		grants[roleName] = append(grants[roleName], explainer.timedSetGrants(AccessGrantJWT, user.JWTRoles(), roleName)...)
+	}
+
+	results, err := explainer.context.QueryRoleAccess(user.Name())
+	if err != nil {
+		return nil, err
+	}
+	var row QueryAccessRow
+	for results.Next(&row) {
+		for roleName := range row.Value {
+			grant := explainer.timedSetGrants(AccessGrantSyncFunction, row.Value, roleName)[0]
+			grant.DocID = row.ID
+			grants[roleName] = append(grants[roleName], grant)
+		}
+		row = QueryAccessRow{}
+	}
+	if err := results.Close(); err != nil {
+		return nil, err
+	}
+	return grants, nil
+}
+
+// Returns the channels granted to a principal by the sync function, with the documents that granted them.
+func (explainer *accessExplainer) syncFunctionGrants(key string) (map[string][]*AccessGrant, error) {
+	if grants, found := explainer.accessGrants[key]; found {
+		return grants, nil
+	}
+
+	results, err := explainer.context.QueryAccess(key)
+	if err != nil {
+		return nil, err
+	}
+	grants := map[string][]*AccessGrant{}
+	var row QueryAccessRow
+	for results.Next(&row) {
+		for channelName := range row.Value {
+			grant := explainer.timedSetGrants(AccessGrantSyncFunction, row.Value, channelName)[0]
+			grant.DocID = row.ID
+			grants[channelName] = append(grants[channelName], grant)
+		}
+		row = QueryAccessRow{}
+	}
+	if err := results.Close(); err != nil {
+		return nil, err
+	}
+
+	if explainer.accessGrants == nil {
+		explainer.accessGrants = map[string]map[string][]*AccessGrant{}
+	}
+	explainer.accessGrants[key] = grants
+	return grants, nil
+}
+
+// Returns a grant of the named channel or role in a TimedSet, if it has one.
+func (explainer *accessExplainer) timedSetGrants(source string, set channels.TimedSet, name string) []*AccessGrant {
+	seq, found := set[name]
+	if !found {
+		return nil
+	}
+	grant := &AccessGrant{Source: source, Sequence: seq.Sequence}
+	if seq.Expiry != 0 {
+		expiry := seq.ExpiryTime()
+		grant.Expiry = &expiry
+		grant.Expired = seq.Expired(explainer.now)
+	}
+	return []*AccessGrant{grant}
+}
@@ -0,0 +1,74 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"time"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// A pending reload of a principal whose time-limited grants expire.
+type grantExpiryTimer struct {
+	expiry time.Time
+	timer  *time.Timer
+}
+
+// Schedules a reload of the principal when its time-limited grants expire.  Loading the principal
+// removes the expired grants and saves it, which notifies changes feeds the same way as an admin
+// revoking access.  This is part of the auth.GrantExpiryScheduler interface.
+func (context *DatabaseContext) ScheduleGrantExpiry(princ auth.Principal, expiry time.Time) {
+	docID := princ.DocID()
+	name := princ.Name()
+	_, isUser := princ.(auth.User)
+
+	context.grantExpiryLock.Lock()
+	defer context.grantExpiryLock.Unlock()
+
+	if pending, ok := context.grantExpiryTimers[docID]; ok {
+		if !pending.expiry.After(expiry) {
+			return
+		}
+		pending.timer.Stop()
+	}
+	if context.grantExpiryTimers == nil {
+		context.grantExpiryTimers = make(map[string]*grantExpiryTimer)
+	}
+
+	// Allow for the clock resolution of the expiry times, which are stored in whole seconds
+	delay := time.Until(expiry) + time.Second
+	context.grantExpiryTimers[docID] = &grantExpiryTimer{
+		expiry: expiry,
+		timer: time.AfterFunc(delay, func() {
+			context.grantExpiryLock.Lock()
+			delete(context.grantExpiryTimers, docID)
+			context.grantExpiryLock.Unlock()
+
+			if context.IsClosed() {
+				return
+			}
+			base.Debugf(base.KeyAccess, "Reloading %q to remove expired grants", base.UD(name))
+			if _, err := context.Authenticator().GetPrincipal(name, isUser); err != nil {
+				base.Warnf(base.KeyAll, "Unable to remove expired grants from %q: %v", base.UD(name), err)
+			}
+		}),
+	}
+}
+
+// Cancels pending grant expiry reloads.
+func (context *DatabaseContext) stopGrantExpiryTimers() {
+	context.grantExpiryLock.Lock()
+	defer context.grantExpiryLock.Unlock()
+	for _, pending := range context.grantExpiryTimers {
+		pending.timer.Stop()
+	}
+	context.grantExpiryTimers = nil
+}
@@ -9,7 +9,6 @@ import (
 	sgbucket "github.com/couchbase/sg-bucket"
 	"github.com/couchbase/sync_gateway/base"
 	"github.com/couchbase/sync_gateway/channels"
-	"github.com/robertkrimen/otto"
 )
 
 type ImportMode uint8
@@ -352,22 +351,21 @@ func (db *Database) backupPreImportRevision(docid, revid string) error {
 
 // A compiled JavaScript event function.
 type jsImportFilterRunner struct {
-	sgbucket.JSRunner
+	base.JSRunner
 	response bool
 }
 
 // Compiles a JavaScript event function to a jsImportFilterRunner object.
-func newImportFilterRunner(funcSource string) (sgbucket.JSServerTask, error) {
+func newImportFilterRunner(funcSource string, jsOptions base.JSOptions) (sgbucket.JSServerTask, error) {
 	importFilterRunner := &jsEventTask{}
-	err := importFilterRunner.InitWithLogging(funcSource,
+	err := importFilterRunner.InitWithLogging(jsOptions, funcSource,
 		func(s string) { base.Errorf(base.KeyJavascript, "Import %s", base.UD(s)) },
 		func(s string) { base.Infof(base.KeyJavascript, "Import %s", base.UD(s)) })
 	if err != nil {
 		return nil, err
 	}
 
-	importFilterRunner.After = func(result otto.Value, err error) (interface{}, error) {
-		nativeValue, _ := result.Export()
+	importFilterRunner.After = func(nativeValue interface{}, err error) (interface{}, error) {
 		return nativeValue, err
 	}
 
@@ -378,13 +376,13 @@ type ImportFilterFunction struct {
 	*sgbucket.JSServer
 }
 
-func NewImportFilterFunction(fnSource string) *ImportFilterFunction {
+func NewImportFilterFunction(fnSource string, jsOptions base.JSOptions) *ImportFilterFunction {
 
 	base.Debugf(base.KeyImport, "Creating new ImportFilterFunction")
 	return &ImportFilterFunction{
 		JSServer: sgbucket.NewJSServer(fnSource, kTaskCacheSize,
 			func(fnSource string) (sgbucket.JSServerTask, error) {
-				return newImportFilterRunner(fnSource)
+				return newImportFilterRunner(fnSource, jsOptions)
 			}),
 	}
 }
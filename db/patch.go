@@ -0,0 +1,352 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Media types identifying the supported document patch formats
+const (
+	JSONPatchContentType  = "application/json-patch+json"  // RFC 6902 JSON Patch
+	MergePatchContentType = "application/merge-patch+json" // RFC 7396 JSON Merge Patch
+)
+
+// A DocumentPatch describes a partial update to a document body.
+type DocumentPatch interface {
+	// Apply returns the result of applying the patch to the given body.  The body may be modified.
+	Apply(body Body) (Body, error)
+}
+
+// ParseDocumentPatch parses a patch in the format identified by contentType.
+func ParseDocumentPatch(contentType string, data []byte) (DocumentPatch, error) {
+	switch contentType {
+	case JSONPatchContentType:
+		var operations jsonPatch
+		if err := decodePatchJSON(data, &operations); err != nil {
+			return nil, err
+		}
+		return operations, nil
+	case MergePatchContentType:
+		var patch map[string]interface{}
+		if err := decodePatchJSON(data, &patch); err != nil {
+			return nil, err
+		}
+		if patch == nil {
+			return nil, base.HTTPErrorf(http.StatusBadRequest, "Merge patch must be a JSON object")
+		}
+		return mergePatch(patch), nil
+	default:
+		return nil, base.HTTPErrorf(http.StatusUnsupportedMediaType, "Invalid content type %s; use %s or %s", contentType, JSONPatchContentType, MergePatchContentType)
+	}
+}
+
+func decodePatchJSON(data []byte, into interface{}) error {
+	decoder := base.JSONDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(into); err != nil {
+		return base.HTTPErrorf(http.StatusBadRequest, "Bad JSON patch: %v", err)
+	}
+	return nil
+}
+
+//////// JSON MERGE PATCH (RFC 7396)
+
+type mergePatch map[string]interface{}
+
+func (patch mergePatch) Apply(body Body) (Body, error) {
+	return Body(applyMergePatch(map[string]interface{}(body), patch)), nil
+}
+
+// applyMergePatch merges patch into target: null values remove properties, nested objects are merged recursively,
+// and all other values replace the existing value.
+func applyMergePatch(target map[string]interface{}, patch map[string]interface{}) map[string]interface{} {
+	if target == nil {
+		target = make(map[string]interface{}, len(patch))
+	}
+	for key, value := range patch {
+		if value == nil {
+			delete(target, key)
+			continue
+		}
+		patchObject, ok := value.(map[string]interface{})
+		if !ok {
+			target[key] = value
+			continue
+		}
+		targetObject, _ := target[key].(map[string]interface{})
+		target[key] = applyMergePatch(targetObject, patchObject)
+	}
+	return target
+}
+
+//////// JSON PATCH (RFC 6902)
+
+// A single JSON Patch operation.  Value is kept raw so that an explicit null can be told apart from a missing value.
+type JSONPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+type jsonPatch []JSONPatchOperation
+
+func (patch jsonPatch) Apply(body Body) (Body, error) {
+	var doc interface{} = map[string]interface{}(body)
+	for i, operation := range patch {
+		var err error
+		if doc, err = operation.apply(doc); err != nil {
+			status, message := base.ErrorAsHTTPStatus(err)
+			return nil, base.HTTPErrorf(status, "JSON patch operation %d (%s %s) failed: %s", i, operation.Op, operation.Path, message)
+		}
+	}
+	result, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "JSON patch must result in a JSON object")
+	}
+	return Body(result), nil
+}
+
+// Applies the operation to doc, returning the updated document.
+func (operation JSONPatchOperation) apply(doc interface{}) (interface{}, error) {
+	switch operation.Op {
+	case "add", "replace", "test":
+		if operation.Value == nil {
+			return nil, base.HTTPErrorf(http.StatusBadRequest, "missing value")
+		}
+		var value interface{}
+		if err := decodePatchJSON(operation.Value, &value); err != nil {
+			return nil, err
+		}
+		switch operation.Op {
+		case "add":
+			return jsonPointerAdd(doc, operation.Path, value)
+		case "replace":
+			if operation.Path == "" {
+				return value, nil
+			}
+			doc, _, err := jsonPointerRemove(doc, operation.Path)
+			if err != nil {
+				return nil, err
+			}
+			return jsonPointerAdd(doc, operation.Path, value)
+		default:
+			existing, err := jsonPointerGet(doc, operation.Path)
+			if err != nil {
+				return nil, err
+			}
+			if !jsonValuesEqual(existing, value) {
+				return nil, base.HTTPErrorf(http.StatusConflict, "test failed")
+			}
+			return doc, nil
+		}
+	case "remove":
+		doc, _, err := jsonPointerRemove(doc, operation.Path)
+		return doc, err
+	case "move":
+		if operation.Path == operation.From || strings.HasPrefix(operation.Path, operation.From+"/") {
+			return nil, base.HTTPErrorf(http.StatusBadRequest, "cannot move a value into itself")
+		}
+		doc, value, err := jsonPointerRemove(doc, operation.From)
+		if err != nil {
+			return nil, err
+		}
+		return jsonPointerAdd(doc, operation.Path, value)
+	case "copy":
+		value, err := jsonPointerGet(doc, operation.From)
+		if err != nil {
+			return nil, err
+		}
+		var copied interface{}
+		if err := base.DeepCopyInefficient(&copied, value); err != nil {
+			return nil, err
+		}
+		return jsonPointerAdd(doc, operation.Path, copied)
+	default:
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "unknown op %q", operation.Op)
+	}
+}
+
+// Splits a JSON pointer (RFC 6901) into its unescaped reference tokens.
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if pointer[0] != '/' {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "invalid JSON pointer %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// Parses an array index token.  When allowEnd is true, "-" refers to the position after the last element.
+func parseArrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if token == "-" && allowEnd {
+		return length, nil
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (token != "0" && token[0] == '0') {
+		return 0, base.HTTPErrorf(http.StatusBadRequest, "invalid array index %q", token)
+	}
+	maxIndex := length - 1
+	if allowEnd {
+		maxIndex = length
+	}
+	if index > maxIndex {
+		return 0, base.HTTPErrorf(http.StatusBadRequest, "array index %d out of range", index)
+	}
+	return index, nil
+}
+
+// Returns the value referenced by pointer.
+func jsonPointerGet(doc interface{}, pointer string) (interface{}, error) {
+	tokens, err := parseJSONPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	value := doc
+	for _, token := range tokens {
+		switch container := value.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if value, ok = container[token]; !ok {
+				return nil, base.HTTPErrorf(http.StatusBadRequest, "path %q not found", pointer)
+			}
+		case []interface{}:
+			index, err := parseArrayIndex(token, len(container), false)
+			if err != nil {
+				return nil, err
+			}
+			value = container[index]
+		default:
+			return nil, base.HTTPErrorf(http.StatusBadRequest, "path %q not found", pointer)
+		}
+	}
+	return value, nil
+}
+
+// Sets the value at pointer, inserting into arrays rather than replacing, and returns the updated document.
+func jsonPointerAdd(doc interface{}, pointer string, value interface{}) (interface{}, error) {
+	tokens, err := parseJSONPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return jsonPointerUpdate(doc, tokens, func(parent interface{}, token string) (interface{}, error) {
+		switch container := parent.(type) {
+		case map[string]interface{}:
+			container[token] = value
+			return container, nil
+		case []interface{}:
+			index, err := parseArrayIndex(token, len(container), true)
+			if err != nil {
+				return nil, err
+			}
+			container = append(container, nil)
+			copy(container[index+1:], container[index:])
+			container[index] = value
+			return container, nil
+		default:
+			return nil, base.HTTPErrorf(http.StatusBadRequest, "path %q not found", pointer)
+		}
+	})
+}
+
+// Removes the value at pointer, returning the updated document and the removed value.
+func jsonPointerRemove(doc interface{}, pointer string) (result interface{}, removed interface{}, err error) {
+	tokens, err := parseJSONPointer(pointer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, nil, base.HTTPErrorf(http.StatusBadRequest, "cannot remove the document root")
+	}
+	result, err = jsonPointerUpdate(doc, tokens, func(parent interface{}, token string) (interface{}, error) {
+		switch container := parent.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if removed, ok = container[token]; !ok {
+				return nil, base.HTTPErrorf(http.StatusBadRequest, "path %q not found", pointer)
+			}
+			delete(container, token)
+			return container, nil
+		case []interface{}:
+			index, err := parseArrayIndex(token, len(container), false)
+			if err != nil {
+				return nil, err
+			}
+			removed = container[index]
+			return append(container[:index], container[index+1:]...), nil
+		default:
+			return nil, base.HTTPErrorf(http.StatusBadRequest, "path %q not found", pointer)
+		}
+	})
+	return result, removed, err
+}
+
+// Walks doc to the parent of the last token and calls update on it.  As updating an array may reallocate it, the
+// value returned by update is stored back into its own parent on the way out.
+func jsonPointerUpdate(doc interface{}, tokens []string, update func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 1 {
+		return update(doc, tokens[0])
+	}
+	token := tokens[0]
+	switch container := doc.(type) {
+	case map[string]interface{}:
+		child, ok := container[token]
+		if !ok {
+			return nil, base.HTTPErrorf(http.StatusBadRequest, "path element %q not found", token)
+		}
+		updated, err := jsonPointerUpdate(child, tokens[1:], update)
+		if err != nil {
+			return nil, err
+		}
+		container[token] = updated
+		return container, nil
+	case []interface{}:
+		index, err := parseArrayIndex(token, len(container), false)
+		if err != nil {
+			return nil, err
+		}
+		updated, err := jsonPointerUpdate(container[index], tokens[1:], update)
+		if err != nil {
+			return nil, err
+		}
+		container[index] = updated
+		return container, nil
+	default:
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "path element %q not found", token)
+	}
+}
+
+// Compares two JSON values, ignoring differences in numeric representation (json.Number vs float64).
+func jsonValuesEqual(a, b interface{}) bool {
+	var normalizedA, normalizedB interface{}
+	if err := base.DeepCopyInefficient(&normalizedA, a); err != nil {
+		return false
+	}
+	if err := base.DeepCopyInefficient(&normalizedB, b); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(normalizedA, normalizedB)
+}
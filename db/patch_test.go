@@ -0,0 +1,166 @@
+package db
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		patch    string
+		expected string
+	}{
+		{"add property", `{"a":1}`, `{"b":2}`, `{"a":1,"b":2}`},
+		{"replace property", `{"a":1}`, `{"a":"x"}`, `{"a":"x"}`},
+		{"remove property", `{"a":1,"b":2}`, `{"b":null}`, `{"a":1}`},
+		{"merge nested", `{"a":{"b":1,"c":2}}`, `{"a":{"c":null,"d":3}}`, `{"a":{"b":1,"d":3}}`},
+		{"replace array", `{"a":[1,2]}`, `{"a":[3]}`, `{"a":[3]}`},
+		{"object replaces scalar", `{"a":1}`, `{"a":{"b":1}}`, `{"a":{"b":1}}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			patch, err := ParseDocumentPatch(MergePatchContentType, []byte(test.patch))
+			require.NoError(t, err)
+			assertPatchResult(t, patch, test.body, test.expected)
+		})
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		patch    string
+		expected string
+	}{
+		{"add", `{"a":1}`, `[{"op":"add","path":"/b","value":{"c":true}}]`, `{"a":1,"b":{"c":true}}`},
+		{"add null", `{"a":1}`, `[{"op":"add","path":"/b","value":null}]`, `{"a":1,"b":null}`},
+		{"add to array", `{"a":[1,3]}`, `[{"op":"add","path":"/a/1","value":2}]`, `{"a":[1,2,3]}`},
+		{"append to array", `{"a":[1]}`, `[{"op":"add","path":"/a/-","value":2}]`, `{"a":[1,2]}`},
+		{"remove", `{"a":1,"b":2}`, `[{"op":"remove","path":"/b"}]`, `{"a":1}`},
+		{"remove from array", `{"a":[1,2,3]}`, `[{"op":"remove","path":"/a/0"}]`, `{"a":[2,3]}`},
+		{"replace", `{"a":{"b":1}}`, `[{"op":"replace","path":"/a/b","value":2}]`, `{"a":{"b":2}}`},
+		{"move", `{"a":{"b":1},"c":{}}`, `[{"op":"move","from":"/a/b","path":"/c/d"}]`, `{"a":{},"c":{"d":1}}`},
+		{"copy", `{"a":[1]}`, `[{"op":"copy","from":"/a","path":"/b"}]`, `{"a":[1],"b":[1]}`},
+		{"test", `{"a":1}`, `[{"op":"test","path":"/a","value":1},{"op":"add","path":"/b","value":2}]`, `{"a":1,"b":2}`},
+		{"escaped pointer", `{"a/b":1,"c~d":2}`, `[{"op":"remove","path":"/a~1b"},{"op":"remove","path":"/c~0d"}]`, `{}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			patch, err := ParseDocumentPatch(JSONPatchContentType, []byte(test.patch))
+			require.NoError(t, err)
+			assertPatchResult(t, patch, test.body, test.expected)
+		})
+	}
+}
+
+func TestJSONPatchErrors(t *testing.T) {
+	tests := []struct {
+		name           string
+		patch          string
+		expectedStatus int
+	}{
+		{"unknown op", `[{"op":"frob","path":"/a"}]`, http.StatusBadRequest},
+		{"missing value", `[{"op":"add","path":"/b"}]`, http.StatusBadRequest},
+		{"missing path", `[{"op":"remove","path":"/b"}]`, http.StatusBadRequest},
+		{"replace missing path", `[{"op":"replace","path":"/b","value":1}]`, http.StatusBadRequest},
+		{"array index out of range", `[{"op":"add","path":"/c/5","value":1}]`, http.StatusBadRequest},
+		{"invalid pointer", `[{"op":"add","path":"a","value":1}]`, http.StatusBadRequest},
+		{"move into child", `[{"op":"move","from":"/c","path":"/c/0"}]`, http.StatusBadRequest},
+		{"failed test", `[{"op":"test","path":"/a","value":2}]`, http.StatusConflict},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			patch, err := ParseDocumentPatch(JSONPatchContentType, []byte(test.patch))
+			require.NoError(t, err)
+			var body Body
+			require.NoError(t, body.Unmarshal([]byte(`{"a":1,"c":[1]}`)))
+			_, err = patch.Apply(body)
+			assertHTTPError(t, err, test.expectedStatus)
+		})
+	}
+
+	_, err := ParseDocumentPatch("application/json", []byte(`{}`))
+	assertHTTPError(t, err, http.StatusUnsupportedMediaType)
+}
+
+func assertPatchResult(t *testing.T, patch DocumentPatch, body, expected string) {
+	var doc Body
+	require.NoError(t, doc.Unmarshal([]byte(body)))
+	result, err := patch.Apply(doc)
+	require.NoError(t, err)
+	resultBytes, err := base.JSONMarshal(result)
+	require.NoError(t, err)
+	assert.JSONEq(t, expected, string(resultBytes))
+}
+
+func TestPatchDocument(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	rev1, _, err := db.Put("doc1", Body{"a": 1, "flag": false})
+	require.NoError(t, err)
+
+	patch, err := ParseDocumentPatch(MergePatchContentType, []byte(`{"flag":true}`))
+	require.NoError(t, err)
+
+	// Patch without a rev applies to the current revision
+	rev2, _, err := db.Patch("doc1", "", patch)
+	require.NoError(t, err)
+	generation, _ := ParseRevID(rev2)
+	assert.Equal(t, 2, generation)
+
+	body, err := db.Get("doc1")
+	require.NoError(t, err)
+	assert.Equal(t, true, body["flag"])
+	assert.Contains(t, body, "a")
+
+	// A rev that isn't current is a conflict
+	_, _, err = db.Patch("doc1", rev1, patch)
+	assertHTTPError(t, err, http.StatusConflict)
+
+	// Patching a missing document fails
+	_, _, err = db.Patch("missing", "", patch)
+	assertHTTPError(t, err, http.StatusNotFound)
+
+	// Patches can't introduce special properties
+	patch, err = ParseDocumentPatch(MergePatchContentType, []byte(`{"_deleted":true}`))
+	require.NoError(t, err)
+	_, _, err = db.Patch("doc1", rev2, patch)
+	assertHTTPError(t, err, http.StatusBadRequest)
+}
+
+func TestPatchDocumentKeepsExpiry(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	_, _, err := db.Put("doc1", Body{"a": 1, BodyExpiry: 3600})
+	require.NoError(t, err)
+	doc, err := db.GetDocument("doc1", DocUnmarshalAll)
+	require.NoError(t, err)
+	require.NotNil(t, doc.Expiry)
+	expiry := *doc.Expiry
+
+	patch, err := ParseDocumentPatch(MergePatchContentType, []byte(`{"a":2}`))
+	require.NoError(t, err)
+	_, doc, err = db.Patch("doc1", "", patch)
+	require.NoError(t, err)
+	require.NotNil(t, doc.Expiry)
+	assert.Equal(t, expiry.Unix(), doc.Expiry.Unix())
+
+	doc, err = db.GetDocument("doc1", DocUnmarshalAll)
+	require.NoError(t, err)
+	require.NotNil(t, doc.Expiry)
+	assert.Equal(t, expiry.Unix(), doc.Expiry.Unix())
+}
@@ -29,6 +29,9 @@ const (
 	QueryTypeTombstones   = "tombstones"
 	QueryTypeResync       = "resync"
 	QueryTypeAllDocs      = "allDocs"
+	QueryTypeAttachments  = "attachments"
+	QueryTypeChannelStats = "channelStats"
+	QueryTypeNextChannel  = "nextChannel"
 )
 
 type SGQuery struct {
@@ -40,26 +43,27 @@ type SGQuery struct {
 var QueryAccess = SGQuery{
 	name: QueryTypeAccess,
 	statement: fmt.Sprintf(
-		"SELECT $sync.access.`$$selectUserName` as `value` "+
+		"SELECT $sync.access.`$$selectUserName` as `value`, META(`%s`).id AS id "+
 			"FROM `%s` "+
 			"WHERE any op in object_pairs($sync.access) satisfies op.name = $userName end;",
-		base.BucketQueryToken),
+		base.BucketQueryToken, base.BucketQueryToken),
 	adhoc: true,
 }
 
 var QueryRoleAccess = SGQuery{
 	name: QueryTypeRoleAccess,
 	statement: fmt.Sprintf(
-		"SELECT $sync.role_access.`$$selectUserName` as `value` "+
+		"SELECT $sync.role_access.`$$selectUserName` as `value`, META(`%s`).id AS id "+
 			"FROM `%s` "+
 			"WHERE any op in object_pairs($sync.role_access) satisfies op.name = $userName end;",
-		base.BucketQueryToken),
+		base.BucketQueryToken, base.BucketQueryToken),
 	adhoc: true,
 }
 
 // QueryAccessRow used for response from both QueryAccess and QueryRoleAccess
 type QueryAccessRow struct {
 	Value channels.TimedSet
+	ID    string `json:"id"` // The document whose sync function call made the grants
 }
 
 var QueryChannels = SGQuery{
@@ -78,6 +82,49 @@ var QueryChannels = SGQuery{
 	adhoc: false,
 }
 
+// Finds the first channel whose key in the channels index sorts at or after $startkey - so [name] finds the channel
+// called name (or the one after it, if there's none), and [name, {}] the channel after it.  The index is scanned in
+// order, so only the first matching entry is read.
+var QueryNextChannel = SGQuery{
+	name: QueryTypeNextChannel,
+	statement: fmt.Sprintf(
+		"SELECT %[1]s[0] AS name "+
+			"FROM `%[2]s` "+
+			"UNNEST OBJECT_PAIRS($sync.channels) AS op "+
+			"WHERE %[1]s >= $startkey "+
+			"ORDER BY %[1]s "+
+			"LIMIT 1",
+		"[op.name, LEAST($sync.sequence, op.val.seq),IFMISSING(op.val.rev,null),IFMISSING(op.val.del,null)]",
+		base.BucketQueryToken),
+	adhoc: false,
+}
+
+// Counts the documents currently in the channel $channelName (not removed from it, and not deleted), and finds its
+// latest sequence, reading only the channel's entries in the channels index.
+var QueryChannelStats = SGQuery{
+	name: QueryTypeChannelStats,
+	statement: fmt.Sprintf(
+		"SELECT SUM(CASE WHEN %[1]s[2] IS NULL AND BITAND(IFMISSINGORNULL($sync.flags, 0), %[3]d) = 0 THEN 1 ELSE 0 END) AS docs, "+
+			"MAX(%[1]s[1]) AS seq "+
+			"FROM `%[2]s` "+
+			"UNNEST OBJECT_PAIRS($sync.channels) AS op "+
+			"WHERE %[1]s BETWEEN [$channelName] AND [$channelName, {}]",
+		"[op.name, LEAST($sync.sequence, op.val.seq),IFMISSING(op.val.rev,null),IFMISSING(op.val.del,null)]",
+		base.BucketQueryToken, channels.Deleted),
+	adhoc: false,
+}
+
+// QueryChannelStatsRow is the row of the response to QueryChannelStats
+type QueryChannelStatsRow struct {
+	DocCount int    `json:"docs"`
+	Sequence uint64 `json:"seq"`
+}
+
+// QueryNextChannelRow is the row of the response to QueryNextChannel
+type QueryNextChannelRow struct {
+	Name string `json:"name"`
+}
+
 var QueryStarChannel = SGQuery{
 	name: QueryTypeChannelsStar,
 	statement: fmt.Sprintf(
@@ -149,9 +196,13 @@ var QueryTombstones = SGQuery{
 }
 
 // QueryResync and QueryImport both use IndexAllDocs.  If these need to be revisited for performance reasons,
-// they could be retooled to use covering indexes, where the id filtering is done at indexing time.  Given that this code
-// doesn't even do pagination currently, it's likely that this functionality should just be replaced by an ad-hoc
-// DCP stream.
+// they could be retooled to use covering indexes, where the id filtering is done at indexing time.  As IndexAllDocs
+// isn't ordered by id, each page of a paginated QueryResync sorts the index's results, so it's likely that this
+// functionality should just be replaced by an ad-hoc DCP stream.
+// Note: QueryResync function may append additional filter, ordering and limit of the form:
+//    AND META(`bucket`).id > $startkey
+//    ORDER BY META(`bucket`).id
+//    LIMIT n
 var QueryResync = SGQuery{
 	name: QueryTypeResync,
 	statement: fmt.Sprintf(
@@ -163,6 +214,22 @@ var QueryResync = SGQuery{
 	adhoc: false,
 }
 
+// QueryAttachments uses IndexSyncDocs, which is ordered by id, to page through the stored attachments.
+var QueryAttachments = SGQuery{
+	name: QueryTypeAttachments,
+	statement: fmt.Sprintf(
+		"SELECT META(`%s`).id "+
+			"FROM `%s` "+
+			"WHERE META(`%s`).id LIKE '%s' "+
+			"AND (META(`%s`).id LIKE '%s' "+
+			"OR META(`%s`).id LIKE '%s') "+
+			"AND META(`%s`).id > $startkey "+
+			"ORDER BY META(`%s`).id",
+		base.BucketQueryToken, base.BucketQueryToken, base.BucketQueryToken, SyncDocWildcard, base.BucketQueryToken, `\\_sync:att:%`, base.BucketQueryToken, `\\_sync:attm:%`,
+		base.BucketQueryToken, base.BucketQueryToken),
+	adhoc: false,
+}
+
 // QueryAllDocs is using the star channel's index, which is indexed by sequence, then ordering the results by doc id.
 // We currently don't have a performance-tuned use of AllDocs today - if needed, should create a custom index indexed by doc id.
 // Note: QueryAllDocs function may appends additional filter and ordering of the form:
@@ -376,18 +443,57 @@ func (context *DatabaseContext) buildChannelsQuery(channelName string, startSeq
 	return channelQueryStatement, params
 }
 
-func (context *DatabaseContext) QueryResync() (sgbucket.QueryResultIterator, error) {
+// Query to find the first channel in the channels index whose key sorts at or after startKey (see QueryNextChannel).
+// N1QL only; view-based databases query the channels view directly (see ListChannels).
+func (context *DatabaseContext) QueryNextChannel(startKey []interface{}) (sgbucket.QueryResultIterator, error) {
+
+	statement := replaceSyncTokensQuery(QueryNextChannel.statement, context.UseXattrs())
+	params := map[string]interface{}{QueryParamStartKey: startKey}
+	return context.N1QLQueryWithStats(QueryTypeNextChannel, statement, params, gocb.RequestPlus, QueryNextChannel.adhoc)
+}
+
+// Query to count the documents in a channel and find its latest sequence.  N1QL only; the channels view has no
+// reduce, so view-based databases count the channel's rows (see GetChannelInfo).
+func (context *DatabaseContext) QueryChannelStats(channelName string) (sgbucket.QueryResultIterator, error) {
+
+	statement := replaceSyncTokensQuery(QueryChannelStats.statement, context.UseXattrs())
+	params := map[string]interface{}{QueryParamChannelName: channelName}
+	return context.N1QLQueryWithStats(QueryTypeChannelStats, statement, params, gocb.RequestPlus, QueryChannelStats.adhoc)
+}
+
+// Query to retrieve the ids of the documents to be resynced.  When startAfter is set, only ids after it are returned,
+// in id order - though as the view's startkey is inclusive, the view query may also return startAfter itself.  A
+// limit of zero returns every id.
+func (context *DatabaseContext) QueryResync(startAfter string, limit int) (sgbucket.QueryResultIterator, error) {
 
 	if context.Options.UseViews {
 		opts := Body{"stale": false, "reduce": false}
 		opts[QueryParamStartKey] = []interface{}{true}
+		if startAfter != "" {
+			opts[QueryParamStartKey] = []interface{}{true, startAfter}
+		}
+		if limit > 0 {
+			opts[QueryParamLimit] = viewPageLimit(startAfter, limit)
+		}
 		return context.ViewQueryWithStats(DesignDocSyncHousekeeping(), ViewImport, opts)
 	}
 
 	// N1QL Query
-	var importQueryStatement string
-	importQueryStatement = replaceSyncTokensQuery(QueryResync.statement, context.UseXattrs())
-	return context.N1QLQueryWithStats(QueryTypeResync, importQueryStatement, nil, gocb.RequestPlus, QueryResync.adhoc)
+	bucketName := context.Bucket.GetName()
+	importQueryStatement := replaceSyncTokensQuery(QueryResync.statement, context.UseXattrs())
+	params := make(map[string]interface{}, 0)
+	if startAfter != "" {
+		importQueryStatement = fmt.Sprintf("%s AND META(`%s`).id > $startkey ORDER BY META(`%s`).id",
+			importQueryStatement, bucketName, bucketName)
+		params[QueryParamStartKey] = startAfter
+	}
+	if limit > 0 {
+		if startAfter == "" {
+			importQueryStatement = fmt.Sprintf("%s ORDER BY META(`%s`).id", importQueryStatement, bucketName)
+		}
+		importQueryStatement = fmt.Sprintf("%s LIMIT %d", importQueryStatement, limit)
+	}
+	return context.N1QLQueryWithStats(QueryTypeResync, importQueryStatement, params, gocb.RequestPlus, QueryResync.adhoc)
 }
 
 // Query to retrieve the set of user and role doc ids, using the primary index
@@ -420,6 +526,41 @@ func (context *DatabaseContext) QuerySessions(userName string) (sgbucket.QueryRe
 	return context.N1QLQueryWithStats(QueryTypeSessions, QuerySessions.statement, params, gocb.RequestPlus, QuerySessions.adhoc)
 }
 
+// Query to retrieve up to limit doc ids of attachments stored in the bucket, and of the manifests of chunked
+// attachments, after the doc id startAfter.  As the view's startkey is inclusive, the view query may also return
+// startAfter itself.
+func (context *DatabaseContext) QueryAttachments(startAfter string, limit int) (sgbucket.QueryResultIterator, error) {
+
+	// View Query
+	if context.Options.UseViews {
+		opts := Body{"stale": false}
+		if startAfter != "" {
+			opts[QueryParamStartKey] = startAfter
+		}
+		if limit > 0 {
+			opts[QueryParamLimit] = viewPageLimit(startAfter, limit)
+		}
+		return context.ViewQueryWithStats(DesignDocSyncHousekeeping(), ViewAttachments, opts)
+	}
+
+	// N1QL Query
+	statement := QueryAttachments.statement
+	if limit > 0 {
+		statement = fmt.Sprintf("%s LIMIT %d", statement, limit)
+	}
+	params := map[string]interface{}{QueryParamStartKey: startAfter}
+	return context.N1QLQueryWithStats(QueryTypeAttachments, statement, params, gocb.RequestPlus, QueryAttachments.adhoc)
+}
+
+// Returns the limit for a view query returning a page of up to limit rows after startAfter.  As the view's startkey
+// is inclusive, an extra row is requested in case startAfter itself is returned.
+func viewPageLimit(startAfter string, limit int) int {
+	if startAfter != "" {
+		return limit + 1
+	}
+	return limit
+}
+
 type AllDocsViewQueryRow struct {
 	Key   string
 	Value struct {
@@ -0,0 +1,298 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Background resync states, as reported in ResyncStatus.State
+const (
+	ResyncStateRunning   = "running"
+	ResyncStateCompleted = "completed"
+	ResyncStateStopped   = "stopped"
+	ResyncStateFailed    = "failed"
+)
+
+// Number of documents resynced between checkpoints.
+var ResyncBatchSize = 1000
+
+// Options for a background resync.
+type ResyncOptions struct {
+	Restart bool // Start a new run rather than resuming a stopped or interrupted one
+}
+
+// Progress of a background resync.  Also stored as the run's checkpoint, so that a stopped or interrupted run can be
+// resumed, along with the lease of the node running it.
+type ResyncStatus struct {
+	BackgroundJobLease
+	State              string     `json:"state"`
+	StartTime          time.Time  `json:"start_time"`
+	EndTime            *time.Time `json:"end_time,omitempty"`
+	Error              string     `json:"error,omitempty"`
+	SyncFunctionDigest string     `json:"sync_function_digest"` // Digest of the sync function (or sync rules) being applied
+
+	DocsTotal     int    `json:"docs_total,omitempty"`  // Documents in the run; unknown (omitted) until its last page is read
+	DocsProcessed int    `json:"docs_processed"`        // Documents the sync function has been re-run on
+	DocsChanged   int    `json:"docs_changed"`          // Documents whose channels or access grants changed
+	LastDocID     string `json:"last_doc_id,omitempty"` // Last document processed
+}
+
+func (status *ResyncStatus) isComplete() bool {
+	return status.State == ResyncStateCompleted
+}
+
+// StartResync starts re-running the sync function on every document in the background, while the database stays
+// online.  Documents whose channels or access grants change are given new sequences, so that changes feeds and users
+// see the changes as they're made.  A stopped or interrupted run is resumed from its checkpoint, unless the sync
+// function has changed since or options.Restart is set.
+func (db *Database) StartResync(options ResyncOptions) (*ResyncStatus, error) {
+	status, stop, done, err := db.beginResync(options)
+	if err != nil {
+		return nil, err
+	}
+	resyncDb := &Database{DatabaseContext: db.DatabaseContext, Ctx: db.Ctx}
+	go resyncDb.runResync(status, stop, done)
+	return db.ResyncStatus()
+}
+
+// StopResync stops the background resync running on this node, and returns its final status.  The stopped run can
+// be resumed by StartResync.
+func (context *DatabaseContext) StopResync() (*ResyncStatus, error) {
+	context.resyncLock.Lock()
+	if context.resyncStatus == nil {
+		context.resyncLock.Unlock()
+		return nil, base.HTTPErrorf(http.StatusConflict, "No resync is running")
+	}
+	stop, done := context.resyncStop, context.resyncDone
+	select {
+	case <-stop: // Already stopping
+	default:
+		close(stop)
+	}
+	context.resyncLock.Unlock()
+
+	<-done
+	return context.ResyncStatus()
+}
+
+// ResyncRunning returns true if a background resync is running on this node.
+func (context *DatabaseContext) ResyncRunning() bool {
+	context.resyncLock.Lock()
+	defer context.resyncLock.Unlock()
+	return context.resyncStatus != nil
+}
+
+// ResyncStatus returns the status of the background resync running on this node, otherwise that of the most recent
+// run (which may be running on another node) as recorded in its checkpoint.  Returns a 404 error if a background
+// resync has never been run.
+func (context *DatabaseContext) ResyncStatus() (*ResyncStatus, error) {
+	context.resyncLock.Lock()
+	if context.resyncStatus != nil {
+		status := *context.resyncStatus
+		context.resyncLock.Unlock()
+		return &status, nil
+	}
+	context.resyncLock.Unlock()
+
+	status, _, err := context.getResyncCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+	if status.State == ResyncStateRunning && !status.heldByOther(context.nodeID) {
+		// Nothing is running here or on another node, so the run was interrupted - e.g. by a restart
+		status.State = ResyncStateFailed
+		status.Error = "Interrupted"
+	}
+	return status, nil
+}
+
+// ResyncInterrupted returns true if the most recent background resync of the current sync function was interrupted,
+// and isn't running on another node.
+func (context *DatabaseContext) ResyncInterrupted() bool {
+	status, _, err := context.getResyncCheckpoint()
+	return err == nil && status.State == ResyncStateRunning && !status.heldByOther(context.nodeID) &&
+		status.SyncFunctionDigest == context.syncFunctionDigest()
+}
+
+// Claims the database's background resync, by taking the lease in its checkpoint, and returns the status of the run
+// to be made, along with the channels used to stop it and to signal that it has stopped.
+func (db *Database) beginResync(options ResyncOptions) (status *ResyncStatus, stop, done chan struct{}, err error) {
+	db.resyncLock.Lock()
+	defer db.resyncLock.Unlock()
+	if db.resyncStatus != nil || atomic.LoadUint32(&db.State) == DBResyncing {
+		return nil, nil, nil, base.HTTPErrorf(http.StatusServiceUnavailable, "Database _resync is already in progress")
+	}
+
+	checkpoint, cas, err := db.getResyncCheckpoint()
+	if err != nil && !base.IsDocNotFoundError(err) {
+		return nil, nil, nil, err
+	}
+	if checkpoint != nil && checkpoint.State == ResyncStateRunning && checkpoint.heldByOther(db.nodeID) {
+		return nil, nil, nil, base.HTTPErrorf(http.StatusServiceUnavailable, "Database _resync is already in progress on another node")
+	}
+
+	digest := db.syncFunctionDigest()
+	if checkpoint != nil && !checkpoint.isComplete() && checkpoint.SyncFunctionDigest == digest && !options.Restart {
+		base.InfofCtx(db.Ctx, base.KeyAll, "Resuming resync of %s after %d docs", base.MD(db.Name), checkpoint.DocsProcessed)
+		status = checkpoint
+		status.Error = ""
+	} else {
+		status = &ResyncStatus{
+			StartTime:          time.Now().UTC(),
+			SyncFunctionDigest: digest,
+		}
+	}
+	status.State = ResyncStateRunning
+	status.EndTime = nil
+	status.renew(db.nodeID)
+	saver, err := claimBackgroundJob(db.Bucket, base.ResyncCheckpointKey, cas, status)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	db.resyncStatus = status
+	db.resyncSaver = saver
+	db.resyncStop = make(chan struct{})
+	db.resyncDone = make(chan struct{})
+	return status, db.resyncStop, db.resyncDone, nil
+}
+
+// Resyncs the remaining documents from the given status, which is updated as the run progresses and checkpointed
+// after each batch.
+func (db *Database) runResync(status *ResyncStatus, stop, done chan struct{}) {
+	defer close(done)
+	err := db.resyncDocuments(status, stop)
+
+	db.resyncLock.Lock()
+	defer db.resyncLock.Unlock()
+	if err == errResyncTerminated {
+		// Leave the checkpoint as running, to be resumed by the next run, but give up the lease so that it can be
+		// resumed right away
+		base.InfofCtx(db.Ctx, base.KeyAll, "Resync of %s stopped as the database is closing", base.MD(db.Name))
+		status.BackgroundJobLease = BackgroundJobLease{}
+	} else {
+		endTime := time.Now().UTC()
+		status.EndTime = &endTime
+		switch err {
+		case nil:
+			base.InfofCtx(db.Ctx, base.KeyAll, "Finished resync of %s; %d/%d docs changed", base.MD(db.Name), status.DocsChanged, status.DocsProcessed)
+			status.State = ResyncStateCompleted
+		case errResyncStopped:
+			base.InfofCtx(db.Ctx, base.KeyAll, "Resync of %s stopped after %d docs", base.MD(db.Name), status.DocsProcessed)
+			status.State = ResyncStateStopped
+		default:
+			base.WarnfCtx(db.Ctx, base.KeyAll, "Resync of %s failed: %v", base.MD(db.Name), err)
+			status.State = ResyncStateFailed
+			status.Error = err.Error()
+		}
+	}
+	if checkpointErr := db.resyncSaver.save(*status); checkpointErr != nil {
+		base.WarnfCtx(db.Ctx, base.KeyAll, "Unable to save resync checkpoint for %s: %v", base.MD(db.Name), checkpointErr)
+	}
+	db.resyncStatus, db.resyncSaver = nil, nil
+}
+
+var (
+	errResyncStopped    = base.HTTPErrorf(http.StatusServiceUnavailable, "Resync stopped")
+	errResyncTerminated = base.HTTPErrorf(http.StatusServiceUnavailable, "Database is closing")
+)
+
+// Re-runs the sync function on each document after the status's last document, a page at a time in the order of the
+// index used by QueryResync.  Errors updating a document are logged and skipped, as they are by UpdateAllDocChannels.
+// The documents aren't counted up front, as that would mean reading every ID before the first checkpoint, so the
+// total is only known once the last page has been read.
+func (db *Database) resyncDocuments(status *ResyncStatus, stop chan struct{}) error {
+	base.InfofCtx(db.Ctx, base.KeyAll, "Starting background resync of %s", base.MD(db.Name))
+	db.updateResyncStatus(func() {
+		status.DocsTotal = 0
+	})
+
+	for {
+		docIDs, err := db.docIDsAfter(status.LastDocID, ResyncBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(docIDs) == 0 {
+			db.updateResyncStatus(func() {
+				status.DocsTotal = status.DocsProcessed
+			})
+			return nil
+		}
+
+		for _, docID := range docIDs {
+			select {
+			case <-stop:
+				return errResyncStopped
+			case <-db.terminator:
+				return errResyncTerminated
+			default:
+			}
+
+			updated, err := db.resyncDocument(docID, true)
+			if err != nil {
+				base.WarnfCtx(db.Ctx, base.KeyAll, "Error updating doc %q: %v", base.UD(docID), err)
+			}
+			db.updateResyncStatus(func() {
+				status.DocsProcessed++
+				if updated {
+					status.DocsChanged++
+				}
+				status.LastDocID = docID
+			})
+			if db.resyncSaver.heartbeatDue() {
+				if err := db.setResyncCheckpoint(status); err != nil {
+					return err
+				}
+			}
+		}
+		if err := db.setResyncCheckpoint(status); err != nil {
+			return err
+		}
+	}
+}
+
+// Applies an update to the status of the run in progress, under the lock used by ResyncStatus.
+func (db *Database) updateResyncStatus(update func()) {
+	db.resyncLock.Lock()
+	update()
+	db.resyncLock.Unlock()
+}
+
+// Returns the checkpoint, along with its CAS.
+func (context *DatabaseContext) getResyncCheckpoint() (*ResyncStatus, uint64, error) {
+	var status ResyncStatus
+	cas, err := context.Bucket.Get(base.ResyncCheckpointKey, &status)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &status, cas, nil
+}
+
+// Saves the checkpoint, renewing this node's lease.
+func (db *Database) setResyncCheckpoint(status *ResyncStatus) error {
+	db.resyncLock.Lock()
+	status.renew(db.nodeID)
+	checkpoint := *status
+	db.resyncLock.Unlock()
+	return db.resyncSaver.save(checkpoint)
+}
+
+// Identifies the sync function (or sync rules) a resync applies, so that a run isn't resumed after it changes.
+func (context *DatabaseContext) syncFunctionDigest() string {
+	syncFun := ""
+	if context.ChannelMapper != nil {
+		syncFun = context.ChannelMapper.Function()
+	}
+	return Sha1DigestKey([]byte(syncFun))
+}
@@ -0,0 +1,195 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Polls the status of a background resync until it's no longer running.
+func waitForResync(t *testing.T, db *Database) *ResyncStatus {
+	var status *ResyncStatus
+	var err error
+	for i := 0; i < 100; i++ {
+		status, err = db.ResyncStatus()
+		require.NoError(t, err)
+		if status.State != ResyncStateRunning {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return status
+}
+
+func TestResync(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	_, err := db.ResyncStatus()
+	assert.True(t, base.IsDocNotFoundError(err))
+
+	_, _, err = db.Put("doc1", Body{"channels": []string{"a"}, "owner": "alice"})
+	require.NoError(t, err)
+	_, _, err = db.Put("doc2", Body{"channels": []string{"b"}})
+	require.NoError(t, err)
+	doc1, err := db.GetDocument("doc1", DocUnmarshalAll)
+	require.NoError(t, err)
+	assert.Empty(t, doc1.Access)
+
+	_, err = db.UpdateSyncFun(`function(doc) {channel(doc.channels); if (doc.owner) {access(doc.owner, doc.channels);}}`)
+	require.NoError(t, err)
+
+	_, err = db.StartResync(ResyncOptions{})
+	require.NoError(t, err)
+	status := waitForResync(t, db)
+	assert.Equal(t, ResyncStateCompleted, status.State)
+	assert.Equal(t, 2, status.DocsTotal)
+	assert.Equal(t, 2, status.DocsProcessed)
+	assert.Equal(t, 1, status.DocsChanged)
+	assert.Equal(t, "doc2", status.LastDocID)
+	assert.NotNil(t, status.EndTime)
+
+	// The changed document is given a new sequence, at which its grant is made:
+	resynced, err := db.GetDocument("doc1", DocUnmarshalAll)
+	require.NoError(t, err)
+	assert.True(t, resynced.Sequence > doc1.Sequence)
+	require.Contains(t, resynced.Access, "alice")
+	assert.Equal(t, resynced.Sequence, resynced.Access["alice"]["a"].Sequence)
+
+	_, err = db.StopResync()
+	assert.Error(t, err)
+}
+
+func TestResyncResume(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	for _, docID := range []string{"doc1", "doc2"} {
+		_, _, err := db.Put(docID, Body{"channels": []string{"a"}, "owner": "alice"})
+		require.NoError(t, err)
+	}
+	_, err := db.UpdateSyncFun(`function(doc) {channel(doc.channels); if (doc.owner) {access(doc.owner, doc.channels);}}`)
+	require.NoError(t, err)
+
+	// Checkpoint of a run of the current sync function interrupted after the first document
+	require.NoError(t, db.Bucket.Set(base.ResyncCheckpointKey, 0, ResyncStatus{
+		State:              ResyncStateRunning,
+		StartTime:          time.Now().UTC(),
+		SyncFunctionDigest: db.syncFunctionDigest(),
+		DocsTotal:          2,
+		DocsProcessed:      1,
+		LastDocID:          "doc1",
+	}))
+
+	status, err := db.ResyncStatus()
+	require.NoError(t, err)
+	assert.Equal(t, ResyncStateFailed, status.State)
+
+	_, err = db.StartResync(ResyncOptions{})
+	require.NoError(t, err)
+	status = waitForResync(t, db)
+	assert.Equal(t, ResyncStateCompleted, status.State)
+	assert.Equal(t, 2, status.DocsTotal)
+	assert.Equal(t, 2, status.DocsProcessed)
+	assert.Equal(t, 1, status.DocsChanged)
+
+	doc1, err := db.GetDocument("doc1", DocUnmarshalAll)
+	require.NoError(t, err)
+	assert.Empty(t, doc1.Access)
+	doc2, err := db.GetDocument("doc2", DocUnmarshalAll)
+	require.NoError(t, err)
+	assert.Contains(t, doc2.Access, "alice")
+
+	// A completed run isn't resumed, so a new run resyncs the document skipped above
+	_, err = db.StartResync(ResyncOptions{})
+	require.NoError(t, err)
+	status = waitForResync(t, db)
+	assert.Equal(t, 2, status.DocsProcessed)
+	assert.Equal(t, 1, status.DocsChanged)
+}
+
+func TestResyncStop(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	numDocs := 100
+	for i := 0; i < numDocs; i++ {
+		_, _, err := db.Put(fmt.Sprintf("doc%03d", i), Body{"channels": []string{"a"}})
+		require.NoError(t, err)
+	}
+	_, err := db.UpdateSyncFun(`function(doc) {channel(doc.channels, "all");}`)
+	require.NoError(t, err)
+
+	_, err = db.StartResync(ResyncOptions{})
+	require.NoError(t, err)
+	_, err = db.StartResync(ResyncOptions{})
+	assert.Error(t, err, "Only one resync can run at a time")
+
+	// The run may have finished before it's stopped
+	status, err := db.StopResync()
+	if err == nil {
+		assert.Contains(t, []string{ResyncStateStopped, ResyncStateCompleted}, status.State)
+	}
+
+	// A stopped run is resumed from where it stopped
+	_, err = db.StartResync(ResyncOptions{})
+	require.NoError(t, err)
+	status = waitForResync(t, db)
+	assert.Equal(t, ResyncStateCompleted, status.State)
+	assert.Equal(t, numDocs, status.DocsProcessed)
+	doc, err := db.GetDocument(fmt.Sprintf("doc%03d", numDocs-1), DocUnmarshalAll)
+	require.NoError(t, err)
+	assert.Contains(t, doc.Channels, "all")
+}
+
+func TestResyncLease(t *testing.T) {
+	db, testBucket := setupTestDB(t)
+	defer testBucket.Close()
+	defer tearDownTestDB(t, db)
+
+	defer func(batchSize int) { ResyncBatchSize = batchSize }(ResyncBatchSize)
+	ResyncBatchSize = 2
+
+	for i := 0; i < 5; i++ {
+		_, _, err := db.Put(fmt.Sprintf("doc%d", i), Body{"channels": []string{"a"}})
+		require.NoError(t, err)
+	}
+	_, err := db.UpdateSyncFun(`function(doc) {channel(doc.channels, "all");}`)
+	require.NoError(t, err)
+
+	// A run checkpointed recently by another node is still running there
+	heartbeat := time.Now().UTC()
+	checkpoint := ResyncStatus{
+		BackgroundJobLease: BackgroundJobLease{Owner: "other-node", Heartbeat: &heartbeat},
+		State:              ResyncStateRunning,
+		StartTime:          heartbeat,
+		SyncFunctionDigest: db.syncFunctionDigest(),
+	}
+	require.NoError(t, db.Bucket.Set(base.ResyncCheckpointKey, 0, checkpoint))
+	status, err := db.ResyncStatus()
+	require.NoError(t, err)
+	assert.Equal(t, ResyncStateRunning, status.State)
+	assert.False(t, db.ResyncInterrupted())
+	_, err = db.StartResync(ResyncOptions{})
+	assert.Error(t, err)
+
+	// Once its lease has expired, the run is taken over, a page at a time
+	heartbeat = heartbeat.Add(-2 * BackgroundJobLeaseExpiry)
+	require.NoError(t, db.Bucket.Set(base.ResyncCheckpointKey, 0, checkpoint))
+	assert.True(t, db.ResyncInterrupted())
+	_, err = db.StartResync(ResyncOptions{})
+	require.NoError(t, err)
+	status = waitForResync(t, db)
+	assert.Equal(t, ResyncStateCompleted, status.State)
+	assert.Equal(t, 5, status.DocsTotal)
+	assert.Equal(t, 5, status.DocsProcessed)
+	assert.Equal(t, "doc4", status.LastDocID)
+	assert.Equal(t, db.nodeID, status.Owner)
+}
@@ -30,6 +30,8 @@ const (
 	BodyAttachments = "_attachments"
 	BodyPurged      = "_purged"
 	BodyExpiry      = "_exp"
+	BodyDelta       = "_delta"
+	BodyDeltaSrc    = "_deltaSrc"
 )
 
 // A revisions property found within a Body.  Expected to be of the form:
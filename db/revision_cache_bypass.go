@@ -63,3 +63,8 @@ func (rc *BypassRevisionCache) Put(docID string, docRev DocumentRevision) {
 func (rc *BypassRevisionCache) UpdateDelta(docID, revID string, toDelta *RevisionDelta) {
 	// no-op
 }
+
+// Remove is a no-op for a BypassRevisionCache
+func (rc *BypassRevisionCache) Remove(docID, revID string) {
+	// no-op
+}
@@ -31,6 +31,9 @@ type RevisionCache interface {
 
 	// UpdateDelta stores the given toDelta value in the given rev if cached
 	UpdateDelta(docID, revID string, toDelta *RevisionDelta)
+
+	// Remove evicts the given revision if cached, e.g. when its channels have been recomputed
+	Remove(docID, revID string)
 }
 
 // Force compile-time check of all RevisionCache types for interface
@@ -54,6 +54,10 @@ func (sc *ShardedLRURevisionCache) Put(docID string, docRev DocumentRevision) {
 	sc.getShard(docID).Put(docID, docRev)
 }
 
+func (sc *ShardedLRURevisionCache) Remove(docID, revID string) {
+	sc.getShard(docID).Remove(docID, revID)
+}
+
 // An LRU cache of document revision bodies, together with their channel access.
 type LRURevisionCache struct {
 	cache        map[IDAndRev]*list.Element // Fast lookup of list element by doc/rev ID
@@ -177,6 +181,13 @@ func (rc *LRURevisionCache) Put(docID string, docRev DocumentRevision) {
 	value.store(docRev)
 }
 
+// Removes a revision from the cache, if present.
+func (rc *LRURevisionCache) Remove(docID, revID string) {
+	if value := rc.getValue(docID, revID, false); value != nil {
+		rc.removeValue(value)
+	}
+}
+
 func (rc *LRURevisionCache) getValue(docID, revID string, create bool) (value *revCacheValue) {
 	if docID == "" || revID == "" {
 		panic("RevisionCache: invalid empty doc/rev id")
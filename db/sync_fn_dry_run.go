@@ -0,0 +1,119 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// The outcome of running a document through a sync function without saving it.
+type SyncFnDryRunResult struct {
+	Channels     base.Set                        `json:"channels"`
+	Access       channels.AccessMap              `json:"access"`
+	Roles        channels.AccessMap              `json:"roles"`
+	AccessExpiry map[string]map[string]time.Time `json:"access_expiry,omitempty"` // Expiry of time-limited access() grants
+	RoleExpiry   map[string]map[string]time.Time `json:"role_expiry,omitempty"`   // Expiry of time-limited role() grants
+	Expiry       *uint32                         `json:"expiry,omitempty"`        // Document expiry set by expiry(), in CBS expiry format
+	Rejection    *SyncFnRejection                `json:"rejection,omitempty"`     // Set if the function called throw() or a failed requireX()
+	Exception    string                          `json:"exception,omitempty"`     // Set if the function failed with an error
+}
+
+// SyncFnRejection is why a sync function rejected a document, and the status a write would fail with.
+type SyncFnRejection struct {
+	Status int    `json:"status"`
+	Reason string `json:"reason"`
+}
+
+// The sync function implementations a dry run can use.
+type syncFnMapper interface {
+	MapToChannelsAndAccess(body map[string]interface{}, oldBodyJSON string, userCtx map[string]interface{}) (*channels.ChannelMapperOutput, error)
+}
+
+// SyncFnDryRun runs a document through the sync function as if it were replacing oldDoc, written by the
+// user whose context is given (or by an admin if userCtx is nil), without saving anything.  If syncFn is
+// non-empty, that function is run instead of the database's own.  Failures of the function itself are
+// reported in the result; the returned error is only set if syncFn can't be compiled.
+func (context *DatabaseContext) SyncFnDryRun(doc Body, oldDoc Body, userCtx map[string]interface{}, syncFn string) (*SyncFnDryRunResult, error) {
+	var mapper syncFnMapper
+	if syncFn != "" {
+		runner, err := channels.NewSyncRunner(syncFn, context.Options.JSOptions)
+		if err != nil {
+			return nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid sync function: %v", err)
+		}
+		mapper = runner
+	} else if context.ChannelMapper != nil {
+		mapper = context.ChannelMapper
+	}
+
+	result := &SyncFnDryRunResult{}
+	if mapper == nil {
+		// No sync function, so by default use the "channels" property, as a write would:
+		if value := doc["channels"]; value != nil {
+			var err error
+			if result.Channels, err = channels.SetFromArray(base.ValueToStringArray(value), channels.KeepStar); err != nil {
+				result.Rejection = newSyncFnRejection(err)
+			}
+		}
+		return result, nil
+	}
+
+	oldJson := ""
+	if oldDoc != nil {
+		oldJsonBytes, err := base.JSONMarshal(oldDoc)
+		if err != nil {
+			return nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid oldDoc: %v", err)
+		}
+		oldJson = string(oldJsonBytes)
+	}
+
+	body := map[string]interface{}(doc.ShallowCopy())
+	channels.ConvertJSONNumbers(body)
+	output, err := mapper.MapToChannelsAndAccess(body, oldJson, userCtx)
+	if err != nil {
+		result.Exception = err.Error()
+		return result, nil
+	}
+	result.Channels = output.Channels
+	result.Access = output.Access
+	result.Roles = output.Roles
+	result.AccessExpiry = grantExpiryTimes(output.GrantExpiry.Access)
+	result.RoleExpiry = grantExpiryTimes(output.GrantExpiry.Roles)
+	result.Expiry = output.Expiry
+	if output.Rejection != nil {
+		result.Rejection = newSyncFnRejection(output.Rejection)
+	} else if !validateAccessMap(output.Access) || !validateRoleAccessMap(output.Roles) {
+		result.Exception = "Sync function granted access to an invalid user, role or channel name"
+	}
+	return result, nil
+}
+
+func newSyncFnRejection(err error) *SyncFnRejection {
+	status, reason := base.ErrorAsHTTPStatus(err)
+	return &SyncFnRejection{Status: status, Reason: reason}
+}
+
+// Converts the Unix expiry times of time-limited grants to times, or returns nil if there are none.
+func grantExpiryTimes(expiries channels.AccessExpiryMap) map[string]map[string]time.Time {
+	if len(expiries) == 0 {
+		return nil
+	}
+	times := make(map[string]map[string]time.Time, len(expiries))
+	for name, grants := range expiries {
+		times[name] = make(map[string]time.Time, len(grants))
+		for grant, expiry := range grants {
+			times[name][grant] = time.Unix(expiry, 0)
+		}
+	}
+	return times
+}
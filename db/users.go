@@ -2,6 +2,7 @@ package db
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/couchbase/sync_gateway/auth"
 	"github.com/couchbase/sync_gateway/base"
@@ -12,15 +13,19 @@ import (
 // Also used in the rest package as a JSON object that defines a User/Role within a DbConfig
 // and structures the request/response body in the admin REST API for /db/_user/*
 type PrincipalConfig struct {
-	Name             *string  `json:"name,omitempty"`
-	ExplicitChannels base.Set `json:"admin_channels,omitempty"`
-	Channels         base.Set `json:"all_channels"`
+	Name                  *string              `json:"name,omitempty"`
+	ExplicitChannels      base.Set             `json:"admin_channels,omitempty"`
+	ExplicitChannelExpiry map[string]time.Time `json:"admin_channel_expiry,omitempty"` // When time-limited admin channels expire
+	Channels              base.Set             `json:"all_channels"`
 	// Fields below only apply to Users, not Roles:
-	Email             string   `json:"email,omitempty"`
-	Disabled          bool     `json:"disabled,omitempty"`
-	Password          *string  `json:"password,omitempty"`
-	ExplicitRoleNames []string `json:"admin_roles,omitempty"`
-	RoleNames         []string `json:"roles,omitempty"`
+	Email              string               `json:"email,omitempty"`
+	Disabled           bool                 `json:"disabled,omitempty"`
+	Password           *string              `json:"password,omitempty"`
+	ExplicitRoleNames  []string             `json:"admin_roles,omitempty"`
+	ExplicitRoleExpiry map[string]time.Time `json:"admin_role_expiry,omitempty"` // When time-limited admin roles expire
+	RoleNames          []string             `json:"roles,omitempty"`
+	JWTRoleNames       []string             `json:"jwt_roles,omitempty"`    // Read-only; granted by OIDC/JWT token claims
+	JWTChannels        base.Set             `json:"jwt_channels,omitempty"` // Read-only; granted by OIDC/JWT token claims
 }
 
 // Check if the password in this PrincipalConfig is valid.  Only allow
@@ -56,6 +61,57 @@ func (p PrincipalConfig) IsPasswordValid(allowEmptyPass bool) (isValid bool, rea
 	return true, ""
 }
 
+// Checks that the expiries are only given for channels and roles that are being granted.
+func (p PrincipalConfig) validateGrantExpiry() error {
+	for name := range p.ExplicitChannelExpiry {
+		if !p.ExplicitChannels.Contains(name) {
+			return base.HTTPErrorf(http.StatusBadRequest, "admin_channel_expiry includes %q, which isn't in admin_channels", name)
+		}
+	}
+	roles := base.SetFromArray(p.ExplicitRoleNames)
+	for name := range p.ExplicitRoleExpiry {
+		if !roles.Contains(name) {
+			return base.HTTPErrorf(http.StatusBadRequest, "admin_role_expiry includes %q, which isn't in admin_roles", name)
+		}
+	}
+	return nil
+}
+
+// Returns when each time-limited grant in the set expires, or nil if there are none.
+func GrantExpiryTimes(grants ch.TimedSet) map[string]time.Time {
+	var result map[string]time.Time
+	for name, vbSeq := range grants {
+		if vbSeq.Expiry != 0 {
+			if result == nil {
+				result = make(map[string]time.Time)
+			}
+			result[name] = vbSeq.ExpiryTime()
+		}
+	}
+	return result
+}
+
+// Returns true if setting the expiries would change those of the grants already in the set.
+func grantExpiryChanged(grants ch.TimedSet, expiries map[string]time.Time) bool {
+	for name, vbSeq := range grants {
+		if vbSeq.Expiry != ch.ExpiryFromTime(expiries[name]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sets the expiry of each grant in the set, clearing it for grants without an expiry.  Returns true
+// if any changed.
+func setGrantExpiry(grants ch.TimedSet, expiries map[string]time.Time) (changed bool) {
+	for name := range grants {
+		if grants.SetExpiry(name, expiries[name]) {
+			changed = true
+		}
+	}
+	return changed
+}
+
 // Test-only version of GetPrincipal that doesn't trigger channel/role recalculation
 func (dbc *DatabaseContext) GetPrincipal(name string, isUser bool) (info *PrincipalConfig, err error) {
 	var princ auth.Principal
@@ -70,20 +126,43 @@ func (dbc *DatabaseContext) GetPrincipal(name string, isUser bool) (info *Princi
 	info = new(PrincipalConfig)
 	info.Name = &name
 	info.ExplicitChannels = princ.ExplicitChannels().AsSet()
+	info.ExplicitChannelExpiry = GrantExpiryTimes(princ.ExplicitChannels())
 	if user, ok := princ.(auth.User); ok {
 		info.Channels = user.InheritedChannels().AsSet()
 		info.Email = user.Email()
 		info.Disabled = user.Disabled()
 		info.ExplicitRoleNames = user.ExplicitRoles().AllChannels()
+		info.ExplicitRoleExpiry = GrantExpiryTimes(user.ExplicitRoles())
 		info.RoleNames = user.RoleNames().AllChannels()
+		info.JWTRoleNames = user.JWTRoles().AllChannels()
+		info.JWTChannels = user.JWTChannels().AsSet()
 	} else {
 		info.Channels = princ.Channels().AsSet()
 	}
 	return
 }
 
-// Updates or creates a principal from a PrincipalConfig structure.
+// Allocates the sequence at which roles and channels granted by token claims, or the removal of
+// expired grants, are recorded.  This is part of the PrincipalSequenceAllocator interface defined by
+// the Authenticator.
+func (dbc *DatabaseContext) NextPrincipalSequence() (uint64, error) {
+	return dbc.sequences.nextSequence()
+}
+
+// Releases a sequence allocated by NextPrincipalSequence that a principal wasn't saved at.  This is part
+// of the PrincipalSequenceAllocator interface.
+func (dbc *DatabaseContext) ReleasePrincipalSequence(sequence uint64) error {
+	return dbc.sequences.releaseSequence(sequence)
+}
+
+// Updates or creates a principal from a PrincipalConfig structure.  If the expiry of the explicit
+// channels or roles isn't given, the existing grants keep their expiry; otherwise grants without an
+// expiry are permanent.
 func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool, allowReplace bool) (replaced bool, err error) {
+	if err := newInfo.validateGrantExpiry(); err != nil {
+		return false, err
+	}
+
 	// Get the existing principal, or if this is a POST make sure there isn't one:
 	var princ auth.Principal
 	var user auth.User
@@ -138,6 +217,8 @@ func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool
 		}
 		if !updatedChannels.Equals(newInfo.ExplicitChannels) {
 			changed = true
+		} else if newInfo.ExplicitChannelExpiry != nil && grantExpiryChanged(updatedChannels, newInfo.ExplicitChannelExpiry) {
+			changed = true
 		}
 
 		var updatedRoles ch.TimedSet
@@ -151,8 +232,15 @@ func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool
 				changed = true
 			}
 			if newInfo.Password != nil {
-				user.SetPassword(*newInfo.Password)
-				changed = true
+				// When there's a password policy, resending the current password isn't treated as reuse
+				policy := dbc.Options.PasswordPolicy
+				if policy == nil || !replaced || !user.MatchesRecentPassword(*newInfo.Password, 1) {
+					if err := dbc.validatePasswordChange(user, *newInfo.Password); err != nil {
+						return replaced, err
+					}
+					policy.SetPassword(user, *newInfo.Password)
+					changed = true
+				}
 			}
 			if newInfo.Disabled != user.Disabled() {
 				user.SetDisabled(newInfo.Disabled)
@@ -165,6 +253,8 @@ func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool
 			}
 			if !updatedRoles.Equals(base.SetFromArray(newInfo.ExplicitRoleNames)) {
 				changed = true
+			} else if newInfo.ExplicitRoleExpiry != nil && grantExpiryChanged(updatedRoles, newInfo.ExplicitRoleExpiry) {
+				changed = true
 			}
 		}
 
@@ -183,12 +273,20 @@ func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool
 		princ.SetSequence(nextSeq)
 
 		// Now update the Principal object from the properties in the request, first the channels:
-		if updatedChannels.UpdateAtSequence(newInfo.ExplicitChannels, nextSeq) {
+		channelsChanged := updatedChannels.UpdateAtSequence(newInfo.ExplicitChannels, nextSeq)
+		if newInfo.ExplicitChannelExpiry != nil && setGrantExpiry(updatedChannels, newInfo.ExplicitChannelExpiry) {
+			channelsChanged = true
+		}
+		if channelsChanged {
 			princ.SetExplicitChannels(updatedChannels)
 		}
 
 		if isUser {
-			if updatedRoles.UpdateAtSequence(base.SetFromArray(newInfo.ExplicitRoleNames), nextSeq) {
+			rolesChanged := updatedRoles.UpdateAtSequence(base.SetFromArray(newInfo.ExplicitRoleNames), nextSeq)
+			if newInfo.ExplicitRoleExpiry != nil && setGrantExpiry(updatedRoles, newInfo.ExplicitRoleExpiry) {
+				rolesChanged = true
+			}
+			if rolesChanged {
 				user.SetExplicitRoles(updatedRoles)
 			}
 		}
@@ -204,3 +302,44 @@ func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool
 	base.Errorf(base.KeyAuth, "CAS mismatch updating principal %s - exceeded retry count. Latest failure: %v", base.UD(princ.Name()), err)
 	return replaced, err
 }
+
+// Checks a new password for a user against the database's password policy.  Empty passwords, when
+// allowed, aren't subject to the policy.
+func (dbc *DatabaseContext) validatePasswordChange(user auth.User, password string) error {
+	if password == "" && dbc.AllowEmptyPassword {
+		return nil
+	}
+	return dbc.Options.PasswordPolicy.ValidatePasswordChange(user, password)
+}
+
+// Changes a user's password, enforcing the password policy.  Used for self-service password changes,
+// where the caller has already verified the user's current password.
+func (dbc *DatabaseContext) ChangeUserPassword(username string, password string) error {
+	if isValid, reason := (PrincipalConfig{Name: &username, Password: &password}).IsPasswordValid(dbc.AllowEmptyPassword); !isValid {
+		return base.HTTPErrorf(http.StatusBadRequest, reason)
+	}
+
+	authenticator := dbc.Authenticator()
+	var err error
+	for i := 1; i <= auth.PrincipalUpdateMaxCasRetries; i++ {
+		var user auth.User
+		user, err = authenticator.GetUser(username)
+		if err != nil {
+			return err
+		} else if user == nil {
+			return base.HTTPErrorf(http.StatusNotFound, "missing")
+		}
+
+		if err = dbc.validatePasswordChange(user, password); err != nil {
+			return err
+		}
+		dbc.Options.PasswordPolicy.SetPassword(user, password)
+
+		err = authenticator.Save(user)
+		if !base.IsCasMismatch(err) {
+			return err
+		}
+		base.Infof(base.KeyAuth, "CAS mismatch changing password for user %s - will retry", base.UD(username))
+	}
+	return err
+}
@@ -35,13 +35,15 @@ func (h *handler) handleCreateDB() error {
 	h.assertAdminOnly()
 	dbName := h.PathVar("newdb")
 	var config *DbConfig
-	if err := h.readJSONInto(&config); err != nil {
-		return err
+	err := h.readJSONInto(&config)
+	if err == nil {
+		err = config.setup(dbName)
 	}
-	if err := config.setup(dbName); err != nil {
-		return err
+	if err == nil {
+		_, err = h.server.AddDatabaseFromConfig(config)
 	}
-	if _, err := h.server.AddDatabaseFromConfig(config); err != nil {
+	h.audit(base.AuditEventConfigChange, dbName, err, map[string]interface{}{"action": "create_db"})
+	if err != nil {
 		return err
 	}
 	return base.HTTPErrorf(http.StatusCreated, "created")
@@ -75,6 +77,7 @@ func (h *handler) handleDbOnline() error {
 	base.JSONUnmarshal(body, &input)
 
 	base.Infof(base.KeyCRUD, "Taking Database : %v, online in %v seconds", base.MD(h.db.Name), input.Delay)
+	h.audit(base.AuditEventDbState, h.db.Name, nil, map[string]interface{}{"state": "online", "delay": input.Delay})
 
 	timer := time.NewTimer(time.Duration(input.Delay) * time.Second)
 	go func() {
@@ -93,6 +96,7 @@ func (h *handler) handleDbOffline() error {
 	if err = h.db.TakeDbOffline("ADMIN Request"); err != nil {
 		base.Infof(base.KeyCRUD, "Unable to take Database : %v, offline", base.MD(h.db.Name))
 	}
+	h.audit(base.AuditEventDbState, h.db.Name, err, map[string]interface{}{"state": "offline"})
 
 	return err
 }
@@ -114,10 +118,12 @@ func (h *handler) handlePutDbConfig() error {
 	h.assertAdminOnly()
 	dbName := h.db.Name
 	var config *DbConfig
-	if err := h.readJSONInto(&config); err != nil {
-		return err
+	err := h.readJSONInto(&config)
+	if err == nil {
+		err = config.setup(dbName)
 	}
-	if err := config.setup(dbName); err != nil {
+	h.audit(base.AuditEventConfigChange, dbName, err, map[string]interface{}{"action": "update_db_config"})
+	if err != nil {
 		return err
 	}
 	h.server.lock.Lock()
@@ -127,11 +133,96 @@ func (h *handler) handlePutDbConfig() error {
 	return base.HTTPErrorf(http.StatusCreated, "created")
 }
 
+// Request body of POST /db/_sync_test
+type syncTestRequest struct {
+	Doc     db.Body                `json:"doc"`
+	OldDoc  db.Body                `json:"oldDoc,omitempty"`
+	User    string                 `json:"user,omitempty"`    // Run as this existing user
+	UserCtx map[string]interface{} `json:"userCtx,omitempty"` // Run with this user context, e.g. {"name":..., "roles":[...], "channels":[...]}
+	Sync    string                 `json:"sync,omitempty"`    // A candidate sync function to run instead of the database's
+}
+
+// Runs a document through the sync function, or a candidate function, without saving anything.
+func (h *handler) handleSyncTest() error {
+	var request syncTestRequest
+	if err := h.readJSONInto(&request); err != nil {
+		return err
+	}
+	if request.Doc == nil {
+		return base.HTTPErrorf(http.StatusBadRequest, "Missing doc")
+	}
+	if request.User != "" && request.UserCtx != nil {
+		return base.HTTPErrorf(http.StatusBadRequest, "Only one of user and userCtx can be given")
+	}
+
+	userCtx := request.UserCtx
+	if request.User != "" {
+		user, err := h.db.Authenticator().GetUser(request.User)
+		if err != nil {
+			return err
+		} else if user == nil {
+			return base.HTTPErrorf(http.StatusNotFound, "No such user %q", request.User)
+		}
+		userCtx = db.MakeUserCtx(user)
+	}
+
+	result, err := h.db.SyncFnDryRun(request.Doc, request.OldDoc, userCtx, request.Sync)
+	if err != nil {
+		return err
+	}
+	h.writeJSON(result)
+	return nil
+}
+
+// Lists the database's channels in name order, with their channel cache stats.  By default only channels resident
+// in the cache are listed; ?count=exact lists every channel in the channels index, with the exact document counts of
+// the returned page.  Paginates with ?limit and ?startkey; the response's "next" property is the startkey of the
+// next page.
+func (h *handler) handleGetChannels() error {
+	options := db.ListChannelsOptions{
+		StartKey: h.getQuery("startkey"),
+		Limit:    int(getRestrictedIntQuery(h.getQueryValues(), "limit", db.DefaultChannelListLimit, 1, 10000, false)),
+	}
+	switch count := h.getQuery("count"); count {
+	case "", "cached":
+	case "exact":
+		options.Exact = true
+	default:
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid count %q; must be \"cached\" or \"exact\"", count)
+	}
+
+	list, next, err := h.db.ListChannels(options)
+	if err != nil {
+		return err
+	}
+	response := map[string]interface{}{"channels": list}
+	if next != "" {
+		response["next"] = next
+	}
+	h.writeJSON(response)
+	return nil
+}
+
+// Returns a channel's cache stats, along with its exact document count and latest sequence from the channels index.
+func (h *handler) handleGetChannel() error {
+	info, err := h.db.GetChannelInfo(h.PathVar("channel"))
+	if err != nil {
+		return err
+	}
+	h.writeJSON(info)
+	return nil
+}
+
 // "Delete" a database (it doesn't actually do anything to the underlying bucket)
 func (h *handler) handleDeleteDB() error {
 	h.assertAdminOnly()
+	var err error
 	if !h.server.RemoveDatabase(h.db.Name) {
-		return base.HTTPErrorf(http.StatusNotFound, "missing")
+		err = base.HTTPErrorf(http.StatusNotFound, "missing")
+	}
+	h.audit(base.AuditEventConfigChange, h.db.Name, err, map[string]interface{}{"action": "delete_db"})
+	if err != nil {
+		return err
 	}
 	h.response.Write([]byte("{}"))
 	return nil
@@ -491,6 +582,7 @@ func (h *handler) handleSetLogging() error {
 	if setLogLevel {
 		base.Infof(base.KeyAll, "Setting log level to: %v", newLogLevel)
 		base.ConsoleLogLevel().Set(newLogLevel)
+		h.audit(base.AuditEventConfigChange, "logging", nil, map[string]interface{}{"log_level": newLogLevel.String()})
 
 		// empty body is OK if request is just setting the log level
 		if len(body) == 0 {
@@ -513,6 +605,7 @@ func (h *handler) handleSetLogging() error {
 	}
 
 	base.UpdateLogKeys(keys, h.rq.Method == "PUT")
+	h.audit(base.AuditEventConfigChange, "logging", nil, map[string]interface{}{"log_keys": keys, "replace": h.rq.Method == "PUT"})
 	return nil
 }
 
@@ -586,15 +679,19 @@ func externalUserName(name string) string {
 func marshalPrincipal(princ auth.Principal) ([]byte, error) {
 	name := externalUserName(princ.Name())
 	info := db.PrincipalConfig{
-		Name:             &name,
-		ExplicitChannels: princ.ExplicitChannels().AsSet(),
+		Name:                  &name,
+		ExplicitChannels:      princ.ExplicitChannels().AsSet(),
+		ExplicitChannelExpiry: db.GrantExpiryTimes(princ.ExplicitChannels()),
 	}
 	if user, ok := princ.(auth.User); ok {
 		info.Channels = user.InheritedChannels().AsSet()
 		info.Email = user.Email()
 		info.Disabled = user.Disabled()
 		info.ExplicitRoleNames = user.ExplicitRoles().AllChannels()
+		info.ExplicitRoleExpiry = db.GrantExpiryTimes(user.ExplicitRoles())
 		info.RoleNames = user.RoleNames().AllChannels()
+		info.JWTRoleNames = user.JWTRoles().AllChannels()
+		info.JWTChannels = user.JWTChannels().AsSet()
 	} else {
 		info.Channels = princ.Channels().AsSet()
 	}
@@ -629,6 +726,7 @@ func (h *handler) updatePrincipal(name string, isUser bool) error {
 	internalName := internalUserName(*newInfo.Name)
 	newInfo.Name = &internalName
 	replaced, err := h.db.UpdatePrincipal(newInfo, isUser, h.rq.Method != "POST")
+	h.auditPrincipalChange(isUser, *newInfo.Name, replaced, newInfo, err)
 	if err != nil {
 		return err
 	} else if replaced {
@@ -646,6 +744,25 @@ func (h *handler) updatePrincipal(name string, isUser bool) error {
 	return nil
 }
 
+// Records the creation or update of a user or role in the audit log.
+func (h *handler) auditPrincipalChange(isUser bool, name string, replaced bool, newInfo db.PrincipalConfig, err error) {
+	event := base.AuditEventRoleChange
+	if isUser {
+		event = base.AuditEventUserChange
+	}
+	action := "create"
+	if replaced {
+		action = "update"
+	}
+	details := map[string]interface{}{"action": action, "admin_channels": newInfo.ExplicitChannels}
+	if isUser {
+		details["admin_roles"] = newInfo.ExplicitRoleNames
+		details["disabled"] = newInfo.Disabled
+		details["password_changed"] = newInfo.Password != nil
+	}
+	h.audit(event, name, err, details)
+}
+
 // Handles PUT or POST to /_user/*
 func (h *handler) putUser() error {
 	username := mux.Vars(h.rq)["name"]
@@ -675,7 +792,9 @@ func (h *handler) deleteUser() error {
 		}
 		return err
 	}
-	return h.db.Authenticator().Delete(user)
+	err = h.db.Authenticator().Delete(user)
+	h.audit(base.AuditEventUserChange, username, err, map[string]interface{}{"action": "delete"})
+	return err
 }
 
 func (h *handler) deleteRole() error {
@@ -687,7 +806,9 @@ func (h *handler) deleteRole() error {
 		}
 		return err
 	}
-	return h.db.Authenticator().Delete(role)
+	err = h.db.Authenticator().Delete(role)
+	h.audit(base.AuditEventRoleChange, role.Name(), err, map[string]interface{}{"action": "delete"})
+	return err
 }
 
 func (h *handler) getUserInfo() error {
@@ -705,6 +826,37 @@ func (h *handler) getUserInfo() error {
 	return err
 }
 
+// Explains how a user was granted access to a channel (?channel=) or a document (?doc=): every admin, JWT and
+// sync function grant, directly or through a role, with the documents and sequences that made them.
+func (h *handler) handleExplainUserAccess() error {
+	h.assertAdminOnly()
+	channelName := h.getQuery("channel")
+	docID := h.getQuery("doc")
+	if (channelName == "") == (docID == "") {
+		return base.HTTPErrorf(http.StatusBadRequest, "Exactly one of channel or doc must be given")
+	}
+
+	user, err := h.db.Authenticator().GetUser(internalUserName(mux.Vars(h.rq)["name"]))
+	if user == nil {
+		if err == nil {
+			err = kNotFoundError
+		}
+		return err
+	}
+
+	var explanation interface{}
+	if channelName != "" {
+		explanation, err = h.db.ExplainChannelAccess(user, channelName)
+	} else {
+		explanation, err = h.db.ExplainDocAccess(user, docID)
+	}
+	if err != nil {
+		return err
+	}
+	h.writeJSON(explanation)
+	return nil
+}
+
 func (h *handler) getRoleInfo() error {
 	h.assertAdminOnly()
 	role, err := h.db.Authenticator().GetRole(mux.Vars(h.rq)["name"])
@@ -806,9 +958,39 @@ func (h *handler) handlePurge() error {
 		count := h.db.GetChangeCache().Remove(docIDs, startTime)
 		base.Debugf(base.KeyCache, "Purged %d items from caches", count)
 	}
+	h.audit(base.AuditEventPurge, "", nil, map[string]interface{}{"doc_ids": docIDs})
 
 	h.response.Write([]byte("}\n}\n"))
 	h.logStatusWithDuration(http.StatusOK, message)
 
 	return nil
 }
+
+// ADMIN API: Lists the users and client addresses currently locked out after failed logins.
+func (h *handler) getLoginLockouts() error {
+	h.assertAdminOnly()
+	users, clientIPs, err := h.db.Authenticator().GetLoginLockouts()
+	if err != nil {
+		return err
+	}
+	h.writeJSON(db.Body{"users": users, "client_ips": clientIPs})
+	return nil
+}
+
+// ADMIN API: Clears a user's login lockout and failed login count.
+func (h *handler) deleteUserLockout() error {
+	h.assertAdminOnly()
+	user, err := h.getPathUser()
+	if err != nil {
+		return err
+	}
+	err = h.db.Authenticator().ClearUserLockout(user)
+	h.audit(base.AuditEventUserChange, user.Name(), err, map[string]interface{}{"action": "clear_lockout"})
+	return err
+}
+
+// ADMIN API: Clears a client address's login lockout and failed login count.
+func (h *handler) deleteClientIPLockout() error {
+	h.assertAdminOnly()
+	return h.db.Authenticator().ClearAddressLockout(h.PathVar("ip"))
+}
@@ -12,11 +12,16 @@ package rest
 import (
 	"bufio"
 	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -1145,6 +1150,120 @@ func TestDBOfflinePostResync(t *testing.T) {
 	assertStatus(t, rt.SendAdminRequest("POST", "/db/_resync", ""), 200)
 }
 
+func TestVacuum(t *testing.T) {
+	rt := NewRestTester(t, nil)
+	defer rt.Close()
+
+	// No run has been made yet
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_vacuum", ""), 404)
+
+	response := rt.SendAdminRequest("PUT", "/db/doc1", `{"_attachments": {"hello.txt": {"data":"aGVsbG8gd29ybGQ="}}}`)
+	assertStatus(t, response, 201)
+	_, err := rt.GetDatabase().Options.AttachmentStore.AddAttachment(db.AttachmentKey(db.Sha1DigestKey([]byte("orphaned"))), []byte("orphaned"))
+	require.NoError(t, err)
+
+	// Runs in the background, so poll the status until it completes
+	waitForVacuum := func() db.AttachmentGCStatus {
+		var status db.AttachmentGCStatus
+		for i := 0; i < 100; i++ {
+			response := rt.SendAdminRequest("GET", "/db/_vacuum", "")
+			assertStatus(t, response, 200)
+			require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &status))
+			if status.State != db.AttachmentGCStateRunning {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		return status
+	}
+
+	response = rt.SendAdminRequest("POST", "/db/_vacuum?dry_run=true&grace_period=0", "")
+	assertStatus(t, response, 202)
+	status := waitForVacuum()
+	assert.Equal(t, db.AttachmentGCStateCompleted, status.State)
+	assert.True(t, status.DryRun)
+	assert.Equal(t, 1, status.Referenced)
+	assert.Equal(t, 1, status.Deleted)
+
+	response = rt.SendAdminRequest("POST", "/db/_vacuum?grace_period=0", "")
+	assertStatus(t, response, 202)
+	status = waitForVacuum()
+	assert.Equal(t, db.AttachmentGCStateCompleted, status.State)
+	assert.False(t, status.DryRun)
+	assert.Equal(t, 1, status.Deleted)
+
+	// The referenced attachment is still available
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/doc1/hello.txt", ""), 200)
+}
+
+// With an empty body, attachments are migrated from the bucket
+func TestMigrateAttachmentsDefaultOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "attachments")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	rt := NewRestTester(t, &RestTesterConfig{DatabaseConfig: &DbConfig{
+		AttachmentStore: &db.AttachmentStoreConfig{Type: db.AttachmentStoreTypeFileSystem, Path: dir},
+	}})
+	defer rt.Close()
+
+	// Store an attachment in the bucket, as it would have been before the database's store was changed
+	key := db.AttachmentKey(db.Sha1DigestKey([]byte("hello world")))
+	_, err = db.NewBucketAttachmentStore(rt.Bucket()).AddAttachment(key, []byte("hello world"))
+	require.NoError(t, err)
+
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_offline", ""), 200)
+	response := rt.SendAdminRequest("POST", "/db/_migrate_attachments", "")
+	assertStatus(t, response, 200)
+	var result db.AttachmentMigrationResult
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &result))
+	assert.Equal(t, db.AttachmentMigrationResult{Migrated: 1}, result)
+
+	data, err := rt.GetDatabase().Options.AttachmentStore.GetAttachment(key)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(data))
+
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_migrate_attachments", "{"), 400)
+}
+
+func TestOnlineResync(t *testing.T) {
+	rt := NewRestTester(t, &RestTesterConfig{SyncFn: `function(doc) {channel(doc.channels);}`})
+	defer rt.Close()
+
+	// No run has been made yet
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_resync", ""), 404)
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc1", `{"channels": ["a"], "owner": "alice"}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc2", `{"channels": ["b"]}`), 201)
+	_, err := rt.GetDatabase().UpdateSyncFun(`function(doc) {channel(doc.channels); if (doc.owner) {access(doc.owner, doc.channels);}}`)
+	require.NoError(t, err)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password": "letmein"}`), 201)
+
+	// Runs in the background while the database is online, so poll the status until it completes
+	response := rt.SendAdminRequest("POST", "/db/_resync", "")
+	assertStatus(t, response, 202)
+	var status db.ResyncStatus
+	for i := 0; i < 100; i++ {
+		response := rt.SendAdminRequest("GET", "/db/_resync", "")
+		assertStatus(t, response, 200)
+		require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &status))
+		if status.State != db.ResyncStateRunning {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.Equal(t, db.ResyncStateCompleted, status.State)
+	assert.Equal(t, 2, status.DocsProcessed)
+	assert.Equal(t, 1, status.DocsChanged)
+
+	// The new grant is seen by the user without taking the database offline
+	response = rt.SendUserRequestWithHeaders("GET", "/db/doc1", "", nil, "alice", "letmein")
+	assertStatus(t, response, 200)
+
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_resync?action=stop", ""), 409)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_resync?action=pause", ""), 400)
+}
+
 //Take DB offline and ensure only one _resync can be in progress
 func TestDBOfflineSingleResync(t *testing.T) {
 
@@ -1743,3 +1862,729 @@ func TestRawRedaction(t *testing.T) {
 	res = rt.SendAdminRequest("GET", "/db/_raw/testdoc?include_doc=true&redact=true", ``)
 	assertStatus(t, res, http.StatusBadRequest)
 }
+
+func TestAPIKeyAPI(t *testing.T) {
+	rt := NewRestTester(t, &RestTesterConfig{noAdminParty: true})
+	defer rt.Close()
+
+	response := rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein", "admin_channels":["a", "b"]}`)
+	assertStatus(t, response, 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/docb", `{"channels":["b"]}`), 201)
+
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_user/bob/_api_key", `{}`), 404)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_user/GUEST/_api_key", `{}`), 400)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_user/alice/_api_key", `{"ttl":-1}`), 400)
+
+	createKey := func(body string) (id, token string) {
+		response := rt.SendAdminRequest("POST", "/db/_user/alice/_api_key", body)
+		assertStatus(t, response, 201)
+		var key map[string]interface{}
+		require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &key))
+		return key["id"].(string), key["key"].(string)
+	}
+	_, channelToken := createKey(`{"name":"device1", "channels":["a"]}`)
+	readOnlyID, readOnlyToken := createKey(`{"name":"device2", "read_only":true, "ttl":3600}`)
+	apiKey := func(token string) map[string]string {
+		return map[string]string{"Authorization": "ApiKey " + token}
+	}
+
+	// The channel-restricted key can write to its channels but not read others
+	response = rt.SendRequestWithHeaders("PUT", "/db/doca", `{"channels":["a"]}`, apiKey(channelToken))
+	assertStatus(t, response, 201)
+	response = rt.SendRequestWithHeaders("GET", "/db/docb", "", apiKey(channelToken))
+	assertStatus(t, response, 403)
+
+	// The read-only key can read but not write
+	response = rt.SendRequestWithHeaders("GET", "/db/docb", "", apiKey(readOnlyToken))
+	assertStatus(t, response, 200)
+	response = rt.SendRequestWithHeaders("POST", "/db/_bulk_get", `{"docs":[{"id":"doca"}]}`, apiKey(readOnlyToken))
+	assertStatus(t, response, 200)
+	response = rt.SendRequestWithHeaders("PUT", "/db/docc", `{"channels":["a"]}`, apiKey(readOnlyToken))
+	assertStatus(t, response, 403)
+
+	response = rt.SendRequestWithHeaders("GET", "/db/doca", "", apiKey("invalid.token"))
+	assertStatus(t, response, 401)
+
+	// A key can't be used to create a session, which would have none of its restrictions
+	response = rt.SendRequestWithHeaders("POST", "/db/_session", "", apiKey(channelToken))
+	assertStatus(t, response, 403)
+	assert.Empty(t, response.Header().Get("Set-Cookie"))
+
+	// Listing doesn't include the tokens
+	response = rt.SendAdminRequest("GET", "/db/_user/alice/_api_key", "")
+	assertStatus(t, response, 200)
+	var keys []map[string]interface{}
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &keys))
+	require.Len(t, keys, 2)
+	for _, key := range keys {
+		assert.Nil(t, key["key"])
+		assert.Nil(t, key["secret_hash_bcrypt"])
+	}
+
+	// Revoke a key
+	assertStatus(t, rt.SendAdminRequest("DELETE", "/db/_user/alice/_api_key/"+readOnlyID, ""), 200)
+	assertStatus(t, rt.SendAdminRequest("DELETE", "/db/_user/alice/_api_key/"+readOnlyID, ""), 404)
+	response = rt.SendRequestWithHeaders("GET", "/db/docb", "", apiKey(readOnlyToken))
+	assertStatus(t, response, 401)
+	response = rt.SendRequestWithHeaders("GET", "/db/doca", "", apiKey(channelToken))
+	assertStatus(t, response, 200)
+}
+
+// A user's channel grants made during a changes feed are still restricted to the channels of the API key the feed
+// was authenticated with.
+func TestAPIKeyChangesFeedGrant(t *testing.T) {
+	rt := NewRestTester(t, &RestTesterConfig{
+		noAdminParty: true,
+		SyncFn:       `function(doc) {channel(doc.channels); if (doc.grant) {access(doc.grant, doc.grant_channels);}}`,
+	})
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein", "admin_channels":["a"]}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/docb", `{"channels":["b"]}`), 201)
+	response := rt.SendAdminRequest("POST", "/db/_user/alice/_api_key", `{"channels":["a"]}`)
+	assertStatus(t, response, 201)
+	var key map[string]interface{}
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &key))
+	apiKey := map[string]string{"Authorization": "ApiKey " + key["key"].(string)}
+
+	var changes struct {
+		Results  []db.ChangeEntry
+		Last_Seq db.SequenceID
+	}
+	response = rt.SendRequestWithHeaders("GET", "/db/_changes", "", apiKey)
+	assertStatus(t, response, 200)
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &changes))
+	assert.Len(t, changes.Results, 0)
+
+	caughtUpCount := base.ExpvarVar2Int(rt.GetDatabase().DbStats.StatsCblReplicationPull().Get(base.StatKeyPullReplicationsCaughtUp))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		response := rt.SendRequestWithHeaders("GET", fmt.Sprintf("/db/_changes?feed=longpoll&since=%s", changes.Last_Seq), "", apiKey)
+		assertStatus(t, response, 200)
+		assert.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &changes))
+	}()
+	require.NoError(t, rt.GetDatabase().WaitForCaughtUp(caughtUpCount+1))
+
+	// Granting channel "b" to the user wakes the feed, but the key doesn't allow it, so the feed keeps waiting
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/grant", `{"grant":"alice", "grant_channels":["b"]}`), 201)
+	require.NoError(t, rt.WaitForPendingChanges())
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doca", `{"channels":["a"]}`), 201)
+	wg.Wait()
+
+	require.Len(t, changes.Results, 1)
+	assert.Equal(t, "doca", changes.Results[0].ID)
+}
+
+func TestLoginLockout(t *testing.T) {
+	rt := NewRestTester(t, &RestTesterConfig{
+		noAdminParty: true,
+		DatabaseConfig: &DbConfig{
+			LoginLockout: &auth.LoginLockoutOptions{MaxFailures: 2, LockoutSecs: 60},
+		},
+	})
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein", "admin_channels":["a"]}`), 201)
+
+	login := func(password string) *TestResponse {
+		request, _ := http.NewRequest("GET", "/db/", nil)
+		request.SetBasicAuth("alice", password)
+		return rt.Send(request)
+	}
+	assertStatus(t, login("wrong"), 401)
+	assertStatus(t, login("wrong"), 401)
+	response := login("letmein")
+	assertStatus(t, response, 429)
+	assert.NotEmpty(t, response.Header().Get("Retry-After"))
+
+	// Logins through _session are also rejected
+	response = rt.SendRequest("POST", "/db/_session", `{"name":"alice", "password":"letmein"}`)
+	assertStatus(t, response, 429)
+
+	response = rt.SendAdminRequest("GET", "/db/_lockout", "")
+	assertStatus(t, response, 200)
+	var lockouts struct {
+		Users     []auth.LoginLockout `json:"users"`
+		ClientIPs []auth.LoginLockout `json:"client_ips"`
+	}
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &lockouts))
+	require.Len(t, lockouts.Users, 1)
+	assert.Equal(t, "alice", lockouts.Users[0].Username)
+
+	assertStatus(t, rt.SendAdminRequest("DELETE", "/db/_lockout/user/alice", ""), 200)
+	assertStatus(t, rt.SendAdminRequest("DELETE", "/db/_lockout/user/bob", ""), 404)
+	assertStatus(t, login("letmein"), 200)
+}
+
+func TestChangePassword(t *testing.T) {
+	rt := NewRestTester(t, &RestTesterConfig{
+		noAdminParty: true,
+		DatabaseConfig: &DbConfig{
+			PasswordPolicy: &auth.PasswordPolicy{MinLength: 8, RequireDigit: true, HistoryCount: 2},
+		},
+	})
+	defer rt.Close()
+
+	// The policy applies to the admin API
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"short1", "admin_channels":["a"]}`), 400)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"password1", "admin_channels":["a"]}`), 201)
+	// Resending the current password isn't reuse
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"password1", "admin_channels":["a", "b"]}`), 200)
+
+	aliceSession := rt.createSession(t, "alice")
+	otherSession := rt.createSession(t, "alice")
+	changePassword := func(body string) *TestResponse {
+		return rt.SendRequestWithHeaders("PUT", "/db/_session/password", body, map[string]string{
+			"Cookie": auth.DefaultCookieName + "=" + aliceSession,
+		})
+	}
+
+	assertStatus(t, rt.SendRequest("PUT", "/db/_session/password", `{"old_password":"password1", "new_password":"password2"}`), 401)
+	assertStatus(t, changePassword(`{"old_password":"wrong", "new_password":"password2"}`), 403)
+	assertStatus(t, changePassword(`{"old_password":"password1", "new_password":"nodigits"}`), 400)
+	assertStatus(t, changePassword(`{"old_password":"password1", "new_password":"password1"}`), 400)
+
+	response := changePassword(`{"old_password":"password1", "new_password":"password2", "invalidate_sessions":true}`)
+	assertStatus(t, response, 200)
+	assert.Contains(t, response.Header().Get("Set-Cookie"), auth.DefaultCookieName)
+
+	// Other sessions were removed, and the new password is in effect
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_session/"+otherSession, ""), 404)
+	request, _ := http.NewRequest("GET", "/db/", nil)
+	request.SetBasicAuth("alice", "password2")
+	assertStatus(t, rt.Send(request), 200)
+
+	// Admins can't set a recently used password either
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"password1", "admin_channels":["a"]}`), 400)
+}
+
+func TestAdminAuth(t *testing.T) {
+	var auditOutput bytes.Buffer
+	defer base.SetUpTestAuditLog(&auditOutput)()
+
+	rt := NewRestTester(t, &RestTesterConfig{noAdminParty: true})
+	defer rt.Close()
+	rt.ServerContext().config.AdminAuth = &AdminAuthConfig{
+		Users: map[string]*AdminUserConfig{
+			"reader":    {Password: "pw-reader", Role: AdminRoleReadOnly},
+			"useradmin": {Password: "pw-useradmin", Role: AdminRoleUserAdmin},
+			"dbadmin":   {Password: "pw-dbadmin", Role: AdminRoleDbAdmin},
+			"root":      {Password: "pw-root", Role: AdminRoleFullAdmin},
+		},
+	}
+	adminRequest := func(username, method, resource, body string) *TestResponse {
+		request, _ := http.NewRequest(method, "http://localhost"+resource, bytes.NewBufferString(body))
+		if username != "" {
+			request.SetBasicAuth(username, "pw-"+username)
+		}
+		response := &TestResponse{httptest.NewRecorder(), request}
+		rt.TestAdminHandler().ServeHTTP(response, request)
+		return response
+	}
+
+	response := adminRequest("", "GET", "/db/", "")
+	assertStatus(t, response, 401)
+	assert.Equal(t, `Basic realm="Couchbase Sync Gateway Admin"`, response.Header().Get("WWW-Authenticate"))
+	response = rt.SendAdminRequestWithHeaders("GET", "/db/", "", map[string]string{"Authorization": "Basic cm9vdDp3cm9uZw=="}) // root:wrong
+	assertStatus(t, response, 401)
+
+	// read_only can only read, and can't see configs
+	assertStatus(t, adminRequest("reader", "GET", "/db/", ""), 200)
+	assertStatus(t, adminRequest("reader", "GET", "/db/_user/", ""), 200)
+	assertStatus(t, adminRequest("reader", "POST", "/db/_all_docs", `{"keys":[]}`), 200)
+	assertStatus(t, adminRequest("reader", "PUT", "/db/_user/alice", `{"password":"letmein"}`), 403)
+	assertStatus(t, adminRequest("reader", "PUT", "/db/doc1", `{}`), 403)
+	assertStatus(t, adminRequest("reader", "GET", "/db/_config", ""), 403)
+	assertStatus(t, adminRequest("reader", "GET", "/_config", ""), 403)
+	assertStatus(t, adminRequest("reader", "GET", "/db/_user/alice/_session", ""), 403)
+
+	// user_admin can also manage users
+	assertStatus(t, adminRequest("useradmin", "PUT", "/db/_user/alice", `{"password":"letmein"}`), 201)
+	assertStatus(t, adminRequest("useradmin", "PUT", "/db/_role/staff", `{}`), 201)
+	assertStatus(t, adminRequest("useradmin", "GET", "/db/_user/alice/_session", ""), 200)
+	assertStatus(t, adminRequest("useradmin", "PUT", "/db/doc1", `{}`), 403)
+
+	// db_admin can also write docs and manage the database, but not the server
+	assertStatus(t, adminRequest("dbadmin", "PUT", "/db/doc1", `{}`), 201)
+	assertStatus(t, adminRequest("dbadmin", "GET", "/db/_config", ""), 200)
+	assertStatus(t, adminRequest("dbadmin", "DELETE", "/db/_user/alice", ""), 200)
+	assertStatus(t, adminRequest("dbadmin", "GET", "/_config", ""), 403)
+	assertStatus(t, adminRequest("dbadmin", "DELETE", "/db/", ""), 403)
+	assertStatus(t, adminRequest("dbadmin", "PUT", "/_logging", `{}`), 403)
+
+	assertStatus(t, adminRequest("root", "GET", "/_config", ""), 200)
+	assertStatus(t, adminRequest("root", "GET", "/_logging", ""), 200)
+
+	// Rejections by role are audited along with rejected logins
+	assert.Contains(t, auditOutput.String(), `"event":"access_denied"`)
+	assert.Contains(t, auditOutput.String(), `"event":"login_failure"`)
+}
+
+func TestAdminAuthClientCertRole(t *testing.T) {
+	config := &AdminAuthConfig{
+		ClientCerts: map[string]string{
+			"ops-dashboard":      AdminRoleReadOnly,
+			"deploy.example.com": AdminRoleFullAdmin,
+		},
+	}
+	identity, role := config.clientCertRole(&x509.Certificate{Subject: pkix.Name{CommonName: "ops-dashboard"}})
+	assert.Equal(t, "ops-dashboard", identity)
+	assert.Equal(t, AdminRoleReadOnly, role)
+
+	identity, role = config.clientCertRole(&x509.Certificate{Subject: pkix.Name{CommonName: "deploy"}, DNSNames: []string{"deploy.example.com"}})
+	assert.Equal(t, "deploy.example.com", identity)
+	assert.Equal(t, AdminRoleFullAdmin, role)
+
+	_, role = config.clientCertRole(&x509.Certificate{Subject: pkix.Name{CommonName: "unknown"}})
+	assert.Equal(t, "", role)
+
+	// Client cert mappings need a CA and TLS, and roles must be known
+	assert.Len(t, config.validate(false), 2)
+	config.ClientCACert = "ca.pem"
+	assert.Len(t, config.validate(true), 0)
+	config.Users = map[string]*AdminUserConfig{"ops": {Password: "pw", Role: "superuser"}}
+	assert.Len(t, config.validate(true), 1)
+}
+
+func TestUserSessionList(t *testing.T) {
+	rt := NewRestTester(t, &RestTesterConfig{noAdminParty: true})
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein"}`), 201)
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_user/bob/_session", ""), 404)
+	phoneSession := rt.createSession(t, "alice")
+	laptopSession := rt.createSession(t, "alice")
+
+	var sessions []sessionInfoResponse
+	response := rt.SendAdminRequest("GET", "/db/_user/alice/_session", "")
+	assertStatus(t, response, 200)
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &sessions))
+	require.Len(t, sessions, 2)
+	assert.ElementsMatch(t, []string{phoneSession, laptopSession}, []string{sessions[0].ID, sessions[1].ID})
+	assert.NotNil(t, sessions[0].Created)
+	assert.Nil(t, sessions[0].LastUsed)
+	assert.Equal(t, int(kDefaultSessionTTL/time.Second), sessions[0].TTL)
+
+	// Authenticating with a session records its last use
+	assertStatus(t, rt.SendRequest("GET", "/db/_session/all", ""), 401)
+	response = rt.SendRequestWithHeaders("GET", "/db/_session/all", "", map[string]string{
+		"Cookie":     auth.DefaultCookieName + "=" + phoneSession,
+		"User-Agent": "PhoneApp/1.0",
+	})
+	assertStatus(t, response, 200)
+	sessions = nil
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &sessions))
+	require.Len(t, sessions, 2)
+	var current *sessionInfoResponse
+	for i, session := range sessions {
+		assert.Equal(t, "", session.ID)
+		if session.Current {
+			current = &sessions[i]
+		}
+	}
+	require.NotNil(t, current)
+	assert.NotNil(t, current.LastUsed)
+	assert.Equal(t, "PhoneApp/1.0", current.UserAgent)
+
+	session, err := rt.GetDatabase().Authenticator().GetSession(phoneSession)
+	require.NoError(t, err)
+	assert.Equal(t, "PhoneApp/1.0", session.UserAgent)
+
+	assertStatus(t, rt.SendAdminRequest("DELETE", "/db/_user/alice/_session/"+laptopSession, ""), 200)
+	response = rt.SendAdminRequest("GET", "/db/_user/alice/_session", "")
+	sessions = nil
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &sessions))
+	require.Len(t, sessions, 1)
+	assert.Equal(t, phoneSession, sessions[0].ID)
+}
+
+func TestTimeLimitedGrants(t *testing.T) {
+	rtConfig := RestTesterConfig{
+		noAdminParty: true,
+		SyncFn:       `function(doc) {channel(doc.channel); if (doc.owner) {access(doc.owner, doc.channel, doc.until);}}`,
+	}
+	rt := NewRestTester(t, &rtConfig)
+	defer rt.Close()
+
+	future := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+	past := time.Now().Add(-time.Hour).Truncate(time.Second).UTC()
+
+	// Expiries can only be given for granted channels
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", fmt.Sprintf(
+		`{"password":"letmein", "admin_channels":["a"], "admin_channel_expiry":{"b":%q}}`, future.Format(time.RFC3339))), 400)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", fmt.Sprintf(
+		`{"password":"letmein", "admin_channels":["a","b","c"], "admin_channel_expiry":{"a":%q,"b":%q}}`,
+		future.Format(time.RFC3339), past.Format(time.RFC3339))), 201)
+
+	var info db.PrincipalConfig
+	response := rt.SendAdminRequest("GET", "/db/_user/alice", "")
+	assertStatus(t, response, 200)
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &info))
+	assert.Equal(t, base.SetOf("a", "c"), info.ExplicitChannels)
+	assert.Equal(t, base.SetOf("!", "a", "c"), info.Channels)
+	require.Len(t, info.ExplicitChannelExpiry, 1)
+	assert.True(t, future.Equal(info.ExplicitChannelExpiry["a"]))
+
+	// Updating without an expiry keeps the existing one; an empty expiry map makes the grants permanent
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"admin_channels":["a","c"]}`), 200)
+	user, err := rt.GetDatabase().Authenticator().GetUser("alice")
+	require.NoError(t, err)
+	assert.True(t, future.Equal(user.ExplicitChannels()["a"].ExpiryTime()))
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"admin_channels":["a","c"], "admin_channel_expiry":{}}`), 200)
+	user, err = rt.GetDatabase().Authenticator().GetUser("alice")
+	require.NoError(t, err)
+	assert.Equal(t, time.Time{}, user.ExplicitChannels().NextExpiry())
+
+	// Expired grants made by the sync function are ignored
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc1", fmt.Sprintf(
+		`{"channel":"d", "owner":"alice", "until":%q}`, past.Format(time.RFC3339))), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc2", fmt.Sprintf(
+		`{"channel":"e", "owner":"alice", "until":%q}`, future.Format(time.RFC3339))), 201)
+	user, err = rt.GetDatabase().Authenticator().GetUser("alice")
+	require.NoError(t, err)
+	assert.False(t, user.CanSeeChannel("d"))
+	assert.True(t, user.CanSeeChannel("e"))
+	assert.True(t, future.Equal(user.Channels()["e"].ExpiryTime()))
+	assertStatus(t, rt.SendUserRequestWithHeaders("GET", "/db/doc1", "", nil, "alice", "letmein"), 403)
+	assertStatus(t, rt.SendUserRequestWithHeaders("GET", "/db/doc2", "", nil, "alice", "letmein"), 200)
+}
+
+// A continuous changes feed stops sending a channel once the user's grant of it expires.
+func TestTimeLimitedGrantExpiryDuringChanges(t *testing.T) {
+	rt := NewRestTester(t, &RestTesterConfig{noAdminParty: true, SyncFn: `function(doc) {channel(doc.channel);}`})
+	defer rt.Close()
+
+	expiry := time.Now().Add(2 * time.Second).Truncate(time.Second).UTC()
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", fmt.Sprintf(
+		`{"password":"letmein", "admin_channels":["a","b"], "admin_channel_expiry":{"b":%q}}`, expiry.Format(time.RFC3339))), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/b1", `{"channel":"b"}`), 201)
+	require.NoError(t, rt.WaitForPendingChanges())
+
+	caughtUpCount := base.ExpvarVar2Int(rt.GetDatabase().DbStats.StatsCblReplicationPull().Get(base.StatKeyPullReplicationsCaughtUp))
+	var changes []db.ChangeEntry
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		response := rt.Send(requestByUser("GET", "/db/_changes?feed=continuous&since=0&timeout=5000", "", "alice"))
+		var err error
+		changes, err = readContinuousChanges(response)
+		assert.NoError(t, err)
+	}()
+	require.NoError(t, rt.GetDatabase().WaitForCaughtUp(caughtUpCount+1))
+
+	// Wait for the grant to expire, and be removed from the user
+	for i := 0; i < 50; i++ {
+		user, err := rt.GetDatabase().Authenticator().GetUser("alice")
+		require.NoError(t, err)
+		if !user.CanSeeChannel("b") {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.NoError(t, rt.WaitForPendingChanges())
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/b2", `{"channel":"b"}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/a1", `{"channel":"a"}`), 201)
+	require.NoError(t, rt.WaitForPendingChanges())
+	wg.Wait()
+
+	var docIDs []string
+	for _, change := range changes {
+		if change.ID != "" {
+			docIDs = append(docIDs, change.ID)
+		}
+	}
+	assert.Equal(t, []string{"b1", "a1"}, docIDs)
+}
+
+func TestAuditLog(t *testing.T) {
+	var auditOutput bytes.Buffer
+	defer base.SetUpTestAuditLog(&auditOutput)()
+
+	rt := NewRestTester(t, &RestTesterConfig{noAdminParty: true})
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein", "admin_channels":["a"]}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_role/froods", `{}`), 201)
+	assertStatus(t, rt.SendUserRequestWithHeaders("GET", "/db/", "", nil, "alice", "wrong"), 401)
+	assertStatus(t, rt.SendRequest("POST", "/db/_session", `{"name":"alice", "password":"letmein"}`), 200)
+	assertStatus(t, rt.SendUserRequestWithHeaders("GET", "/db/", "", nil, "alice", "letmein"), 200)
+	assertStatus(t, rt.SendAdminRequest("DELETE", "/db/_user/alice/_session", ""), 200)
+	assertStatus(t, rt.SendAdminRequest("DELETE", "/db/_user/alice", ""), 200)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_config", `{`), 400)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_offline", ""), 200)
+
+	var entries []base.AuditEntry
+	for _, line := range strings.Split(strings.TrimSpace(auditOutput.String()), "\n") {
+		var entry base.AuditEntry
+		require.NoError(t, base.JSONUnmarshal([]byte(line), &entry), "Invalid audit entry %s", line)
+		entries = append(entries, entry)
+	}
+	var events []base.AuditEvent
+	for _, entry := range entries {
+		events = append(events, entry.Event)
+		assert.Equal(t, "db", entry.Database)
+	}
+	assert.Equal(t, []base.AuditEvent{
+		base.AuditEventUserChange,
+		base.AuditEventRoleChange,
+		base.AuditEventLoginFailure,
+		base.AuditEventSessionCreate,
+		base.AuditEventLogin,
+		base.AuditEventLogin,
+		base.AuditEventSessionDelete,
+		base.AuditEventUserChange,
+		base.AuditEventConfigChange,
+		base.AuditEventDbState,
+	}, events)
+
+	assert.Equal(t, "admin", entries[0].Actor)
+	assert.Equal(t, "alice", entries[0].Target)
+	assert.Equal(t, "create", entries[0].Details["action"])
+	assert.Equal(t, base.AuditOutcomeFailure, entries[2].Outcome)
+	assert.Equal(t, "alice", entries[2].Actor)
+	assert.Equal(t, "basic", entries[2].Details["method"])
+	assert.Equal(t, "alice", entries[4].Actor)
+	assert.Equal(t, "session", entries[4].Details["method"])
+	assert.Equal(t, "alice", entries[5].Actor)
+	assert.Equal(t, "basic", entries[5].Details["method"])
+	assert.Equal(t, "delete", entries[7].Details["action"])
+	assert.Equal(t, base.AuditOutcomeFailure, entries[8].Outcome)
+	assert.Equal(t, "update_db_config", entries[8].Details["action"])
+	assert.Equal(t, "offline", entries[9].Details["state"])
+	assert.NotContains(t, auditOutput.String(), "letmein")
+}
+
+func TestSyncFnDryRun(t *testing.T) {
+	rt := NewRestTester(t, &RestTesterConfig{
+		noAdminParty: true,
+		SyncFn: `function(doc, oldDoc) {
+			if (oldDoc && oldDoc.owner != doc.owner) {
+				throw({forbidden: "owner can't change"});
+			}
+			requireUser(doc.owner);
+			channel(doc.channels);
+			access(doc.owner, "private-" + doc.owner);
+			role(doc.owner, "role:editor");
+		}`,
+	})
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein"}`), 201)
+
+	var result db.SyncFnDryRunResult
+	dryRun := func(body string) {
+		response := rt.SendAdminRequest("POST", "/db/_sync_test", body)
+		assertStatus(t, response, 200)
+		result = db.SyncFnDryRunResult{}
+		require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &result))
+	}
+
+	// Written by an admin
+	dryRun(`{"doc": {"_id": "doc1", "owner": "alice", "channels": ["a", "b"]}}`)
+	assert.Equal(t, base.SetOf("a", "b"), result.Channels)
+	assert.Equal(t, base.SetOf("private-alice"), result.Access["alice"])
+	assert.Equal(t, base.SetOf("editor"), result.Roles["alice"])
+	assert.Nil(t, result.Rejection)
+	assert.Equal(t, "", result.Exception)
+
+	// Written by the owner, and by another user
+	dryRun(`{"doc": {"owner": "alice", "channels": ["a"]}, "user": "alice"}`)
+	assert.Nil(t, result.Rejection)
+	dryRun(`{"doc": {"owner": "alice", "channels": ["a"]}, "userCtx": {"name": "bob", "roles": [], "channels": []}}`)
+	require.NotNil(t, result.Rejection)
+	assert.Equal(t, 403, result.Rejection.Status)
+
+	// Replacing an older revision
+	dryRun(`{"doc": {"owner": "alice"}, "oldDoc": {"owner": "bob"}}`)
+	require.NotNil(t, result.Rejection)
+	assert.Equal(t, 403, result.Rejection.Status)
+	assert.Equal(t, "owner can't change", result.Rejection.Reason)
+
+	// A candidate sync function, with a time-limited grant and an exception
+	dryRun(`{"doc": {"owner": "alice", "until": "2030-01-01T00:00:00Z"}, "sync": "function(doc) { access(doc.owner, 'trial', doc.until); expiry(60); }"}`)
+	assert.Equal(t, base.SetOf("trial"), result.Access["alice"])
+	assert.Equal(t, time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC).Unix(), result.AccessExpiry["alice"]["trial"].Unix())
+	require.NotNil(t, result.Expiry)
+	assert.Equal(t, uint32(60), *result.Expiry)
+	dryRun(`{"doc": {}, "sync": "function(doc) { channel(doc.missing.channels); }"}`)
+	assert.NotEqual(t, "", result.Exception)
+
+	// Nothing was saved
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/doc1", ""), 404)
+
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_sync_test", `{"doc": {}, "sync": "function(doc) {"}`), 400)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_sync_test", `{"doc": {}, "user": "carol"}`), 404)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_sync_test", `{"oldDoc": {}}`), 400)
+}
+
+func TestGetChannels(t *testing.T) {
+	rt := NewRestTester(t, nil)
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc1", `{"channels": ["a", "b"]}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc2", `{"channels": ["b"]}`), 201)
+	response := rt.SendAdminRequest("PUT", "/db/doc3", `{"channels": ["c"]}`)
+	assertStatus(t, response, 201)
+	var body db.Body
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &body))
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc3?rev="+body["rev"].(string), `{"channels": ["a"]}`), 201)
+
+	var result struct {
+		Channels []db.ChannelInfo `json:"channels"`
+		Next     string           `json:"next"`
+	}
+	getChannels := func(query string) {
+		response := rt.SendAdminRequest("GET", "/db/_channels"+query, "")
+		assertStatus(t, response, 200)
+		result.Channels, result.Next = nil, ""
+		require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &result))
+	}
+	findChannel := func(name string) *db.ChannelInfo {
+		for i := range result.Channels {
+			if result.Channels[i].Name == name {
+				return &result.Channels[i]
+			}
+		}
+		return nil
+	}
+
+	// Exact counts come from the channels index, including channels every doc was removed from:
+	getChannels("?count=exact")
+	require.Len(t, result.Channels, 3)
+	assert.Equal(t, "", result.Next)
+	expectedCounts := map[string]int{"a": 2, "b": 2, "c": 0}
+	for _, info := range result.Channels {
+		require.NotNil(t, info.DocCount, "Channel %s", info.Name)
+		assert.Equal(t, expectedCounts[info.Name], *info.DocCount, "Channel %s", info.Name)
+		assert.True(t, info.LatestSeq > 0, "Channel %s", info.Name)
+	}
+
+	// Pagination:
+	getChannels("?count=exact&limit=2")
+	require.Len(t, result.Channels, 2)
+	assert.Equal(t, "a", result.Channels[0].Name)
+	assert.Equal(t, "b", result.Channels[1].Name)
+	assert.Equal(t, "c", result.Next)
+	getChannels("?count=exact&limit=2&startkey=" + result.Next)
+	require.Len(t, result.Channels, 1)
+	assert.Equal(t, "c", result.Channels[0].Name)
+	require.NotNil(t, result.Channels[0].DocCount)
+	assert.Equal(t, 0, *result.Channels[0].DocCount)
+	assert.Equal(t, "", result.Next)
+
+	// A single channel's stats:
+	for name, expectedCount := range expectedCounts {
+		response := rt.SendAdminRequest("GET", "/db/_channels/"+name, "")
+		assertStatus(t, response, 200)
+		var info db.ChannelInfo
+		require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &info))
+		assert.Equal(t, name, info.Name)
+		require.NotNil(t, info.DocCount, "Channel %s", name)
+		assert.Equal(t, expectedCount, *info.DocCount, "Channel %s", name)
+		assert.True(t, info.LatestSeq > 0, "Channel %s", name)
+	}
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_channels/d", ""), 404)
+
+	// A changes feed for channel "a" makes it resident in the channel cache:
+	_, err := rt.WaitForChanges(2, "/db/_changes?filter=sync_gateway/bychannel&channels=a", "", true)
+	require.NoError(t, err)
+	getChannels("")
+	info := findChannel("a")
+	require.NotNil(t, info)
+	assert.True(t, info.Cached)
+	assert.Equal(t, 2, info.CacheEntries)
+	assert.Nil(t, info.DocCount)
+	assert.Nil(t, findChannel("c"))
+
+	getChannels("?count=exact")
+	assert.True(t, findChannel("a").Cached)
+	assert.False(t, findChannel("c").Cached)
+
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_channels?count=approximate", ""), 400)
+	assertStatus(t, rt.SendRequest("GET", "/db/_channels", ""), 404)
+}
+
+func TestExplainUserAccess(t *testing.T) {
+	rt := NewRestTester(t, &RestTesterConfig{
+		SyncFn: `function(doc) {
+			channel(doc.channels);
+			if (doc.grant) {access(doc.grant.user, doc.grant.channels);}
+			if (doc.roles) {role(doc.roles.user, doc.roles.roles);}
+		}`,
+	})
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_role/editor", `{"admin_channels": ["drafts"]}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_role/reviewer", `{"admin_channels": ["drafts", "reviews"]}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password": "letmein", "admin_channels": ["news"], "admin_roles": ["editor"]}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/grantDoc", `{"grant": {"user": "alice", "channels": ["news", "sports"]}}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/roleDoc", `{"roles": {"user": "alice", "roles": ["role:reviewer"]}}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc1", `{"channels": ["drafts", "secret"]}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc2", `{"channels": ["secret"]}`), 201)
+
+	explainChannel := func(channelName string) (explanation db.ChannelAccessExplanation) {
+		response := rt.SendAdminRequest("GET", "/db/_user/alice/_explain?channel="+channelName, "")
+		assertStatus(t, response, 200)
+		require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &explanation))
+		return explanation
+	}
+
+	// Granted by the admin API and by a document's access() call:
+	explanation := explainChannel("news")
+	assert.True(t, explanation.CanSee)
+	require.Len(t, explanation.Grants, 2)
+	assert.Equal(t, db.AccessGrantAdmin, explanation.Grants[0].Source)
+	assert.Equal(t, db.AccessGrantSyncFunction, explanation.Grants[1].Source)
+	assert.Equal(t, "grantDoc", explanation.Grants[1].DocID)
+	assert.True(t, explanation.Grants[1].Sequence > 0)
+
+	// Granted through two roles, one granted by the admin API and one by a document's role() call:
+	explanation = explainChannel("drafts")
+	assert.True(t, explanation.CanSee)
+	require.Len(t, explanation.Grants, 2)
+	editor, reviewer := explanation.Grants[0], explanation.Grants[1]
+	assert.Equal(t, db.AccessGrantRole, editor.Source)
+	assert.Equal(t, "editor", editor.Role)
+	require.Len(t, editor.RoleGrants, 1)
+	assert.Equal(t, db.AccessGrantAdmin, editor.RoleGrants[0].Source)
+	require.Len(t, editor.ChannelGrants, 1)
+	assert.Equal(t, db.AccessGrantAdmin, editor.ChannelGrants[0].Source)
+	assert.Equal(t, "reviewer", reviewer.Role)
+	require.Len(t, reviewer.RoleGrants, 1)
+	assert.Equal(t, db.AccessGrantSyncFunction, reviewer.RoleGrants[0].Source)
+	assert.Equal(t, "roleDoc", reviewer.RoleGrants[0].DocID)
+
+	explanation = explainChannel("secret")
+	assert.False(t, explanation.CanSee)
+	assert.Empty(t, explanation.Grants)
+
+	explanation = explainChannel("!")
+	require.Len(t, explanation.Grants, 1)
+	assert.Equal(t, db.AccessGrantPublic, explanation.Grants[0].Source)
+
+	// A document is visible through any of its channels:
+	var docExplanation db.DocAccessExplanation
+	response := rt.SendAdminRequest("GET", "/db/_user/alice/_explain?doc=doc1", "")
+	assertStatus(t, response, 200)
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &docExplanation))
+	assert.True(t, docExplanation.CanSee)
+	require.Len(t, docExplanation.Channels, 2)
+	assert.Equal(t, "drafts", docExplanation.Channels[0].Channel)
+	assert.True(t, docExplanation.Channels[0].CanSee)
+	assert.Equal(t, "secret", docExplanation.Channels[1].Channel)
+	assert.False(t, docExplanation.Channels[1].CanSee)
+
+	response = rt.SendAdminRequest("GET", "/db/_user/alice/_explain?doc=doc2", "")
+	assertStatus(t, response, 200)
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &docExplanation))
+	assert.False(t, docExplanation.CanSee)
+
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_user/alice/_explain?doc=missing", ""), 404)
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_user/alice/_explain", ""), 400)
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_user/alice/_explain?channel=news&doc=doc1", ""), 400)
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_user/bob/_explain?channel=news", ""), 404)
+}
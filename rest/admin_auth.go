@@ -0,0 +1,183 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"crypto/subtle"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Built-in admin roles
+const (
+	AdminRoleReadOnly  = "read_only"
+	AdminRoleUserAdmin = "user_admin"
+	AdminRoleDbAdmin   = "db_admin"
+	AdminRoleFullAdmin = "full_admin"
+)
+
+// A class of admin endpoints that a role can be allowed to call.
+type adminPermission int
+
+const (
+	adminPermRead         adminPermission = iota // Read-only requests for databases, docs, users and stats
+	adminPermManageUsers                         // Changes to users, roles, sessions, API keys and lockouts
+	adminPermManageDb                            // Doc writes, database config and database maintenance
+	adminPermManageServer                        // Server config, logging, profiling, replication, creating and deleting databases
+)
+
+var adminRolePermissions = map[string][]adminPermission{
+	AdminRoleReadOnly:  {adminPermRead},
+	AdminRoleUserAdmin: {adminPermRead, adminPermManageUsers},
+	AdminRoleDbAdmin:   {adminPermRead, adminPermManageUsers, adminPermManageDb},
+	AdminRoleFullAdmin: {adminPermRead, adminPermManageUsers, adminPermManageDb, adminPermManageServer},
+}
+
+func adminRoleAllows(role string, permission adminPermission) bool {
+	for _, p := range adminRolePermissions[role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+func (config *AdminAuthConfig) validate(tlsEnabled bool) (errs []error) {
+	for name, user := range config.Users {
+		if user == nil || user.Password == "" {
+			errs = append(errs, fmt.Errorf("admin_auth user %q must have a password", name))
+		} else if _, ok := adminRolePermissions[user.Role]; !ok {
+			errs = append(errs, fmt.Errorf("admin_auth user %q has unknown role %q", name, user.Role))
+		}
+	}
+	for name, role := range config.ClientCerts {
+		if _, ok := adminRolePermissions[role]; !ok {
+			errs = append(errs, fmt.Errorf("admin_auth client cert %q has unknown role %q", name, role))
+		}
+	}
+	if len(config.ClientCerts) > 0 && config.ClientCACert == "" {
+		errs = append(errs, fmt.Errorf("admin_auth.client_certs requires admin_auth.client_ca_cert"))
+	}
+	if config.ClientCACert != "" && !tlsEnabled {
+		errs = append(errs, fmt.Errorf("admin_auth.client_ca_cert requires SSLCert and SSLKey"))
+	}
+	return errs
+}
+
+// Returns the identity and role a client certificate maps to.  The common name is checked first,
+// followed by the certificate's DNS and email SANs.
+func (config *AdminAuthConfig) clientCertRole(cert *x509.Certificate) (identity string, role string) {
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, name := range names {
+		if role, ok := config.ClientCerts[name]; ok && name != "" {
+			return name, role
+		}
+	}
+	return "", ""
+}
+
+// Authenticates a request to the admin API using a verified client certificate or basic auth.
+// Returns empty strings if the request has no valid credentials.
+func (h *handler) authenticateAdmin(config *AdminAuthConfig) (identity string, role string) {
+	if h.rq.TLS != nil && len(h.rq.TLS.VerifiedChains) > 0 && len(h.rq.TLS.VerifiedChains[0]) > 0 {
+		if identity, role = config.clientCertRole(h.rq.TLS.VerifiedChains[0][0]); role != "" {
+			return identity, role
+		}
+	}
+	if username, password := h.getBasicAuth(); username != "" {
+		user := config.Users[username]
+		if user != nil && subtle.ConstantTimeCompare([]byte(password), []byte(user.Password)) == 1 {
+			return username, user.Role
+		}
+	}
+	return "", ""
+}
+
+// Returns the permission needed to make the current admin request.
+func (h *handler) requiredAdminPermission() adminPermission {
+	if h.PathVar("newdb") != "" {
+		return adminPermManageServer
+	}
+
+	path := strings.Split(strings.Trim(h.rq.URL.Path, "/"), "/")
+	if h.PathVar("db") == "" {
+		switch path[0] {
+		case "_config", "_debug", "_expvar", "_sgcollect_info":
+			// These expose credentials or process internals even when read
+			return adminPermManageServer
+		}
+		if h.isReadOnlyRequest() {
+			return adminPermRead
+		}
+		return adminPermManageServer
+	}
+
+	endpoint := ""
+	if len(path) > 1 {
+		endpoint = path[1]
+	}
+	switch endpoint {
+	case "":
+		if h.rq.Method == "DELETE" {
+			return adminPermManageServer
+		}
+	case "_config", "_blipsync":
+		return adminPermManageDb
+	case "_user", "_role", "_session", "_lockout":
+		if endpoint == "_user" && len(path) > 3 && path[3] == "_session" {
+			// A user's session listing includes the session IDs, which can be used to act as the user
+			return adminPermManageUsers
+		}
+		if h.isReadOnlyRequest() {
+			return adminPermRead
+		}
+		return adminPermManageUsers
+	}
+	if h.isReadOnlyRequest() {
+		return adminPermRead
+	}
+	return adminPermManageDb
+}
+
+// Authenticates an admin request and checks that the caller's role allows it, if admin auth is
+// configured.  Every admin request is logged along with the caller's identity.
+func (h *handler) checkAdminAuth() error {
+	config := h.server.config.AdminAuth
+	if config == nil {
+		return nil
+	}
+
+	queryValues := h.getQueryValues()
+	requestURL := base.SanitizeRequestURL(h.rq, &queryValues)
+	identity, role := h.authenticateAdmin(config)
+	if role == "" {
+		base.Infof(base.KeyAll, "%s: Admin request %s %s rejected: invalid login", h.formatSerialNumber(), h.rq.Method, requestURL)
+		h.response.Header().Set("WWW-Authenticate", `Basic realm="Couchbase Sync Gateway Admin"`)
+		err := base.HTTPErrorf(http.StatusUnauthorized, "Invalid login")
+		username, _ := h.getBasicAuth()
+		h.auditLoginFailure(username, "admin", err)
+		return err
+	}
+	h.adminIdentity = identity
+
+	if !adminRoleAllows(role, h.requiredAdminPermission()) {
+		base.Infof(base.KeyAll, "%s: Admin request %s %s by %s rejected: not allowed for role %s", h.formatSerialNumber(), h.rq.Method, requestURL, base.UD(identity), role)
+		err := base.HTTPErrorf(http.StatusForbidden, "Admin role %q can't access this endpoint", role)
+		h.audit(base.AuditEventAccessDenied, h.rq.Method+" "+requestURL, err, map[string]interface{}{"role": role})
+		return err
+	}
+	base.Infof(base.KeyAll, "%s: Admin request %s %s by %s (role %s)", h.formatSerialNumber(), h.rq.Method, requestURL, base.UD(identity), role)
+	return nil
+}
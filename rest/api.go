@@ -15,9 +15,11 @@ import (
 	"net/http"
 	httpprof "net/http/pprof"
 	"os"
+	"reflect"
 	"runtime"
 	"runtime/pprof"
 	"sync/atomic"
+	"time"
 
 	sgbucket "github.com/couchbase/sg-bucket"
 	"github.com/couchbase/sync_gateway/base"
@@ -52,15 +54,89 @@ func (h *handler) handleCompact() error {
 	return nil
 }
 
+// Starts garbage collection of attachments that are no longer referenced by any document, or resumes an interrupted
+// run.  Runs in the background; progress is reported by GET /{db}/_vacuum.
 func (h *handler) handleVacuum() error {
-	attsDeleted, err := db.VacuumAttachments(h.db.Bucket)
+	options := db.AttachmentGCOptions{
+		DryRun:      h.getBoolQuery("dry_run"),
+		GracePeriod: time.Duration(h.getIntQuery("grace_period", uint64(db.DefaultAttachmentGCGracePeriod/time.Second))) * time.Second,
+		Restart:     h.getBoolQuery("restart"),
+	}
+	status, err := h.db.StartAttachmentGC(options)
+	if err != nil {
+		return err
+	}
+	h.writeJSONStatus(http.StatusAccepted, status)
+	return nil
+}
+
+// Returns the progress of the running, or most recent, attachment garbage collection.
+func (h *handler) handleGetVacuum() error {
+	status, err := h.db.AttachmentGCStatus()
 	if err != nil {
 		return err
 	}
-	h.writeJSON(db.Body{"atts": attsDeleted})
+	h.writeJSON(status)
 	return nil
 }
 
+// Copies attachments from a previous attachment store into the database's current one.  The request body's "from"
+// property describes the previous store, and defaults to the bucket; an empty body uses the defaults.
+func (h *handler) handleMigrateAttachments() error {
+
+	if atomic.LoadUint32(&h.db.State) != db.DBOffline {
+		return base.HTTPErrorf(http.StatusServiceUnavailable, "Database must be _offline before calling /_migrate_attachments")
+	}
+
+	var request struct {
+		From         *db.AttachmentStoreConfig `json:"from"`
+		DeleteSource bool                      `json:"delete_source"`
+	}
+	body, err := h.readBody()
+	if err != nil {
+		return err
+	}
+	if len(body) > 0 {
+		if err := base.JSONUnmarshal(body, &request); err != nil {
+			return base.HTTPErrorf(http.StatusBadRequest, "Bad JSON")
+		}
+	}
+
+	if request.From == nil {
+		request.From = &db.AttachmentStoreConfig{Type: db.AttachmentStoreTypeBucket}
+	}
+	if config := h.server.GetDatabaseConfig(h.db.Name); config != nil && sameAttachmentStore(request.From, config.AttachmentStore) {
+		return base.HTTPErrorf(http.StatusBadRequest, "Source attachment store is the database's current attachment store")
+	}
+
+	source, err := db.NewAttachmentStore(request.From, h.db.Bucket)
+	if err != nil {
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid source attachment store: %v", err)
+	}
+
+	result, err := h.db.MigrateAttachments(source, request.DeleteSource)
+	if err != nil {
+		return err
+	}
+	h.writeJSON(result)
+	return nil
+}
+
+// Whether two attachment store configs refer to the same store.  A nil config or empty type is the bucket store.
+func sameAttachmentStore(a, b *db.AttachmentStoreConfig) bool {
+	normalize := func(config *db.AttachmentStoreConfig) db.AttachmentStoreConfig {
+		if config == nil || config.Type == "" {
+			return db.AttachmentStoreConfig{Type: db.AttachmentStoreTypeBucket}
+		}
+		normalized := *config
+		if normalized.Type == db.AttachmentStoreTypeBucket {
+			normalized.Path, normalized.S3 = "", nil
+		}
+		return normalized
+	}
+	return reflect.DeepEqual(normalize(a), normalize(b))
+}
+
 func (h *handler) handleFlush() error {
 
 	// If it can be flushed, then flush it
@@ -134,14 +210,40 @@ func (h *handler) handleFlush() error {
 
 }
 
+// Re-runs the sync function on every document.  While the database is online the resync runs in the background,
+// resuming a stopped or interrupted run unless ?restart=true; ?action=stop stops it, and GET /{db}/_resync reports
+// its progress.  While the database is offline the resync runs to completion within the request.
 func (h *handler) handleResync() error {
 
+	switch action := h.getQuery("action"); action {
+	case "", "start":
+	case "stop":
+		status, err := h.db.StopResync()
+		if err != nil {
+			return err
+		}
+		h.writeJSON(status)
+		return nil
+	default:
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid action %q; must be \"start\" or \"stop\"", action)
+	}
+
 	//If the DB is already re syncing, return error to user
 	dbState := atomic.LoadUint32(&h.db.State)
-	if dbState == db.DBResyncing {
+	if dbState == db.DBResyncing || h.db.ResyncRunning() {
 		return base.HTTPErrorf(http.StatusServiceUnavailable, "Database _resync is already in progress")
 	}
 
+	if dbState == db.DBOnline {
+		status, err := h.db.StartResync(db.ResyncOptions{Restart: h.getBoolQuery("restart")})
+		h.audit(base.AuditEventResync, "", err, map[string]interface{}{"background": true})
+		if err != nil {
+			return err
+		}
+		h.writeJSONStatus(http.StatusAccepted, status)
+		return nil
+	}
+
 	if dbState != db.DBOffline {
 		return base.HTTPErrorf(http.StatusServiceUnavailable, "Database must be _offline before calling /_resync")
 	}
@@ -149,6 +251,7 @@ func (h *handler) handleResync() error {
 	if atomic.CompareAndSwapUint32(&h.db.State, db.DBOffline, db.DBResyncing) {
 		defer atomic.CompareAndSwapUint32(&h.db.State, db.DBResyncing, db.DBOffline)
 		docsChanged, err := h.db.UpdateAllDocChannels()
+		h.audit(base.AuditEventResync, "", err, map[string]interface{}{"changes": docsChanged})
 		if err != nil {
 			return err
 		}
@@ -157,6 +260,16 @@ func (h *handler) handleResync() error {
 	return nil
 }
 
+// Returns the progress of the running, or most recent, background resync.
+func (h *handler) handleGetResync() error {
+	status, err := h.db.ResyncStatus()
+	if err != nil {
+		return err
+	}
+	h.writeJSON(status)
+	return nil
+}
+
 type PostUpgradeResponse struct {
 	Result  PostUpgradeResult `json:"post_upgrade_results"`
 	Preview bool              `json:"preview,omitempty"`
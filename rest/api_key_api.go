@@ -0,0 +1,151 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// API key info returned by the admin API.  The key's token is only included when it's created.
+type apiKeyResponse struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name,omitempty"`
+	Key        string     `json:"key,omitempty"`
+	Created    time.Time  `json:"created"`
+	Expiration *time.Time `json:"expiration,omitempty"`
+	ReadOnly   bool       `json:"read_only,omitempty"`
+	Channels   base.Set   `json:"channels,omitempty"`
+}
+
+func newAPIKeyResponse(key *auth.APIKey) apiKeyResponse {
+	return apiKeyResponse{
+		ID:         key.ID,
+		Name:       key.Name,
+		Created:    key.Created,
+		Expiration: key.Expiration,
+		ReadOnly:   key.ReadOnly,
+		Channels:   key.Channels,
+	}
+}
+
+// Returns the user named in the request path, or a 404 error.
+func (h *handler) getPathUser() (auth.User, error) {
+	user, err := h.db.Authenticator().GetUser(internalUserName(h.PathVar("name")))
+	if user == nil {
+		if err == nil {
+			err = kNotFoundError
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// ADMIN API: Issues an API key for a user.  The response includes the key's token, which isn't
+// retrievable afterwards.
+func (h *handler) createUserAPIKey() error {
+	h.assertAdminOnly()
+	var params struct {
+		Name     string   `json:"name"`
+		TTL      int      `json:"ttl"` // seconds; zero means the key doesn't expire
+		ReadOnly bool     `json:"read_only"`
+		Channels []string `json:"channels"`
+	}
+	if err := h.readJSONInto(&params); err != nil {
+		return err
+	} else if params.TTL < 0 {
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid ttl")
+	}
+
+	user, err := h.getPathUser()
+	if err != nil {
+		return err
+	} else if user.Name() == "" {
+		return base.HTTPErrorf(http.StatusBadRequest, "API keys can't be issued to the guest user")
+	}
+
+	options := auth.APIKeyOptions{
+		Name:     params.Name,
+		TTL:      time.Duration(params.TTL) * time.Second,
+		ReadOnly: params.ReadOnly,
+	}
+	if params.Channels != nil {
+		options.Channels = base.SetFromArray(params.Channels)
+	}
+	key, token, err := h.db.Authenticator().CreateAPIKey(user, options)
+	if err != nil {
+		return err
+	}
+
+	response := newAPIKeyResponse(key)
+	response.Key = token
+	h.writeJSONStatus(http.StatusCreated, response)
+	return nil
+}
+
+// ADMIN API: Lists a user's API keys, without their tokens.
+func (h *handler) getUserAPIKeys() error {
+	h.assertAdminOnly()
+	user, err := h.getPathUser()
+	if err != nil {
+		return err
+	}
+
+	response := make([]apiKeyResponse, 0, len(user.APIKeys()))
+	for _, key := range user.APIKeys() {
+		if !key.Expired() {
+			response = append(response, newAPIKeyResponse(key))
+		}
+	}
+	sort.Slice(response, func(i, j int) bool { return response[i].Created.Before(response[j].Created) })
+	h.writeJSON(response)
+	return nil
+}
+
+// ADMIN API: Revokes one of a user's API keys.
+func (h *handler) deleteUserAPIKey() error {
+	h.assertAdminOnly()
+	user, err := h.getPathUser()
+	if err != nil {
+		return err
+	}
+	return h.db.Authenticator().RevokeAPIKey(user, h.PathVar("keyid"))
+}
+
+// Returns the token from an "Authorization: ApiKey <token>" header
+func (h *handler) getAPIKeyToken() string {
+	auth := h.rq.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "ApiKey ") {
+		return auth[7:]
+	}
+	return ""
+}
+
+// The database endpoints that only read, but are called with POST to pass a request body.  A read-only API key can
+// call these along with any GET or HEAD request.
+var readOnlyPostEndpoints = base.SetOf("_all_docs", "_bulk_get", "_changes", "_revs_diff")
+
+// Whether the request can be made with a read-only API key.
+func (h *handler) isReadOnlyRequest() bool {
+	switch h.rq.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	case "POST":
+		// Only a database endpoint itself (/db/_changes), never a document or attachment whose name matches one
+		path := strings.Split(strings.Trim(h.rq.URL.Path, "/"), "/")
+		return len(path) == 2 && readOnlyPostEndpoints.Contains(path[1])
+	}
+	return false
+}
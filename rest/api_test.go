@@ -12,6 +12,11 @@ package rest
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
 	"fmt"
 	"io"
@@ -22,6 +27,7 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"sort"
 	"strconv"
 	"strings"
@@ -224,6 +230,81 @@ func TestDocAttachment(t *testing.T) {
 	goassert.Equals(t, response.Header().Get("Content-Type"), attachmentContentType)
 }
 
+// Attachments are streamed to and from the attachment store, and large ones are stored in chunks.
+func TestStreamedAttachmentChunks(t *testing.T) {
+	rt := NewRestTester(t, nil)
+	defer rt.Close()
+
+	defer func(chunkSize int) { db.BucketAttachmentChunkSize = chunkSize }(db.BucketAttachmentChunkSize)
+	db.BucketAttachmentChunkSize = 8
+
+	attachmentBody := "this is the body of attachment"
+	response := rt.SendRequestWithHeaders("PUT", "/db/doc/attach1", attachmentBody, map[string]string{"Content-Type": "text/plain"})
+	assertStatus(t, response, 201)
+
+	// The attachment metadata is the same as for a buffered upload
+	response = rt.SendRequest("GET", "/db/doc", "")
+	assertStatus(t, response, 200)
+	var body db.Body
+	assert.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &body))
+	meta := db.GetBodyAttachments(body)["attach1"].(map[string]interface{})
+	assert.Equal(t, db.Sha1DigestKey([]byte(attachmentBody)), meta["digest"])
+	assert.Equal(t, float64(len(attachmentBody)), meta["length"])
+	assert.Equal(t, float64(1), meta["revpos"])
+
+	response = rt.SendRequest("GET", "/db/doc/attach1", "")
+	assertStatus(t, response, 200)
+	assert.Equal(t, attachmentBody, response.Body.String())
+	assert.Equal(t, "30", response.Header().Get("Content-Length"))
+
+	// A range spanning several chunks
+	response = rt.SendRequestWithHeaders("GET", "/db/doc/attach1", "", map[string]string{"Range": "bytes=5-20"})
+	assertStatus(t, response, 206)
+	assert.Equal(t, attachmentBody[5:21], response.Body.String())
+	assert.Equal(t, "16", response.Header().Get("Content-Length"))
+	assert.Equal(t, "bytes 5-20/30", response.Header().Get("Content-Range"))
+}
+
+// An attachment PUT that can't be written isn't streamed to the attachment store.
+func TestPutAttachmentCheckedBeforeStreaming(t *testing.T) {
+	rt := NewRestTester(t, &RestTesterConfig{
+		noAdminParty: true,
+		SyncFn:       `function(doc) {channel(doc.channels); requireUser(doc.owner);}`,
+	})
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein", "admin_channels":["a"]}`), 201)
+	response := rt.SendAdminRequest("PUT", "/db/bobs", `{"channels":["a"], "owner":"bob"}`)
+	assertStatus(t, response, 201)
+	var body db.Body
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &body))
+	bobsRev := body["rev"].(string)
+	response = rt.SendAdminRequest("PUT", "/db/alices", `{"channels":["a"], "owner":"alice"}`)
+	assertStatus(t, response, 201)
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &body))
+	alicesRev := body["rev"].(string)
+
+	attachmentBody := "rejected attachment"
+	attachmentKey := db.AttachmentKey(db.Sha1DigestKey([]byte(attachmentBody)))
+	assertNotStored := func() {
+		_, err := rt.GetDatabase().Options.AttachmentStore.GetAttachment(attachmentKey)
+		assert.True(t, base.IsDocNotFoundError(err), "Expected not found error, got %v", err)
+	}
+
+	// Rejected by the sync function
+	assertStatus(t, rt.Send(requestByUser("PUT", "/db/bobs/attach1?rev="+bobsRev, attachmentBody, "alice")), 403)
+	assertNotStored()
+
+	// Not the current revision
+	assertStatus(t, rt.Send(requestByUser("PUT", "/db/alices/attach1?rev=1-abc", attachmentBody, "alice")), 409)
+	assertStatus(t, rt.Send(requestByUser("PUT", "/db/alices/attach1", attachmentBody, "alice")), 409)
+	assertNotStored()
+
+	assertStatus(t, rt.Send(requestByUser("PUT", "/db/alices/attach1?rev="+alicesRev, attachmentBody, "alice")), 201)
+	_, err := rt.GetDatabase().Options.AttachmentStore.GetAttachment(attachmentKey)
+	assert.NoError(t, err)
+}
+
 // Add an attachment to a document that has been removed from the users channels
 func TestDocAttachmentOnRemovedRev(t *testing.T) {
 	rt := NewRestTester(t, nil)
@@ -4163,3 +4244,178 @@ func Benchmark_RestApiGetDocPerformanceFullRevCache(b *testing.B) {
 		}
 	})
 }
+
+func TestBulkDocsAllOrNothing(t *testing.T) {
+
+	rtConfig := RestTesterConfig{SyncFn: `function(doc) {
+		if (doc.invalid) {
+			throw({forbidden: "invalid doc"});
+		}
+	}`}
+	rt := NewRestTester(t, &rtConfig)
+	defer rt.Close()
+
+	// A rejected doc fails the whole batch
+	input := `{"all_or_nothing": true, "docs": [{"_id": "parent", "n": 1}, {"_id": "child", "invalid": true}]}`
+	response := rt.SendAdminRequest("POST", "/db/_bulk_docs", input)
+	assertStatus(t, response, http.StatusExpectationFailed)
+	var docResults []map[string]interface{}
+	assert.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &docResults))
+	require.Len(t, docResults, 1)
+	assert.Equal(t, "child", docResults[0]["id"])
+	assert.Equal(t, "forbidden", docResults[0]["error"])
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/parent", ""), 404)
+
+	// A valid batch is written
+	input = `{"all_or_nothing": true, "docs": [{"_id": "parent", "n": 1}, {"_id": "child", "n": 2}]}`
+	response = rt.SendAdminRequest("POST", "/db/_bulk_docs", input)
+	assertStatus(t, response, 201)
+	assert.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &docResults))
+	require.Len(t, docResults, 2)
+	assert.Equal(t, "parent", docResults[0]["id"])
+	assert.NotEmpty(t, docResults[1]["rev"])
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/child", ""), 200)
+
+	// new_edits=false isn't supported
+	input = `{"all_or_nothing": true, "new_edits": false, "docs": [{"_id": "other", "_rev": "1-abc"}]}`
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_bulk_docs", input), 400)
+
+	// Nor are _local docs, which can't be rolled back
+	input = `{"all_or_nothing": true, "docs": [{"_id": "other", "n": 1}, {"_id": "_local/other", "n": 1}]}`
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_bulk_docs", input), 400)
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/other", ""), 404)
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_local/other", ""), 404)
+}
+
+// Builds an HS256 JWT for the given claims.
+func hs256TestJWT(t *testing.T, secret string, claims map[string]interface{}) string {
+	headerJSON, err := base.JSONMarshal(map[string]interface{}{"alg": "HS256", "typ": "JWT"})
+	require.NoError(t, err)
+	claimsJSON, err := base.JSONMarshal(claims)
+	require.NoError(t, err)
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestLocalJWTAuth(t *testing.T) {
+	rt := NewRestTester(t, &RestTesterConfig{
+		noAdminParty: true,
+		DatabaseConfig: &DbConfig{
+			JWTConfig: &auth.LocalJWTOptions{
+				Issuer:    "https://issuer.example.com",
+				Audiences: []string{"sync_gateway"},
+				Keys:      []auth.LocalJWTKey{{Algorithm: auth.JWTAlgorithmHS256, Key: "shared secret"}},
+				Register:  true,
+			},
+		},
+	})
+	defer rt.Close()
+
+	claims := map[string]interface{}{
+		"iss": "https://issuer.example.com",
+		"aud": "sync_gateway",
+		"sub": "alice",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	bearer := func(token string) map[string]string {
+		return map[string]string{"Authorization": "Bearer " + token}
+	}
+
+	// The user is created on first use
+	response := rt.SendRequestWithHeaders("GET", "/db/_session", "", bearer(hs256TestJWT(t, "shared secret", claims)))
+	assertStatus(t, response, 200)
+	var session map[string]interface{}
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &session))
+	assert.Equal(t, "alice", session["userCtx"].(map[string]interface{})["name"])
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_user/alice", ""), 200)
+
+	// Wrong key
+	response = rt.SendRequestWithHeaders("GET", "/db/_session", "", bearer(hs256TestJWT(t, "wrong secret", claims)))
+	assertStatus(t, response, 401)
+
+	// Expired
+	claims["exp"] = time.Now().Add(-5 * time.Minute).Unix()
+	response = rt.SendRequestWithHeaders("GET", "/db/_session", "", bearer(hs256TestJWT(t, "shared secret", claims)))
+	assertStatus(t, response, 401)
+}
+
+func TestClientCertAuth(t *testing.T) {
+	rt := NewRestTester(t, &RestTesterConfig{
+		noAdminParty: true,
+		DatabaseConfig: &DbConfig{
+			ClientCertAuth: &auth.ClientCertOptions{
+				UsernameField:   auth.ClientCertFieldSANURI,
+				UsernamePattern: `^spiffe://example\.com/user/(.+)$`,
+			},
+		},
+	})
+	defer rt.Close()
+
+	sendWithCert := func(uri string) *TestResponse {
+		req := request("GET", "/db/_session", "")
+		if uri != "" {
+			certURI, err := url.Parse(uri)
+			require.NoError(t, err)
+			cert := &x509.Certificate{Subject: pkix.Name{CommonName: "device-1234"}, URIs: []*url.URL{certURI}}
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		}
+		return rt.Send(req)
+	}
+
+	// Without registration, the user must already exist
+	assertStatus(t, sendWithCert("spiffe://example.com/user/alice"), 401)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein"}`), 201)
+
+	response := sendWithCert("spiffe://example.com/user/alice")
+	assertStatus(t, response, 200)
+	var session map[string]interface{}
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &session))
+	assert.Equal(t, "alice", session["userCtx"].(map[string]interface{})["name"])
+
+	// A certificate that doesn't map to a username is rejected
+	assertStatus(t, sendWithCert("spiffe://other.example.com/user/alice"), 401)
+
+	// Without a certificate, other auth methods still apply
+	response = sendWithCert("")
+	assertStatus(t, response, 200)
+	session = nil
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &session))
+	assert.Nil(t, session["userCtx"].(map[string]interface{})["name"])
+}
+
+func TestSyncRules(t *testing.T) {
+	var rules channels.SyncRules
+	require.NoError(t, base.JSONUnmarshal([]byte(`[
+		{"match": {"type": "task"},
+		 "channels": ["tasks-${owner}"],
+		 "grants": [{"to": ["${owner}"], "channels": ["tasks-${owner}"]}],
+		 "require_users": ["${owner}"]}
+	]`), &rules))
+	rt := NewRestTester(t, &RestTesterConfig{
+		noAdminParty:   true,
+		DatabaseConfig: &DbConfig{SyncRules: rules},
+	})
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein"}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/bob", `{"password":"letmein"}`), 201)
+
+	// Only the owner can write a task, which grants them access to it:
+	response := rt.SendUserRequestWithHeaders("PUT", "/db/task1", `{"type": "task", "owner": "alice"}`, nil, "bob", "letmein")
+	assertStatus(t, response, 403)
+	response = rt.SendUserRequestWithHeaders("PUT", "/db/task1", `{"type": "task", "owner": "alice"}`, nil, "alice", "letmein")
+	assertStatus(t, response, 201)
+
+	assertStatus(t, rt.SendUserRequestWithHeaders("GET", "/db/task1", "", nil, "alice", "letmein"), 200)
+	assertStatus(t, rt.SendUserRequestWithHeaders("GET", "/db/task1", "", nil, "bob", "letmein"), 403)
+
+	// The dry-run endpoint applies the rules too:
+	response = rt.SendAdminRequest("POST", "/db/_sync_test", `{"doc": {"type": "task", "owner": "bob"}}`)
+	assertStatus(t, response, 200)
+	var result db.SyncFnDryRunResult
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &result))
+	assert.Equal(t, base.SetOf("tasks-bob"), result.Channels)
+	assert.Equal(t, base.SetOf("tasks-bob"), result.Access["bob"])
+}
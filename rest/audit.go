@@ -0,0 +1,72 @@
+//  Copyright (c) 2019 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Returns who is making the request, for the audit log: "admin" (or "admin:<name>" when admin auth is
+// configured) for the admin API, otherwise the user's name or "GUEST".
+func (h *handler) auditActor() string {
+	if h.privs == adminPrivs {
+		if h.adminIdentity != "" {
+			return "admin:" + h.adminIdentity
+		}
+		return "admin"
+	} else if h.user == nil {
+		return ""
+	} else if name := h.user.Name(); name != "" {
+		return name
+	}
+	return base.GuestUsername
+}
+
+// Records an action made by the request in the audit log.  The outcome is a failure if err is non-nil.
+func (h *handler) audit(event base.AuditEvent, target string, err error, details map[string]interface{}) {
+	if !base.AuditEnabled(event) {
+		return
+	}
+	base.Audit(h.newAuditEntry(event, h.auditActor(), target, err, details))
+}
+
+// Records a successful login by the request's user in the audit log.
+func (h *handler) auditLogin(method string) {
+	h.audit(base.AuditEventLogin, h.user.Name(), nil, map[string]interface{}{"method": method})
+}
+
+// Records a rejected login in the audit log.  The actor is the name the client tried to log in as, if known.
+func (h *handler) auditLoginFailure(username string, method string, err error) {
+	if !base.AuditEnabled(base.AuditEventLoginFailure) {
+		return
+	}
+	base.Audit(h.newAuditEntry(base.AuditEventLoginFailure, username, "", err, map[string]interface{}{"method": method}))
+}
+
+func (h *handler) newAuditEntry(event base.AuditEvent, actor string, target string, err error, details map[string]interface{}) base.AuditEntry {
+	entry := base.AuditEntry{
+		Event:    event,
+		Outcome:  base.AuditOutcomeSuccess,
+		Actor:    actor,
+		SourceIP: h.clientIP(),
+		Target:   target,
+		Details:  details,
+	}
+	if h.db != nil {
+		entry.Database = h.db.Name
+	} else if dbName := h.PathVar("db"); dbName != "" {
+		entry.Database = dbName
+	}
+	if err != nil {
+		entry.Outcome = base.AuditOutcomeFailure
+		entry.Error = err.Error()
+	}
+	return entry
+}
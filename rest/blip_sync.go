@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"regexp"
 	"runtime/debug"
@@ -16,6 +17,7 @@ import (
 	"time"
 
 	"github.com/couchbase/go-blip"
+	"github.com/couchbase/sync_gateway/auth"
 	"github.com/couchbase/sync_gateway/base"
 	"github.com/couchbase/sync_gateway/channels"
 	"github.com/couchbase/sync_gateway/db"
@@ -27,6 +29,9 @@ const (
 	BlipDefaultBatchSize = uint64(200)
 	BlipMinimumBatchSize = uint64(10) // Not in the replication spec - is this required?
 
+	// The largest range of an attachment sent in response to a getAttachment request with offset/length properties
+	BlipMaxAttachmentChunkSize = uint64(1024 * 1024)
+
 	// The AppProtocolId part of the BLIP websocket subprotocol.  Must match identically with the peer (typically CBLite / LiteCore).
 	// At some point this will need to be able to support an array of protocols.  See go-blip/issues/27.
 	BlipCBMobileReplication = "CBMobile_2"
@@ -60,6 +65,8 @@ type blipSyncContext struct {
 	continuous          bool
 	activeOnly          bool
 	channels            base.Set
+	changesFilter       *db.ChangesFilterFunction // User-defined filter function selected by subChanges, if any
+	changesFilterReq    db.Body                   // The 'req' argument passed to changesFilter
 	lock                sync.Mutex
 	allowedAttachments  map[string]int
 	handlerSerialNumber uint64    // Each handler within a context gets a unique serial number for logging
@@ -68,6 +75,7 @@ type blipSyncContext struct {
 	activeSubChanges    uint32    // Flag for whether there is a subChanges subscription currently active.  Atomic access
 	useDeltas           bool      // Whether deltas can be used for this connection - This should be set via setUseDeltas()
 	sgCanUseDeltas      bool      // Whether deltas can be used by Sync Gateway for this connection
+	readOnly            bool      // Set when the connection was authenticated with a read-only API key
 }
 
 type blipHandler struct {
@@ -89,6 +97,14 @@ func userBlipHandler(next blipHandlerFunc) blipHandlerFunc {
 				return err
 			}
 
+			// Reapply the restrictions of the API key the connection authenticated with, unless it's been revoked
+			if key := auth.UserAPIKey(oldUser); key != nil {
+				if newUser == nil || newUser.APIKeys()[key.ID] == nil || key.Expired() {
+					return base.HTTPErrorf(http.StatusUnauthorized, "API key is no longer valid")
+				}
+				newUser = auth.RestrictToAPIKey(newUser, key)
+			}
+
 			newDatabase, err := db.GetDatabase(bh.db.DatabaseContext, newUser)
 			if err != nil {
 				return err
@@ -102,15 +118,25 @@ func userBlipHandler(next blipHandlerFunc) blipHandlerFunc {
 	}
 }
 
+// Rejects messages that write to the database when the connection was authenticated with a read-only API key.
+func writeBlipHandler(next blipHandlerFunc) blipHandlerFunc {
+	return func(bh *blipHandler, bm *blip.Message) error {
+		if bh.readOnly {
+			return base.HTTPErrorf(http.StatusForbidden, "API key is read-only")
+		}
+		return next(bh, bm)
+	}
+}
+
 // kHandlersByProfile defines the routes for each message profile (verb) of an incoming request to the function that handles it.
 var kHandlersByProfile = map[string]blipHandlerFunc{
 	messageGetCheckpoint:  (*blipHandler).handleGetCheckpoint,
 	messageSetCheckpoint:  (*blipHandler).handleSetCheckpoint,
 	messageSubChanges:     userBlipHandler((*blipHandler).handleSubChanges),
-	messageChanges:        userBlipHandler((*blipHandler).handleChanges),
-	messageRev:            userBlipHandler((*blipHandler).handleRev),
+	messageChanges:        writeBlipHandler(userBlipHandler((*blipHandler).handleChanges)),
+	messageRev:            writeBlipHandler(userBlipHandler((*blipHandler).handleRev)),
 	messageGetAttachment:  userBlipHandler((*blipHandler).handleGetAttachment),
-	messageProposeChanges: (*blipHandler).handleProposeChanges,
+	messageProposeChanges: writeBlipHandler((*blipHandler).handleProposeChanges),
 }
 
 // HTTP handler for incoming BLIP sync WebSocket request (/db/_blipsync)
@@ -146,6 +172,10 @@ func (h *handler) handleBLIPSync() error {
 	// determine if SG has delta sync enabled for the given database
 	ctx.sgCanUseDeltas = ctx.db.DeltaSyncEnabled()
 
+	if key := auth.UserAPIKey(h.user); key != nil {
+		ctx.readOnly = key.ReadOnly
+	}
+
 	blipContext.DefaultHandler = ctx.notFound
 	for profile, handlerFn := range kHandlersByProfile {
 		ctx.register(profile, handlerFn)
@@ -343,8 +373,15 @@ func (bh *blipHandler) handleSubChanges(rq *blip.Message) error {
 			return base.HTTPErrorf(http.StatusBadRequest, "Empty channel list")
 
 		}
+	} else if changesFilter, found := bh.db.GetChangesFilter(filter); found {
+		query := make(map[string]interface{}, len(rq.Properties))
+		for key, value := range rq.Properties {
+			query[key] = value
+		}
+		bh.changesFilter = changesFilter
+		bh.changesFilterReq = bh.db.MakeChangesFilterRequest(query)
 	} else if filter != "" {
-		return base.HTTPErrorf(http.StatusBadRequest, "Unknown filter; try sync_gateway/bychannel")
+		return base.HTTPErrorf(http.StatusBadRequest, "Unknown filter; try sync_gateway/bychannel or a filter defined in changes_filters")
 	}
 
 	// Start asynchronous changes goroutine
@@ -381,12 +418,14 @@ func (bh *blipHandler) sendChanges(sender *blip.Sender, params *subChangesParams
 	bh.Logf(base.LevelInfo, base.KeySync, "Sending changes since %v", params.since())
 
 	options := db.ChangesOptions{
-		Since:      params.since(),
-		Conflicts:  false, // CBL 2.0/BLIP don't support branched rev trees (LiteCore #437)
-		Continuous: bh.continuous,
-		ActiveOnly: bh.activeOnly,
-		Terminator: bh.blipSyncContext.terminator,
-		Ctx:        bh.db.Ctx,
+		Since:         params.since(),
+		Conflicts:     false, // CBL 2.0/BLIP don't support branched rev trees (LiteCore #437)
+		Continuous:    bh.continuous,
+		ActiveOnly:    bh.activeOnly,
+		Filter:        bh.changesFilter,
+		FilterRequest: bh.changesFilterReq,
+		Terminator:    bh.blipSyncContext.terminator,
+		Ctx:           bh.db.Ctx,
 	}
 
 	channelSet := bh.channels
@@ -1000,6 +1039,9 @@ func (bh *blipHandler) handleGetAttachment(rq *blip.Message) error {
 	if !bh.isAttachmentAllowed(digest) {
 		return base.HTTPErrorf(http.StatusForbidden, "Attachment's doc not being synced")
 	}
+	if getAttachmentParams.ranged() {
+		return bh.sendAttachmentRange(rq, digest, getAttachmentParams.offset(), getAttachmentParams.length())
+	}
 	attachment, err := bh.db.GetAttachment(db.AttachmentKey(digest))
 	if err != nil {
 		return err
@@ -1014,6 +1056,43 @@ func (bh *blipHandler) handleGetAttachment(rq *blip.Message) error {
 	return nil
 }
 
+// Responds to a getAttachment request for a range of the attachment, reading only that range from the attachment
+// store.  Clients fetching large attachments can request successive ranges, so that neither side needs to hold the
+// whole attachment in a single message.
+func (bh *blipHandler) sendAttachmentRange(rq *blip.Message, digest string, offset, length uint64) error {
+	attachment, err := bh.db.OpenAttachment(db.AttachmentKey(digest))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = attachment.Close() }()
+
+	size := uint64(attachment.Size())
+	if offset > size {
+		return base.HTTPErrorf(http.StatusRequestedRangeNotSatisfiable, "Offset %d is beyond the attachment's length %d", offset, size)
+	}
+	if length > size-offset {
+		length = size - offset
+	}
+	if _, err := attachment.Seek(int64(offset), io.SeekStart); err != nil {
+		return err
+	}
+	chunk := make([]byte, length)
+	if _, err := io.ReadFull(attachment, chunk); err != nil {
+		return err
+	}
+
+	bh.Logf(base.LevelDebug, base.KeySync, "Sending attachment with digest=%q bytes %d-%d of %d", digest, offset, offset+length, size)
+	response := rq.Response()
+	response.Properties[getAttachmentResponseSize] = strconv.FormatUint(size, 10)
+	response.SetBody(chunk)
+	response.SetCompressed(rq.Properties[blipCompress] == "true")
+	if offset == 0 {
+		bh.db.DatabaseContext.DbStats.StatsCblReplicationPull().Add(base.StatKeyAttachmentPullCount, 1)
+	}
+	bh.db.DatabaseContext.DbStats.StatsCblReplicationPull().Add(base.StatKeyAttachmentPullBytes, int64(length))
+	return nil
+}
+
 // For each attachment in the revision, makes sure it's in the database, asking the client to
 // upload it if necessary. This method blocks until all the attachments have been processed.
 func (bh *blipHandler) downloadOrVerifyAttachments(sender *blip.Sender, body db.Body, minRevpos int) error {
@@ -70,6 +70,11 @@ const (
 
 	// getAttachment message properties
 	getAttachmentDigest = "digest"
+	getAttachmentOffset = "offset" // Optional; requests the range of the attachment starting at this offset
+	getAttachmentLength = "length" // Optional; requests a range of at most this many bytes
+
+	// getAttachment response properties
+	getAttachmentResponseSize = "size" // Total length of the attachment, sent in response to a range request
 
 	// proveAttachment
 	proveAttachmentDigest = "digest"
@@ -399,11 +404,29 @@ func (g *getAttachmentParams) digest() string {
 	return g.rq.Properties[getAttachmentDigest]
 }
 
+// Whether the request is for a range of the attachment, rather than the whole attachment.
+func (g *getAttachmentParams) ranged() bool {
+	_, hasOffset := g.rq.Properties[getAttachmentOffset]
+	_, hasLength := g.rq.Properties[getAttachmentLength]
+	return hasOffset || hasLength
+}
+
+func (g *getAttachmentParams) offset() uint64 {
+	return getRestrictedIntFromString(g.rq.Properties[getAttachmentOffset], 0, 0, math.MaxInt64, true)
+}
+
+func (g *getAttachmentParams) length() uint64 {
+	return getRestrictedIntFromString(g.rq.Properties[getAttachmentLength], BlipMaxAttachmentChunkSize, 1, BlipMaxAttachmentChunkSize, false)
+}
+
 func (g *getAttachmentParams) String() string {
 
 	buffer := bytes.NewBufferString("")
 
 	buffer.WriteString(fmt.Sprintf("Digest:%v ", g.digest()))
+	if g.ranged() {
+		buffer.WriteString(fmt.Sprintf("Offset:%v Length:%v ", g.offset(), g.length()))
+	}
 
 	return buffer.String()
 
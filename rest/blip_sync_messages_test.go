@@ -84,3 +84,27 @@ func TestSubChangesSince(t *testing.T) {
 	goassert.True(t, seqId.Seq == 1)
 
 }
+
+func TestGetAttachmentParamsRange(t *testing.T) {
+
+	testCases := []struct {
+		properties     blip.Properties
+		expectedRanged bool
+		expectedOffset uint64
+		expectedLength uint64
+	}{
+		{blip.Properties{getAttachmentDigest: "sha1-abc"}, false, 0, BlipMaxAttachmentChunkSize},
+		{blip.Properties{getAttachmentOffset: "100"}, true, 100, BlipMaxAttachmentChunkSize},
+		{blip.Properties{getAttachmentLength: "10"}, true, 0, 10},
+		{blip.Properties{getAttachmentOffset: "5", getAttachmentLength: "0"}, true, 5, 1},
+		{blip.Properties{getAttachmentLength: "1000000000"}, true, 0, BlipMaxAttachmentChunkSize},
+	}
+
+	for _, testCase := range testCases {
+		blipMessage := blip.Message{Properties: testCase.properties}
+		params := newGetAttachmentParams(&blipMessage)
+		goassert.Equals(t, params.ranged(), testCase.expectedRanged)
+		goassert.Equals(t, params.offset(), testCase.expectedOffset)
+		goassert.Equals(t, params.length(), testCase.expectedLength)
+	}
+}
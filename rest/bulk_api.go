@@ -415,7 +415,12 @@ func (h *handler) handleBulkGet() error {
 
 			}
 
-			if err == nil {
+			// Return a delta in place of the revision when the client identifies a deltaSrc it already has
+			if deltaSrc, _ := doc["deltaSrc"].(string); err == nil && deltaSrc != "" {
+				body, err = h.db.GetDeltaBody(docid, deltaSrc, revid)
+			}
+
+			if err == nil && body == nil {
 				body, err = h.db.GetRevWithHistory(docid, revid, docRevsLimit, revsFrom, attsSince, showExp)
 			}
 
@@ -437,6 +442,41 @@ func (h *handler) handleBulkGet() error {
 	})
 }
 
+// Writes docs for an all_or_nothing _bulk_docs request.  Returns the per-doc statuses, and whether the docs were
+// written - if not, only the statuses of the docs that failed are returned.
+func (h *handler) bulkDocsAllOrNothing(docs []interface{}) (result []db.Body, ok bool) {
+	docids := make([]string, len(docs))
+	bodies := make([]db.Body, len(docs))
+	for i, item := range docs {
+		bodies[i] = item.(map[string]interface{})
+		docid, idFound := bodies[i][db.BodyId].(string)
+		if !idFound {
+			docid = base.CreateUUID()
+		}
+		docids[i] = docid
+	}
+
+	revids, docErrors := h.db.PutAllOrNothing(docids, bodies)
+	if docErrors != nil {
+		result = make([]db.Body, 0)
+		for i, err := range docErrors {
+			if err == nil {
+				continue
+			}
+			code, msg := base.ErrorAsHTTPStatus(err)
+			base.Infof(base.KeyAll, "\tBulkDocs: Doc %q --> %d %s (%v)", base.UD(docids[i]), code, msg, err)
+			result = append(result, db.Body{"id": docids[i], "status": code, "error": base.CouchHTTPErrorName(code), "reason": msg})
+		}
+		return result, false
+	}
+
+	result = make([]db.Body, 0, len(docs))
+	for i, docid := range docids {
+		result = append(result, db.Body{"id": docid, "rev": revids[i]})
+	}
+	return result, true
+}
+
 // HTTP handler for a POST to _bulk_docs
 func (h *handler) handleBulkDocs() error {
 
@@ -455,6 +495,11 @@ func (h *handler) handleBulkDocs() error {
 		newEdits = true
 	}
 
+	allOrNothing, _ := body["all_or_nothing"].(bool)
+	if allOrNothing && !newEdits {
+		return base.HTTPErrorf(http.StatusBadRequest, "all_or_nothing is not supported with new_edits=false")
+	}
+
 	userDocs, ok := body["docs"].([]interface{})
 	if !ok {
 		err = base.HTTPErrorf(http.StatusBadRequest, "missing 'docs' property")
@@ -483,43 +528,56 @@ func (h *handler) handleBulkDocs() error {
 		}
 	}
 
+	// Local docs aren't versioned, so can't be rolled back
+	if allOrNothing && len(localDocs) > 0 {
+		return base.HTTPErrorf(http.StatusBadRequest, "all_or_nothing is not supported with _local docs")
+	}
+
 	result := make([]db.Body, 0, len(docs))
-	for _, item := range docs {
-		doc := item.(map[string]interface{})
-		docid, _ := doc[db.BodyId].(string)
-		var err error
-		var revid string
-		if newEdits {
-			if docid != "" {
-				revid, _, err = h.db.Put(docid, doc)
+	if allOrNothing {
+		var ok bool
+		if result, ok = h.bulkDocsAllOrNothing(docs); !ok {
+			h.writeJSONStatus(http.StatusExpectationFailed, result)
+			return nil
+		}
+	} else {
+		for _, item := range docs {
+			doc := item.(map[string]interface{})
+			docid, _ := doc[db.BodyId].(string)
+			var err error
+			var revid string
+			if newEdits {
+				if docid != "" {
+					revid, _, err = h.db.Put(docid, doc)
+				} else {
+					docid, revid, _, err = h.db.Post(doc)
+				}
 			} else {
-				docid, revid, _, err = h.db.Post(doc)
+				revisions := db.ParseRevisions(doc)
+				if revisions == nil {
+					err = base.HTTPErrorf(http.StatusBadRequest, "Bad _revisions")
+				} else {
+					revid = revisions[0]
+					_, err = h.db.PutExistingRevWithBody(docid, doc, revisions, false)
+				}
 			}
-		} else {
-			revisions := db.ParseRevisions(doc)
-			if revisions == nil {
-				err = base.HTTPErrorf(http.StatusBadRequest, "Bad _revisions")
+
+			status := db.Body{}
+			if docid != "" {
+				status["id"] = docid
+			}
+			if err != nil {
+				code, msg := base.ErrorAsHTTPStatus(err)
+				status["status"] = code
+				status["error"] = base.CouchHTTPErrorName(code)
+				status["reason"] = msg
+				base.Infof(base.KeyAll, "\tBulkDocs: Doc %q --> %d %s (%v)", base.UD(docid), code, msg, err)
+				err = nil // wrote it to output already; not going to return it
 			} else {
-				revid = revisions[0]
-				_, err = h.db.PutExistingRevWithBody(docid, doc, revisions, false)
+				status["rev"] = revid
 			}
+			result = append(result, status)
 		}
-
-		status := db.Body{}
-		if docid != "" {
-			status["id"] = docid
-		}
-		if err != nil {
-			code, msg := base.ErrorAsHTTPStatus(err)
-			status["status"] = code
-			status["error"] = base.CouchHTTPErrorName(code)
-			status["reason"] = msg
-			base.Infof(base.KeyAll, "\tBulkDocs: Doc %q --> %d %s (%v)", base.UD(docid), code, msg, err)
-			err = nil // wrote it to output already; not going to return it
-		} else {
-			status["rev"] = revid
-		}
-		result = append(result, status)
 	}
 
 	for _, item := range localDocs {
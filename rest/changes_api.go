@@ -165,6 +165,7 @@ func (h *handler) handleChanges() error {
 	var filter string
 	var channelsArray []string
 	var docIdsArray []string
+	var postBody []byte
 
 	if h.rq.Method == "GET" {
 		// GET request has parameters in URL:
@@ -221,6 +222,7 @@ func (h *handler) handleChanges() error {
 		if err != nil {
 			return err
 		}
+		postBody = body
 		feed, options, filter, channelsArray, docIdsArray, _, err = h.readChangesOptionsFromJSON(body)
 
 		if err != nil {
@@ -246,6 +248,16 @@ func (h *handler) handleChanges() error {
 		feed = "normal"
 	}
 
+	// EventSource clients send the id of the last event received when reconnecting, which is used in place of since
+	if feed == "eventsource" {
+		if lastEventID := h.rq.Header.Get("Last-Event-ID"); lastEventID != "" {
+			var err error
+			if options.Since, err = h.db.ParseSequenceID(lastEventID); err != nil {
+				return err
+			}
+		}
+	}
+
 	// Get the channels as parameters to an imaginary "bychannel" filter.
 	// The default is all channels the user can access.
 	userChannels := base.SetOf(ch.AllChannelWildcard)
@@ -272,8 +284,15 @@ func (h *handler) handleChanges() error {
 			if len(docIdsArray) == 0 {
 				return base.HTTPErrorf(http.StatusBadRequest, "Empty doc_ids list")
 			}
+		} else if changesFilter, found := h.db.GetChangesFilter(filter); found {
+			query, err := h.changesFilterQuery(postBody)
+			if err != nil {
+				return err
+			}
+			options.Filter = changesFilter
+			options.FilterRequest = h.db.MakeChangesFilterRequest(query)
 		} else {
-			return base.HTTPErrorf(http.StatusBadRequest, "Unknown filter; try sync_gateway/bychannel or _doc_ids")
+			return base.HTTPErrorf(http.StatusBadRequest, "Unknown filter; try sync_gateway/bychannel, _doc_ids or a filter defined in changes_filters")
 		}
 	}
 
@@ -313,6 +332,8 @@ func (h *handler) handleChanges() error {
 		err, forceClose = h.sendContinuousChangesByHTTP(userChannels, options)
 	case "websocket":
 		err, forceClose = h.sendContinuousChangesByWebSocket(userChannels, options)
+	case "eventsource":
+		err, forceClose = h.sendContinuousChangesByEventSource(userChannels, options)
 	default:
 		err = base.HTTPErrorf(http.StatusBadRequest, "Unknown feed type")
 		forceClose = false
@@ -328,6 +349,23 @@ func (h *handler) handleChanges() error {
 	return err
 }
 
+// Returns the request's parameters, in the form passed to a changes filter function as req.query: those in the JSON
+// body of a POST request, if given, overridden by the URL's query parameters.
+func (h *handler) changesFilterQuery(postBody []byte) (map[string]interface{}, error) {
+	query := make(map[string]interface{})
+	if len(postBody) > 0 {
+		if err := base.JSONUnmarshal(postBody, &query); err != nil {
+			return nil, err
+		}
+	}
+	for key, values := range h.getQueryValues() {
+		if len(values) > 0 {
+			query[key] = values[0]
+		}
+	}
+	return query, nil
+}
+
 func (h *handler) sendSimpleChanges(channels base.Set, options db.ChangesOptions, docids []string) (error, bool) {
 	lastSeq := options.Since
 	var first bool = true
@@ -645,6 +683,29 @@ func (h *handler) sendContinuousChangesByHTTP(inChannels base.Set, options db.Ch
 	})
 }
 
+// Sends a continuous changes feed as Server-Sent Events (https://html.spec.whatwg.org/multipage/server-sent-events.html).
+// Each change is sent as a data frame with its sequence as the event id, and heartbeats are sent as comments.
+func (h *handler) sendContinuousChangesByEventSource(inChannels base.Set, options db.ChangesOptions) (error, bool) {
+	h.setHeader("Content-Type", "text/event-stream")
+	h.setHeader("Cache-Control", "private, max-age=0, no-cache, no-store")
+	h.logStatus(http.StatusOK, "sending eventsource feed")
+	return h.generateContinuousChanges(inChannels, options, func(changes []*db.ChangeEntry) error {
+		var err error
+		if changes != nil {
+			for _, change := range changes {
+				data, _ := base.JSONMarshal(change)
+				if _, err = fmt.Fprintf(h.response, "id: %s\ndata: %s\n\n", change.Seq.String(), data); err != nil {
+					break
+				}
+			}
+		} else {
+			_, err = h.response.Write([]byte(":\n\n"))
+		}
+		h.flush()
+		return err
+	})
+}
+
 func (h *handler) sendContinuousChangesByWebSocket(inChannels base.Set, options db.ChangesOptions) (error, bool) {
 
 	forceClose := false
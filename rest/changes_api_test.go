@@ -3238,3 +3238,96 @@ func WriteDirectWithKey(testDb *db.DatabaseContext, key string, channelArray []s
 
 	testDb.Bucket.Add(key, 0, db.Body{base.SyncXattrName: syncData, "key": key})
 }
+
+// Validates named changes filter functions defined in the database config, including use of req.query
+func TestChangesNamedFilter(t *testing.T) {
+
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyChanges|base.KeyHTTP)()
+
+	rtConfig := RestTesterConfig{
+		DatabaseConfig: &DbConfig{
+			ChangesFilters: map[string]string{
+				"orders":    `function(doc, req) { return doc.type == "order" && doc.status != "archived"; }`,
+				"by_status": `function(doc, req) { return doc.status == req.query.status; }`,
+			},
+		},
+	}
+	rt := NewRestTester(t, &rtConfig)
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/order1", `{"type":"order", "status":"open"}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/order2", `{"type":"order", "status":"archived"}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/customer1", `{"type":"customer", "status":"open"}`), 201)
+	assert.NoError(t, rt.WaitForPendingChanges())
+
+	var changes changesResults
+	response := rt.SendAdminRequest("GET", "/db/_changes?filter=orders", "")
+	assertStatus(t, response, 200)
+	assert.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &changes))
+	require.Len(t, changes.Results, 1)
+	assert.Equal(t, "order1", changes.Results[0].ID)
+
+	// Filter parameters are passed to the function via req.query
+	response = rt.SendAdminRequest("GET", "/db/_changes?filter=by_status&status=archived", "")
+	assertStatus(t, response, 200)
+	assert.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &changes))
+	require.Len(t, changes.Results, 1)
+	assert.Equal(t, "order2", changes.Results[0].ID)
+
+	// POST requests support the same filters
+	response = rt.SendAdminRequest("POST", "/db/_changes", `{"filter":"orders"}`)
+	assertStatus(t, response, 200)
+	assert.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &changes))
+	require.Len(t, changes.Results, 1)
+	assert.Equal(t, "order1", changes.Results[0].ID)
+
+	// ...taking their parameters from the body
+	response = rt.SendAdminRequest("POST", "/db/_changes", `{"filter":"by_status", "status":"archived"}`)
+	assertStatus(t, response, 200)
+	assert.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &changes))
+	require.Len(t, changes.Results, 1)
+	assert.Equal(t, "order2", changes.Results[0].ID)
+
+	// Unknown filter names are rejected
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_changes?filter=unknown", ""), 400)
+}
+
+// Validates the eventsource feed format, and use of Last-Event-ID in place of since
+func TestChangesEventSource(t *testing.T) {
+
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyChanges|base.KeyHTTP)()
+
+	rt := NewRestTester(t, nil)
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc1", `{"value":1}`), 201)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc2", `{"value":2}`), 201)
+	assert.NoError(t, rt.WaitForPendingChanges())
+
+	response := rt.SendAdminRequest("GET", "/db/_changes?feed=eventsource&limit=2&heartbeat=0&timeout=1000", "")
+	assertStatus(t, response, 200)
+	assert.Equal(t, "text/event-stream", response.Header().Get("Content-Type"))
+
+	var events []string
+	for _, event := range strings.Split(response.Body.String(), "\n\n") {
+		if strings.HasPrefix(event, "id: ") {
+			events = append(events, event)
+		}
+	}
+	require.Len(t, events, 2)
+
+	lines := strings.Split(events[0], "\n")
+	require.Len(t, lines, 2)
+	require.True(t, strings.HasPrefix(lines[1], "data: "))
+	var entry db.ChangeEntry
+	assert.NoError(t, base.JSONUnmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &entry))
+	assert.Equal(t, "doc1", entry.ID)
+	assert.Equal(t, "id: "+entry.Seq.String(), lines[0])
+
+	// Reconnect with the id of the first event - only the second change should be sent
+	response = rt.SendAdminRequestWithHeaders("GET", "/db/_changes?feed=eventsource&limit=1&heartbeat=0&timeout=1000", "",
+		map[string]string{"Last-Event-ID": entry.Seq.String()})
+	assertStatus(t, response, 200)
+	assert.Contains(t, response.Body.String(), `"id":"doc2"`)
+	assert.NotContains(t, response.Body.String(), `"id":"doc1"`)
+}
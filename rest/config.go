@@ -26,9 +26,11 @@ import (
 	"runtime/debug"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/couchbase/sync_gateway/auth"
 	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
 	"github.com/couchbase/sync_gateway/db"
 	"github.com/pkg/errors"
 
@@ -76,10 +78,13 @@ type ServerConfig struct {
 	Interface                  *string                  `json:",omitempty"`                       // Interface to bind REST API to, default ":4984"
 	SSLCert                    *string                  `json:",omitempty"`                       // Path to SSL cert file, or nil
 	SSLKey                     *string                  `json:",omitempty"`                       // Path to SSL private key file, or nil
+	ClientCertCA               string                   `json:"client_cert_ca,omitempty"`         // Path to CA bundle for verifying client certificates
+	ClientCertRequired         bool                     `json:"client_cert_required,omitempty"`   // If true, clients must present a certificate signed by ClientCertCA
 	ServerReadTimeout          *int                     `json:",omitempty"`                       // maximum duration.Second before timing out read of the HTTP(S) request
 	ServerWriteTimeout         *int                     `json:",omitempty"`                       // maximum duration.Second before timing out write of the HTTP(S) response
 	AdminInterface             *string                  `json:",omitempty"`                       // Interface to bind admin API to, default "localhost:4985"
 	AdminUI                    *string                  `json:",omitempty"`                       // Path to Admin HTML page, if omitted uses bundled HTML
+	AdminAuth                  *AdminAuthConfig         `json:"admin_auth,omitempty"`             // If set, requests to the admin API must authenticate
 	ProfileInterface           *string                  `json:",omitempty"`                       // Interface to bind Go profile API to (no default)
 	ConfigServer               *string                  `json:",omitempty"`                       // URL of config server (for dynamic db discovery)
 	Facebook                   *FacebookConfig          `json:",omitempty"`                       // Configuration for Facebook validation
@@ -174,11 +179,15 @@ type DbConfig struct {
 	BucketConfig
 	Name                      string                         `json:"name,omitempty"`                         // Database name in REST API (stored as key in JSON)
 	Sync                      *string                        `json:"sync,omitempty"`                         // Sync function defines which users can see which data
+	SyncRules                 channels.SyncRules             `json:"sync_rules,omitempty"`                   // Declarative rules to use instead of a sync function
+	AutoResync                bool                           `json:"auto_resync,omitempty"`                  // Resync in the background when the sync function or sync rules change
 	Users                     map[string]*db.PrincipalConfig `json:"users,omitempty"`                        // Initial user accounts
 	Roles                     map[string]*db.PrincipalConfig `json:"roles,omitempty"`                        // Initial roles
 	RevsLimit                 *uint32                        `json:"revs_limit,omitempty"`                   // Max depth a document's revision tree can grow to
 	AutoImport                interface{}                    `json:"import_docs,omitempty"`                  // Whether to automatically import Couchbase Server docs into SG.  Xattrs must be enabled.  true or "continuous" both enable this.
 	ImportFilter              *string                        `json:"import_filter,omitempty"`                // Filter function (import)
+	JavascriptEngine          base.JSEngine                  `json:"javascript_engine,omitempty"`            // Engine for the sync function, filters and other JS functions: "otto" (the default) or "goja"
+	JavascriptTimeoutSecs     *uint32                        `json:"javascript_timeout_secs,omitempty"`      // Maximum time a single call of a JS function can run; 0 or unset for no limit
 	ImportBackupOldRev        bool                           `json:"import_backup_old_rev"`                  // Whether import should attempt to create a temporary backup of the previous revision body, when available.
 	EventHandlers             interface{}                    `json:"event_handlers,omitempty"`               // Event handlers (webhook)
 	FeedType                  string                         `json:"feed_type,omitempty"`                    // Feed type - "DCP" or "TAP"; defaults based on Couchbase server version
@@ -189,6 +198,10 @@ type DbConfig struct {
 	Unsupported               db.UnsupportedOptions          `json:"unsupported,omitempty"`                  // Config for unsupported features
 	Deprecated                DeprecatedOptions              `json:"deprecated,omitempty"`                   // Config for Deprecated features
 	OIDCConfig                *auth.OIDCOptions              `json:"oidc,omitempty"`                         // Config properties for OpenID Connect authentication
+	JWTConfig                 *auth.LocalJWTOptions          `json:"jwt,omitempty"`                          // Config properties for bearer JWTs validated with local keys
+	ClientCertAuth            *auth.ClientCertOptions        `json:"client_cert_auth,omitempty"`             // Authenticate users by TLS client certificates verified against client_cert_ca
+	LoginLockout              *auth.LoginLockoutOptions      `json:"login_lockout,omitempty"`                // Throttling of failed password logins per user and client address
+	PasswordPolicy            *auth.PasswordPolicy           `json:"password_policy,omitempty"`              // Requirements for user passwords, for both admin and self-service changes
 	OldRevExpirySeconds       *uint32                        `json:"old_rev_expiry_seconds,omitempty"`       // The number of seconds before old revs are removed from CBS bucket
 	ViewQueryTimeoutSecs      *uint32                        `json:"view_query_timeout_secs,omitempty"`      // The view query timeout in seconds
 	LocalDocExpirySecs        *uint32                        `json:"local_doc_expiry_secs,omitempty"`        // The _local doc expiry time in seconds
@@ -201,6 +214,9 @@ type DbConfig struct {
 	BucketOpTimeoutMs         *uint32                        `json:"bucket_op_timeout_ms,omitempty"`         // How long bucket ops should block returning "operation timed out". If nil, uses GoCB default.  GoCB buckets only.
 	DeltaSync                 *DeltaSyncConfig               `json:"delta_sync,omitempty"`                   // Config for delta sync
 	CompactIntervalDays       *float32                       `json:"compact_interval_days,omitempty"`        //Interval in days between compaction is automatically ran - 0 means don't run
+	ConflictResolver          *string                        `json:"conflict_resolver,omitempty"`            // Conflict resolver function (pushed revisions)
+	ChangesFilters            map[string]string              `json:"changes_filters,omitempty"`              // Named filter functions for _changes and subChanges, selected with filter=<name>
+	AttachmentStore           *db.AttachmentStoreConfig      `json:"attachment_store,omitempty"`             // Where attachment bodies are stored; defaults to the bucket
 }
 
 type DeltaSyncConfig struct {
@@ -231,11 +247,25 @@ type CORSConfig struct {
 	MaxAge      int      // Maximum age of the CORS Options request
 }
 
+// Authentication for the admin API.  Each admin user or client certificate is given one of the
+// built-in admin roles, which limits the admin endpoints it can call.
+type AdminAuthConfig struct {
+	Users        map[string]*AdminUserConfig `json:"users,omitempty"`          // Basic auth users, keyed by username
+	ClientCerts  map[string]string           `json:"client_certs,omitempty"`   // Maps client cert common names or SANs to roles
+	ClientCACert string                      `json:"client_ca_cert,omitempty"` // Path to the CA cert(s) that sign admin client certs
+}
+
+type AdminUserConfig struct {
+	Password string `json:"password"` // Password for basic auth
+	Role     string `json:"role"`     // One of read_only, user_admin, db_admin or full_admin
+}
+
 type EventHandlerConfig struct {
 	MaxEventProc    uint           `json:"max_processes,omitempty"`    // Max concurrent event handling goroutines
 	WaitForProcess  string         `json:"wait_for_process,omitempty"` // Max wait time when event queue is full (ms)
 	DocumentChanged []*EventConfig `json:"document_changed,omitempty"` // Document Commit
 	DBStateChanged  []*EventConfig `json:"db_state_changed,omitempty"` // DB state change
+	AccountLocked   []*EventConfig `json:"account_locked,omitempty"`   // User or client address locked out after failed logins
 }
 
 type EventConfig struct {
@@ -362,6 +392,18 @@ func (dbConfig DbConfig) validate() []error {
 
 	errorMessages := make([]error, 0)
 
+	if err := dbConfig.jsOptions().Validate(); err != nil {
+		errorMessages = append(errorMessages, err)
+	}
+
+	if dbConfig.SyncRules != nil {
+		if dbConfig.Sync != nil {
+			errorMessages = append(errorMessages, errors.New("Only one of sync and sync_rules can be set"))
+		} else if _, err := channels.NewSyncRulesMapper(dbConfig.SyncRules); err != nil {
+			errorMessages = append(errorMessages, err)
+		}
+	}
+
 	// Make sure a non-zero compact_interval_days config is within the valid range
 	if val := dbConfig.CompactIntervalDays; val != nil && *val != 0 &&
 		(*val < db.CompactIntervalMinDays || *val > db.CompactIntervalMaxDays) {
@@ -563,6 +605,15 @@ func (dbConfig *DbConfig) GetCredentials() (string, string, string) {
 	return base.TransformBucketCredentials(dbConfig.Username, dbConfig.Password, *dbConfig.Bucket)
 }
 
+// Returns the JavaScript engine and timeout for the database's JS functions.
+func (dbConfig *DbConfig) jsOptions() base.JSOptions {
+	options := base.JSOptions{Engine: dbConfig.JavascriptEngine}
+	if dbConfig.JavascriptTimeoutSecs != nil {
+		options.Timeout = time.Duration(*dbConfig.JavascriptTimeoutSecs) * time.Second
+	}
+	return options
+}
+
 func (dbConfig *DbConfig) ConflictsAllowed() *bool {
 	if dbConfig.AllowConflicts != nil {
 		return dbConfig.AllowConflicts
@@ -675,6 +726,22 @@ func (config *ServerConfig) validate() []error {
 		}
 	}
 
+	if config.AdminAuth != nil {
+		errorMessages = append(errorMessages, config.AdminAuth.validate(config.SSLCert != nil)...)
+	}
+
+	if config.ClientCertCA != "" && config.SSLCert == nil {
+		errorMessages = append(errorMessages, fmt.Errorf("client_cert_ca requires SSLCert and SSLKey"))
+	}
+	if config.ClientCertRequired && config.ClientCertCA == "" {
+		errorMessages = append(errorMessages, fmt.Errorf("client_cert_required requires client_cert_ca"))
+	}
+	for name, dbConfig := range config.Databases {
+		if dbConfig.ClientCertAuth != nil && config.ClientCertCA == "" {
+			errorMessages = append(errorMessages, fmt.Errorf("client_cert_auth for database %q requires client_cert_ca", name))
+		}
+	}
+
 	return errorMessages
 }
 
@@ -942,7 +1009,9 @@ func SetMaxFileDescriptors(maxP *uint64) {
 	}
 }
 
-func (config *ServerConfig) Serve(addr string, handler http.Handler) {
+// Serves HTTP on the given address.  If clientCACert is given, clients can authenticate with a certificate
+// signed by one of its CAs, and must do so if requireClientCert is set.
+func (config *ServerConfig) Serve(addr string, handler http.Handler, clientCACert string, requireClientCert bool) {
 	maxConns := DefaultMaxIncomingConnections
 	if config.MaxIncomingConnections != nil {
 		maxConns = *config.MaxIncomingConnections
@@ -960,6 +1029,8 @@ func (config *ServerConfig) Serve(addr string, handler http.Handler) {
 		maxConns,
 		config.SSLCert,
 		config.SSLKey,
+		clientCACert,
+		requireClientCert,
 		handler,
 		config.ServerReadTimeout,
 		config.ServerWriteTimeout,
@@ -1020,10 +1091,14 @@ func RunServer(config *ServerConfig) {
 	go sc.PostStartup()
 
 	base.Consolef(base.LevelInfo, base.KeyAll, "Starting admin server on %s", *config.AdminInterface)
-	go config.Serve(*config.AdminInterface, CreateAdminHandler(sc))
+	adminClientCACert := config.ClientCertCA
+	if config.AdminAuth != nil && config.AdminAuth.ClientCACert != "" {
+		adminClientCACert = config.AdminAuth.ClientCACert
+	}
+	go config.Serve(*config.AdminInterface, CreateAdminHandler(sc), adminClientCACert, config.ClientCertRequired)
 
 	base.Consolef(base.LevelInfo, base.KeyAll, "Starting server on %s ...", *config.Interface)
-	config.Serve(*config.Interface, CreatePublicHandler(sc))
+	config.Serve(*config.Interface, CreatePublicHandler(sc), config.ClientCertCA, config.ClientCertRequired)
 }
 
 func HandleSighup() {
@@ -12,7 +12,9 @@ package rest
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"math"
+	"mime"
 	"mime/multipart"
 	"net/http"
 	"strconv"
@@ -62,6 +64,20 @@ func (h *handler) handleGetDoc() error {
 	}
 
 	if openRevs == "" {
+		// Delta from a revision the client already has, when available:
+		if deltaSrc := h.getQuery("deltaSrc"); deltaSrc != "" {
+			deltaBody, err := h.db.GetDeltaBody(docid, deltaSrc, revid)
+			if err != nil {
+				return err
+			}
+			if deltaBody != nil {
+				h.setHeader("Etag", strconv.Quote(deltaBody[db.BodyRev].(string)))
+				h.db.DbStats.StatsDatabase().Add(base.StatKeyNumDocReadsRest, 1)
+				h.writeJSON(deltaBody)
+				return nil
+			}
+		}
+
 		// Single-revision GET:
 		value, err := h.db.GetRevWithHistory(docid, revid, revsLimit, revsFrom, attachmentsSince, showExp)
 		if err != nil {
@@ -162,18 +178,24 @@ func (h *handler) handleGetAttachment() error {
 		return base.HTTPErrorf(http.StatusNotFound, "missing attachment %s", attachmentName)
 	}
 	digest := meta["digest"].(string)
-	data, err := h.db.GetAttachment(db.AttachmentKey(digest))
+	attachment, err := h.db.OpenAttachment(db.AttachmentKey(digest))
 	if err != nil {
 		return err
 	}
+	defer func() { _ = attachment.Close() }()
 
-	status, start, end := h.handleRange(uint64(len(data)))
+	// Stream the attachment (or the requested range of it) rather than loading it into memory
+	length := uint64(attachment.Size())
+	status, start, end := h.handleRange(length)
 	if status > 299 {
 		return base.HTTPErrorf(status, "")
 	} else if status == http.StatusPartialContent {
-		data = data[start:end]
+		if _, err := attachment.Seek(int64(start), io.SeekStart); err != nil {
+			return err
+		}
+		length = end - start
 	}
-	h.setHeader("Content-Length", strconv.FormatUint(uint64(len(data)), 10))
+	h.setHeader("Content-Length", strconv.FormatUint(length, 10))
 
 	h.setHeader("Etag", strconv.Quote(digest))
 	if contentType, ok := meta["content_type"].(string); ok {
@@ -197,9 +219,13 @@ func (h *handler) handleGetAttachment() error {
 
 	}
 	h.db.DatabaseContext.DbStats.StatsCblReplicationPull().Add(base.StatKeyAttachmentPullCount, 1)
-	h.db.DatabaseContext.DbStats.StatsCblReplicationPull().Add(base.StatKeyAttachmentPullBytes, int64(len(data)))
+	h.db.DatabaseContext.DbStats.StatsCblReplicationPull().Add(base.StatKeyAttachmentPullBytes, int64(length))
 	h.response.WriteHeader(status)
-	h.response.Write(data)
+	if h.rq.Method != http.MethodHead {
+		if _, err := io.CopyN(h.response, attachment, int64(length)); err != nil {
+			base.InfofCtx(h.db.Ctx, base.KeyHTTP, "Error streaming attachment %q of doc %q: %v", base.UD(attachmentName), base.UD(docid), err)
+		}
+	}
 	return nil
 
 }
@@ -216,10 +242,6 @@ func (h *handler) handlePutAttachment() error {
 	if revid == "" {
 		revid = h.rq.Header.Get("If-Match")
 	}
-	attachmentData, err := h.readBody()
-	if err != nil {
-		return err
-	}
 
 	body, err := h.db.GetRev(docid, revid, false, nil)
 	if err != nil && base.IsDocNotFoundError(err) {
@@ -239,6 +261,16 @@ func (h *handler) handlePutAttachment() error {
 		attachments = make(map[string]interface{})
 	}
 
+	// check the document could be written before storing anything, then stream the attachment data into the
+	// attachment store, rather than reading it into memory
+	if err := h.db.CheckAttachmentPut(docid, body); err != nil {
+		return err
+	}
+	attachmentData, err := h.db.StreamAttachment(h.requestBody)
+	if err != nil {
+		return err
+	}
+
 	// create new attachment
 	attachment := make(map[string]interface{})
 	attachment["data"] = attachmentData
@@ -325,6 +357,50 @@ func (h *handler) handlePutDoc() error {
 	return nil
 }
 
+// HTTP handler for a PATCH of a document, applying a JSON Patch or JSON Merge Patch to the current revision
+func (h *handler) handlePatchDoc() error {
+
+	startTime := time.Now()
+	defer func() {
+		h.db.DbStats.CblReplicationPush().Add(base.StatKeyWriteProcessingTime, time.Since(startTime).Nanoseconds())
+	}()
+
+	docid := h.PathVar("docid")
+
+	contentType, _, _ := mime.ParseMediaType(h.rq.Header.Get("Content-Type"))
+	patchBytes, err := h.readBody()
+	if err != nil {
+		return err
+	}
+	if len(patchBytes) == 0 {
+		return base.HTTPErrorf(http.StatusBadRequest, "Missing patch")
+	}
+	patch, err := db.ParseDocumentPatch(contentType, patchBytes)
+	if err != nil {
+		return err
+	}
+
+	matchRev := h.getQuery("rev")
+	if matchRev == "" {
+		matchRev = h.rq.Header.Get("If-Match")
+	}
+
+	newRev, doc, err := h.db.Patch(docid, matchRev, patch)
+	if err != nil {
+		return err
+	}
+	h.setHeader("Etag", strconv.Quote(newRev))
+
+	if doc != nil && h.getBoolQuery("roundtrip") {
+		if err := h.db.WaitForSequenceNotSkipped(h.rq.Context(), doc.Sequence); err != nil {
+			return err
+		}
+	}
+
+	h.writeJSONStatus(http.StatusOK, db.Body{"ok": true, "id": docid, "rev": newRev})
+	return nil
+}
+
 func (h *handler) handlePutDocReplicator2(docid string, roundTrip bool) (err error) {
 	bodyBytes, err := h.readBody()
 	if err != nil {
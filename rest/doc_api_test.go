@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/db"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -117,3 +118,102 @@ func TestDocumentNumbers(t *testing.T) {
 	}
 
 }
+
+func TestPatchDoc(t *testing.T) {
+
+	rt := NewRestTester(t, nil)
+	defer rt.Close()
+
+	response := rt.SendAdminRequest("PUT", "/db/doc1", `{"type":"order", "archived":false, "items":["a"]}`)
+	assertStatus(t, response, 201)
+	var body db.Body
+	assert.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &body))
+	rev1 := body["rev"].(string)
+
+	// Merge patch
+	mergePatchHeaders := map[string]string{"Content-Type": db.MergePatchContentType}
+	response = rt.SendAdminRequestWithHeaders("PATCH", "/db/doc1", `{"archived":true}`, mergePatchHeaders)
+	assertStatus(t, response, 200)
+	assert.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &body))
+	rev2 := body["rev"].(string)
+	assert.True(t, strings.HasPrefix(rev2, "2-"))
+
+	// JSON patch, with the expected rev provided via If-Match
+	jsonPatchHeaders := map[string]string{"Content-Type": db.JSONPatchContentType, "If-Match": rev2}
+	response = rt.SendAdminRequestWithHeaders("PATCH", "/db/doc1", `[{"op":"add","path":"/items/-","value":"b"}]`, jsonPatchHeaders)
+	assertStatus(t, response, 200)
+
+	response = rt.SendAdminRequest("GET", "/db/doc1", "")
+	assertStatus(t, response, 200)
+	assert.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &body))
+	assert.Equal(t, true, body["archived"])
+	assert.Equal(t, []interface{}{"a", "b"}, body["items"])
+	assert.True(t, strings.HasPrefix(body[db.BodyRev].(string), "3-"))
+
+	// Stale rev is rejected
+	response = rt.SendAdminRequestWithHeaders("PATCH", "/db/doc1?rev="+rev1, `{"archived":false}`, mergePatchHeaders)
+	assertStatus(t, response, 409)
+
+	// Unsupported content type
+	response = rt.SendAdminRequestWithHeaders("PATCH", "/db/doc1", `{"archived":false}`, map[string]string{"Content-Type": "application/json"})
+	assertStatus(t, response, 415)
+
+	// Missing doc
+	response = rt.SendAdminRequestWithHeaders("PATCH", "/db/missing", `{"archived":false}`, mergePatchHeaders)
+	assertStatus(t, response, 404)
+}
+
+func TestGetDocDeltaSrc(t *testing.T) {
+
+	sgUseDeltas := base.IsEnterpriseEdition()
+	rt := NewRestTester(t, &RestTesterConfig{DatabaseConfig: &DbConfig{DeltaSync: &DeltaSyncConfig{Enabled: &sgUseDeltas}}})
+	defer rt.Close()
+
+	// create doc1 rev 1-0335a345b6ffed05707ccc4cbc1b67f4
+	response := rt.SendAdminRequest("PUT", "/db/doc1", `{"greetings": [{"hello": "world!"}, {"hi": "alice"}]}`)
+	assertStatus(t, response, 201)
+
+	// create doc1 rev 2-26359894b20d89c97638e71c40482f28
+	response = rt.SendAdminRequest("PUT", "/db/doc1?rev=1-0335a345b6ffed05707ccc4cbc1b67f4", `{"greetings": [{"hello": "world!"}, {"hi": "alice"}, {"howdy": 12345678901234567890}]}`)
+	assertStatus(t, response, 201)
+
+	expectedDelta := `"_delta":{"greetings":{"2-":[{"howdy":12345678901234567890}]}}`
+	expectedBody := `"greetings":[{"hello":"world!"},{"hi":"alice"},{"howdy":12345678901234567890}]`
+
+	// Single doc GET, with and without an explicit target rev
+	for _, url := range []string{
+		"/db/doc1?deltaSrc=1-0335a345b6ffed05707ccc4cbc1b67f4",
+		"/db/doc1?rev=2-26359894b20d89c97638e71c40482f28&deltaSrc=1-0335a345b6ffed05707ccc4cbc1b67f4",
+	} {
+		response = rt.SendAdminRequest("GET", url, "")
+		assertStatus(t, response, 200)
+		var body db.Body
+		assert.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &body))
+		assert.Equal(t, "2-26359894b20d89c97638e71c40482f28", body[db.BodyRev])
+		if base.IsEnterpriseEdition() {
+			assert.Equal(t, "1-0335a345b6ffed05707ccc4cbc1b67f4", body[db.BodyDeltaSrc])
+			assert.Contains(t, response.Body.String(), expectedDelta)
+		} else {
+			// Full revision is returned when delta sync isn't available
+			assert.Nil(t, body[db.BodyDeltaSrc])
+			assert.Contains(t, response.Body.String(), expectedBody)
+		}
+	}
+
+	// Unknown deltaSrc falls back to the full revision
+	response = rt.SendAdminRequest("GET", "/db/doc1?deltaSrc=1-abc", "")
+	assertStatus(t, response, 200)
+	assert.NotContains(t, response.Body.String(), db.BodyDeltaSrc)
+	assert.Contains(t, response.Body.String(), expectedBody)
+
+	// _bulk_get with a per-doc deltaSrc
+	response = rt.SendAdminRequest("POST", "/db/_bulk_get", `{"docs": [{"id": "doc1", "rev": "2-26359894b20d89c97638e71c40482f28", "deltaSrc": "1-0335a345b6ffed05707ccc4cbc1b67f4"}]}`)
+	assertStatus(t, response, 200)
+	if base.IsEnterpriseEdition() {
+		assert.Contains(t, response.Body.String(), `"_deltaSrc":"1-0335a345b6ffed05707ccc4cbc1b67f4"`)
+		assert.Contains(t, response.Body.String(), expectedDelta)
+	} else {
+		assert.NotContains(t, response.Body.String(), db.BodyDeltaSrc)
+		assert.Contains(t, response.Body.String(), expectedBody)
+	}
+}
@@ -24,7 +24,7 @@ func NewEncodedResponseWriter(response http.ResponseWriter, rq *http.Request) *E
 		strings.Contains(strings.ToLower(rq.Header.Get("Connection")), "upgrade")
 
 	if isWebSocketRequest || !strings.Contains(rq.Header.Get("Accept-Encoding"), "gzip") ||
-		rq.Method == "HEAD" || rq.Method == "PUT" || rq.Method == "DELETE" {
+		rq.Method == "HEAD" || rq.Method == "PUT" || rq.Method == "PATCH" || rq.Method == "DELETE" {
 		return nil
 	}
 
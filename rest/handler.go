@@ -69,6 +69,7 @@ type handler struct {
 	loggedDuration bool
 	runOffline     bool
 	queryValues    url.Values // Copy of results of rq.URL.Query()
+	adminIdentity  string     // Authenticated admin user or client cert name, if admin auth is enabled
 }
 
 type handlerPrivs int
@@ -147,6 +148,12 @@ func (h *handler) invoke(method handlerMethod) error {
 
 	h.setHeader("Server", base.VersionString)
 
+	if h.privs == adminPrivs {
+		if err = h.checkAdminAuth(); err != nil {
+			return err
+		}
+	}
+
 	// If there is a "db" path variable, look up the database context:
 	var dbContext *db.DatabaseContext
 	if dbname := h.PathVar("db"); dbname != "" {
@@ -304,14 +311,54 @@ func (h *handler) checkAuth(context *db.DatabaseContext) (err error) {
 
 	}(time.Now())
 
+	// Check for an API key
+	if token := h.getAPIKeyToken(); token != "" {
+		var authKeyErr error
+		h.user, authKeyErr = context.Authenticator().AuthenticateAPIKey(token)
+		if authKeyErr != nil {
+			base.Infof(base.KeyAuth, "API key auth failed: %v", authKeyErr)
+		}
+		if h.user == nil || authKeyErr != nil {
+			err = base.HTTPErrorf(http.StatusUnauthorized, "Invalid login")
+			h.auditLoginFailure("", "api_key", err)
+			return err
+		}
+		h.auditLogin("api_key")
+		if auth.UserAPIKey(h.user).ReadOnly && !h.isReadOnlyRequest() {
+			return base.HTTPErrorf(http.StatusForbidden, "API key is read-only")
+		}
+		return nil
+	}
+
+	// If local JWT validation is enabled, check for a bearer token from its issuer
+	if context.LocalJWTValidator != nil {
+		if token := h.getBearerToken(); token != "" && (context.Options.OIDCOptions == nil || auth.GetUnverifiedJWTIssuer(token) == context.LocalJWTValidator.Issuer()) {
+			var authJwtErr error
+			h.user, authJwtErr = context.Authenticator().AuthenticateLocalJWT(token, context.LocalJWTValidator)
+			if authJwtErr != nil {
+				base.Infof(base.KeyAuth, "JWT auth failed: %v", authJwtErr)
+			}
+			if h.user == nil || authJwtErr != nil {
+				err = base.HTTPErrorf(http.StatusUnauthorized, "Invalid login")
+				h.auditLoginFailure("", "jwt", err)
+				return err
+			}
+			h.auditLogin("jwt")
+			return nil
+		}
+	}
+
 	// If oidc enabled, check for bearer ID token
 	if context.Options.OIDCOptions != nil {
 		if token := h.getBearerToken(); token != "" {
 			var authJwtErr error
 			h.user, _, authJwtErr = context.Authenticator().AuthenticateUntrustedJWT(token, context.OIDCProviders, h.getOIDCCallbackURL)
 			if h.user == nil || authJwtErr != nil {
-				return base.HTTPErrorf(http.StatusUnauthorized, "Invalid login")
+				err = base.HTTPErrorf(http.StatusUnauthorized, "Invalid login")
+				h.auditLoginFailure("", "oidc", err)
+				return err
 			}
+			h.auditLogin("oidc")
 			return nil
 		}
 
@@ -335,20 +382,48 @@ func (h *handler) checkAuth(context *db.DatabaseContext) (err error) {
 
 	// Check basic auth first
 	if userName, password := h.getBasicAuth(); userName != "" {
-		h.user = context.Authenticator().AuthenticateUser(userName, password)
+		var authErr error
+		h.user, authErr = context.Authenticator().AuthenticatePassword(userName, password, h.clientIP())
+		if authErr != nil {
+			err = h.loginError(authErr)
+			h.auditLoginFailure(userName, "basic", err)
+			return err
+		}
 		if h.user == nil {
 			base.Infof(base.KeyAll, "HTTP auth failed for username=%q", base.UD(userName))
 			if context.Options.SendWWWAuthenticateHeader == nil || *context.Options.SendWWWAuthenticateHeader {
 				h.response.Header().Set("WWW-Authenticate", `Basic realm="Couchbase Sync Gateway"`)
 			}
-			return base.HTTPErrorf(http.StatusUnauthorized, "Invalid login")
+			err = base.HTTPErrorf(http.StatusUnauthorized, "Invalid login")
+			h.auditLoginFailure(userName, "basic", err)
+			return err
+		}
+		h.auditLogin("basic")
+		return nil
+	}
+
+	// If client certificate auth is enabled, check for a certificate verified by the TLS handshake
+	if context.ClientCertMapper != nil && h.rq.TLS != nil && len(h.rq.TLS.VerifiedChains) > 0 && len(h.rq.TLS.VerifiedChains[0]) > 0 {
+		cert := h.rq.TLS.VerifiedChains[0][0]
+		var authCertErr error
+		h.user, authCertErr = context.Authenticator().AuthenticateClientCert(cert, context.ClientCertMapper)
+		if authCertErr != nil {
+			base.Infof(base.KeyAuth, "Client certificate auth failed: %v", authCertErr)
 		}
+		if h.user == nil || authCertErr != nil {
+			err = base.HTTPErrorf(http.StatusUnauthorized, "Invalid login")
+			username, _ := context.ClientCertMapper.Username(cert)
+			h.auditLoginFailure(username, "client_cert", err)
+			return err
+		}
+		h.auditLogin("client_cert")
 		return nil
 	}
 
 	// Check cookie
 	h.user, err = context.Authenticator().AuthenticateCookie(h.rq, h.response)
 	if err != nil {
+		h.auditLoginFailure("", "session", err)
 		return err
 	} else if h.user != nil {
 		return nil
@@ -476,7 +551,7 @@ func (h *handler) readDocument() (db.Body, error) {
 				return nil, err
 			}
 			reader := multipart.NewReader(bytes.NewReader(raw), attrs["boundary"])
-			body, err := db.ReadMultipartDocument(reader)
+			body, err := h.db.ReadMultipartDocument(reader)
 			if err != nil {
 				ioutil.WriteFile("GatewayPUT.mime", raw, 0600)
 				base.Warnf(base.KeyAll, "Error reading MIME data: copied to file GatewayPUT.mime")
@@ -484,7 +559,7 @@ func (h *handler) readDocument() (db.Body, error) {
 			return body, err
 		} else {
 			reader := multipart.NewReader(h.requestBody, attrs["boundary"])
-			return db.ReadMultipartDocument(reader)
+			return h.db.ReadMultipartDocument(reader)
 		}
 	default:
 		return nil, base.HTTPErrorf(http.StatusUnsupportedMediaType, "Invalid content type %s", contentType)
@@ -510,6 +585,22 @@ func (h *handler) getBasicAuth() (username string, password string) {
 	return
 }
 
+// Returns the address of the client making the request, without the port
+func (h *handler) clientIP() string {
+	return base.RequestClientIP(h.rq)
+}
+
+// Converts an error from password authentication to the response error.  Logins rejected by the login
+// lockout get a 429 status, with a Retry-After header giving the end of the lockout.
+func (h *handler) loginError(err error) error {
+	if lockedOut, ok := err.(*auth.LoginLockedOutError); ok {
+		retryAfter := int(time.Until(lockedOut.LockedUntil).Seconds()) + 1
+		h.response.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		return base.HTTPErrorf(http.StatusTooManyRequests, "Too many failed login attempts")
+	}
+	return err
+}
+
 func (h *handler) getBearerToken() string {
 	auth := h.rq.Header.Get("Authorization")
 	if strings.HasPrefix(auth, "Bearer ") {
@@ -523,6 +614,9 @@ func (h *handler) getBearerToken() string {
 // e.g: '<ud>alice</ud>' or 'GUEST'
 func (h *handler) taggedEffectiveUserName() string {
 	if h.privs == adminPrivs {
+		if h.adminIdentity != "" {
+			return "ADMIN:" + base.UD(h.adminIdentity).Redact()
+		}
 		return "ADMIN"
 	} else if h.user == nil {
 		return ""
@@ -68,6 +68,7 @@ func createHandler(sc *ServerContext, privs handlerPrivs) (*mux.Router, *mux.Rou
 
 	dbr.Handle("/{docid:"+docRegex+"}", makeHandler(sc, privs, (*handler).handleGetDoc)).Methods("GET", "HEAD")
 	dbr.Handle("/{docid:"+docRegex+"}", makeHandler(sc, privs, (*handler).handlePutDoc)).Methods("PUT")
+	dbr.Handle("/{docid:"+docRegex+"}", makeHandler(sc, privs, (*handler).handlePatchDoc)).Methods("PATCH")
 	dbr.Handle("/{docid:"+docRegex+"}", makeHandler(sc, privs, (*handler).handleDeleteDoc)).Methods("DELETE")
 
 	dbr.Handle("/{docid:"+docRegex+"}/{attach}", makeHandler(sc, privs, (*handler).handleGetAttachment)).Methods("GET", "HEAD")
@@ -121,6 +122,10 @@ func CreatePublicHandler(sc *ServerContext) http.Handler {
 		(*handler).handleSessionPOST)).Methods("POST")
 	dbr.Handle("/_session", makeHandler(sc, regularPrivs,
 		(*handler).handleSessionDELETE)).Methods("DELETE")
+	dbr.Handle("/_session/password", makeHandler(sc, regularPrivs,
+		(*handler).handleSessionPasswordPUT)).Methods("PUT")
+	dbr.Handle("/_session/all", makeHandler(sc, regularPrivs,
+		(*handler).handleSessionsGET)).Methods("GET", "HEAD")
 	// The routine below is part of the CouchDB REST API, users can't create DB's via the pblic API
 	// but if the client set the 'createTarget' property of the Replicatior SG should return HTTP status 412
 	// if the db exists, and 403 if it doesn't.
@@ -179,10 +184,27 @@ func CreateAdminRouter(sc *ServerContext) *mux.Router {
 	dbr.Handle("/_user/{name}",
 		makeHandler(sc, adminPrivs, (*handler).deleteUser)).Methods("DELETE")
 
+	dbr.Handle("/_user/{name}/_session",
+		makeHandler(sc, adminPrivs, (*handler).getUserSessions)).Methods("GET", "HEAD")
 	dbr.Handle("/_user/{name}/_session",
 		makeHandler(sc, adminPrivs, (*handler).deleteUserSessions)).Methods("DELETE")
 	dbr.Handle("/_user/{name}/_session/{sessionid}",
 		makeHandler(sc, adminPrivs, (*handler).deleteUserSession)).Methods("DELETE")
+	dbr.Handle("/_user/{name}/_api_key",
+		makeHandler(sc, adminPrivs, (*handler).getUserAPIKeys)).Methods("GET", "HEAD")
+	dbr.Handle("/_user/{name}/_api_key",
+		makeHandler(sc, adminPrivs, (*handler).createUserAPIKey)).Methods("POST")
+	dbr.Handle("/_user/{name}/_api_key/{keyid}",
+		makeHandler(sc, adminPrivs, (*handler).deleteUserAPIKey)).Methods("DELETE")
+	dbr.Handle("/_user/{name}/_explain",
+		makeHandler(sc, adminPrivs, (*handler).handleExplainUserAccess)).Methods("GET", "HEAD")
+
+	dbr.Handle("/_lockout",
+		makeHandler(sc, adminPrivs, (*handler).getLoginLockouts)).Methods("GET", "HEAD")
+	dbr.Handle("/_lockout/user/{name}",
+		makeHandler(sc, adminPrivs, (*handler).deleteUserLockout)).Methods("DELETE")
+	dbr.Handle("/_lockout/ip/{ip}",
+		makeHandler(sc, adminPrivs, (*handler).deleteClientIPLockout)).Methods("DELETE")
 
 	dbr.Handle("/_role/",
 		makeHandler(sc, adminPrivs, (*handler).getRoles)).Methods("GET", "HEAD")
@@ -254,8 +276,16 @@ func CreateAdminRouter(sc *ServerContext) *mux.Router {
 		makeOfflineHandler(sc, adminPrivs, (*handler).handlePutDbConfig)).Methods("PUT")
 	dbr.Handle("/_resync",
 		makeOfflineHandler(sc, adminPrivs, (*handler).handleResync)).Methods("POST")
+	dbr.Handle("/_resync",
+		makeOfflineHandler(sc, adminPrivs, (*handler).handleGetResync)).Methods("GET", "HEAD")
+	dbr.Handle("/_sync_test",
+		makeHandler(sc, adminPrivs, (*handler).handleSyncTest)).Methods("POST")
 	dbr.Handle("/_vacuum",
 		makeHandler(sc, adminPrivs, (*handler).handleVacuum)).Methods("POST")
+	dbr.Handle("/_vacuum",
+		makeHandler(sc, adminPrivs, (*handler).handleGetVacuum)).Methods("GET", "HEAD")
+	dbr.Handle("/_migrate_attachments",
+		makeOfflineHandler(sc, adminPrivs, (*handler).handleMigrateAttachments)).Methods("POST")
 	dbr.Handle("/_purge",
 		makeHandler(sc, adminPrivs, (*handler).handlePurge)).Methods("POST")
 	dbr.Handle("/_flush",
@@ -270,6 +300,10 @@ func CreateAdminRouter(sc *ServerContext) *mux.Router {
 		makeHandler(sc, adminPrivs, (*handler).handleView)).Methods("GET")
 	dbr.Handle("/_dumpchannel/{channel}",
 		makeHandler(sc, adminPrivs, (*handler).handleDumpChannel)).Methods("GET")
+	dbr.Handle("/_channels",
+		makeHandler(sc, adminPrivs, (*handler).handleGetChannels)).Methods("GET", "HEAD")
+	dbr.Handle("/_channels/{channel}",
+		makeHandler(sc, adminPrivs, (*handler).handleGetChannel)).Methods("GET", "HEAD")
 	dbr.Handle("/_repair",
 		makeHandler(sc, adminPrivs, (*handler).handleRepair)).Methods("POST")
 
@@ -314,7 +348,7 @@ func wrapRouter(sc *ServerContext, privs handlerPrivs, router *mux.Router) http.
 
 			// What methods would have matched?
 			var options []string
-			for _, method := range []string{"GET", "HEAD", "POST", "PUT", "DELETE"} {
+			for _, method := range []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"} {
 				if wouldMatch(router, rq, method) {
 					options = append(options, method)
 				}
@@ -24,6 +24,7 @@ import (
 	"github.com/couchbase/go-couchbase"
 	sgbucket "github.com/couchbase/sg-bucket"
 	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
 	"github.com/couchbase/sync_gateway/db"
 	pkgerrors "github.com/pkg/errors"
 )
@@ -348,7 +349,7 @@ func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisti
 
 	importOptions := db.ImportOptions{}
 	if config.ImportFilter != nil {
-		importOptions.ImportFilter = db.NewImportFilterFunction(*config.ImportFilter)
+		importOptions.ImportFilter = db.NewImportFilterFunction(*config.ImportFilter, config.jsOptions())
 	}
 	importOptions.BackupOldRev = config.ImportBackupOldRev
 
@@ -517,6 +518,10 @@ func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisti
 		AdminInterface:            sc.config.AdminInterface,
 		UnsupportedOptions:        config.Unsupported,
 		OIDCOptions:               config.OIDCConfig,
+		LocalJWTOptions:           config.JWTConfig,
+		ClientCertOptions:         config.ClientCertAuth,
+		LoginLockoutOptions:       config.LoginLockout,
+		PasswordPolicy:            config.PasswordPolicy,
 		DBOnlineCallback:          dbOnlineCallback,
 		ImportOptions:             importOptions,
 		EnableXattr:               config.UseXattrs(),
@@ -526,8 +531,26 @@ func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisti
 		UseViews:                  useViews,
 		DeltaSyncOptions:          deltaSyncOptions,
 		CompactInterval:           compactIntervalSecs,
+		JSOptions:                 config.jsOptions(),
 	}
 
+	if config.ConflictResolver != nil {
+		contextOptions.ConflictResolver = db.NewConflictResolverFunction(*config.ConflictResolver, config.jsOptions())
+	}
+
+	if len(config.ChangesFilters) > 0 {
+		contextOptions.ChangesFilters = make(map[string]*db.ChangesFilterFunction, len(config.ChangesFilters))
+		for name, fnSource := range config.ChangesFilters {
+			contextOptions.ChangesFilters[name] = db.NewChangesFilterFunction(fnSource, config.jsOptions())
+		}
+	}
+
+	attachmentStore, err := db.NewAttachmentStore(config.AttachmentStore, bucket)
+	if err != nil {
+		return nil, err
+	}
+	contextOptions.AttachmentStore = attachmentStore
+
 	// Create the DB Context
 	dbcontext, err := db.NewDatabaseContext(dbName, bucket, autoImport, contextOptions)
 	if err != nil {
@@ -535,12 +558,19 @@ func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisti
 	}
 	dbcontext.BucketSpec = spec
 
-	syncFn := ""
-	if config.Sync != nil {
-		syncFn = *config.Sync
-	}
-	if err := sc.applySyncFunction(dbcontext, syncFn); err != nil {
-		return nil, err
+	var syncChanged bool
+	if config.SyncRules != nil {
+		if syncChanged, err = sc.applySyncRules(dbcontext, config.SyncRules); err != nil {
+			return nil, err
+		}
+	} else {
+		syncFn := ""
+		if config.Sync != nil {
+			syncFn = *config.Sync
+		}
+		if syncChanged, err = sc.applySyncFunction(dbcontext, syncFn); err != nil {
+			return nil, err
+		}
 	}
 
 	if config.RevsLimit != nil {
@@ -601,6 +631,10 @@ func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisti
 		}
 	}
 
+	if config.AutoResync && (syncChanged || dbcontext.ResyncInterrupted()) {
+		sc.startAutoResync(dbcontext)
+	}
+
 	return dbcontext, nil
 }
 
@@ -649,7 +683,7 @@ func (sc *ServerContext) initEventHandlers(dbcontext *db.DatabaseContext, config
 
 		// validate event-related keys
 		for k := range eventHandlersMap {
-			if k != "max_processes" && k != "wait_for_process" && k != "document_changed" && k != "db_state_changed" {
+			if k != "max_processes" && k != "wait_for_process" && k != "document_changed" && k != "db_state_changed" && k != "account_locked" {
 				return errors.New(fmt.Sprintf("Unsupported event property '%s' defined for db %s", k, dbcontext.Name))
 			}
 		}
@@ -671,6 +705,11 @@ func (sc *ServerContext) initEventHandlers(dbcontext *db.DatabaseContext, config
 		if err = sc.processEventHandlersForEvent(eventHandlers.DBStateChanged, db.DBStateChange, dbcontext); err != nil {
 			return err
 		}
+
+		// Process account lockout event handlers
+		if err = sc.processEventHandlersForEvent(eventHandlers.AccountLocked, db.AccountLocked, dbcontext); err != nil {
+			return err
+		}
 		// WaitForProcess uses string, to support both omitempty and zero values
 		customWaitTime := int64(-1)
 		if eventHandlers.WaitForProcess != "" {
@@ -697,7 +736,7 @@ func (sc *ServerContext) processEventHandlersForEvent(events []*EventConfig, eve
 	for _, event := range events {
 		switch event.HandlerType {
 		case "webhook":
-			wh, err := db.NewWebhook(event.Url, event.Filter, event.Timeout)
+			wh, err := db.NewWebhook(event.Url, event.Filter, event.Timeout, dbcontext.Options.JSOptions)
 			if err != nil {
 				base.Warnf(base.KeyAll, "Error creating webhook %v", err)
 				return err
@@ -711,14 +750,38 @@ func (sc *ServerContext) processEventHandlersForEvent(events []*EventConfig, eve
 	return nil
 }
 
-func (sc *ServerContext) applySyncFunction(dbcontext *db.DatabaseContext, syncFn string) error {
-	changed, err := dbcontext.UpdateSyncFun(syncFn)
+func (sc *ServerContext) applySyncFunction(dbcontext *db.DatabaseContext, syncFn string) (changed bool, err error) {
+	changed, err = dbcontext.UpdateSyncFun(syncFn)
 	if err != nil || !changed {
-		return err
+		return changed, err
 	}
 	// Sync function has changed:
 	base.Infof(base.KeyAll, "**NOTE:** %q's sync function has changed. The new function may assign different channels to documents, or permissions to users. You may want to re-sync the database to update these.", base.MD(dbcontext.Name))
-	return nil
+	return changed, nil
+}
+
+func (sc *ServerContext) applySyncRules(dbcontext *db.DatabaseContext, rules channels.SyncRules) (changed bool, err error) {
+	changed, err = dbcontext.UpdateSyncRules(rules)
+	if err != nil || !changed {
+		return changed, err
+	}
+	base.Infof(base.KeyAll, "**NOTE:** %q's sync rules have changed. The new rules may assign different channels to documents, or permissions to users. You may want to re-sync the database to update these.", base.MD(dbcontext.Name))
+	return changed, nil
+}
+
+// Starts a background resync of a database whose sync function or sync rules have changed, if auto_resync is set, or
+// resumes one that was interrupted.  The resync's lease ensures that only one node runs it.  A run interrupted by a
+// crash can't be resumed until the crashed node's lease has expired, so may need to be resumed through _resync.
+func (sc *ServerContext) startAutoResync(dbcontext *db.DatabaseContext) {
+	database, err := db.CreateDatabase(dbcontext)
+	if err == nil {
+		_, err = database.StartResync(db.ResyncOptions{})
+	}
+	if err != nil {
+		base.Warnf(base.KeyAll, "Unable to start automatic resync of %q: %v", base.MD(dbcontext.Name), err)
+		return
+	}
+	base.Infof(base.KeyAll, "Started background resync of %q as auto_resync is enabled", base.MD(dbcontext.Name))
 }
 
 func (sc *ServerContext) RemoveDatabase(dbName string) bool {
@@ -53,6 +53,10 @@ func (h *handler) handleSessionPOST() error {
 
 	// If we fail to get a user from the body and we've got a non-GUEST authenticated user, create the session based on that user
 	if user == nil && h.user != nil && h.user.Name() != "" {
+		if auth.UserAPIKey(h.user) != nil {
+			// A session would have none of the key's restrictions, and outlive its revocation
+			return base.HTTPErrorf(http.StatusForbidden, "Sessions can't be created using an API key")
+		}
 		return h.makeSession(h.user)
 	} else {
 		if err != nil {
@@ -74,16 +78,76 @@ func (h *handler) getUserFromSessionRequestBody() (auth.User, error) {
 		return nil, err
 	}
 
-	var user auth.User
-	user, err = h.db.Authenticator().GetUser(params.Name)
+	user, err := h.db.Authenticator().AuthenticatePassword(params.Name, params.Password, h.clientIP())
 	if err != nil {
+		err = h.loginError(err)
+		h.auditLoginFailure(params.Name, "password", err)
 		return nil, err
+	} else if user == nil && params.Name != "" {
+		h.auditLoginFailure(params.Name, "password", base.HTTPErrorf(http.StatusUnauthorized, "Invalid login"))
+	}
+	return user, nil
+}
+
+// PUT /_session/password changes the password of the logged-in user, who must provide their current
+// password.  If invalidate_sessions is set, the user's other login sessions are deleted; a request made
+// with a session cookie is given a new session.
+func (h *handler) handleSessionPasswordPUT() error {
+	if h.user == nil || h.user.Name() == "" {
+		return base.HTTPErrorf(http.StatusUnauthorized, "Login required")
+	} else if auth.UserAPIKey(h.user) != nil {
+		return base.HTTPErrorf(http.StatusForbidden, "Passwords can't be changed using an API key")
+	}
+
+	var params struct {
+		OldPassword        string `json:"old_password"`
+		NewPassword        string `json:"new_password"`
+		InvalidateSessions bool   `json:"invalidate_sessions"`
+	}
+	if err := h.readJSONInto(&params); err != nil {
+		return err
+	}
+
+	user, err := h.db.Authenticator().AuthenticatePassword(h.user.Name(), params.OldPassword, h.clientIP())
+	if err != nil {
+		err = h.loginError(err)
+		h.auditLoginFailure(h.user.Name(), "password", err)
+		return err
+	} else if user == nil {
+		err = base.HTTPErrorf(http.StatusForbidden, "Incorrect password")
+		h.auditLoginFailure(h.user.Name(), "password", err)
+		return err
+	}
+
+	err = h.db.ChangeUserPassword(user.Name(), params.NewPassword)
+	h.audit(base.AuditEventUserChange, user.Name(), err, map[string]interface{}{"action": "change_password"})
+	if err != nil {
+		return err
+	}
+	base.Infof(base.KeyAuth, "User %s changed their password", base.UD(user.Name()))
+
+	if params.InvalidateSessions {
+		err := h.db.DeleteUserSessions(user.Name())
+		h.audit(base.AuditEventSessionDelete, user.Name(), err, map[string]interface{}{"action": "delete_all"})
+		if err != nil {
+			return err
+		}
+		if cookie, _ := h.rq.Cookie(h.db.Authenticator().SessionCookieName()); cookie != nil {
+			if _, err := h.makeSessionWithTTL(user, kDefaultSessionTTL); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
+}
 
-	if user != nil && !user.Authenticate(params.Password) {
-		user = nil
+// GET /_session/all lists the logged-in user's sessions.  Session IDs aren't included, since they're
+// credentials for the user's other devices.
+func (h *handler) handleSessionsGET() error {
+	if h.user == nil || h.user.Name() == "" {
+		return base.HTTPErrorf(http.StatusUnauthorized, "Login required")
 	}
-	return user, err
+	return h.writeUserSessions(h.user.Name(), false)
 }
 
 // DELETE /_session logs out the current session
@@ -104,6 +168,7 @@ func (h *handler) handleSessionDELETE() error {
 	if cookie == nil {
 		return base.HTTPErrorf(http.StatusNotFound, "no session")
 	}
+	h.audit(base.AuditEventSessionDelete, h.auditActor(), nil, map[string]interface{}{"action": "logout"})
 	http.SetCookie(h.response, cookie)
 	return nil
 }
@@ -125,9 +190,11 @@ func (h *handler) makeSessionWithTTL(user auth.User, expiry time.Duration) (sess
 	h.user = user
 	auth := h.db.Authenticator()
 	session, err := auth.CreateSession(user.Name(), expiry)
+	h.audit(base.AuditEventSessionCreate, user.Name(), err, map[string]interface{}{"ttl": int(expiry / time.Second)})
 	if err != nil {
 		return "", err
 	}
+	h.auditLogin("session")
 	cookie := auth.MakeSessionCookie(session)
 	base.AddDbPathToCookie(h.rq, cookie)
 	http.SetCookie(h.response, cookie)
@@ -209,6 +276,7 @@ func (h *handler) createUserSession() error {
 
 	authenticator := h.db.Authenticator()
 	session, err := authenticator.CreateSession(params.Name, ttl)
+	h.audit(base.AuditEventSessionCreate, params.Name, err, map[string]interface{}{"ttl": params.TTL})
 	if err != nil {
 		return err
 	}
@@ -239,16 +307,71 @@ func (h *handler) getUserSession() error {
 	return h.respondWithSessionInfoForSession(session)
 }
 
+// ADMIN API: Lists a user's sessions
+func (h *handler) getUserSessions() error {
+	h.assertAdminOnly()
+	user, err := h.getPathUser()
+	if err != nil {
+		return err
+	}
+	return h.writeUserSessions(user.Name(), true)
+}
+
+// Session info returned when listing a user's sessions
+type sessionInfoResponse struct {
+	ID         string     `json:"id,omitempty"`
+	Created    *time.Time `json:"created,omitempty"`
+	Expiration time.Time  `json:"expiration"`
+	TTL        int        `json:"ttl"` // seconds
+	LastUsed   *time.Time `json:"last_used,omitempty"`
+	ClientIP   string     `json:"client_ip,omitempty"`
+	UserAgent  string     `json:"user_agent,omitempty"`
+	Current    bool       `json:"current,omitempty"` // Whether this is the session the request was made with
+}
+
+func (h *handler) writeUserSessions(userName string, includeIDs bool) error {
+	sessions, err := h.db.GetUserSessions(userName)
+	if err != nil {
+		return err
+	}
+
+	currentID := ""
+	if cookie, _ := h.rq.Cookie(h.db.Authenticator().SessionCookieName()); cookie != nil {
+		currentID = cookie.Value
+	}
+	response := make([]sessionInfoResponse, 0, len(sessions))
+	for _, session := range sessions {
+		info := sessionInfoResponse{
+			Created:    session.Created,
+			Expiration: session.Expiration,
+			TTL:        int(session.Ttl / time.Second),
+			LastUsed:   session.LastUsed,
+			ClientIP:   session.ClientIP,
+			UserAgent:  session.UserAgent,
+			Current:    session.ID == currentID,
+		}
+		if includeIDs {
+			info.ID = session.ID
+		}
+		response = append(response, info)
+	}
+	h.writeJSON(response)
+	return nil
+}
+
 // ADMIN API: Deletes a specified session.  If username is present on the request, validates
 // that the session being deleted is associated with the user.
 func (h *handler) deleteUserSession() error {
 	h.assertAdminOnly()
 	userName := h.PathVar("name")
+	var err error
 	if userName != "" {
-		return h.deleteUserSessionWithValidation(h.PathVar("sessionid"), userName)
+		err = h.deleteUserSessionWithValidation(h.PathVar("sessionid"), userName)
 	} else {
-		return h.db.Authenticator().DeleteSession(h.PathVar("sessionid"))
+		err = h.db.Authenticator().DeleteSession(h.PathVar("sessionid"))
 	}
+	h.audit(base.AuditEventSessionDelete, userName, err, nil)
+	return err
 }
 
 // ADMIN API: Deletes all sessions for a user
@@ -256,7 +379,9 @@ func (h *handler) deleteUserSessions() error {
 	h.assertAdminOnly()
 
 	userName := h.PathVar("name")
-	return h.db.DeleteUserSessions(userName)
+	err := h.db.DeleteUserSessions(userName)
+	h.audit(base.AuditEventSessionDelete, userName, err, map[string]interface{}{"action": "delete_all"})
+	return err
 }
 
 // Delete a session if associated with the user provided